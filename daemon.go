@@ -0,0 +1,124 @@
+package main
+
+import (
+    "context"
+    "log"
+    "sync/atomic"
+    "time"
+
+    "teamdrive-scanner/database"
+    "teamdrive-scanner/scanner"
+    "teamdrive-scanner/web"
+
+    "github.com/robfig/cron/v3"
+)
+
+// runDaemon serves the web interface and rescans all Team Drives on the
+// cron schedule in scanner.schedule, all in one process. Changes to
+// config.json apply without a restart: drives, schedule and rate limits at
+// once, scan settings from the next scan on.
+func runDaemon(config *Config, db *database.Database, configPath string) {
+    if config.Scanner.Schedule == "" {
+        log.Fatalf("Daemon mode requires scanner.schedule (e.g. \"0 3 * * *\")")
+    }
+
+    pool, err := initPool(config)
+    if err != nil {
+        log.Fatalf("Failed to initialize service account pool: %v", err)
+    }
+    log.Printf("Loaded %d service accounts", pool.Count())
+
+    go pool.MonitorHealth(context.Background(), db)
+    go pool.WatchAccounts(context.Background())
+    handlePauseSignals()
+
+    var current atomic.Pointer[Config]
+    current.Store(config)
+
+    var running atomic.Bool
+    scan := func() {
+        // A scan that overruns the next trigger is not doubled up
+        if !running.CompareAndSwap(false, true) {
+            log.Println("Scheduled scan skipped: previous scan still running")
+            return
+        }
+        defer running.Store(false)
+
+        config := current.Load()
+        log.Println("=== Starting Scheduled Scan ===")
+        // Pick up drives discovered through the API since the last run
+        loadDiscoveredTeamDrives(config, db)
+        stopCheckpoints := db.StartCheckpointer(time.Duration(config.Database.CheckpointIntervalSeconds) * time.Second)
+        defer stopCheckpoints()
+        start := time.Now()
+        withDeferredIndexing(config, db, func() {
+            scanTeamDrives(context.Background(), config, db, pool)
+            scanRescanQueue(context.Background(), config, db, pool, start)
+        })
+        log.Println("=== Scheduled Scan Complete ===")
+    }
+
+    scheduler := cron.New()
+    entry, err := scheduler.AddFunc(config.Scanner.Schedule, scan)
+    if err != nil {
+        log.Fatalf("Invalid scanner.schedule %q: %v", config.Scanner.Schedule, err)
+    }
+    scheduler.Start()
+    defer scheduler.Stop()
+
+    log.Printf("Scan schedule: %s (next run %s)", config.Scanner.Schedule,
+        scheduler.Entry(entry).Next.Format("2006-01-02 15:04:05"))
+
+    if config.Scanner.ScanOnStart {
+        go scan()
+    }
+
+    log.Printf("Starting web server on %s:%d", config.Web.Host, config.Web.Port)
+
+    accounts := func() (*scanner.ServiceAccountPool, error) {
+        return pool, nil
+    }
+    cfg := webConfig(config, false, accounts)
+    cfg.Scans = scanner.Control{}
+    if config.Downloads.Dir != "" {
+        jobs := scanner.NewDownloadJobs(db, pool, config.Downloads.Dir, config.Downloads.Concurrency,
+            config.Downloads.Bandwidth, web.SearchOptions)
+        if err := jobs.Resume(context.Background()); err != nil {
+            log.Printf("Failed to resume download jobs: %v", err)
+        }
+        cfg.Downloads = jobs
+    }
+    if config.Auth.WriteAccess {
+        copies := scanner.NewCopyJobs(db, pool)
+        if err := copies.Resume(context.Background()); err != nil {
+            log.Printf("Failed to resume copy jobs: %v", err)
+        }
+        cfg.Copies = copies
+    }
+    server := web.NewServer(db, teamDriveList(config), cfg)
+
+    go watchConfig(configPath, config, func(next *Config) {
+        loadDiscoveredTeamDrives(next, db)
+        pool.SetRate(next.Scanner.RatePerAccount)
+        setBudget(next, pool)
+        server.Reload(teamDriveList(next), webConfig(next, false, accounts))
+
+        if schedule := next.Scanner.Schedule; schedule != current.Load().Scanner.Schedule {
+            if replaced, err := scheduler.AddFunc(schedule, scan); err != nil {
+                log.Printf("Invalid scanner.schedule %q, keeping the old schedule: %v", schedule, err)
+                next.Scanner.Schedule = current.Load().Scanner.Schedule
+            } else {
+                scheduler.Remove(entry)
+                entry = replaced
+                log.Printf("Scan schedule changed to %s", schedule)
+            }
+        }
+
+        current.Store(next)
+        log.Printf("Config reloaded: %d Team Drives", len(next.TeamDrives))
+    })
+
+    if err := server.Start(config.Web.Host, config.Web.Port); err != nil {
+        log.Fatalf("Server error: %v", err)
+    }
+}
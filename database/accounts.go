@@ -0,0 +1,107 @@
+package database
+
+import "context"
+
+// AccountStatus is the health snapshot of one service account, written by
+// the scanner and served by the web API.
+type AccountStatus struct {
+    Name             string  `json:"name"`
+    Requests         int64   `json:"requests"`
+    Failures         int64   `json:"failures"`
+    Errors401        int64   `json:"errors_401"`
+    Errors403        int64   `json:"errors_403"`
+    Errors429        int64   `json:"errors_429"`
+    RateLimit        float64 `json:"rate_limit"`
+    Quarantined      bool    `json:"quarantined"`
+    QuarantinedUntil string  `json:"quarantined_until,omitempty"`
+    LastError        string  `json:"last_error,omitempty"`
+    UpdatedAt        string  `json:"updated_at"`
+    // BudgetUsed is the number of API calls made on BudgetDay, the day in
+    // the quota's time zone, counted against scanner.daily_budget_per_account
+    BudgetDay  string `json:"budget_day,omitempty"`
+    BudgetUsed int64  `json:"budget_used"`
+}
+
+func (d *Database) SaveAccountStatuses(statuses []AccountStatus) error {
+    return d.write(context.Background(), func() error {
+        tx, err := d.db.Begin()
+        if err != nil {
+            return err
+        }
+
+        stmt, err := tx.Prepare(d.dialect.rebind(upsertSQL("service_accounts", "name", []string{
+            "name", "requests", "failures", "errors_401", "errors_403", "errors_429",
+            "rate_limit", "quarantined", "quarantined_until", "last_error", "updated_at",
+            "budget_day", "budget_used",
+        })))
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+        defer stmt.Close()
+
+        for _, status := range statuses {
+            _, err := stmt.Exec(
+                status.Name,
+                status.Requests,
+                status.Failures,
+                status.Errors401,
+                status.Errors403,
+                status.Errors429,
+                status.RateLimit,
+                status.Quarantined,
+                status.QuarantinedUntil,
+                status.LastError,
+                status.UpdatedAt,
+                status.BudgetDay,
+                status.BudgetUsed,
+            )
+            if err != nil {
+                tx.Rollback()
+                return err
+            }
+        }
+
+        return tx.Commit()
+    })
+}
+
+func (d *Database) GetAccountStatuses(ctx context.Context) ([]AccountStatus, error) {
+    rows, err := d.query(ctx, `
+        SELECT name, requests, failures, errors_401, errors_403, errors_429,
+               COALESCE(rate_limit, 0), quarantined, COALESCE(quarantined_until, ''), COALESCE(last_error, ''), COALESCE(updated_at, ''),
+               COALESCE(budget_day, ''), COALESCE(budget_used, 0)
+        FROM service_accounts
+        ORDER BY name
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    statuses := make([]AccountStatus, 0)
+    for rows.Next() {
+        var status AccountStatus
+        err := rows.Scan(
+            &status.Name,
+            &status.Requests,
+            &status.Failures,
+            &status.Errors401,
+            &status.Errors403,
+            &status.Errors429,
+            &status.RateLimit,
+            &status.Quarantined,
+            &status.QuarantinedUntil,
+            &status.LastError,
+            &status.UpdatedAt,
+            &status.BudgetDay,
+            &status.BudgetUsed,
+        )
+        if err != nil {
+            return nil, err
+        }
+        statuses = append(statuses, status)
+    }
+
+    return statuses, rows.Err()
+}
@@ -0,0 +1,260 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "strings"
+)
+
+// BrowseFolder describes the folder a listing is of. The drive root has
+// no parent and an empty path. A trashed folder lists its trashed
+// contents; other folders leave trashed items out.
+type BrowseFolder struct {
+    ID            string `json:"id"`
+    Name          string `json:"name"`
+    Path          string `json:"path"`
+    ParentID      string `json:"parent_id,omitempty"`
+    TeamDriveID   string `json:"teamdrive_id"`
+    TeamDriveName string `json:"teamdrive_name"`
+    Trashed       bool   `json:"trashed,omitempty"`
+}
+
+// BrowseResult is one page of a folder's contents, folders first and then
+// by name.
+type BrowseResult struct {
+    Folder     BrowseFolder `json:"folder"`
+    Files      []FileRecord `json:"files"`
+    TotalCount int          `json:"total_count"`
+    Limit      int          `json:"limit"`
+    Offset     int          `json:"offset"`
+    HasMore    bool         `json:"has_more"`
+    NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// BrowseOptions selects the page of a folder listing.
+type BrowseOptions struct {
+    Limit  int
+    Offset int
+    Cursor string // NextCursor of the previous page; overrides Offset
+    Sizes  bool   // compute the total size and item count of subfolders
+}
+
+// browseKeys is the order of a folder listing, served by idx_browse.
+var browseKeys = []sortKey{{column: "is_folder", desc: true}, {column: "name"}, {column: "id"}}
+
+// Browse lists the direct contents of a folder of a drive; folderID is the
+// drive's ID for its root. It returns nil if the folder is not in the drive.
+// Unlike a Search with a parent, it runs a single query for the page and
+// one for all subfolder sizes, rather than one per subfolder.
+func (d *Database) Browse(ctx context.Context, teamDriveID string, folderID string, opts BrowseOptions) (*BrowseResult, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.Browse(ctx, teamDriveID, folderID, opts)
+    }
+
+    folder, err := d.browseFolder(ctx, teamDriveID, folderID)
+    if err != nil || folder == nil {
+        return nil, err
+    }
+
+    offset := opts.Offset
+    pageSQL := ""
+    var pageArgs []interface{}
+    if opts.Cursor != "" {
+        cursor, err := decodeCursor(opts.Cursor)
+        if err != nil {
+            return nil, err
+        }
+        if cursor.Sort != "" || (len(cursor.Keys) > 0 && len(cursor.Keys) != len(browseKeys)) {
+            return nil, ErrInvalidCursor
+        }
+        offset = cursor.Offset
+        if len(cursor.Keys) > 0 {
+            var clause string
+            clause, pageArgs = keysetClause("", browseKeys, cursor.Keys)
+            pageSQL = " AND " + clause
+        }
+    }
+    skip := offset
+    if pageSQL != "" {
+        skip = 0
+    }
+
+    args := append([]interface{}{folderID, teamDriveID, folder.Trashed}, pageArgs...)
+    rows, err := d.query(ctx, "SELECT "+selectColumns("")+" FROM files WHERE parent_id = ? AND teamdrive_id = ? AND trashed = ? AND deleted_at IS NULL"+pageSQL+
+        " ORDER BY "+orderClause("", browseKeys)+" LIMIT ? OFFSET ?", append(args, opts.Limit+1, skip)...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    records, err := d.scanRows(rows)
+    if err != nil {
+        return nil, err
+    }
+
+    result := &BrowseResult{Folder: *folder, Limit: opts.Limit, Offset: offset}
+    if err := d.queryRow(ctx, "SELECT COUNT(*) FROM files WHERE parent_id = ? AND teamdrive_id = ? AND trashed = ? AND deleted_at IS NULL",
+        folderID, teamDriveID, folder.Trashed).Scan(&result.TotalCount); err != nil {
+        return nil, err
+    }
+
+    if result.HasMore = len(records) > opts.Limit; result.HasMore {
+        records = records[:opts.Limit]
+        last := records[len(records)-1]
+        next := pageCursor{Offset: offset + len(records)}
+        for _, key := range browseKeys {
+            next.Keys = append(next.Keys, key.value(last))
+        }
+        result.NextCursor = next.encode()
+    }
+
+    var folders []string
+    for i := range records {
+        switch {
+        case records[i].IsFolder:
+            folders = append(folders, records[i].ID)
+        case records[i].IsShortcut:
+            records[i].TotalSize = records[i].ShortcutTargetSize
+        default:
+            records[i].TotalSize = records[i].Size
+        }
+    }
+    if opts.Sizes && len(folders) > 0 {
+        sizes, err := d.folderSizes(ctx, folders)
+        if err != nil {
+            return nil, err
+        }
+        for i := range records {
+            if size, ok := sizes[records[i].ID]; ok {
+                records[i].TotalSize, records[i].ChildCount = size.total, size.count
+            }
+        }
+    }
+
+    result.Files = records
+    if result.Files == nil {
+        result.Files = []FileRecord{}
+    }
+    return result, nil
+}
+
+// GetFolder returns a folder of a drive, or the drive's root when folderID
+// is the drive's ID, or nil when there is no such folder.
+func (d *Database) GetFolder(ctx context.Context, teamDriveID string, folderID string) (*BrowseFolder, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.GetFolder(ctx, teamDriveID, folderID)
+    }
+
+    return d.browseFolder(ctx, teamDriveID, folderID)
+}
+
+// browseFolder looks up the folder being listed.
+func (d *Database) browseFolder(ctx context.Context, teamDriveID string, folderID string) (*BrowseFolder, error) {
+    folder := &BrowseFolder{ID: folderID, TeamDriveID: teamDriveID}
+
+    if folderID == teamDriveID {
+        // The root is not stored in files; any of its files knows its name
+        err := d.queryRow(ctx, "SELECT teamdrive_name FROM files WHERE teamdrive_id = ? LIMIT 1", teamDriveID).
+            Scan(&folder.TeamDriveName)
+        if err == sql.ErrNoRows {
+            err = d.queryRow(ctx, "SELECT name FROM teamdrives WHERE id = ?", teamDriveID).Scan(&folder.TeamDriveName)
+        }
+        if err == sql.ErrNoRows {
+            return nil, nil
+        }
+        folder.Name = folder.TeamDriveName
+        return folder, err
+    }
+
+    var parentID, path sql.NullString
+    var isFolder bool
+    var trashed sql.NullBool
+    err := d.queryRow(ctx, "SELECT name, parent_id, path, teamdrive_name, is_folder, trashed FROM files WHERE id = ? AND teamdrive_id = ?",
+        folderID, teamDriveID).Scan(&folder.Name, &parentID, &path, &folder.TeamDriveName, &isFolder, &trashed)
+    if err == sql.ErrNoRows || err == nil && !isFolder {
+        return nil, nil
+    }
+    folder.ParentID, folder.Path, folder.Trashed = parentID.String, path.String, trashed.Bool
+    return folder, err
+}
+
+type folderSize struct {
+    total int64
+    count int
+}
+
+// folderSizes returns the total size and item count below each folder, as
+// GetFolderSize does, in one query.
+func (d *Database) folderSizes(ctx context.Context, folderIDs []string) (map[string]folderSize, error) {
+    placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(folderIDs)), ", ")
+    args := make([]interface{}, len(folderIDs))
+    for i, id := range folderIDs {
+        args[i] = id
+    }
+
+    rows, err := d.query(ctx, `
+        WITH RECURSIVE tree(root, id, size, trashed, deleted) AS (
+            SELECT id, id, CAST(0 AS BIGINT), trashed, deleted_at IS NOT NULL
+            FROM files
+            WHERE id IN (`+placeholders+`)
+
+            UNION ALL
+
+            SELECT t.root, f.id, f.size, f.trashed, f.deleted_at IS NOT NULL
+            FROM files f
+            JOIN tree t ON f.parent_id = t.id AND f.trashed = t.trashed AND (f.deleted_at IS NOT NULL) = t.deleted
+        )
+        SELECT root, COALESCE(SUM(size), 0), COUNT(*) - 1
+        FROM tree
+        GROUP BY root
+    `, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    sizes := make(map[string]folderSize, len(folderIDs))
+    for rows.Next() {
+        var id string
+        var size folderSize
+        if err := rows.Scan(&id, &size.total, &size.count); err != nil {
+            return nil, err
+        }
+        sizes[id] = size
+    }
+    return sizes, rows.Err()
+}
+
+// FolderTree returns the files and folders below a folder, ordered by
+// path, in the folder's own trashed and deleted state as GetFolderSize
+// counts them.
+func (d *Database) FolderTree(ctx context.Context, folderID string) ([]FileRecord, error) {
+    shard, err := d.fileShard(ctx, folderID)
+    if err != nil {
+        return nil, err
+    }
+    if shard != nil {
+        return shard.FolderTree(ctx, folderID)
+    }
+
+    rows, err := d.query(ctx, `
+        WITH RECURSIVE tree(id, trashed, deleted) AS (
+            SELECT id, trashed, deleted_at IS NOT NULL
+            FROM files
+            WHERE parent_id = ? AND trashed = COALESCE((SELECT trashed FROM files WHERE id = ?), FALSE)
+                AND (deleted_at IS NOT NULL) = COALESCE((SELECT deleted_at IS NOT NULL FROM files WHERE id = ?), FALSE)
+
+            UNION ALL
+
+            SELECT f.id, f.trashed, f.deleted_at IS NOT NULL
+            FROM files f
+            JOIN tree t ON f.parent_id = t.id AND f.trashed = t.trashed AND (f.deleted_at IS NOT NULL) = t.deleted
+        )
+        SELECT `+selectColumns("")+` FROM files WHERE id IN (SELECT id FROM tree) ORDER BY path, id
+    `, folderID, folderID, folderID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    return d.scanRows(rows)
+}
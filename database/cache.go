@@ -0,0 +1,178 @@
+package database
+
+import (
+    "container/list"
+    "context"
+    "encoding/json"
+    "sync"
+    "time"
+
+    "teamdrive-scanner/metrics"
+)
+
+// ResultCacheOptions sizes the in-memory cache of Search and
+// GetTeamDriveStats results. Entries are dropped when anything is written
+// to the database, and after TTL even when nothing seems to have been:
+// writes by another process are only noticed on SQLite.
+type ResultCacheOptions struct {
+    Size int           // results kept, least recently used dropped first; negative disables the cache
+    TTL  time.Duration // age after which a result is read again
+}
+
+var defaultResultCacheOptions = ResultCacheOptions{
+    Size: 500,
+    TTL:  5 * time.Minute,
+}
+
+// SetResultCache enables the result cache, with the defaults for zero
+// fields of opts. It must be called before the first search.
+func (d *Database) SetResultCache(opts ResultCacheOptions) {
+    if opts.Size < 0 {
+        d.cache = nil
+        return
+    }
+    if opts.Size == 0 {
+        opts.Size = defaultResultCacheOptions.Size
+    }
+    if opts.TTL <= 0 {
+        opts.TTL = defaultResultCacheOptions.TTL
+    }
+    d.cache = &resultCache{
+        options: opts,
+        entries: make(map[string]*list.Element),
+        order:   list.New(),
+    }
+}
+
+// cacheVersion identifies the state of the database a result was read
+// from. generation counts this process's writes; dataVersion is SQLite's
+// PRAGMA data_version, which changes on commits by other processes.
+type cacheVersion struct {
+    generation  uint64
+    dataVersion int64
+}
+
+type cacheEntry struct {
+    key     string
+    value   interface{}
+    version cacheVersion
+    stored  time.Time
+}
+
+// resultCache is a least recently used cache of query results. Cached
+// values are shared between callers, which must not modify them.
+type resultCache struct {
+    options ResultCacheOptions
+
+    mu      sync.Mutex
+    entries map[string]*list.Element
+    order   *list.List // most recently used first
+}
+
+func (c *resultCache) get(key string, version cacheVersion) (interface{}, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    element, ok := c.entries[key]
+    if !ok {
+        return nil, false
+    }
+    entry := element.Value.(*cacheEntry)
+    if entry.version != version || time.Since(entry.stored) > c.options.TTL {
+        c.order.Remove(element)
+        delete(c.entries, key)
+        return nil, false
+    }
+    c.order.MoveToFront(element)
+    return entry.value, true
+}
+
+func (c *resultCache) put(key string, value interface{}, version cacheVersion) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    entry := &cacheEntry{key: key, value: value, version: version, stored: time.Now()}
+    if element, ok := c.entries[key]; ok {
+        element.Value = entry
+        c.order.MoveToFront(element)
+        return
+    }
+    c.entries[key] = c.order.PushFront(entry)
+    for c.order.Len() > c.options.Size {
+        oldest := c.order.Back()
+        c.order.Remove(oldest)
+        delete(c.entries, oldest.Value.(*cacheEntry).key)
+    }
+}
+
+// cacheVersion reads the current version of the database. On SQLite it
+// asks a connection of its own, since data_version only reports commits
+// by connections other than the one asking.
+func (d *Database) cacheVersion(ctx context.Context) (cacheVersion, error) {
+    version := cacheVersion{generation: d.generation.Load()}
+    if d.dialect.name() != "sqlite" {
+        return version, nil
+    }
+
+    d.versionMu.Lock()
+    defer d.versionMu.Unlock()
+    if d.versionConn == nil {
+        conn, err := d.db.Conn(ctx)
+        if err != nil {
+            return version, err
+        }
+        d.versionConn = conn
+    }
+    err := d.versionConn.QueryRowContext(ctx, "PRAGMA data_version").Scan(&version.dataVersion)
+    if err != nil && err != context.Canceled && err != context.DeadlineExceeded {
+        // Start over with a new connection next time
+        d.versionConn.Close()
+        d.versionConn = nil
+    }
+    return version, err
+}
+
+// cached returns the result of load for key, reading it from the cache
+// when the database has not changed since it was stored. Errors are not
+// cached, nor are results keep rejects.
+func (d *Database) cached(ctx context.Context, key string, load func() (interface{}, error), keep func(interface{}) bool) (interface{}, error) {
+    if d.cache == nil {
+        return load()
+    }
+
+    version, err := d.cacheVersion(ctx)
+    if err != nil {
+        return load()
+    }
+    if value, ok := d.cache.get(key, version); ok {
+        metrics.ResultCacheLookups.WithLabelValues("hit").Inc()
+        return value, nil
+    }
+    metrics.ResultCacheLookups.WithLabelValues("miss").Inc()
+
+    value, err := load()
+    if err == nil && (keep == nil || keep(value)) {
+        d.cache.put(key, value, version)
+    }
+    return value, err
+}
+
+// closeCache releases the connection held for cache versions.
+func (d *Database) closeCache() {
+    d.versionMu.Lock()
+    defer d.versionMu.Unlock()
+    if d.versionConn != nil {
+        d.versionConn.Close()
+        d.versionConn = nil
+    }
+}
+
+// searchCacheKey identifies a search by all of its options.
+func searchCacheKey(opts SearchOptions) string {
+    pattern := ""
+    if opts.Regex != nil {
+        pattern = opts.Regex.String()
+    }
+    options, _ := json.Marshal(opts)
+    return "search\x00" + pattern + "\x00" + string(options)
+}
@@ -0,0 +1,235 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "log"
+    "strings"
+    "time"
+)
+
+// Kinds of Change.
+const (
+    ChangeCreated  = "created"  // first seen, or restored from the trash
+    ChangeModified = "modified" // new content, name or location
+    ChangeDeleted  = "deleted"  // moved to the trash
+)
+
+// Change is an entry of the change feed: a file or folder created,
+// modified or deleted as seen by a scan. Seq orders the feed and is the
+// cursor of the entries after it.
+type Change struct {
+    Seq          int64  `json:"seq"`
+    Kind         string `json:"kind"`
+    FileID       string `json:"file_id"`
+    TeamDriveID  string `json:"teamdrive_id"`
+    Name         string `json:"name"`
+    Path         string `json:"path"`
+    MimeType     string `json:"mime_type"`
+    IsFolder     bool   `json:"is_folder"`
+    Size         int64  `json:"size"`
+    ModifiedTime string `json:"modified_time,omitempty"`
+    ChangedAt    string `json:"changed_at"`
+}
+
+// changeColumns are the columns of the changes table after seq, in Change
+// order.
+const changeColumns = "kind, file_id, teamdrive_id, name, path, mime_type, is_folder, size, modified_time, changed_at"
+
+// SetChangeFeed turns the change feed on or off. Entries older than
+// retention are dropped by Maintain; zero keeps them all.
+func (d *Database) SetChangeFeed(enabled bool, retention time.Duration) {
+    d.changeFeed = enabled
+    d.changeRetention = retention
+}
+
+// storedFile is what writeHistory compares a record with.
+type storedFile struct {
+    name, parentID, teamDriveID, path, modifiedTime string
+    size                                            int64
+    trashed                                         bool
+}
+
+// changeKind is the kind of change from prev, if stored, to record, or ""
+// for none.
+func changeKind(prev storedFile, stored bool, record FileRecord) string {
+    switch {
+    case !stored && record.Trashed:
+        return ""
+    case !stored || prev.trashed && !record.Trashed:
+        return ChangeCreated
+    case !prev.trashed && record.Trashed:
+        return ChangeDeleted
+    case prev.size != record.Size || prev.modifiedTime != record.ModifiedTime ||
+        prev.name != record.Name || prev.parentID != record.ParentID || prev.teamDriveID != record.TeamDriveID:
+        return ChangeModified
+    }
+    return ""
+}
+
+// writeHistory compares records with the rows they are about to replace,
+// recording moves, and returns the changes for the feed when it is on. It
+// must run before the records are written.
+func writeHistory(tx *sql.Tx, dia dialect, records []FileRecord, feed bool) ([]Change, error) {
+    now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+
+    var changes []Change
+    var moveStmt *sql.Stmt
+    for start := 0; start < len(records); start += insertChunkRows {
+        chunk := records[start:]
+        if len(chunk) > insertChunkRows {
+            chunk = chunk[:insertChunkRows]
+        }
+        old, err := storedFiles(tx, dia, chunk)
+        if err != nil {
+            return nil, err
+        }
+
+        for _, record := range chunk {
+            prev, stored := old[record.ID]
+
+            if kind := moveKind(prev, record); stored && kind != "" {
+                if moveStmt == nil {
+                    if moveStmt, err = tx.Prepare(dia.rebind("INSERT INTO moves (" + moveColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")); err != nil {
+                        return nil, err
+                    }
+                    defer moveStmt.Close()
+                }
+                if _, err := moveStmt.Exec(record.ID, kind, record.TeamDriveID, prev.teamDriveID,
+                    prev.parentID, record.ParentID, prev.path, record.Path, now); err != nil {
+                    return nil, err
+                }
+            }
+
+            if kind := changeKind(prev, stored, record); feed && kind != "" {
+                changes = append(changes, Change{
+                    Kind:         kind,
+                    FileID:       record.ID,
+                    TeamDriveID:  record.TeamDriveID,
+                    Name:         record.Name,
+                    Path:         record.Path,
+                    MimeType:     record.MimeType,
+                    IsFolder:     record.IsFolder,
+                    Size:         record.Size,
+                    ModifiedTime: record.ModifiedTime,
+                    ChangedAt:    now,
+                })
+            }
+        }
+    }
+    return changes, nil
+}
+
+// writeChanges appends changes to the feed.
+func writeChanges(tx *sql.Tx, dia dialect, changes []Change) error {
+    if len(changes) == 0 {
+        return nil
+    }
+    stmt, err := tx.Prepare(dia.rebind("INSERT INTO changes (" + changeColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"))
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+    for _, c := range changes {
+        if _, err := stmt.Exec(c.Kind, c.FileID, c.TeamDriveID, c.Name, c.Path,
+            c.MimeType, c.IsFolder, c.Size, nullString(c.ModifiedTime), c.ChangedAt); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// storedFiles looks up the stored rows of records, by ID.
+func storedFiles(tx *sql.Tx, dia dialect, records []FileRecord) (map[string]storedFile, error) {
+    ids := make([]interface{}, len(records))
+    for i, record := range records {
+        ids[i] = record.ID
+    }
+    rows, err := tx.Query(dia.rebind("SELECT id, name, parent_id, teamdrive_id, path, modified_time, size, trashed FROM files WHERE id IN (?"+
+        strings.Repeat(", ?", len(ids)-1)+")"), ids...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    old := make(map[string]storedFile, len(records))
+    for rows.Next() {
+        var id string
+        var f storedFile
+        var parentID, path, modifiedTime sql.NullString
+        var size sql.NullInt64
+        var trashed sql.NullBool
+        if err := rows.Scan(&id, &f.name, &parentID, &f.teamDriveID, &path, &modifiedTime, &size, &trashed); err != nil {
+            return nil, err
+        }
+        f.parentID, f.path, f.modifiedTime = parentID.String, path.String, modifiedTime.String
+        f.size, f.trashed = size.Int64, trashed.Bool
+        old[id] = f
+    }
+    return old, rows.Err()
+}
+
+// GetChanges returns up to limit changes after the since cursor, 0 for the
+// start of the feed, in the given drives (nil for all), and whether more
+// follow.
+func (d *Database) GetChanges(ctx context.Context, since int64, teamDriveIDs []string, limit int) ([]Change, bool, error) {
+    where := " FROM changes WHERE seq > ?"
+    args := []interface{}{since}
+    if len(teamDriveIDs) > 0 {
+        where += " AND teamdrive_id IN (?" + strings.Repeat(", ?", len(teamDriveIDs)-1) + ")"
+        for _, id := range teamDriveIDs {
+            args = append(args, id)
+        }
+    }
+
+    rows, err := d.query(ctx, "SELECT seq, "+changeColumns+where+" ORDER BY seq LIMIT ?", append(args, limit+1)...)
+    if err != nil {
+        return nil, false, err
+    }
+    defer rows.Close()
+
+    changes := make([]Change, 0)
+    for rows.Next() {
+        var c Change
+        var path, mimeType, modifiedTime sql.NullString
+        if err := rows.Scan(&c.Seq, &c.Kind, &c.FileID, &c.TeamDriveID, &c.Name, &path, &mimeType,
+            &c.IsFolder, &c.Size, &modifiedTime, &c.ChangedAt); err != nil {
+            return nil, false, err
+        }
+        c.Path, c.MimeType, c.ModifiedTime = path.String, mimeType.String, modifiedTime.String
+        changes = append(changes, c)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, false, err
+    }
+
+    hasMore := len(changes) > limit
+    if hasMore {
+        changes = changes[:limit]
+    }
+    return changes, hasMore, nil
+}
+
+// LatestChange returns the cursor of the newest change, 0 when there are
+// none, for consumers that start following the feed from now.
+func (d *Database) LatestChange(ctx context.Context) (int64, error) {
+    var seq sql.NullInt64
+    err := d.queryRow(ctx, "SELECT MAX(seq) FROM changes").Scan(&seq)
+    return seq.Int64, err
+}
+
+// pruneChanges drops the change feed entries older than the retention.
+func (d *Database) pruneChanges(ctx context.Context) error {
+    if d.changeRetention <= 0 {
+        return nil
+    }
+    cutoff := time.Now().UTC().Add(-d.changeRetention).Format("2006-01-02T15:04:05.000Z")
+    result, err := d.exec(ctx, "DELETE FROM changes WHERE changed_at < ?", cutoff)
+    if err != nil {
+        return err
+    }
+    if n, _ := result.RowsAffected(); n > 0 {
+        log.Printf("Dropped %d change feed entries older than %s", n, d.changeRetention)
+    }
+    return nil
+}
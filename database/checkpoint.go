@@ -0,0 +1,71 @@
+package database
+
+import (
+    "context"
+    "log"
+    "time"
+
+    "teamdrive-scanner/metrics"
+)
+
+// StartCheckpointer runs a PASSIVE WAL checkpoint every interval until the
+// returned function is called. During long scans SQLite's automatic
+// checkpoints fall behind while readers hold the log, which can then grow
+// to tens of gigabytes; passive checkpoints copy back what they can without
+// blocking readers or writers. It does nothing for PostgreSQL, read-only
+// databases or a zero interval.
+func (d *Database) StartCheckpointer(interval time.Duration) (stop func()) {
+    if interval <= 0 || d.dialect.name() != "sqlite" || d.readOnly {
+        return func() {}
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                d.checkpointAll(ctx)
+            }
+        }
+    }()
+
+    return func() {
+        cancel()
+        <-done
+    }
+}
+
+// checkpointAll checkpoints the database and its shards, reporting their
+// combined log size.
+func (d *Database) checkpointAll(ctx context.Context) {
+    databases := []*Database{d}
+    if d.shards != nil {
+        databases = append(databases, d.shardsOf(nil)...)
+    }
+
+    var frames, backlog int64
+    for _, db := range databases {
+        start := time.Now()
+        var busy, logged, copied int64
+        err := db.queryRow(ctx, "PRAGMA wal_checkpoint(PASSIVE)").Scan(&busy, &logged, &copied)
+        if err != nil {
+            if ctx.Err() == nil {
+                log.Printf("WAL checkpoint failed: %v", err)
+            }
+            continue
+        }
+        metrics.DBCheckpointDuration.Observe(time.Since(start).Seconds())
+        if logged > 0 {
+            frames += logged
+            backlog += logged - copied
+        }
+    }
+    metrics.DBWALFrames.Set(float64(frames))
+    metrics.DBCheckpointBacklog.Set(float64(backlog))
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// maxContentText caps the bytes of text kept per file, well below the
+// size PostgreSQL can turn into one tsvector.
+const maxContentText = 256 << 10
+
+// contentFTSSchema indexes the text of file_content for content searches.
+// Prose is split at every punctuation mark, unlike names.
+const contentFTSSchema = `
+CREATE VIRTUAL TABLE IF NOT EXISTS content_fts USING fts5(
+    content,
+    content='file_content',
+    content_rowid='rowid',
+    tokenize="unicode61 remove_diacritics 2"
+);
+
+CREATE TRIGGER IF NOT EXISTS file_content_ai AFTER INSERT ON file_content BEGIN
+    INSERT INTO content_fts(rowid, content) VALUES (new.rowid, new.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS file_content_ad AFTER DELETE ON file_content BEGIN
+    INSERT INTO content_fts(content_fts, rowid, content) VALUES('delete', old.rowid, old.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS file_content_au AFTER UPDATE ON file_content BEGIN
+    INSERT INTO content_fts(content_fts, rowid, content) VALUES('delete', old.rowid, old.content);
+    INSERT INTO content_fts(rowid, content) VALUES (new.rowid, new.content);
+END;
+`
+
+// FileContent is the text extracted from a document, for searches of
+// what files say rather than what they are called.
+type FileContent struct {
+    FileID string
+    // ModifiedTime is the file's when its text was extracted; the text is
+    // extracted again once the file's differs
+    ModifiedTime string
+    // Text is empty for documents without any, such as scanned PDFs, so
+    // they are not tried again until they change
+    Text string
+}
+
+// contentColumns is the column list written by SaveContent.
+var contentColumns = []string{"file_id", "teamdrive_id", "modified_time", "content", "indexed_at"}
+
+// ContentCandidates returns up to limit files of a drive with IDs after
+// after, in ID order, whose text is not indexed or was extracted from an
+// older version. Only files of mimeTypes are returned, "text/*" matching
+// every subtype, and when maxSize is set, only those of at most maxSize
+// bytes; Google-native files report no size and always pass.
+func (d *Database) ContentCandidates(ctx context.Context, teamDriveID string, mimeTypes []string, maxSize int64, after string, limit int) ([]FileRecord, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.ContentCandidates(ctx, teamDriveID, mimeTypes, maxSize, after, limit)
+    }
+    if len(mimeTypes) == 0 {
+        return nil, nil
+    }
+
+    where := []string{"f.teamdrive_id = ?", "f.id > ?", "f.is_folder = FALSE", "f.trashed = FALSE", "f.deleted_at IS NULL"}
+    args := []interface{}{teamDriveID, after}
+    types := make([]string, len(mimeTypes))
+    for i, mimeType := range mimeTypes {
+        if strings.HasSuffix(mimeType, "/*") {
+            types[i] = "f.mime_type LIKE ?"
+            args = append(args, strings.TrimSuffix(mimeType, "*")+"%")
+        } else {
+            types[i] = "f.mime_type = ?"
+            args = append(args, mimeType)
+        }
+    }
+    where = append(where, "("+strings.Join(types, " OR ")+")")
+    if maxSize > 0 {
+        where = append(where, "f.size <= ?")
+        args = append(args, maxSize)
+    }
+    where = append(where, "NOT EXISTS (SELECT 1 FROM file_content c WHERE c.file_id = f.id AND COALESCE(c.modified_time, '') = COALESCE(f.modified_time, ''))")
+
+    rows, err := d.query(ctx, "SELECT "+selectColumns("f.")+" FROM files f WHERE "+strings.Join(where, " AND ")+
+        " ORDER BY f.id LIMIT ?", append(args, limit)...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    return d.scanRows(rows)
+}
+
+// SaveContent stores the text of files of one drive, replacing what was
+// extracted from earlier versions. Text past maxContentText is dropped.
+func (d *Database) SaveContent(ctx context.Context, teamDriveID string, contents []FileContent) error {
+    if len(contents) == 0 {
+        return nil
+    }
+    if d.readOnly {
+        return fmt.Errorf("database is opened read-only")
+    }
+    target := d
+    if d.shards != nil {
+        shard, err := d.writeShard(teamDriveID)
+        if err != nil {
+            return err
+        }
+        target = shard
+    }
+
+    now := time.Now().UTC().Format(time.RFC3339)
+    return target.write(ctx, func() error {
+        tx, err := target.db.BeginTx(ctx, nil)
+        if err != nil {
+            return err
+        }
+        stmt, err := tx.Prepare(target.dialect.rebind(upsertSQL("file_content", "file_id", contentColumns)))
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+        defer stmt.Close()
+
+        for _, content := range contents {
+            text := truncateText(content.Text, maxContentText)
+            if _, err := stmt.Exec(content.FileID, teamDriveID, nullString(content.ModifiedTime), text, now); err != nil {
+                tx.Rollback()
+                return err
+            }
+        }
+        return tx.Commit()
+    })
+}
+
+// truncateText cuts s to at most n bytes without splitting a character.
+// PostgreSQL refuses NUL bytes in text, so they become spaces.
+func truncateText(s string, n int) string {
+    if len(s) > n {
+        s = strings.ToValidUTF8(s[:n], "")
+    }
+    return strings.ReplaceAll(s, "\x00", " ")
+}
@@ -0,0 +1,176 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "strings"
+    "time"
+)
+
+// CopyJob copies files and folders between drives on Drive's side.
+// Sources are the IDs of the items to copy, folders with everything below
+// them as the index knows it, and DestFolderID the folder of
+// DestTeamDriveID they are copied into, the drive's root when it is the
+// drive's ID. DoneFiles includes the SkippedFiles copied by an earlier run.
+type CopyJob struct {
+    ID              string   `json:"id"`
+    Sources         []string `json:"sources"`
+    DestTeamDriveID string   `json:"dest_teamdrive_id"`
+    DestFolderID    string   `json:"dest_folder_id"`
+    Concurrency     int      `json:"concurrency"`
+    Status          string   `json:"status"`
+    Error           string   `json:"error,omitempty"`
+    TotalFiles      int64    `json:"total_files"`
+    TotalBytes      int64    `json:"total_bytes"`
+    DoneFiles       int64    `json:"done_files"`
+    DoneBytes       int64    `json:"done_bytes"`
+    SkippedFiles    int64    `json:"skipped_files"`
+    FailedFiles     int64    `json:"failed_files"`
+    CreatedAt       string   `json:"created_at"`
+    StartedAt       string   `json:"started_at,omitempty"`
+    FinishedAt      string   `json:"finished_at,omitempty"`
+}
+
+const copyJobColumns = `id, sources, dest_teamdrive_id, dest_folder_id, concurrency, status, COALESCE(error, ''),
+    total_files, total_bytes, done_files, done_bytes, skipped_files, failed_files,
+    created_at, COALESCE(started_at, ''), COALESCE(finished_at, '')`
+
+func scanCopyJob(row interface{ Scan(...interface{}) error }) (CopyJob, error) {
+    var job CopyJob
+    var sources string
+    err := row.Scan(&job.ID, &sources, &job.DestTeamDriveID, &job.DestFolderID, &job.Concurrency, &job.Status, &job.Error,
+        &job.TotalFiles, &job.TotalBytes, &job.DoneFiles, &job.DoneBytes, &job.SkippedFiles, &job.FailedFiles,
+        &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+    // sources is a comma-separated list of IDs
+    job.Sources = strings.Split(sources, ",")
+    return job, err
+}
+
+// CreateCopyJob stores a new queued job and returns it with its ID.
+func (d *Database) CreateCopyJob(ctx context.Context, sources []string, destTeamDriveID, destFolderID string, concurrency int) (*CopyJob, error) {
+    id, err := newShortID()
+    if err != nil {
+        return nil, err
+    }
+
+    job := &CopyJob{
+        ID:              id,
+        Sources:         sources,
+        DestTeamDriveID: destTeamDriveID,
+        DestFolderID:    destFolderID,
+        Concurrency:     concurrency,
+        Status:          JobQueued,
+        CreatedAt:       time.Now().UTC().Format(time.RFC3339),
+    }
+
+    err = d.write(ctx, func() error {
+        _, err := d.exec(ctx, `INSERT INTO copy_jobs (id, sources, dest_teamdrive_id, dest_folder_id, concurrency, status, created_at)
+            VALUES (?, ?, ?, ?, ?, ?, ?)`,
+            job.ID, strings.Join(job.Sources, ","), job.DestTeamDriveID, job.DestFolderID, job.Concurrency, job.Status, job.CreatedAt)
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    return job, nil
+}
+
+// UpdateCopyJob stores the state and progress of a job.
+func (d *Database) UpdateCopyJob(ctx context.Context, job *CopyJob) error {
+    return d.write(ctx, func() error {
+        _, err := d.exec(ctx, `UPDATE copy_jobs SET status = ?, error = ?,
+            total_files = ?, total_bytes = ?, done_files = ?, done_bytes = ?, skipped_files = ?, failed_files = ?,
+            started_at = ?, finished_at = ? WHERE id = ?`,
+            job.Status, job.Error, job.TotalFiles, job.TotalBytes, job.DoneFiles, job.DoneBytes,
+            job.SkippedFiles, job.FailedFiles, job.StartedAt, job.FinishedAt, job.ID)
+        return err
+    })
+}
+
+// DeleteCopyJob removes a job and its record of copied items, reporting
+// whether it existed. The copies are kept.
+func (d *Database) DeleteCopyJob(ctx context.Context, id string) (bool, error) {
+    var deleted int64
+    err := d.write(ctx, func() error {
+        if _, err := d.exec(ctx, "DELETE FROM copy_items WHERE job_id = ?", id); err != nil {
+            return err
+        }
+        result, err := d.exec(ctx, "DELETE FROM copy_jobs WHERE id = ?", id)
+        if err != nil {
+            return err
+        }
+        deleted, _ = result.RowsAffected()
+        return nil
+    })
+    return deleted > 0, err
+}
+
+// GetCopyJob returns a job by ID, or nil if there is none.
+func (d *Database) GetCopyJob(ctx context.Context, id string) (*CopyJob, error) {
+    job, err := scanCopyJob(d.queryRow(ctx, "SELECT "+copyJobColumns+" FROM copy_jobs WHERE id = ?", id))
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &job, nil
+}
+
+// GetCopyJobs returns all jobs, newest first.
+func (d *Database) GetCopyJobs(ctx context.Context) ([]CopyJob, error) {
+    return d.copyJobs(ctx, "SELECT "+copyJobColumns+" FROM copy_jobs ORDER BY created_at DESC, id")
+}
+
+// UnfinishedCopyJobs returns the queued and running jobs, oldest first,
+// for resuming them.
+func (d *Database) UnfinishedCopyJobs(ctx context.Context) ([]CopyJob, error) {
+    return d.copyJobs(ctx, "SELECT "+copyJobColumns+" FROM copy_jobs WHERE status IN (?, ?) ORDER BY created_at, id",
+        JobQueued, JobRunning)
+}
+
+func (d *Database) copyJobs(ctx context.Context, query string, args ...interface{}) ([]CopyJob, error) {
+    rows, err := d.query(ctx, query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    jobs := make([]CopyJob, 0)
+    for rows.Next() {
+        job, err := scanCopyJob(rows)
+        if err != nil {
+            return nil, err
+        }
+        jobs = append(jobs, job)
+    }
+    return jobs, rows.Err()
+}
+
+// CopiedItems returns the IDs of the copies a job has made, by the ID of
+// the item copied, so a resumed job does not copy an item twice.
+func (d *Database) CopiedItems(ctx context.Context, jobID string) (map[string]string, error) {
+    rows, err := d.query(ctx, "SELECT source_id, dest_id FROM copy_items WHERE job_id = ?", jobID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    copied := make(map[string]string)
+    for rows.Next() {
+        var source, dest string
+        if err := rows.Scan(&source, &dest); err != nil {
+            return nil, err
+        }
+        copied[source] = dest
+    }
+    return copied, rows.Err()
+}
+
+// RecordCopiedItem stores the copy a job made of an item.
+func (d *Database) RecordCopiedItem(ctx context.Context, jobID, sourceID, destID string) error {
+    return d.write(ctx, func() error {
+        _, err := d.exec(ctx, "INSERT INTO copy_items (job_id, source_id, dest_id) VALUES (?, ?, ?)", jobID, sourceID, destID)
+        return err
+    })
+}
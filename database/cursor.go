@@ -0,0 +1,161 @@
+package database
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strings"
+)
+
+// ErrInvalidCursor is returned by Search when a cursor is malformed or was
+// issued for a different sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// sortKey is one column of a result ordering. The final key is always id,
+// so every ordering is total and can be resumed from the last row seen.
+type sortKey struct {
+    column string
+    desc   bool
+}
+
+// expr returns the SQL expression ordered on. created_time is NULL for
+// records indexed before it was collected, and NULL never compares equal,
+// so it is ordered as an empty string instead.
+func (k sortKey) expr(prefix string) string {
+    if k.column == "created_time" {
+        return "COALESCE(" + prefix + "created_time, '')"
+    }
+    return prefix + k.column
+}
+
+// value returns the key's value for record, as stored in a cursor.
+func (k sortKey) value(record FileRecord) interface{} {
+    switch k.column {
+    case "is_folder":
+        return record.IsFolder
+    case "name":
+        return record.Name
+    case "size":
+        return record.Size
+    case "modified_time":
+        return record.ModifiedTime
+    case "created_time":
+        return record.CreatedTime
+    default:
+        return record.ID
+    }
+}
+
+// sortKeys returns the ordering for a search. Listings put folders first
+// unless filtered to one kind, which lets the date and size indexes serve
+// the sort. Nil means relevance order, which can only be paged by offset.
+func (o SearchOptions) sortKeys(listing bool) []sortKey {
+    column, sorted := sortColumns[o.Sort]
+    if !listing && !sorted {
+        return nil
+    }
+
+    var keys []sortKey
+    if listing && o.IsFolder == nil {
+        keys = append(keys, sortKey{column: "is_folder", desc: true})
+    }
+    if sorted {
+        keys = append(keys, sortKey{column: column, desc: strings.EqualFold(o.Order, "desc")})
+    }
+    if column != "name" {
+        keys = append(keys, sortKey{column: "name"})
+    }
+    return append(keys, sortKey{column: "id"})
+}
+
+// sortSignature identifies the ordering a cursor was issued for.
+func (o SearchOptions) sortSignature() string {
+    if _, ok := sortColumns[o.Sort]; !ok {
+        return ""
+    }
+    if strings.EqualFold(o.Order, "desc") {
+        return o.Sort + " desc"
+    }
+    return o.Sort + " asc"
+}
+
+func orderClause(prefix string, keys []sortKey) string {
+    parts := make([]string, len(keys))
+    for i, key := range keys {
+        direction := "ASC"
+        if key.desc {
+            direction = "DESC"
+        }
+        parts[i] = key.expr(prefix) + " " + direction
+    }
+    return strings.Join(parts, ", ")
+}
+
+// keysetClause returns a condition selecting the rows that sort strictly
+// after values in the given ordering.
+func keysetClause(prefix string, keys []sortKey, values []interface{}) (string, []interface{}) {
+    var disjuncts []string
+    var args []interface{}
+
+    for i, key := range keys {
+        var terms []string
+        for j := 0; j < i; j++ {
+            terms = append(terms, keys[j].expr(prefix)+" = ?")
+            args = append(args, values[j])
+        }
+
+        op := ">"
+        if key.desc {
+            op = "<"
+        }
+        terms = append(terms, key.expr(prefix)+" "+op+" ?")
+        args = append(args, values[i])
+
+        disjuncts = append(disjuncts, "("+strings.Join(terms, " AND ")+")")
+    }
+
+    return "(" + strings.Join(disjuncts, " OR ") + ")", args
+}
+
+// pageCursor is the decoded form of SearchResult.NextCursor. Keys holds the
+// sort key values of the last row returned; relevance-ordered searches have
+// none and resume from Offset.
+type pageCursor struct {
+    Sort   string        `json:"s,omitempty"`
+    Offset int           `json:"o"`
+    Keys   []interface{} `json:"k,omitempty"`
+}
+
+func (c pageCursor) encode() string {
+    data, _ := json.Marshal(c)
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+    var cursor pageCursor
+
+    data, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil {
+        return cursor, ErrInvalidCursor
+    }
+
+    decoder := json.NewDecoder(strings.NewReader(string(data)))
+    decoder.UseNumber()
+    if err := decoder.Decode(&cursor); err != nil || cursor.Offset < 0 {
+        return cursor, ErrInvalidCursor
+    }
+
+    // Sizes must be bound as integers, not as JSON's float64
+    for i, key := range cursor.Keys {
+        if number, ok := key.(json.Number); ok {
+            n, err := number.Int64()
+            if err != nil {
+                return cursor, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+            }
+            cursor.Keys[i] = n
+        }
+    }
+
+    return cursor, nil
+}
@@ -1,18 +1,51 @@
 package database
 
 import (
+    "context"
     "database/sql"
     "fmt"
     "log"
+    "os"
+    "regexp"
+    "strings"
     "sync"
+    "sync/atomic"
     "time"
 
     _ "github.com/mattn/go-sqlite3"
 )
 
 type Database struct {
-    db    *sql.DB
-    mutex sync.Mutex
+    db       *sql.DB
+    dialect  dialect
+    readOnly bool
+    fuzzy    bool   // trigram index available for SearchOptions.Fuzzy
+    instance string // the PostgreSQL instance ID namespacing the tables
+
+    // Writes are serialized through a goroutine; see writer.go
+    writeOptions WriteOptions
+    writes       chan writeJob
+    writerOnce   sync.Once
+    writerDone   chan struct{}
+    generation   atomic.Uint64 // writes run so far, for the result cache
+
+    // Search and stats results; see cache.go
+    cache       *resultCache
+    versionMu   sync.Mutex
+    versionConn *sql.Conn
+
+    nativeEstimates map[string]int64 // export sizes by NativeKind; see native.go
+
+    // Change feed; see changes.go
+    changeFeed      bool
+    changeRetention time.Duration
+
+    deletedRetention time.Duration // see deleted.go
+
+    // Per-drive databases when sharded, and the catalog of a shard; see
+    // shards.go
+    shards  *shardSet
+    catalog *Database
 }
 
 type FileRecord struct {
@@ -28,16 +61,235 @@ type FileRecord struct {
     Path          string `json:"path"`
     TotalSize     int64  `json:"total_size"`
     ChildCount    int    `json:"child_count"`
+
+    // Shortcut fields are only set for application/vnd.google-apps.shortcut
+    // items. ShortcutTargetSize is known only when targets are resolved.
+    IsShortcut             bool   `json:"is_shortcut"`
+    ShortcutTargetID       string `json:"shortcut_target_id,omitempty"`
+    ShortcutTargetMimeType string `json:"shortcut_target_mime_type,omitempty"`
+    ShortcutTargetSize     int64  `json:"shortcut_target_size,omitempty"`
+
+    // Audit metadata. Owners is empty for items in shared drives, which
+    // are owned by the drive rather than a user.
+    CreatedTime       string   `json:"created_time,omitempty"`
+    LastModifyingUser string   `json:"last_modifying_user,omitempty"`
+    Owners            []string `json:"owners,omitempty"`
+    Shared            bool     `json:"shared"`
+    WebViewLink       string   `json:"web_view_link,omitempty"`
+
+    // Google-native files (Docs, Sheets, Slides, ...) report size 0 and
+    // are downloaded through ExportLinks, keyed by export MIME type.
+    IsNative    bool              `json:"is_native"`
+    ExportLinks map[string]string `json:"export_links,omitempty"`
+
+    // Revisions are only counted for the file types selected in the scan
+    // config; zero means they were not. RevisionSize includes the current
+    // revision.
+    RevisionCount int   `json:"revision_count,omitempty"`
+    RevisionSize  int64 `json:"revision_size,omitempty"`
+
+    // Trashed items are only scanned with the trash included, and are left
+    // out of browsing, searches and stats unless asked for.
+    Trashed     bool   `json:"trashed,omitempty"`
+    TrashedTime string `json:"trashed_time,omitempty"`
+
+    // MD5Checksum is the content checksum Drive reports for binary files;
+    // empty for folders and Google-native files.
+    MD5Checksum string `json:"md5_checksum,omitempty"`
+
+    // DeletedAt is set on files a full scan no longer found, which are
+    // kept for the recently deleted report until the retention purges
+    // them and are left out everywhere else. Writing the record again
+    // clears it.
+    DeletedAt string `json:"deleted_at,omitempty"`
+
+    // ThumbnailLink is where Drive serves the file's thumbnail to
+    // authorized clients, for a few hours after it is listed; the web
+    // server fetches it for the browser. HasThumbnail is set when read.
+    ThumbnailLink string `json:"-"`
+    HasThumbnail  bool   `json:"has_thumbnail,omitempty"`
+
+    // Permissions are set by scans that list permissions, and written to
+    // the permissions table with the record; nil leaves the stored ones.
+    Permissions []Permission `json:"permissions,omitempty"`
+
+    // Labels are the Drive labels and custom properties of the file, set
+    // by Drive scans and written to the file_labels table with the record;
+    // nil leaves the stored ones.
+    Labels []Label `json:"labels,omitempty"`
+
+    // Ext is the lowercased file extension without the dot; empty for
+    // folders and names without one. It is derived from Name when written.
+    Ext string `json:"ext,omitempty"`
+
+    // Media fields are parsed from the names of videos when written; see
+    // ParseMedia.
+    MediaTitle string `json:"media_title,omitempty"`
+    MediaYear  int    `json:"media_year,omitempty"`
+    Season     int    `json:"season,omitempty"`
+    Episode    int    `json:"episode,omitempty"`
+    Resolution string `json:"resolution,omitempty"`
+    Codec      string `json:"codec,omitempty"`
+
+    // Set on full-text search results only: HTML-escaped name and path
+    // excerpt with the matched terms in <mark> tags, or an excerpt of the
+    // document's text for content searches.
+    NameHighlight  string `json:"name_highlight,omitempty"`
+    PathSnippet    string `json:"path_snippet,omitempty"`
+    ContentSnippet string `json:"content_snippet,omitempty"`
+}
+
+const ShortcutMimeType = "application/vnd.google-apps.shortcut"
+
+// insertChunkRows is the number of rows per INSERT statement in
+// BatchInsert, just under 9500 parameters with the current columns.
+const insertChunkRows = 287
+
+// fileColumns is the column list written by BatchInsert and read by scanRows.
+var fileColumns = []string{
+    "id", "name", "parent_id", "teamdrive_id", "teamdrive_name",
+    "size", "modified_time", "mime_type", "is_folder", "path",
+    "shortcut_target_id", "shortcut_target_mime_type", "shortcut_target_size",
+    "created_time", "last_modifying_user", "owners", "shared", "web_view_link",
+    "export_links", "revision_count", "revision_size", "trashed",
+    "trashed_time", "md5_checksum", "ext", "media_title", "media_year",
+    "season", "episode", "resolution", "codec", "deleted_at",
+    "thumbnail_link",
+}
+
+// selectColumns returns fileColumns qualified with a table alias prefix.
+func selectColumns(prefix string) string {
+    columns := make([]string, len(fileColumns))
+    for i, column := range fileColumns {
+        columns[i] = prefix + column
+    }
+    return strings.Join(columns, ", ")
 }
 
+// SearchResult is one page of a search. NextCursor is set when HasMore is
+// and resumes directly after the last file, which stays fast however deep
+// the page; NextOffset does the same for offset paging.
 type SearchResult struct {
     Files      []FileRecord `json:"files"`
     TotalCount int          `json:"total_count"`
+    Limit      int          `json:"limit"`
+    Offset     int          `json:"offset"`
+    NextOffset int          `json:"next_offset"`
+    HasMore    bool         `json:"has_more"`
+    NextCursor string       `json:"next_cursor,omitempty"`
+    Fuzzy      bool         `json:"fuzzy,omitempty"`   // typo-tolerant matching was used
+    Partial    bool         `json:"partial,omitempty"` // a regex search timed out; counts are lower bounds
+    Substring  bool         `json:"substring,omitempty"` // no full-text match; names containing the query were returned
+}
+
+// Breadcrumb is one entry of an ancestor chain, root first.
+type Breadcrumb struct {
+    ID       string `json:"id"`
+    Name     string `json:"name"`
+    IsFolder bool   `json:"is_folder"`
+}
+
+// TreeNode is a lightweight folder entry for tree browsing.
+type TreeNode struct {
+    ID          string `json:"id"`
+    Name        string `json:"name"`
+    ParentID    string `json:"parent_id"`
+    HasChildren bool   `json:"has_children"`
+}
+
+// SearchOptions describes a search or folder listing. Zero values disable
+// the corresponding filter.
+type SearchOptions struct {
+    Query          string
+    Fuzzy          bool           // tolerate typos in Query, when the index supports it
+    Content        bool           // match Query against the indexed text of documents instead of names
+    Regex          *regexp.Regexp // match names and paths instead of Query
+    TeamDriveID    string
+    TeamDriveIDs   []string // restricts results to these drives, for scoped API keys
+    ParentID       string
+    MinSize        int64
+    MaxSize        int64
+    ModifiedAfter  string
+    ModifiedBefore string
+    MimeType       string
+    Extensions     []string // any of these extensions, lowercase without the dot
+    Labels         []string // all of these labels or properties, "key" or "key=value"
+    IsFolder       *bool
+    CreatedAfter   string
+    CreatedBefore  string
+    Owner          string
+    ModifiedBy     string
+    Shared         *bool
+    Native         *bool  // only Google-native files, or only files with bytes
+    Trash          string // TrashInclude or TrashOnly; trashed files are left out by default
+    Resolution     string // media filters, matching the parsed names of videos
+    Codec          string
+    MediaTitle     string // case-insensitive
+    Year           int
+    Season         int
+    Episode        int
+    Sort           string // name, size, modified or created; empty keeps the default order
+    Order          string // asc or desc
+    Limit          int
+    Offset         int
+    Cursor         string // NextCursor of the previous page; overrides Offset
+    NoCount        bool   // skip the COUNT query; TotalCount is left at zero
 }
 
+// sortColumns whitelists the columns that may be used in ORDER BY.
+var sortColumns = map[string]string{
+    "name":     "name",
+    "size":     "size",
+    "modified": "modified_time",
+    "created":  "created_time",
+}
+
+// ftsTokenizer keeps '.' and '-' inside tokens, so "DTS-HD" or a dotted
+// release name is matched as one term rather than as any of its parts. The
+// words column holds the name split at those characters, so single words
+// of such names still match.
+const ftsTokenizer = "unicode61 remove_diacritics 2 tokenchars '.-'"
+
+// ftsWords is the SQL expression for the words column of a files row.
+const ftsWords = "replace(replace(%[1]s.name, '.', ' '), '-', ' ')"
+
+// The index reads its content through files_fts_content, which adds the
+// computed words column to files.
+var ftsSchema = fmt.Sprintf(`
+CREATE VIEW IF NOT EXISTS files_fts_content AS
+    SELECT rowid AS rowid, id, name, path, teamdrive_name, %[2]s AS words FROM files;
+
+CREATE VIRTUAL TABLE IF NOT EXISTS files_fts USING fts5(
+    id UNINDEXED,
+    name,
+    path,
+    teamdrive_name UNINDEXED,
+    words,
+    content='files_fts_content',
+    content_rowid='rowid',
+    tokenize="%[1]s"
+);
+
+CREATE TRIGGER IF NOT EXISTS files_ai AFTER INSERT ON files BEGIN
+    INSERT INTO files_fts(rowid, id, name, path, teamdrive_name, words)
+    VALUES (new.rowid, new.id, new.name, new.path, new.teamdrive_name, %[3]s);
+END;
+
+CREATE TRIGGER IF NOT EXISTS files_ad AFTER DELETE ON files BEGIN
+    INSERT INTO files_fts(files_fts, rowid, id, name, path, teamdrive_name, words)
+    VALUES('delete', old.rowid, old.id, old.name, old.path, old.teamdrive_name, %[4]s);
+END;
+
+CREATE TRIGGER IF NOT EXISTS files_au AFTER UPDATE ON files BEGIN
+    INSERT INTO files_fts(files_fts, rowid, id, name, path, teamdrive_name, words)
+    VALUES('delete', old.rowid, old.id, old.name, old.path, old.teamdrive_name, %[4]s);
+    INSERT INTO files_fts(rowid, id, name, path, teamdrive_name, words)
+    VALUES (new.rowid, new.id, new.name, new.path, new.teamdrive_name, %[3]s);
+END;
+`, ftsTokenizer, fmt.Sprintf(ftsWords, "files"), fmt.Sprintf(ftsWords, "new"), fmt.Sprintf(ftsWords, "old"))
 
 func InitDatabase(path string, cacheSizeMB int) (*Database, error) {
-    db, err := sql.Open("sqlite3", fmt.Sprintf("%s?cache=shared&mode=rwc&_journal_mode=WAL&_busy_timeout=5000", path))
+    db, err := sql.Open("sqlite3", fmt.Sprintf("%s?cache=shared&mode=rwc&_journal_mode=WAL&_busy_timeout=5000&_auto_vacuum=incremental", path))
     if err != nil {
         return nil, err
     }
@@ -75,8 +327,31 @@ func InitDatabase(path string, cacheSizeMB int) (*Database, error) {
         mime_type TEXT,
         is_folder BOOLEAN,
         path TEXT,
+        shortcut_target_id TEXT,
+        shortcut_target_mime_type TEXT,
+        shortcut_target_size INTEGER,
+        created_time TEXT,
+        last_modifying_user TEXT,
+        owners TEXT,
+        shared BOOLEAN DEFAULT FALSE,
+        web_view_link TEXT,
+        export_links TEXT,
+        revision_count INTEGER,
+        revision_size INTEGER,
+        trashed BOOLEAN DEFAULT FALSE,
+        trashed_time TEXT,
+        md5_checksum TEXT,
+        ext TEXT,
+        media_title TEXT,
+        media_year INTEGER,
+        season INTEGER,
+        episode INTEGER,
+        resolution TEXT,
+        codec TEXT,
+        deleted_at TEXT,
+        thumbnail_link TEXT,
         created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-    ) WITHOUT ROWID;
+    );
 
     CREATE INDEX IF NOT EXISTS idx_parent ON files(parent_id);
     CREATE INDEX IF NOT EXISTS idx_teamdrive ON files(teamdrive_id);
@@ -84,294 +359,1230 @@ func InitDatabase(path string, cacheSizeMB int) (*Database, error) {
     CREATE INDEX IF NOT EXISTS idx_size ON files(size DESC);
     CREATE INDEX IF NOT EXISTS idx_modified ON files(modified_time DESC);
     CREATE INDEX IF NOT EXISTS idx_folder ON files(is_folder, parent_id);
+    CREATE INDEX IF NOT EXISTS idx_mime ON files(mime_type);
+    CREATE INDEX IF NOT EXISTS idx_teamdrive_size ON files(teamdrive_id, size DESC);
+    CREATE INDEX IF NOT EXISTS idx_teamdrive_modified ON files(teamdrive_id, modified_time DESC);
+
+    CREATE TABLE IF NOT EXISTS service_accounts (
+        name TEXT PRIMARY KEY,
+        requests INTEGER DEFAULT 0,
+        failures INTEGER DEFAULT 0,
+        errors_401 INTEGER DEFAULT 0,
+        errors_403 INTEGER DEFAULT 0,
+        errors_429 INTEGER DEFAULT 0,
+        rate_limit REAL,
+        quarantined BOOLEAN DEFAULT 0,
+        quarantined_until TEXT,
+        last_error TEXT,
+        updated_at TEXT,
+        budget_day TEXT,
+        budget_used INTEGER DEFAULT 0
+    );
+
+    CREATE TABLE IF NOT EXISTS permissions (
+        file_id TEXT NOT NULL,
+        teamdrive_id TEXT NOT NULL,
+        permission_id TEXT NOT NULL,
+        type TEXT NOT NULL,
+        role TEXT,
+        email_address TEXT,
+        domain TEXT,
+        discoverable BOOLEAN DEFAULT FALSE,
+        PRIMARY KEY (file_id, permission_id)
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_permissions_type ON permissions(type, domain);
+
+    CREATE TABLE IF NOT EXISTS file_labels (
+        file_id TEXT NOT NULL,
+        teamdrive_id TEXT NOT NULL,
+        source TEXT NOT NULL,
+        key TEXT NOT NULL,
+        value TEXT,
+        PRIMARY KEY (file_id, source, key)
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_file_labels_key ON file_labels(key, value);
+
+    CREATE TABLE IF NOT EXISTS moves (
+        file_id TEXT NOT NULL,
+        kind TEXT NOT NULL,
+        teamdrive_id TEXT NOT NULL,
+        old_teamdrive_id TEXT NOT NULL,
+        old_parent_id TEXT,
+        new_parent_id TEXT,
+        old_path TEXT,
+        new_path TEXT,
+        moved_at TEXT NOT NULL
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_moves_teamdrive ON moves(teamdrive_id, moved_at);
+    CREATE INDEX IF NOT EXISTS idx_moves_old_teamdrive ON moves(old_teamdrive_id, moved_at);
+
+    CREATE TABLE IF NOT EXISTS changes (
+        seq INTEGER PRIMARY KEY AUTOINCREMENT,
+        kind TEXT NOT NULL,
+        file_id TEXT NOT NULL,
+        teamdrive_id TEXT NOT NULL,
+        name TEXT NOT NULL,
+        path TEXT,
+        mime_type TEXT,
+        is_folder BOOLEAN,
+        size INTEGER DEFAULT 0,
+        modified_time TEXT,
+        changed_at TEXT NOT NULL
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_changes_teamdrive ON changes(teamdrive_id, seq);
+    CREATE INDEX IF NOT EXISTS idx_changes_changed ON changes(changed_at);
+
+    CREATE TABLE IF NOT EXISTS scans (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        teamdrive_id TEXT NOT NULL,
+        started_at TEXT NOT NULL,
+        finished_at TEXT,
+        files INTEGER DEFAULT 0,
+        folders INTEGER DEFAULT 0,
+        size INTEGER DEFAULT 0
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_scans_teamdrive ON scans(teamdrive_id, id);
+
+    CREATE TABLE IF NOT EXISTS scan_files (
+        scan_id INTEGER NOT NULL,
+        file_id TEXT NOT NULL,
+        parent_id TEXT,
+        name TEXT NOT NULL,
+        path TEXT,
+        size INTEGER DEFAULT 0,
+        is_folder BOOLEAN,
+        PRIMARY KEY (scan_id, file_id)
+    );
+
+    CREATE TABLE IF NOT EXISTS shards (
+        teamdrive_id TEXT PRIMARY KEY,
+        file TEXT NOT NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS maintenance_runs (
+        ran_at TEXT PRIMARY KEY,
+        duration_ms INTEGER NOT NULL,
+        size_before INTEGER NOT NULL,
+        size_after INTEGER NOT NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        description TEXT NOT NULL,
+        applied_at TEXT NOT NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS file_content (
+        file_id TEXT PRIMARY KEY,
+        teamdrive_id TEXT NOT NULL,
+        modified_time TEXT,
+        content TEXT NOT NULL,
+        indexed_at TEXT NOT NULL
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_file_content_teamdrive ON file_content(teamdrive_id);
+
+    CREATE TABLE IF NOT EXISTS teamdrives (
+        id TEXT PRIMARY KEY,
+        name TEXT NOT NULL,
+        discovered_at TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS stats_history (
+        teamdrive_id TEXT NOT NULL,
+        recorded_at TEXT NOT NULL,
+        total_files INTEGER,
+        total_folders INTEGER,
+        total_size INTEGER
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_stats_history ON stats_history(teamdrive_id, recorded_at);
+
+    CREATE TABLE IF NOT EXISTS saved_searches (
+        id TEXT PRIMARY KEY,
+        name TEXT NOT NULL,
+        params TEXT NOT NULL,
+        created_at TEXT,
+        updated_at TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS rescan_queue (
+        folder_id TEXT PRIMARY KEY,
+        teamdrive_id TEXT NOT NULL,
+        teamdrive_name TEXT NOT NULL,
+        path TEXT,
+        queued_at TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS download_jobs (
+        id TEXT PRIMARY KEY,
+        params TEXT NOT NULL,
+        dest TEXT NOT NULL,
+        concurrency INTEGER NOT NULL,
+        bandwidth INTEGER NOT NULL,
+        status TEXT NOT NULL,
+        error TEXT,
+        total_files INTEGER DEFAULT 0,
+        total_bytes INTEGER DEFAULT 0,
+        done_files INTEGER DEFAULT 0,
+        done_bytes INTEGER DEFAULT 0,
+        skipped_files INTEGER DEFAULT 0,
+        failed_files INTEGER DEFAULT 0,
+        created_at TEXT,
+        started_at TEXT,
+        finished_at TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS copy_jobs (
+        id TEXT PRIMARY KEY,
+        sources TEXT NOT NULL,
+        dest_teamdrive_id TEXT NOT NULL,
+        dest_folder_id TEXT NOT NULL,
+        concurrency INTEGER NOT NULL,
+        status TEXT NOT NULL,
+        error TEXT,
+        total_files INTEGER DEFAULT 0,
+        total_bytes INTEGER DEFAULT 0,
+        done_files INTEGER DEFAULT 0,
+        done_bytes INTEGER DEFAULT 0,
+        skipped_files INTEGER DEFAULT 0,
+        failed_files INTEGER DEFAULT 0,
+        created_at TEXT,
+        started_at TEXT,
+        finished_at TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS copy_items (
+        job_id TEXT NOT NULL,
+        source_id TEXT NOT NULL,
+        dest_id TEXT NOT NULL,
+        PRIMARY KEY (job_id, source_id)
+    );
     `
 
     if _, err := db.Exec(schema); err != nil {
         return nil, fmt.Errorf("schema creation failed: %w", err)
     }
 
-    // Simplified FTS5 for maximum compatibility
-    ftsSchema := `
-    CREATE VIRTUAL TABLE IF NOT EXISTS files_fts USING fts5(
-        id UNINDEXED,
-        name,
-        path,
-        teamdrive_name UNINDEXED,
-        content='files',
-        content_rowid='rowid'
-    );
+    if err := migrate(db, sqliteDialect{}); err != nil {
+        return nil, err
+    }
 
-    CREATE TRIGGER IF NOT EXISTS files_ai AFTER INSERT ON files BEGIN
-        INSERT INTO files_fts(rowid, id, name, path, teamdrive_name)
-        VALUES (new.rowid, new.id, new.name, new.path, new.teamdrive_name);
-    END;
-
-    CREATE TRIGGER IF NOT EXISTS files_ad AFTER DELETE ON files BEGIN
-        INSERT INTO files_fts(files_fts, rowid, id, name, path, teamdrive_name)
-        VALUES('delete', old.rowid, old.id, old.name, old.path, old.teamdrive_name);
-    END;
-
-    CREATE TRIGGER IF NOT EXISTS files_au AFTER UPDATE ON files BEGIN
-        INSERT INTO files_fts(files_fts, rowid, id, name, path, teamdrive_name)
-        VALUES('delete', old.rowid, old.id, old.name, old.path, old.teamdrive_name);
-        INSERT INTO files_fts(rowid, id, name, path, teamdrive_name)
-        VALUES (new.rowid, new.id, new.name, new.path, new.teamdrive_name);
-    END;
-    `
+    // A scan that deferred indexing and did not finish left the indexes stale
+    deferred := indexingDeferred(db)
+
+    // Indexes built before the derived columns and the current tokenizer
+    // are dropped, and rebuilt once the columns are filled in
+    if staleFTS(db) || needsBackfill(db) {
+        if err := dropFTS(db); err != nil {
+            return nil, fmt.Errorf("FTS5 upgrade failed: %w", err)
+        }
+        deferred = true
+    }
+    if err := backfillDerived(db, sqliteDialect{}); err != nil {
+        return nil, err
+    }
 
     if _, err := db.Exec(ftsSchema); err != nil {
         return nil, fmt.Errorf("FTS5 setup failed: %w", err)
     }
+    if _, err := db.Exec(contentFTSSchema); err != nil {
+        return nil, fmt.Errorf("content FTS5 setup failed: %w", err)
+    }
+
+    fuzzy := setupFuzzySQLite(db)
+    d := &Database{db: db, dialect: sqliteDialect{}, fuzzy: fuzzy, writeOptions: defaultWriteOptions}
+
+    if deferred {
+        if err := d.rebuildIndexes(); err != nil {
+            return nil, fmt.Errorf("FTS5 rebuild failed: %w", err)
+        }
+    }
 
     log.Println("Database initialized: SQLite with WAL mode + FTS5")
     log.Printf("Configuration: %dMB cache, 100 max connections", cacheSizeMB)
 
-    return &Database{db: db}, nil
+    return d, nil
+}
+
+// OpenReadOnly opens an existing SQLite index as read-only and immutable.
+// SQLite then takes no locks and ignores the WAL, so the web server can serve
+// a database file that another machine produces and copies over. The schema
+// is not created or upgraded; the file must come from a scanner instance.
+func OpenReadOnly(path string, cacheSizeMB int) (*Database, error) {
+    if _, err := os.Stat(path); err != nil {
+        return nil, fmt.Errorf("read-only database not available: %w", err)
+    }
+
+    db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&immutable=1", path))
+    if err != nil {
+        return nil, err
+    }
+
+    pragmas := []string{
+        fmt.Sprintf("PRAGMA cache_size = -%d", cacheSizeMB*1024),
+        "PRAGMA temp_store = MEMORY",
+        "PRAGMA mmap_size = 30000000000",
+        "PRAGMA query_only = ON",
+    }
+
+    for _, pragma := range pragmas {
+        if _, err := db.Exec(pragma); err != nil {
+            return nil, fmt.Errorf("pragma failed: %w", err)
+        }
+    }
+
+    db.SetMaxOpenConns(100)
+    db.SetMaxIdleConns(10)
+    db.SetConnMaxLifetime(time.Hour)
+
+    log.Println("Database opened read-only (immutable)")
+
+    return &Database{db: db, dialect: sqliteDialect{}, readOnly: true, fuzzy: hasTrigramIndex(db), writeOptions: defaultWriteOptions}, nil
+}
+
+// Instance returns the instance ID namespacing the tables, empty when the
+// index has the database to itself.
+func (d *Database) Instance() string {
+    return d.instance
+}
+
+// ReadOnly reports whether the database was opened with OpenReadOnly.
+func (d *Database) ReadOnly() bool {
+    return d.readOnly
 }
 
 func (d *Database) BatchInsert(records []FileRecord) error {
-    d.mutex.Lock()
-    defer d.mutex.Unlock()
+    if d.shards != nil {
+        return d.batchInsertShards(records)
+    }
+
+    return d.batchInsert(records, 0)
+}
 
+// batchInsert writes records, adding them to the manifest of scanID unless
+// it is zero.
+func (d *Database) batchInsert(records []FileRecord, scanID int64) error {
     start := time.Now()
 
+    if err := d.write(context.Background(), func() error { return d.insertRecords(records, scanID) }); err != nil {
+        return err
+    }
+
+    duration := time.Since(start)
+    rate := float64(len(records)) / duration.Seconds()
+    log.Printf("DB: Inserted %d records in %v (%.0f/sec)", len(records), duration.Round(time.Millisecond), rate)
+
+    return nil
+}
+
+// insertRecords upserts records in one transaction, insertChunkRows rows
+// per statement. A chunk that fails is retried row by row, and rows that
+// still fail are logged and skipped, unless the database is busy: then the
+// whole batch is rolled back so it can be retried.
+func (d *Database) insertRecords(records []FileRecord, scanID int64) error {
+    records = uniqueRecords(records)
+
     tx, err := d.db.Begin()
     if err != nil {
         return err
     }
 
-    stmt, err := tx.Prepare(`
-        INSERT OR REPLACE INTO files 
-        (id, name, parent_id, teamdrive_id, teamdrive_name, size, modified_time, mime_type, is_folder, path)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-    `)
+    changes, err := writeHistory(tx, d.dialect, records, d.changeFeed)
     if err != nil {
         tx.Rollback()
         return err
     }
-    defer stmt.Close()
-
-    for _, record := range records {
-        _, err := stmt.Exec(
-            record.ID,
-            record.Name,
-            record.ParentID,
-            record.TeamDriveID,
-            record.TeamDriveName,
-            record.Size,
-            record.ModifiedTime,
-            record.MimeType,
-            record.IsFolder,
-            record.Path,
-        )
-        if err != nil {
-            log.Printf("Insert failed for %s: %v", record.Name, err)
+    // A shard's changes join the catalog's feed once it commits
+    if d.catalog == nil {
+        if err := writeChanges(tx, d.dialect, changes); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+
+    if err := writeFiles(tx, d.dialect, records); err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := writePermissions(tx, d.dialect, records); err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := writeLabels(tx, d.dialect, records); err != nil {
+        tx.Rollback()
+        return err
+    }
+    if scanID > 0 {
+        if err := writeScanFiles(tx, d.dialect, scanID, records); err != nil {
+            tx.Rollback()
+            return err
         }
     }
 
     if err := tx.Commit(); err != nil {
         return err
     }
+    if d.catalog != nil && len(changes) > 0 {
+        d.catalog.addChanges(changes)
+    }
+    return nil
+}
 
-    duration := time.Since(start)
-    rate := float64(len(records)) / duration.Seconds()
-    log.Printf("DB: Inserted %d records in %v (%.0f/sec)", len(records), duration.Round(time.Millisecond), rate)
+// writeFiles upserts records insertChunkRows rows per statement. A chunk
+// that fails is retried row by row, and rows that still fail are logged and
+// skipped; only a busy database fails the whole call.
+func writeFiles(tx *sql.Tx, dia dialect, records []FileRecord) error {
+    single, err := tx.Prepare(dia.rebind(upsertSQL("files", "id", fileColumns)))
+    if err != nil {
+        return err
+    }
+    defer single.Close()
+
+    var chunkStmt *sql.Stmt
+    for start := 0; start < len(records); start += insertChunkRows {
+        chunk := records[start:]
+        if len(chunk) > insertChunkRows {
+            chunk = chunk[:insertChunkRows]
+        }
+
+        args := make([]interface{}, 0, len(chunk)*len(fileColumns))
+        for _, record := range chunk {
+            args = append(args, recordArgs(record)...)
+        }
+
+        // Full chunks share one prepared statement; only the last differs
+        if len(chunk) == insertChunkRows && chunkStmt == nil {
+            chunkStmt, err = tx.Prepare(dia.rebind(upsertRowsSQL("files", "id", fileColumns, insertChunkRows)))
+            if err != nil {
+                return err
+            }
+            defer chunkStmt.Close()
+        }
+        if len(chunk) == insertChunkRows {
+            _, err = chunkStmt.Exec(args...)
+        } else {
+            _, err = tx.Exec(dia.rebind(upsertRowsSQL("files", "id", fileColumns, len(chunk))), args...)
+        }
+        if err == nil {
+            continue
+        }
+        if isBusy(err) {
+            return err
+        }
 
+        for _, record := range chunk {
+            _, err := single.Exec(recordArgs(record)...)
+            if isBusy(err) {
+                return err
+            }
+            if err != nil {
+                log.Printf("Insert failed for %s: %v", record.Name, err)
+            }
+        }
+    }
     return nil
 }
 
-func (d *Database) Search(query string, teamDriveID string, parentID string, limit int, offset int) (*SearchResult, error) {
+// uniqueRecords drops all but the last record with each ID, which a single
+// multi-row upsert cannot contain twice.
+func uniqueRecords(records []FileRecord) []FileRecord {
+    last := make(map[string]int, len(records))
+    for i, record := range records {
+        last[record.ID] = i
+    }
+    if len(last) == len(records) {
+        return records
+    }
+
+    unique := make([]FileRecord, 0, len(last))
+    for i, record := range records {
+        if last[record.ID] == i {
+            unique = append(unique, record)
+        }
+    }
+    return unique
+}
+
+// recordArgs returns the values of fileColumns for record.
+func recordArgs(record FileRecord) []interface{} {
+    return append([]interface{}{
+        record.ID,
+        record.Name,
+        record.ParentID,
+        record.TeamDriveID,
+        record.TeamDriveName,
+        record.Size,
+        record.ModifiedTime,
+        record.MimeType,
+        record.IsFolder,
+        record.Path,
+        nullString(record.ShortcutTargetID),
+        nullString(record.ShortcutTargetMimeType),
+        record.ShortcutTargetSize,
+        nullString(record.CreatedTime),
+        nullString(record.LastModifyingUser),
+        nullString(strings.Join(record.Owners, ",")),
+        record.Shared,
+        nullString(record.WebViewLink),
+        encodeExportLinks(record.ExportLinks),
+        nullInt(record.RevisionCount),
+        revisionSize(record),
+        record.Trashed,
+        nullString(record.TrashedTime),
+        nullString(record.MD5Checksum),
+        recordExt(record),
+    }, append(recordMedia(record), nullString(record.DeletedAt), nullString(record.ThumbnailLink))...)
+}
+
+// revisionSize is the revision_size column of a record, NULL when its
+// revisions were not counted.
+func revisionSize(record FileRecord) interface{} {
+    if record.RevisionCount == 0 {
+        return nil
+    }
+    return record.RevisionSize
+}
+
+// Search returns a page of the files matching opts. Results are served from
+// the result cache while the database is unchanged, and must not be
+// modified.
+func (d *Database) Search(ctx context.Context, opts SearchOptions) (*SearchResult, error) {
+    if d.shards != nil {
+        return d.searchShards(ctx, opts)
+    }
+
+    result, err := d.cached(ctx, searchCacheKey(opts), func() (interface{}, error) {
+        return d.search(ctx, opts)
+    }, func(result interface{}) bool {
+        // A timed-out regex search may find more when run again
+        return !result.(*SearchResult).Partial
+    })
+    if err != nil {
+        return nil, err
+    }
+    return result.(*SearchResult), nil
+}
+
+// withQueryTerms parses the query, moving its ext:, type: and label: terms
+// to the other filters.
+func (o SearchOptions) withQueryTerms() (SearchOptions, parsedQuery, error) {
+    var parsed parsedQuery
+    if o.Regex != nil || o.Query == "" {
+        return o, parsed, nil
+    }
+    parsed, err := parseQuery(o.Query)
+    if err != nil {
+        return o, parsed, err
+    }
+    o.Extensions = append(o.Extensions[:len(o.Extensions):len(o.Extensions)], parsed.extensions...)
+    o.Labels = append(o.Labels[:len(o.Labels):len(o.Labels)], parsed.labels...)
+    if parsed.mimeType != "" {
+        o.MimeType = parsed.mimeType
+    }
+    if parsed.isFolder != nil {
+        o.IsFolder = parsed.isFolder
+    }
+    if parsed.empty() {
+        o.Query = ""
+    }
+    return o, parsed, nil
+}
+
+func (d *Database) search(ctx context.Context, opts SearchOptions) (*SearchResult, error) {
+    opts, parsed, err := opts.withQueryTerms()
+    if err != nil {
+        return nil, err
+    }
+
     var records []FileRecord
     var totalCount int
+    fuzzy := false
+    partial := false
+    substring := false
+
+    keys := opts.sortKeys(opts.Query == "" || opts.Regex != nil)
+    offset := opts.Offset
+    var after []interface{}
+    if opts.Cursor != "" {
+        cursor, err := decodeCursor(opts.Cursor)
+        if err != nil {
+            return nil, err
+        }
+        if cursor.Sort != opts.sortSignature() || (len(cursor.Keys) > 0 && len(cursor.Keys) != len(keys)) {
+            return nil, ErrInvalidCursor
+        }
+        offset = cursor.Offset
+        after = cursor.Keys
+    }
+
+    // A keyset condition replaces the offset once the last row is known
+    page := func(prefix string) (string, []interface{}, int) {
+        if len(after) == 0 {
+            return "", nil, offset
+        }
+        clause, args := keysetClause(prefix, keys, after)
+        return " AND " + clause, args, 0
+    }
+
+    if opts.Regex != nil {
+        pageSQL, pageArgs, skip := page("")
+        var matched int
+        var err error
+        records, matched, partial, err = d.searchRegex(ctx, opts, keys, pageSQL, pageArgs, skip)
+        if err != nil {
+            return nil, err
+        }
+        if !opts.NoCount {
+            totalCount = offset - skip + matched
+        }
 
-    if query != "" {
-        searchQuery := `
-            SELECT f.id, f.name, f.parent_id, f.teamdrive_id, f.teamdrive_name, 
-                   f.size, f.modified_time, f.mime_type, f.is_folder, f.path
-            FROM files_fts fts
-            JOIN files f ON fts.rowid = f.rowid
-            WHERE files_fts MATCH ?
-        `
-        args := []interface{}{query}
+    } else if opts.Query != "" {
+        where, args := opts.filterClauses("f.")
+        whereSQL := ""
+        if len(where) > 0 {
+            whereSQL = " AND " + strings.Join(where, " AND ")
+        }
 
-        if teamDriveID != "" {
-            searchQuery += " AND f.teamdrive_id = ?"
-            args = append(args, teamDriveID)
+        source, rank := d.dialect.matchSource()
+        match, highlights := d.dialect.matchQuery(parsed), d.dialect.highlights()
+        if opts.Content {
+            var snippet string
+            source, rank, snippet = d.dialect.contentSource()
+            match, highlights = d.dialect.matchQuery(parsed.anyField()), "NULL, "+snippet
+        } else if opts.Fuzzy && d.fuzzy {
+            if fuzzySource, fuzzyRank, arg := d.dialect.fuzzySource(parsed.words()); arg != "" {
+                source, rank, match, highlights = fuzzySource, fuzzyRank, arg, "NULL, NULL"
+                fuzzy = true
+            }
         }
-        if parentID != "" {
-            searchQuery += " AND f.parent_id = ?"
-            args = append(args, parentID)
+
+        order := rank + ", f.id ASC"
+        if keys != nil {
+            order = orderClause("f.", keys)
         }
+        pageSQL, pageArgs, skip := page("f.")
 
-        searchQuery += " ORDER BY rank LIMIT ? OFFSET ?"
-        args = append(args, limit, offset)
+        searchQuery := "SELECT " + selectColumns("f.") + ", " + highlights + " FROM " + source + whereSQL + pageSQL +
+            " ORDER BY " + order + " LIMIT ? OFFSET ?"
+        searchArgs := append([]interface{}{match}, args...)
+        searchArgs = append(searchArgs, pageArgs...)
+        searchArgs = append(searchArgs, opts.Limit+1, skip)
 
-        rows, err := d.db.Query(searchQuery, args...)
+        rows, err := d.query(ctx, searchQuery, searchArgs...)
         if err != nil {
-            return nil, err
+            return nil, queryError(err)
         }
         defer rows.Close()
 
-        records = d.scanRows(rows)
+        for rows.Next() {
+            var nameHighlight, snippet sql.NullString
+            record, err := scanRecord(rows, &nameHighlight, &snippet)
+            if err != nil {
+                return nil, err
+            }
+            record.NameHighlight = markMatches(nameHighlight.String)
+            if opts.Content {
+                record.ContentSnippet = markMatches(snippet.String)
+            } else {
+                record.PathSnippet = markMatches(snippet.String)
+            }
+            records = append(records, record)
+        }
+        if err := rows.Err(); err != nil {
+            return nil, queryError(err)
+        }
+
+        countQuery := "SELECT COUNT(*) FROM " + source + whereSQL
+        countArgs := append([]interface{}{match}, args...)
+        if !opts.NoCount {
+            if err := d.queryRow(ctx, countQuery, countArgs...).Scan(&totalCount); err != nil {
+                return nil, queryError(err)
+            }
+        }
 
-        countQuery := "SELECT COUNT(*) FROM files_fts WHERE files_fts MATCH ?"
-        countArgs := []interface{}{query}
-        if teamDriveID != "" {
-            countQuery = "SELECT COUNT(*) FROM files_fts fts JOIN files f ON fts.rowid = f.rowid WHERE files_fts MATCH ? AND f.teamdrive_id = ?"
-            countArgs = append(countArgs, teamDriveID)
+        // Nothing matched whole words: look for the query inside names.
+        // Past the first page, only when no page had full-text matches.
+        if terms := substringTerms(parsed.words()); len(records) == 0 && !fuzzy && !opts.Content && parsed.simple() && terms != nil {
+            noMatches := totalCount == 0
+            if opts.NoCount && (skip > 0 || pageSQL != "") {
+                if err := d.queryRow(ctx, countQuery, countArgs...).Scan(&totalCount); err != nil {
+                    return nil, err
+                }
+                noMatches, totalCount = totalCount == 0, 0
+            }
+            if noMatches {
+                var err error
+                records, totalCount, err = d.searchSubstring(ctx, opts, terms, keys, pageSQL, pageArgs, skip)
+                if err != nil {
+                    return nil, err
+                }
+                substring = true
+            }
         }
-        d.db.QueryRow(countQuery, countArgs...).Scan(&totalCount)
 
     } else {
-        listQuery := `
-            SELECT id, name, parent_id, teamdrive_id, teamdrive_name, 
-                   size, modified_time, mime_type, is_folder, path
-            FROM files
-            WHERE 1=1
-        `
-        args := []interface{}{}
-
-        if teamDriveID != "" {
-            listQuery += " AND teamdrive_id = ?"
-            args = append(args, teamDriveID)
+        where, args := opts.filterClauses("")
+        if opts.ParentID == "" && opts.TeamDriveID != "" && !opts.hasFilters() {
+            where = append(where, "parent_id = teamdrive_id")
         }
-        if parentID != "" {
-            listQuery += " AND parent_id = ?"
-            args = append(args, parentID)
-        } else if teamDriveID != "" {
-            listQuery += " AND parent_id = teamdrive_id"
+        whereSQL := ""
+        if len(where) > 0 {
+            whereSQL = " AND " + strings.Join(where, " AND ")
         }
 
-        listQuery += " ORDER BY is_folder DESC, name ASC LIMIT ? OFFSET ?"
-        args = append(args, limit, offset)
+        pageSQL, pageArgs, skip := page("")
 
-        rows, err := d.db.Query(listQuery, args...)
+        listQuery := `
+            SELECT ` + selectColumns("") + `
+            FROM files
+            WHERE 1=1` + whereSQL + pageSQL + " ORDER BY " + orderClause("", keys) + " LIMIT ? OFFSET ?"
+        listArgs := append(append([]interface{}{}, args...), pageArgs...)
+        listArgs = append(listArgs, opts.Limit+1, skip)
+
+        rows, err := d.query(ctx, listQuery, listArgs...)
         if err != nil {
             return nil, err
         }
         defer rows.Close()
 
-        records = d.scanRows(rows)
-
-        countQuery := "SELECT COUNT(*) FROM files WHERE 1=1"
-        countArgs := []interface{}{}
-        if teamDriveID != "" {
-            countQuery += " AND teamdrive_id = ?"
-            countArgs = append(countArgs, teamDriveID)
+        records, err = d.scanRows(rows)
+        if err != nil {
+            return nil, err
         }
-        if parentID != "" {
-            countQuery += " AND parent_id = ?"
-            countArgs = append(countArgs, parentID)
-        } else if teamDriveID != "" {
-            countQuery += " AND parent_id = teamdrive_id"
+
+        if !opts.NoCount {
+            countQuery := "SELECT COUNT(*) FROM files WHERE 1=1" + whereSQL
+            if err := d.queryRow(ctx, countQuery, args...).Scan(&totalCount); err != nil {
+                return nil, err
+            }
         }
-        d.db.QueryRow(countQuery, countArgs...).Scan(&totalCount)
+    }
+
+    // One extra row was fetched to tell whether another page follows
+    hasMore := len(records) > opts.Limit
+    if hasMore {
+        records = records[:opts.Limit]
     }
 
     for i := range records {
         if records[i].IsFolder {
-            records[i].TotalSize, records[i].ChildCount = d.GetFolderSize(records[i].ID)
+            size, count, err := d.GetFolderSize(ctx, records[i].ID)
+            if err != nil {
+                return nil, err
+            }
+            records[i].TotalSize, records[i].ChildCount = size, count
+        } else if records[i].IsShortcut {
+            records[i].TotalSize = records[i].ShortcutTargetSize
         } else {
             records[i].TotalSize = records[i].Size
         }
     }
 
-    return &SearchResult{
+    result := &SearchResult{
         Files:      records,
         TotalCount: totalCount,
-    }, nil
+        Limit:      opts.Limit,
+        Offset:     offset,
+        NextOffset: offset + len(records),
+        HasMore:    hasMore,
+        Fuzzy:      fuzzy,
+        Partial:    partial,
+        Substring:  substring,
+    }
+    if hasMore {
+        next := pageCursor{Sort: opts.sortSignature(), Offset: result.NextOffset}
+        if keys != nil {
+            last := records[len(records)-1]
+            for _, key := range keys {
+                next.Keys = append(next.Keys, key.value(last))
+            }
+        }
+        result.NextCursor = next.encode()
+    }
+
+    return result, nil
+}
+
+// hasFilters reports whether any attribute filter (size, date, type) is set.
+func (o SearchOptions) hasFilters() bool {
+    return o.MinSize > 0 || o.MaxSize > 0 ||
+        o.ModifiedAfter != "" || o.ModifiedBefore != "" ||
+        o.MimeType != "" || len(o.Extensions) > 0 || len(o.Labels) > 0 || o.IsFolder != nil ||
+        o.CreatedAfter != "" || o.CreatedBefore != "" ||
+        o.Owner != "" || o.ModifiedBy != "" || o.Shared != nil || o.Native != nil ||
+        o.Resolution != "" || o.Codec != "" || o.MediaTitle != "" ||
+        o.Year > 0 || o.Season > 0 || o.Episode > 0 || o.Trash != ""
+}
+
+// filterClauses builds the WHERE conditions shared by the search, list and
+// count queries. prefix is the table alias ("f.") used in the FTS join.
+func (o SearchOptions) filterClauses(prefix string) ([]string, []interface{}) {
+    var where []string
+    var args []interface{}
+
+    if o.TeamDriveID != "" {
+        where = append(where, prefix+"teamdrive_id = ?")
+        args = append(args, o.TeamDriveID)
+    }
+    if len(o.TeamDriveIDs) > 0 {
+        placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(o.TeamDriveIDs)), ", ")
+        where = append(where, prefix+"teamdrive_id IN ("+placeholders+")")
+        for _, id := range o.TeamDriveIDs {
+            args = append(args, id)
+        }
+    }
+    if o.ParentID != "" {
+        where = append(where, prefix+"parent_id = ?")
+        args = append(args, o.ParentID)
+    }
+    if o.MinSize > 0 {
+        where = append(where, prefix+"size >= ?")
+        args = append(args, o.MinSize)
+    }
+    if o.MaxSize > 0 {
+        where = append(where, prefix+"size <= ?")
+        args = append(args, o.MaxSize)
+    }
+    if o.ModifiedAfter != "" {
+        where = append(where, prefix+"modified_time >= ?")
+        args = append(args, o.ModifiedAfter)
+    }
+    if o.ModifiedBefore != "" {
+        where = append(where, prefix+"modified_time < ?")
+        args = append(args, o.ModifiedBefore)
+    }
+    if o.MimeType != "" {
+        // "video/*" matches every video subtype
+        if strings.HasSuffix(o.MimeType, "/*") {
+            where = append(where, prefix+"mime_type LIKE ?")
+            args = append(args, strings.TrimSuffix(o.MimeType, "*")+"%")
+        } else {
+            where = append(where, prefix+"mime_type = ?")
+            args = append(args, o.MimeType)
+        }
+    }
+    if len(o.Extensions) > 0 {
+        placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(o.Extensions)), ", ")
+        where = append(where, prefix+"ext IN ("+placeholders+")")
+        for _, ext := range o.Extensions {
+            args = append(args, ext)
+        }
+    }
+    for _, label := range o.Labels {
+        clause, labelArgs := labelClause(prefix, label)
+        where = append(where, clause)
+        args = append(args, labelArgs...)
+    }
+    switch o.Trash {
+    case TrashInclude:
+    case TrashOnly:
+        where = append(where, prefix+"trashed = TRUE")
+    default:
+        where = append(where, prefix+"trashed = FALSE")
+    }
+    where = append(where, prefix+"deleted_at IS NULL")
+    if o.IsFolder != nil {
+        where = append(where, prefix+"is_folder = ?")
+        args = append(args, *o.IsFolder)
+    }
+    if o.CreatedAfter != "" {
+        where = append(where, prefix+"created_time >= ?")
+        args = append(args, o.CreatedAfter)
+    }
+    if o.CreatedBefore != "" {
+        where = append(where, prefix+"created_time < ?")
+        args = append(args, o.CreatedBefore)
+    }
+    if o.Owner != "" {
+        // owners is a comma-separated list of addresses
+        where = append(where, "(',' || "+prefix+"owners || ',') LIKE ?")
+        args = append(args, "%,"+o.Owner+",%")
+    }
+    if o.ModifiedBy != "" {
+        where = append(where, prefix+"last_modifying_user = ?")
+        args = append(args, o.ModifiedBy)
+    }
+    if o.Shared != nil {
+        where = append(where, prefix+"shared = ?")
+        args = append(args, *o.Shared)
+    }
+    if o.Native != nil {
+        if *o.Native {
+            where = append(where, fmt.Sprintf(nativeCondition, prefix))
+        } else {
+            where = append(where, "NOT "+fmt.Sprintf(nativeCondition, prefix))
+        }
+    }
+    if o.Resolution != "" {
+        where = append(where, prefix+"resolution = ?")
+        args = append(args, strings.ToLower(o.Resolution))
+    }
+    if o.Codec != "" {
+        where = append(where, prefix+"codec = ?")
+        args = append(args, strings.ToLower(o.Codec))
+    }
+    if o.MediaTitle != "" {
+        where = append(where, "lower("+prefix+"media_title) = lower(?)")
+        args = append(args, o.MediaTitle)
+    }
+    if o.Year > 0 {
+        where = append(where, prefix+"media_year = ?")
+        args = append(args, o.Year)
+    }
+    if o.Season > 0 {
+        where = append(where, prefix+"season = ?")
+        args = append(args, o.Season)
+    }
+    if o.Episode > 0 {
+        where = append(where, prefix+"episode = ?")
+        args = append(args, o.Episode)
+    }
+
+    return where, args
 }
 
-func (d *Database) scanRows(rows *sql.Rows) []FileRecord {
+// scanRows reads every row selected with fileColumns. A row that cannot
+// be read fails the whole result rather than silently shortening it.
+func (d *Database) scanRows(rows *sql.Rows) ([]FileRecord, error) {
     var records []FileRecord
 
     for rows.Next() {
-        var record FileRecord
-        var parentID, path sql.NullString
-
-        err := rows.Scan(
-            &record.ID,
-            &record.Name,
-            &parentID,
-            &record.TeamDriveID,
-            &record.TeamDriveName,
-            &record.Size,
-            &record.ModifiedTime,
-            &record.MimeType,
-            &record.IsFolder,
-            &path,
-        )
+        record, err := scanRecord(rows)
+        if err != nil {
+            return nil, err
+        }
+        records = append(records, record)
+    }
+
+    return records, rows.Err()
+}
 
+// scanRecord reads one row selected with fileColumns, followed by any
+// extra columns into extra.
+func scanRecord(rows *sql.Rows, extra ...interface{}) (FileRecord, error) {
+    var record FileRecord
+    var parentID, path sql.NullString
+    var targetID, targetMimeType sql.NullString
+    var targetSize sql.NullInt64
+    var createdTime, lastModifyingUser, owners, webViewLink, exportLinks, ext sql.NullString
+    var shared sql.NullBool
+    var mediaTitle, resolution, codec sql.NullString
+    var mediaYear, season, episode sql.NullInt64
+    var revisionCount, revisionSize sql.NullInt64
+    var trashed sql.NullBool
+    var trashedTime, md5Checksum, deletedAt, thumbnailLink sql.NullString
+
+    dest := []interface{}{
+        &record.ID,
+        &record.Name,
+        &parentID,
+        &record.TeamDriveID,
+        &record.TeamDriveName,
+        &record.Size,
+        &record.ModifiedTime,
+        &record.MimeType,
+        &record.IsFolder,
+        &path,
+        &targetID,
+        &targetMimeType,
+        &targetSize,
+        &createdTime,
+        &lastModifyingUser,
+        &owners,
+        &shared,
+        &webViewLink,
+        &exportLinks,
+        &revisionCount,
+        &revisionSize,
+        &trashed,
+        &trashedTime,
+        &md5Checksum,
+        &ext,
+        &mediaTitle,
+        &mediaYear,
+        &season,
+        &episode,
+        &resolution,
+        &codec,
+        &deletedAt,
+        &thumbnailLink,
+    }
+
+    if err := rows.Scan(append(dest, extra...)...); err != nil {
+        return record, err
+    }
+
+    if parentID.Valid {
+        record.ParentID = parentID.String
+    }
+    if path.Valid {
+        record.Path = path.String
+    }
+    record.IsShortcut = record.MimeType == ShortcutMimeType
+    record.IsNative = IsGoogleNative(record.MimeType)
+    record.Trashed = trashed.Bool
+    record.TrashedTime = trashedTime.String
+    record.MD5Checksum = md5Checksum.String
+    record.DeletedAt = deletedAt.String
+    record.ThumbnailLink = thumbnailLink.String
+    record.HasThumbnail = record.ThumbnailLink != ""
+    record.ShortcutTargetID = targetID.String
+    record.ShortcutTargetMimeType = targetMimeType.String
+    record.ShortcutTargetSize = targetSize.Int64
+    record.CreatedTime = createdTime.String
+    record.LastModifyingUser = lastModifyingUser.String
+    if owners.String != "" {
+        record.Owners = strings.Split(owners.String, ",")
+    }
+    record.Shared = shared.Bool
+    record.ExportLinks = decodeExportLinks(exportLinks.String)
+    record.RevisionCount = int(revisionCount.Int64)
+    record.RevisionSize = revisionSize.Int64
+    record.Ext = ext.String
+    record.MediaTitle = mediaTitle.String
+    record.MediaYear = int(mediaYear.Int64)
+    record.Season = int(season.Int64)
+    record.Episode = int(episode.Int64)
+    record.Resolution = resolution.String
+    record.Codec = codec.String
+    record.WebViewLink = webViewLink.String
+    if record.WebViewLink == "" {
+        record.WebViewLink = DriveLink(record.ID, record.IsFolder)
+    }
+
+    return record, nil
+}
+
+// GetFile returns a single record by ID, or nil if it is not indexed.
+func (d *Database) GetFile(ctx context.Context, fileID string) (*FileRecord, error) {
+    shard, err := d.fileShard(ctx, fileID)
+    if err != nil {
+        return nil, err
+    }
+    if shard != nil {
+        return shard.GetFile(ctx, fileID)
+    }
+
+    rows, err := d.query(ctx, "SELECT "+selectColumns("")+" FROM files WHERE id = ?", fileID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    records, err := d.scanRows(rows)
+    if err != nil {
+        return nil, err
+    }
+    if len(records) == 0 {
+        return nil, nil
+    }
+
+    record := records[0]
+    if record.IsFolder {
+        record.TotalSize, record.ChildCount, err = d.GetFolderSize(ctx, record.ID)
         if err != nil {
-            log.Printf("Scan error: %v", err)
-            continue
+            return nil, err
         }
+    } else if record.IsShortcut {
+        record.TotalSize = record.ShortcutTargetSize
+    } else {
+        record.TotalSize = record.Size
+    }
+
+    record.Labels, err = d.GetLabels(ctx, record.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    return &record, nil
+}
+
+// GetPath returns the ancestor chain of a file, starting at the Team Drive
+// root and ending with the file itself. It returns nil if the file is unknown.
+func (d *Database) GetPath(ctx context.Context, fileID string) ([]Breadcrumb, error) {
+    shard, err := d.fileShard(ctx, fileID)
+    if err != nil {
+        return nil, err
+    }
+    if shard != nil {
+        return shard.GetPath(ctx, fileID)
+    }
+
+    rows, err := d.query(ctx, `
+        WITH RECURSIVE ancestors(id, name, parent_id, teamdrive_id, teamdrive_name, is_folder, depth) AS (
+            SELECT id, name, parent_id, teamdrive_id, teamdrive_name, is_folder, 0
+            FROM files
+            WHERE id = ?
+
+            UNION ALL
+
+            SELECT f.id, f.name, f.parent_id, f.teamdrive_id, f.teamdrive_name, f.is_folder, a.depth + 1
+            FROM files f
+            JOIN ancestors a ON f.id = a.parent_id
+            WHERE a.depth < 256
+        )
+        SELECT id, name, parent_id, teamdrive_id, teamdrive_name, is_folder
+        FROM ancestors
+        ORDER BY depth DESC
+    `, fileID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
 
-        if parentID.Valid {
-            record.ParentID = parentID.String
+    var chain []Breadcrumb
+    for rows.Next() {
+        var crumb Breadcrumb
+        var parentID sql.NullString
+        var teamDriveID, teamDriveName string
+
+        if err := rows.Scan(&crumb.ID, &crumb.Name, &parentID, &teamDriveID, &teamDriveName, &crumb.IsFolder); err != nil {
+            return nil, err
         }
-        if path.Valid {
-            record.Path = path.String
+
+        // The shared drive root itself is not stored in files
+        if len(chain) == 0 && parentID.String == teamDriveID {
+            chain = append(chain, Breadcrumb{ID: teamDriveID, Name: teamDriveName, IsFolder: true})
         }
 
-        records = append(records, record)
+        chain = append(chain, crumb)
+    }
+
+    return chain, rows.Err()
+}
+
+// GetChildren lists the subfolders of a folder, marking the ones that have
+// subfolders of their own. Folder sizes are not computed.
+func (d *Database) GetChildren(ctx context.Context, folderID string, limit int, offset int) ([]TreeNode, error) {
+    shard, err := d.fileShard(ctx, folderID)
+    if err != nil {
+        return nil, err
+    }
+    if shard != nil {
+        return shard.GetChildren(ctx, folderID, limit, offset)
+    }
+
+    rows, err := d.query(ctx, `
+        SELECT f.id, f.name, f.parent_id,
+               EXISTS(SELECT 1 FROM files c WHERE c.is_folder = TRUE AND c.parent_id = f.id AND c.trashed = FALSE AND c.deleted_at IS NULL)
+        FROM files f
+        WHERE f.is_folder = TRUE AND f.parent_id = ? AND f.trashed = FALSE AND f.deleted_at IS NULL
+        ORDER BY f.name ASC
+        LIMIT ? OFFSET ?
+    `, folderID, limit, offset)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    nodes := make([]TreeNode, 0)
+    for rows.Next() {
+        var node TreeNode
+        if err := rows.Scan(&node.ID, &node.Name, &node.ParentID, &node.HasChildren); err != nil {
+            return nil, err
+        }
+        nodes = append(nodes, node)
     }
 
-    return records
+    return nodes, rows.Err()
 }
 
-func (d *Database) GetFolderSize(folderID string) (int64, int) {
+// GetFolderSize totals the items below a folder: the ones not in the trash,
+// or everything below a trashed folder. Deleted files count likewise only
+// below a deleted folder.
+func (d *Database) GetFolderSize(ctx context.Context, folderID string) (int64, int, error) {
+    shard, err := d.fileShard(ctx, folderID)
+    if err != nil {
+        return 0, 0, err
+    }
+    if shard != nil {
+        return shard.GetFolderSize(ctx, folderID)
+    }
+
     var totalSize int64
     var childCount int
 
     query := `
         WITH RECURSIVE folder_tree AS (
-            SELECT id, size, is_folder
+            SELECT id, size, is_folder, trashed, deleted_at IS NOT NULL AS deleted
             FROM files
-            WHERE parent_id = ?
+            WHERE parent_id = ? AND trashed = COALESCE((SELECT trashed FROM files WHERE id = ?), FALSE)
+                AND (deleted_at IS NOT NULL) = COALESCE((SELECT deleted_at IS NOT NULL FROM files WHERE id = ?), FALSE)
 
             UNION ALL
 
-            SELECT f.id, f.size, f.is_folder
+            SELECT f.id, f.size, f.is_folder, f.trashed, f.deleted_at IS NOT NULL
             FROM files f
-            JOIN folder_tree ft ON f.parent_id = ft.id
+            JOIN folder_tree ft ON f.parent_id = ft.id AND f.trashed = ft.trashed AND (f.deleted_at IS NOT NULL) = ft.deleted
         )
         SELECT COALESCE(SUM(size), 0), COUNT(*)
         FROM folder_tree
     `
 
-    d.db.QueryRow(query, folderID).Scan(&totalSize, &childCount)
+    err = d.queryRow(ctx, query, folderID, folderID, folderID).Scan(&totalSize, &childCount)
 
-    return totalSize, childCount
+    return totalSize, childCount, err
 }
 
-func (d *Database) GetTeamDriveStats(teamDriveID string) map[string]interface{} {
-    stats := make(map[string]interface{})
+// DriveLink builds the Google Drive URL of a file or folder, for records
+// scanned before webViewLink was captured.
+func DriveLink(id string, isFolder bool) string {
+    if isFolder {
+        return "https://drive.google.com/drive/folders/" + id
+    }
+    return "https://drive.google.com/file/d/" + id + "/view"
+}
 
-    var totalFiles, totalFolders int64
-    var totalSize int64
+// nullString stores empty strings as NULL.
+func nullString(s string) sql.NullString {
+    return sql.NullString{String: s, Valid: s != ""}
+}
 
-    d.db.QueryRow(`
-        SELECT COUNT(*), COALESCE(SUM(size), 0)
-        FROM files
-        WHERE teamdrive_id = ? AND is_folder = 0
-    `, teamDriveID).Scan(&totalFiles, &totalSize)
+// addMissingColumns adds each "name TYPE" column definition that table does
+// not have yet.
+func addMissingColumns(tx *sql.Tx, table string, columns []string) error {
+    rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+    if err != nil {
+        return err
+    }
 
-    d.db.QueryRow(`
-        SELECT COUNT(*)
-        FROM files
-        WHERE teamdrive_id = ? AND is_folder = 1
-    `, teamDriveID).Scan(&totalFolders)
+    existing := make(map[string]bool)
+    for rows.Next() {
+        var cid, notNull, pk int
+        var name, colType string
+        var defaultValue sql.NullString
+        if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+            rows.Close()
+            return err
+        }
+        existing[name] = true
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
 
-    stats["total_files"] = totalFiles
-    stats["total_folders"] = totalFolders
-    stats["total_size"] = totalSize
-    stats["total_size_human"] = formatBytes(totalSize)
+    for _, column := range columns {
+        name := strings.Fields(column)[0]
+        if existing[name] {
+            continue
+        }
+        if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, column)); err != nil {
+            return fmt.Errorf("add column %s.%s: %w", table, name, err)
+        }
+    }
 
-    return stats
+    return nil
 }
 
-func formatBytes(bytes int64) string {
+// FormatBytes renders a byte count in binary units, e.g. 1.50 GB.
+func FormatBytes(bytes int64) string {
     const unit = 1024
     if bytes < unit {
         return fmt.Sprintf("%d B", bytes)
@@ -385,8 +1596,24 @@ func formatBytes(bytes int64) string {
 }
 
 func (d *Database) Close() error {
+    if d.shards != nil {
+        for _, shard := range d.shards.open {
+            if err := shard.Close(); err != nil {
+                log.Printf("Failed to close a shard: %v", err)
+            }
+        }
+    }
+    d.stopWriter()
+    d.closeCache()
+
+    if d.readOnly {
+        return d.db.Close()
+    }
+
     log.Println("Optimizing database...")
-    d.db.Exec("PRAGMA optimize")
-    d.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+    if d.dialect.name() == "sqlite" && !d.readOnly {
+        d.db.Exec("PRAGMA optimize")
+        d.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+    }
     return d.db.Close()
 }
@@ -0,0 +1,91 @@
+package database
+
+import (
+    "context"
+    "log"
+    "time"
+)
+
+// deletedRoot matches the files deleted themselves rather than with their
+// folder.
+const deletedRoot = "f.deleted_at IS NOT NULL AND NOT EXISTS (SELECT 1 FROM files p WHERE p.id = f.parent_id AND p.deleted_at IS NOT NULL)"
+
+// SetDeletedRetention sets how long files a full scan no longer found are
+// kept, marked deleted, before Maintain purges them; zero keeps them all.
+func (d *Database) SetDeletedRetention(retention time.Duration) {
+    d.deletedRetention = retention
+}
+
+// GetDeleted returns a page of the files of a drive that full scans no
+// longer found, most recently deleted first, and its total count. Files
+// deleted with their folder are counted in the folder's TotalSize instead
+// of being listed.
+func (d *Database) GetDeleted(ctx context.Context, teamDriveID string, limit int, offset int) ([]FileRecord, int, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.GetDeleted(ctx, teamDriveID, limit, offset)
+    }
+
+    var total int
+    if err := d.queryRow(ctx, "SELECT COUNT(*) FROM files f WHERE f.teamdrive_id = ? AND "+deletedRoot, teamDriveID).Scan(&total); err != nil {
+        return nil, 0, err
+    }
+
+    rows, err := d.query(ctx, "SELECT "+selectColumns("f.")+" FROM files f WHERE f.teamdrive_id = ? AND "+deletedRoot+
+        " ORDER BY f.deleted_at DESC, f.path LIMIT ? OFFSET ?", teamDriveID, limit, offset)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer rows.Close()
+
+    records, err := d.scanRows(rows)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    var folders []string
+    for i := range records {
+        if records[i].IsFolder {
+            folders = append(folders, records[i].ID)
+        } else {
+            records[i].TotalSize = records[i].Size
+        }
+    }
+    if len(folders) > 0 {
+        sizes, err := d.folderSizes(ctx, folders)
+        if err != nil {
+            return nil, 0, err
+        }
+        for i := range records {
+            if size, ok := sizes[records[i].ID]; ok {
+                records[i].TotalSize, records[i].ChildCount = size.total, size.count
+            }
+        }
+    }
+    if records == nil {
+        records = []FileRecord{}
+    }
+    return records, total, nil
+}
+
+// pruneDeleted purges the files marked deleted longer ago than the
+// retention, with their permissions, labels and indexed text.
+func (d *Database) pruneDeleted(ctx context.Context) error {
+    if d.deletedRetention <= 0 {
+        return nil
+    }
+    cutoff := time.Now().UTC().Add(-d.deletedRetention).Format("2006-01-02T15:04:05.000Z")
+
+    for _, table := range []string{"permissions", "file_labels", "file_content"} {
+        if _, err := d.purgeRows(ctx, table, "file_id IN (SELECT id FROM files WHERE deleted_at < ?)", cutoff); err != nil {
+            return err
+        }
+    }
+    total, err := d.purgeRows(ctx, "files", "deleted_at < ?", cutoff)
+    if err != nil {
+        return err
+    }
+    if total > 0 {
+        log.Printf("Purged %d files deleted more than %s ago", total, d.deletedRetention)
+    }
+    return nil
+}
@@ -0,0 +1,179 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "strings"
+)
+
+// dialect isolates the SQL that differs between storage backends. Queries
+// elsewhere in the package are written with ? placeholders and portable
+// SQL (TRUE/FALSE literals, ON CONFLICT upserts, recursive CTEs) and passed
+// through rebind.
+type dialect interface {
+    name() string
+    rebind(query string) string
+    // matchSource returns the FROM ... WHERE fragment that full-text
+    // matches the files table (aliased f) against a single query argument,
+    // and the ORDER BY expression ranking the best matches first.
+    matchSource() (source string, rank string)
+    // matchQuery renders a parsed query as the argument of matchSource.
+    matchQuery(query parsedQuery) string
+    // highlights returns two SELECT expressions for a match: the name with
+    // matched terms between matchStart and matchEnd, and a short snippet
+    // of the path marked the same way.
+    highlights() string
+    // fuzzySource is matchSource for typo-tolerant matching of query. It
+    // returns the argument to bind in place of the query, or "" when the
+    // query cannot be matched fuzzily.
+    fuzzySource(query string) (source string, rank string, arg string)
+    // contentSource is matchSource for the indexed text of documents, with
+    // a SELECT expression for a snippet of the text marked like
+    // highlights.
+    contentSource() (source string, rank string, snippet string)
+    addColumns(tx *sql.Tx, table string, columns []string) error
+    // rowID is the column that identifies a row of any table, for
+    // deleting rows in batches.
+    rowID() string
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) name() string { return "sqlite" }
+
+func (sqliteDialect) rebind(query string) string { return query }
+
+func (sqliteDialect) matchSource() (string, string) {
+    return "files_fts fts JOIN files f ON fts.rowid = f.rowid WHERE files_fts MATCH ?", "rank"
+}
+
+func (sqliteDialect) matchQuery(query parsedQuery) string { return query.fts5() }
+
+func (sqliteDialect) highlights() string {
+    return fmt.Sprintf("highlight(files_fts, 1, '%[1]s', '%[2]s'), snippet(files_fts, 2, '%[1]s', '%[2]s', '…', 12)",
+        matchStart, matchEnd)
+}
+
+func (sqliteDialect) fuzzySource(query string) (string, string, string) {
+    return "files_trigram tg JOIN files f ON tg.rowid = f.rowid WHERE files_trigram MATCH ?", "rank",
+        trigramQuery(query)
+}
+
+func (sqliteDialect) contentSource() (string, string, string) {
+    return "content_fts cf JOIN file_content c ON cf.rowid = c.rowid JOIN files f ON f.id = c.file_id WHERE content_fts MATCH ?", "rank",
+        fmt.Sprintf("snippet(content_fts, 0, '%s', '%s', '…', 16)", matchStart, matchEnd)
+}
+
+func (sqliteDialect) rowID() string { return "rowid" }
+
+func (sqliteDialect) addColumns(tx *sql.Tx, table string, columns []string) error {
+    return addMissingColumns(tx, table, columns)
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) name() string { return "postgres" }
+
+// rebind rewrites ? placeholders to PostgreSQL's numbered $n form.
+func (postgresDialect) rebind(query string) string {
+    var b strings.Builder
+    n := 0
+    for _, r := range query {
+        if r == '?' {
+            n++
+            fmt.Fprintf(&b, "$%d", n)
+            continue
+        }
+        b.WriteRune(r)
+    }
+    return b.String()
+}
+
+func (postgresDialect) matchSource() (string, string) {
+    return "files f, websearch_to_tsquery('simple', ?) tsq WHERE f.search_vector @@ tsq",
+        "ts_rank(f.search_vector, tsq) DESC"
+}
+
+func (postgresDialect) matchQuery(query parsedQuery) string { return query.websearch() }
+
+func (postgresDialect) highlights() string {
+    return fmt.Sprintf("ts_headline('simple', f.name, tsq, 'StartSel=%[1]s, StopSel=%[2]s, HighlightAll=true'), "+
+        "ts_headline('simple', COALESCE(f.path, ''), tsq, 'StartSel=%[1]s, StopSel=%[2]s, MaxWords=12, MinWords=4')",
+        matchStart, matchEnd)
+}
+
+func (postgresDialect) fuzzySource(query string) (string, string, string) {
+    return "files f, (SELECT ?::text AS q) fq WHERE f.name % fq.q", "similarity(f.name, fq.q) DESC", query
+}
+
+func (postgresDialect) contentSource() (string, string, string) {
+    return "files f JOIN file_content c ON c.file_id = f.id, websearch_to_tsquery('simple', ?) tsq WHERE c.search_vector @@ tsq",
+        "ts_rank(c.search_vector, tsq) DESC",
+        fmt.Sprintf("ts_headline('simple', c.content, tsq, 'StartSel=%s, StopSel=%s, MaxWords=16, MinWords=6')", matchStart, matchEnd)
+}
+
+func (postgresDialect) rowID() string { return "ctid" }
+
+func (postgresDialect) addColumns(tx *sql.Tx, table string, columns []string) error {
+    for _, column := range columns {
+        if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", table, column)); err != nil {
+            return fmt.Errorf("add column %s.%s: %w", table, strings.Fields(column)[0], err)
+        }
+    }
+    return nil
+}
+
+func (d *Database) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+    return d.db.QueryContext(ctx, d.dialect.rebind(query), args...)
+}
+
+func (d *Database) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+    return d.db.QueryRowContext(ctx, d.dialect.rebind(query), args...)
+}
+
+func (d *Database) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+    return d.db.ExecContext(ctx, d.dialect.rebind(query), args...)
+}
+
+// upsertSQL builds an INSERT that updates every column but the key when a
+// row with the same key already exists. Unlike INSERT OR REPLACE it keeps
+// the existing row, so update triggers fire instead of delete+insert.
+func upsertSQL(table string, key string, columns []string) string {
+    return upsertRowsSQL(table, key, columns, 1)
+}
+
+// upsertRowsSQL is upsertSQL for a multi-row VALUES list of rows rows. The
+// rows must have distinct keys: PostgreSQL refuses to update a row twice.
+func upsertRowsSQL(table string, key string, columns []string, rows int) string {
+    placeholders := make([]string, len(columns))
+    for i := range columns {
+        placeholders[i] = "?"
+    }
+
+    row := "(" + strings.Join(placeholders, ", ") + ")"
+    values := strings.TrimSuffix(strings.Repeat(row+", ", rows), ", ")
+
+    return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s ON CONFLICT (%s) DO UPDATE SET %s",
+        table, strings.Join(columns, ", "), values, key, upsertUpdates(key, columns))
+}
+
+// upsertSelectSQL is upsertSQL for the rows of query, a SELECT of columns
+// with distinct keys. query needs a WHERE clause, if only WHERE TRUE:
+// SQLite cannot tell ON CONFLICT from a join constraint without one.
+func upsertSelectSQL(table string, key string, columns []string, query string) string {
+    return fmt.Sprintf("INSERT INTO %s (%s) %s ON CONFLICT (%s) DO UPDATE SET %s",
+        table, strings.Join(columns, ", "), query, key, upsertUpdates(key, columns))
+}
+
+// upsertUpdates sets every column but the key to the value of the row
+// that conflicted.
+func upsertUpdates(key string, columns []string) string {
+    updates := make([]string, 0, len(columns))
+    for _, column := range columns {
+        if column != key {
+            updates = append(updates, fmt.Sprintf("%s = excluded.%s", column, column))
+        }
+    }
+    return strings.Join(updates, ", ")
+}
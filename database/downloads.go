@@ -0,0 +1,151 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "time"
+)
+
+// Job states, of download and copy jobs. Queued and running jobs are
+// picked up again when the daemon restarts.
+const (
+    JobQueued    = "queued"
+    JobRunning   = "running"
+    JobCompleted = "completed"
+    JobFailed    = "failed"
+    JobCanceled  = "canceled"
+)
+
+// DownloadJob mirrors the files of a search to a local directory. Params
+// is a search query string as for saved searches, Dest the directory under
+// the configured download root, and Bandwidth the job's limit in bytes a
+// second, zero for none. DoneBytes counts the bytes on disk, partial files
+// included; DoneFiles includes the SkippedFiles already up to date.
+type DownloadJob struct {
+    ID           string `json:"id"`
+    Params       string `json:"params"`
+    Dest         string `json:"dest"`
+    Concurrency  int    `json:"concurrency"`
+    Bandwidth    int64  `json:"bandwidth"`
+    Status       string `json:"status"`
+    Error        string `json:"error,omitempty"`
+    TotalFiles   int64  `json:"total_files"`
+    TotalBytes   int64  `json:"total_bytes"`
+    DoneFiles    int64  `json:"done_files"`
+    DoneBytes    int64  `json:"done_bytes"`
+    SkippedFiles int64  `json:"skipped_files"`
+    FailedFiles  int64  `json:"failed_files"`
+    CreatedAt    string `json:"created_at"`
+    StartedAt    string `json:"started_at,omitempty"`
+    FinishedAt   string `json:"finished_at,omitempty"`
+}
+
+const downloadJobColumns = `id, params, dest, concurrency, bandwidth, status, COALESCE(error, ''),
+    total_files, total_bytes, done_files, done_bytes, skipped_files, failed_files,
+    created_at, COALESCE(started_at, ''), COALESCE(finished_at, '')`
+
+func scanDownloadJob(row interface{ Scan(...interface{}) error }) (DownloadJob, error) {
+    var job DownloadJob
+    err := row.Scan(&job.ID, &job.Params, &job.Dest, &job.Concurrency, &job.Bandwidth, &job.Status, &job.Error,
+        &job.TotalFiles, &job.TotalBytes, &job.DoneFiles, &job.DoneBytes, &job.SkippedFiles, &job.FailedFiles,
+        &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+    return job, err
+}
+
+// CreateDownloadJob stores a new queued job and returns it with its ID.
+func (d *Database) CreateDownloadJob(ctx context.Context, params, dest string, concurrency int, bandwidth int64) (*DownloadJob, error) {
+    id, err := newShortID()
+    if err != nil {
+        return nil, err
+    }
+
+    job := &DownloadJob{
+        ID:          id,
+        Params:      params,
+        Dest:        dest,
+        Concurrency: concurrency,
+        Bandwidth:   bandwidth,
+        Status:      JobQueued,
+        CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+    }
+
+    err = d.write(ctx, func() error {
+        _, err := d.exec(ctx, `INSERT INTO download_jobs (id, params, dest, concurrency, bandwidth, status, created_at)
+            VALUES (?, ?, ?, ?, ?, ?, ?)`,
+            job.ID, job.Params, job.Dest, job.Concurrency, job.Bandwidth, job.Status, job.CreatedAt)
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    return job, nil
+}
+
+// UpdateDownloadJob stores the state and progress of a job.
+func (d *Database) UpdateDownloadJob(ctx context.Context, job *DownloadJob) error {
+    return d.write(ctx, func() error {
+        _, err := d.exec(ctx, `UPDATE download_jobs SET status = ?, error = ?,
+            total_files = ?, total_bytes = ?, done_files = ?, done_bytes = ?, skipped_files = ?, failed_files = ?,
+            started_at = ?, finished_at = ? WHERE id = ?`,
+            job.Status, job.Error, job.TotalFiles, job.TotalBytes, job.DoneFiles, job.DoneBytes,
+            job.SkippedFiles, job.FailedFiles, job.StartedAt, job.FinishedAt, job.ID)
+        return err
+    })
+}
+
+// DeleteDownloadJob removes a job, reporting whether it existed. The files
+// it downloaded are kept.
+func (d *Database) DeleteDownloadJob(ctx context.Context, id string) (bool, error) {
+    var deleted int64
+    err := d.write(ctx, func() error {
+        result, err := d.exec(ctx, "DELETE FROM download_jobs WHERE id = ?", id)
+        if err != nil {
+            return err
+        }
+        deleted, _ = result.RowsAffected()
+        return nil
+    })
+    return deleted > 0, err
+}
+
+// GetDownloadJob returns a job by ID, or nil if there is none.
+func (d *Database) GetDownloadJob(ctx context.Context, id string) (*DownloadJob, error) {
+    job, err := scanDownloadJob(d.queryRow(ctx, "SELECT "+downloadJobColumns+" FROM download_jobs WHERE id = ?", id))
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &job, nil
+}
+
+// GetDownloadJobs returns all jobs, newest first.
+func (d *Database) GetDownloadJobs(ctx context.Context) ([]DownloadJob, error) {
+    return d.downloadJobs(ctx, "SELECT "+downloadJobColumns+" FROM download_jobs ORDER BY created_at DESC, id")
+}
+
+// UnfinishedDownloadJobs returns the queued and running jobs, oldest
+// first, for resuming them.
+func (d *Database) UnfinishedDownloadJobs(ctx context.Context) ([]DownloadJob, error) {
+    return d.downloadJobs(ctx, "SELECT "+downloadJobColumns+" FROM download_jobs WHERE status IN (?, ?) ORDER BY created_at, id",
+        JobQueued, JobRunning)
+}
+
+func (d *Database) downloadJobs(ctx context.Context, query string, args ...interface{}) ([]DownloadJob, error) {
+    rows, err := d.query(ctx, query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    jobs := make([]DownloadJob, 0)
+    for rows.Next() {
+        job, err := scanDownloadJob(rows)
+        if err != nil {
+            return nil, err
+        }
+        jobs = append(jobs, job)
+    }
+    return jobs, rows.Err()
+}
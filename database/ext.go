@@ -0,0 +1,151 @@
+package database
+
+import (
+    "database/sql"
+    "fmt"
+    "log"
+    "path"
+    "strings"
+    "time"
+)
+
+// maxExtLength bounds what counts as an extension, so the tail of a name
+// like "Mr. Smith goes to Washington" is not taken for one.
+const maxExtLength = 10
+
+// extBackfillRows is the number of rows updated per transaction when
+// filling in the ext and media columns of an existing database.
+const extBackfillRows = 10000
+
+// FileExt returns the lowercased extension of name without the dot, or ""
+// when it has none.
+func FileExt(name string) string {
+    ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+    if len(ext) == 0 || len(ext) > maxExtLength {
+        return ""
+    }
+    for _, r := range ext {
+        if !('a' <= r && r <= 'z' || '0' <= r && r <= '9') {
+            return ""
+        }
+    }
+    return ext
+}
+
+// recordExt is the ext column of a record. Folders store "" rather than
+// NULL, which marks rows written before the column existed.
+func recordExt(record FileRecord) string {
+    if record.IsFolder {
+        return ""
+    }
+    return FileExt(record.Name)
+}
+
+// needsBackfill reports whether rows predate the ext or media columns.
+func needsBackfill(db *sql.DB) bool {
+    var missing bool
+    db.QueryRow("SELECT EXISTS (SELECT 1 FROM files WHERE ext IS NULL OR resolution IS NULL)").Scan(&missing)
+    return missing
+}
+
+// backfillDerived fills in the columns derived from names, ext and the
+// media columns, of rows written before they existed.
+func backfillDerived(db *sql.DB, dia dialect) error {
+    if !needsBackfill(db) {
+        return nil
+    }
+
+    start := time.Now()
+    log.Println("Filling in file extensions and media metadata of existing rows...")
+
+    total := 0
+    for {
+        n, err := backfillBatch(db, dia)
+        if err != nil {
+            return fmt.Errorf("backfill failed: %w", err)
+        }
+        if n == 0 {
+            break
+        }
+        total += n
+    }
+
+    log.Printf("Derived columns of %d rows filled in in %v", total, time.Since(start).Round(time.Millisecond))
+    return nil
+}
+
+func backfillBatch(db *sql.DB, dia dialect) (int, error) {
+    rows, err := db.Query(dia.rebind("SELECT id, name, mime_type, is_folder FROM files WHERE ext IS NULL OR resolution IS NULL LIMIT ?"), extBackfillRows)
+    if err != nil {
+        return 0, err
+    }
+    var records []FileRecord
+    for rows.Next() {
+        var record FileRecord
+        if err := rows.Scan(&record.ID, &record.Name, &record.MimeType, &record.IsFolder); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        records = append(records, record)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil || len(records) == 0 {
+        return 0, err
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    update, err := tx.Prepare(dia.rebind(`UPDATE files SET ext = ?,
+        media_title = ?, media_year = ?, season = ?, episode = ?, resolution = ?, codec = ?
+        WHERE id = ?`))
+    if err != nil {
+        tx.Rollback()
+        return 0, err
+    }
+    defer update.Close()
+
+    for _, record := range records {
+        args := append([]interface{}{recordExt(record)}, recordMedia(record)...)
+        if _, err := update.Exec(append(args, record.ID)...); err != nil {
+            tx.Rollback()
+            return 0, err
+        }
+    }
+    return len(records), tx.Commit()
+}
+
+// staleFTS reports whether the SQLite full-text index was built with an
+// older tokenizer, or is missing although there are rows to index.
+func staleFTS(db *sql.DB) bool {
+    var schema string
+    err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'files_fts'").Scan(&schema)
+    if err == sql.ErrNoRows {
+        var rows bool
+        db.QueryRow("SELECT EXISTS (SELECT 1 FROM files)").Scan(&rows)
+        return rows
+    }
+    return err == nil && !strings.Contains(schema, ftsTokenizer)
+}
+
+// dropFTS removes the index triggers, and the full-text table when it is
+// stale, ahead of a rebuild.
+func dropFTS(db *sql.DB) error {
+    stale := staleFTS(db)
+    for _, trigger := range indexTriggers {
+        if _, err := db.Exec("DROP TRIGGER IF EXISTS " + trigger); err != nil {
+            return err
+        }
+    }
+    if !stale {
+        return nil
+    }
+
+    log.Println("Full-text index uses an older tokenizer, rebuilding it")
+    if _, err := db.Exec("DROP TABLE IF EXISTS files_fts"); err != nil {
+        return err
+    }
+    _, err := db.Exec("DROP VIEW IF EXISTS files_fts_content")
+    return err
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+    "database/sql"
+    "log"
+    "strings"
+    "unicode"
+)
+
+// The trigram tokenizer needs SQLite 3.34 or later. Only names are indexed;
+// paths would multiply the index size for little gain.
+const trigramSchema = `
+CREATE VIRTUAL TABLE IF NOT EXISTS files_trigram USING fts5(
+    name,
+    content='files',
+    content_rowid='rowid',
+    tokenize='trigram'
+);
+
+CREATE TRIGGER IF NOT EXISTS files_tg_ai AFTER INSERT ON files BEGIN
+    INSERT INTO files_trigram(rowid, name) VALUES (new.rowid, new.name);
+END;
+
+CREATE TRIGGER IF NOT EXISTS files_tg_ad AFTER DELETE ON files BEGIN
+    INSERT INTO files_trigram(files_trigram, rowid, name) VALUES('delete', old.rowid, old.name);
+END;
+
+CREATE TRIGGER IF NOT EXISTS files_tg_au AFTER UPDATE ON files BEGIN
+    INSERT INTO files_trigram(files_trigram, rowid, name) VALUES('delete', old.rowid, old.name);
+    INSERT INTO files_trigram(rowid, name) VALUES (new.rowid, new.name);
+END;
+`
+
+// setupFuzzySQLite creates the trigram index behind fuzzy search, filling
+// it from existing rows the first time. It reports whether fuzzy search is
+// available; when it is not, fuzzy searches use the regular index.
+func setupFuzzySQLite(db *sql.DB) bool {
+    var existing int
+    db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'files_trigram'").Scan(&existing)
+
+    if _, err := db.Exec(trigramSchema); err != nil {
+        log.Printf("Fuzzy search unavailable: %v", err)
+        return false
+    }
+
+    if existing == 0 {
+        log.Println("Building trigram index for fuzzy search...")
+        if _, err := db.Exec("INSERT INTO files_trigram(files_trigram) VALUES('rebuild')"); err != nil {
+            log.Printf("Fuzzy search unavailable: trigram rebuild failed: %v", err)
+            return false
+        }
+    }
+
+    return true
+}
+
+// hasTrigramIndex reports whether a database opened read-only was built
+// with fuzzy search.
+func hasTrigramIndex(db *sql.DB) bool {
+    var existing int
+    db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'files_trigram'").Scan(&existing)
+    return existing > 0
+}
+
+// setupFuzzyPostgres enables pg_trgm and indexes names for similarity
+// matching, reporting whether fuzzy search is available.
+func setupFuzzyPostgres(db *sql.DB) bool {
+    for _, stmt := range []string{
+        "CREATE EXTENSION IF NOT EXISTS pg_trgm SCHEMA public",
+        "CREATE INDEX IF NOT EXISTS idx_name_trgm ON files USING GIN (name gin_trgm_ops)",
+    } {
+        if _, err := db.Exec(stmt); err != nil {
+            log.Printf("Fuzzy search unavailable: %v", err)
+            return false
+        }
+    }
+    return true
+}
+
+// trigramQuery turns a search into an FTS5 query matching any trigram of
+// its words, so names sharing most of them rank first even with typos.
+// It returns "" when no word is long enough to have a trigram.
+func trigramQuery(query string) string {
+    seen := make(map[string]bool)
+    var terms []string
+
+    words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    })
+    for _, word := range words {
+        runes := []rune(word)
+        for i := 0; i+3 <= len(runes); i++ {
+            trigram := string(runes[i : i+3])
+            if !seen[trigram] {
+                seen[trigram] = true
+                terms = append(terms, `"`+trigram+`"`)
+            }
+        }
+    }
+
+    return strings.Join(terms, " OR ")
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "os"
+)
+
+// healthTables are the tables whose rows Health counts.
+var healthTables = []string{
+    "files", "permissions", "file_labels", "moves", "changes", "scans", "scan_files",
+    "teamdrives", "stats_history", "saved_searches", "rescan_queue", "service_accounts", "file_content",
+    "download_jobs", "copy_jobs", "copy_items",
+}
+
+// TableRows is the row count of one table.
+type TableRows struct {
+    Table string `json:"table"`
+    Rows  int64  `json:"rows"`
+}
+
+// DatabaseHealth describes the size and state of the database. A sharded
+// index reports the totals of the catalog and its shards.
+type DatabaseHealth struct {
+    Driver        string      `json:"driver"`
+    Instance      string      `json:"instance,omitempty"`
+    SchemaVersion int         `json:"schema_version"`
+    ReadOnly      bool        `json:"read_only"`
+    Shards        int         `json:"shards,omitempty"`
+    Size          int64       `json:"size"`
+    SizeHuman     string      `json:"size_human"`
+    WALSize       int64       `json:"wal_size"`
+    FTSSize       int64       `json:"fts_size"`
+    Tables        []TableRows `json:"tables"`
+    // CacheHitRate is the share of page reads served from PostgreSQL's
+    // buffer cache; SQLite does not report its page cache through SQL
+    CacheHitRate *float64 `json:"cache_hit_rate,omitempty"`
+    // The last Maintain run, if any
+    LastOptimized     string `json:"last_optimized,omitempty"`
+    LastOptimizeMs    int64  `json:"last_optimize_ms,omitempty"`
+    LastOptimizeFreed int64  `json:"last_optimize_freed,omitempty"`
+}
+
+// Health reports the size of the database and its logs and indexes, the
+// rows of each table and the last maintenance run. Counting rows reads
+// every table, which takes a while on large indexes.
+func (d *Database) Health(ctx context.Context) (*DatabaseHealth, error) {
+    health := &DatabaseHealth{Driver: d.dialect.name(), Instance: d.instance, ReadOnly: d.readOnly, Tables: make([]TableRows, len(healthTables))}
+    for i, table := range healthTables {
+        health.Tables[i].Table = table
+    }
+
+    var err error
+    if health.SchemaVersion, err = d.SchemaVersion(); err != nil {
+        return nil, err
+    }
+
+    databases := []*Database{d}
+    if d.shards != nil {
+        shards := d.shardsOf(nil)
+        health.Shards = len(shards)
+        databases = append(databases, shards...)
+    }
+    for _, db := range databases {
+        if err := db.addHealth(ctx, health); err != nil {
+            return nil, err
+        }
+    }
+    health.SizeHuman = FormatBytes(health.Size)
+
+    if d.dialect.name() == "postgres" {
+        var hit, read int64
+        err := d.queryRow(ctx, "SELECT COALESCE(blks_hit, 0), COALESCE(blks_read, 0) FROM pg_stat_database WHERE datname = current_database()").Scan(&hit, &read)
+        if err != nil {
+            return nil, err
+        }
+        if hit+read > 0 {
+            rate := float64(hit) / float64(hit+read)
+            health.CacheHitRate = &rate
+        }
+    }
+
+    var freed sql.NullInt64
+    var ranAt sql.NullString
+    err = d.queryRow(ctx, "SELECT ran_at, duration_ms, size_before - size_after FROM maintenance_runs ORDER BY ran_at DESC LIMIT 1").
+        Scan(&ranAt, &health.LastOptimizeMs, &freed)
+    if err != nil && err != sql.ErrNoRows {
+        return nil, err
+    }
+    health.LastOptimized, health.LastOptimizeFreed = ranAt.String, freed.Int64
+    return health, nil
+}
+
+// addHealth adds the sizes and row counts of one database to health.
+func (d *Database) addHealth(ctx context.Context, health *DatabaseHealth) error {
+    size, err := d.size(ctx)
+    if err != nil {
+        return err
+    }
+    health.Size += size
+
+    for i, table := range healthTables {
+        var rows int64
+        if err := d.queryRow(ctx, "SELECT COUNT(*) FROM "+table).Scan(&rows); err != nil {
+            return err
+        }
+        health.Tables[i].Rows += rows
+    }
+
+    if d.dialect.name() == "postgres" {
+        var fts int64
+        err := d.queryRow(ctx, "SELECT COALESCE(pg_relation_size(to_regclass('idx_search')), 0) + COALESCE(pg_relation_size(to_regclass('idx_name_trgm')), 0) + COALESCE(pg_relation_size(to_regclass('idx_content_search')), 0)").Scan(&fts)
+        health.FTSSize += fts
+        return err
+    }
+
+    // The WAL file sits next to the main file, whose name SQLite knows
+    var seq int
+    var name, file string
+    if err := d.queryRow(ctx, "PRAGMA database_list").Scan(&seq, &name, &file); err != nil {
+        return err
+    }
+    if info, err := os.Stat(file + "-wal"); err == nil {
+        health.WALSize += info.Size()
+    }
+
+    tables := []string{"files_fts_data", "content_fts_data"}
+    if d.fuzzy {
+        tables = append(tables, "files_trigram_data")
+    }
+    for _, table := range tables {
+        var fts int64
+        if err := d.queryRow(ctx, "SELECT COALESCE(SUM(LENGTH(block)), 0) FROM "+table).Scan(&fts); err != nil {
+            return err
+        }
+        health.FTSSize += fts
+    }
+    return nil
+}
@@ -0,0 +1,24 @@
+package database
+
+import (
+    "html"
+    "strings"
+)
+
+// Markers the dialects wrap around matched terms. They are private-use
+// characters so they cannot collide with file names, and are turned into
+// <mark> tags only after the text has been HTML-escaped.
+const (
+    matchStart = "\uE000"
+    matchEnd   = "\uE001"
+)
+
+// markMatches returns text as HTML with matched terms in <mark> tags, or
+// "" when nothing in it matched.
+func markMatches(text string) string {
+    if !strings.Contains(text, matchStart) {
+        return ""
+    }
+    escaped := html.EscapeString(text)
+    return strings.NewReplacer(matchStart, "<mark>", matchEnd, "</mark>").Replace(escaped)
+}
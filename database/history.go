@@ -0,0 +1,87 @@
+package database
+
+import (
+    "context"
+    "time"
+)
+
+// StatsSnapshot is a drive's totals as recorded at the end of a scan.
+type StatsSnapshot struct {
+    RecordedAt   string `json:"recorded_at"`
+    TotalFiles   int64  `json:"total_files"`
+    TotalFolders int64  `json:"total_folders"`
+    TotalSize    int64  `json:"total_size"`
+}
+
+// RecordStatsHistory appends the current totals of a drive to
+// stats_history, for charting growth across scans.
+func (d *Database) RecordStatsHistory(teamDriveID string) error {
+    if d.shards != nil {
+        shard, err := d.writeShard(teamDriveID)
+        if err != nil {
+            return err
+        }
+        return shard.RecordStatsHistory(teamDriveID)
+    }
+
+    ctx := context.Background()
+
+    snapshot := StatsSnapshot{RecordedAt: time.Now().UTC().Format("2006-01-02T15:04:05.000Z")}
+
+    err := d.queryRow(ctx, `
+        SELECT
+            COALESCE(SUM(CASE WHEN is_folder THEN 0 ELSE 1 END), 0),
+            COALESCE(SUM(CASE WHEN is_folder THEN 1 ELSE 0 END), 0),
+            COALESCE(SUM(CASE WHEN is_folder THEN 0 ELSE size END), 0)
+        FROM files
+        WHERE teamdrive_id = ? AND trashed = FALSE AND deleted_at IS NULL
+    `, teamDriveID).Scan(&snapshot.TotalFiles, &snapshot.TotalFolders, &snapshot.TotalSize)
+    if err != nil {
+        return err
+    }
+
+    return d.write(ctx, func() error {
+        _, err := d.exec(ctx, `
+            INSERT INTO stats_history (teamdrive_id, recorded_at, total_files, total_folders, total_size)
+            VALUES (?, ?, ?, ?, ?)
+        `, teamDriveID, snapshot.RecordedAt, snapshot.TotalFiles, snapshot.TotalFolders, snapshot.TotalSize)
+        return err
+    })
+}
+
+// GetStatsHistory returns the latest limit snapshots of a drive, oldest
+// first.
+func (d *Database) GetStatsHistory(ctx context.Context, teamDriveID string, limit int) ([]StatsSnapshot, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.GetStatsHistory(ctx, teamDriveID, limit)
+    }
+
+    rows, err := d.query(ctx, `
+        SELECT recorded_at, total_files, total_folders, total_size
+        FROM stats_history
+        WHERE teamdrive_id = ?
+        ORDER BY recorded_at DESC
+        LIMIT ?
+    `, teamDriveID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    history := make([]StatsSnapshot, 0)
+    for rows.Next() {
+        var snapshot StatsSnapshot
+        if err := rows.Scan(&snapshot.RecordedAt, &snapshot.TotalFiles, &snapshot.TotalFolders, &snapshot.TotalSize); err != nil {
+            return nil, err
+        }
+        history = append(history, snapshot)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+        history[i], history[j] = history[j], history[i]
+    }
+    return history, nil
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "log"
+    "time"
+)
+
+// indexTriggers keep files_fts and files_trigram in sync with files.
+var indexTriggers = []string{"files_ai", "files_ad", "files_au", "files_tg_ai", "files_tg_ad", "files_tg_au"}
+
+// indexingDeferred reports whether DeferIndexing dropped the triggers and
+// RebuildIndexes never ran.
+func indexingDeferred(db *sql.DB) bool {
+    var tables, triggers int
+    db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'files_fts'").Scan(&tables)
+    db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'files_ai'").Scan(&triggers)
+    return tables > 0 && triggers == 0
+}
+
+// DeferIndexing stops updating the SQLite full-text indexes on every write,
+// which roughly halves the cost of a bulk load. Searches see stale results
+// until RebuildIndexes; if the process dies first, the next InitDatabase
+// rebuilds them. PostgreSQL indexes are unaffected.
+func (d *Database) DeferIndexing() error {
+    ctx := context.Background()
+
+    if d.dialect.name() != "sqlite" {
+        return nil
+    }
+    if d.shards != nil {
+        d.shards.mu.Lock()
+        d.shards.deferred = true
+        shards := make([]*Database, 0, len(d.shards.open))
+        for _, shard := range d.shards.open {
+            shards = append(shards, shard)
+        }
+        d.shards.mu.Unlock()
+        for _, shard := range shards {
+            if err := shard.DeferIndexing(); err != nil {
+                return err
+            }
+        }
+    }
+
+    return d.write(ctx, func() error {
+        for _, trigger := range indexTriggers {
+            if _, err := d.exec(ctx, "DROP TRIGGER IF EXISTS " + trigger); err != nil {
+                return err
+            }
+        }
+        log.Println("Full-text indexing deferred until the scan completes")
+        return nil
+    })
+}
+
+// RebuildIndexes restores the triggers dropped by DeferIndexing and
+// rebuilds the full-text indexes from the files table.
+func (d *Database) RebuildIndexes() error {
+    if d.dialect.name() != "sqlite" {
+        return nil
+    }
+    if d.shards != nil {
+        d.shards.mu.Lock()
+        d.shards.deferred = false
+        d.shards.mu.Unlock()
+        for _, shard := range d.shardsOf(nil) {
+            if err := shard.RebuildIndexes(); err != nil {
+                return err
+            }
+        }
+    }
+    return d.write(context.Background(), d.rebuildIndexes)
+}
+
+func (d *Database) rebuildIndexes() error {
+    start := time.Now()
+    log.Println("Rebuilding full-text indexes...")
+
+    if _, err := d.db.Exec(ftsSchema); err != nil {
+        return err
+    }
+    if _, err := d.db.Exec("INSERT INTO files_fts(files_fts) VALUES('rebuild')"); err != nil {
+        return err
+    }
+
+    if d.fuzzy {
+        if _, err := d.db.Exec(trigramSchema); err != nil {
+            return err
+        }
+        if _, err := d.db.Exec("INSERT INTO files_trigram(files_trigram) VALUES('rebuild')"); err != nil {
+            return err
+        }
+    }
+
+    log.Printf("Full-text indexes rebuilt in %v", time.Since(start).Round(time.Millisecond))
+    return nil
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "strings"
+)
+
+// Label sources.
+const (
+    LabelSourceLabel       = "label"        // a Drive label, or one of its fields
+    LabelSourceProperty    = "property"     // a public custom property
+    LabelSourceAppProperty = "app_property" // a property private to the scanning app
+)
+
+// Label is a key-value pair attached to a file: a Drive label, with its
+// fields as "label.field" keys, or a custom property. Keys are stored
+// lowercased so label: terms match them whatever the case.
+type Label struct {
+    Source string `json:"source"`
+    Key    string `json:"key"`
+    Value  string `json:"value,omitempty"`
+}
+
+// writeLabels replaces the stored labels of the records whose labels were
+// scanned, those with a non-nil Labels. Records are deleted a chunk at a
+// time, since most have none.
+func writeLabels(tx *sql.Tx, dia dialect, records []FileRecord) error {
+    var scanned []FileRecord
+    for _, record := range records {
+        if record.Labels != nil {
+            scanned = append(scanned, record)
+        }
+    }
+    if len(scanned) == 0 {
+        return nil
+    }
+
+    var insert *sql.Stmt
+    for start := 0; start < len(scanned); start += insertChunkRows {
+        chunk := scanned[start:]
+        if len(chunk) > insertChunkRows {
+            chunk = chunk[:insertChunkRows]
+        }
+        ids := make([]interface{}, len(chunk))
+        for i, record := range chunk {
+            ids[i] = record.ID
+        }
+        if _, err := tx.Exec(dia.rebind("DELETE FROM file_labels WHERE file_id IN (?"+strings.Repeat(", ?", len(ids)-1)+")"), ids...); err != nil {
+            return err
+        }
+
+        for _, record := range chunk {
+            for _, label := range record.Labels {
+                if insert == nil {
+                    var err error
+                    insert, err = tx.Prepare(dia.rebind(upsertSQL("file_labels", "file_id, source, key",
+                        []string{"file_id", "source", "key", "teamdrive_id", "value"})))
+                    if err != nil {
+                        return err
+                    }
+                    defer insert.Close()
+                }
+                if _, err := insert.Exec(record.ID, label.Source, strings.ToLower(label.Key), record.TeamDriveID, label.Value); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    return nil
+}
+
+// GetLabels returns the labels and properties stored for a file.
+func (d *Database) GetLabels(ctx context.Context, fileID string) ([]Label, error) {
+    shard, err := d.fileShard(ctx, fileID)
+    if err != nil {
+        return nil, err
+    }
+    if shard != nil {
+        return shard.GetLabels(ctx, fileID)
+    }
+
+    rows, err := d.query(ctx, "SELECT source, key, value FROM file_labels WHERE file_id = ? ORDER BY source, key", fileID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    labels := make([]Label, 0)
+    for rows.Next() {
+        var label Label
+        var value sql.NullString
+        if err := rows.Scan(&label.Source, &label.Key, &value); err != nil {
+            return nil, err
+        }
+        label.Value = value.String
+        labels = append(labels, label)
+    }
+    return labels, rows.Err()
+}
+
+// labelClause is the condition for a label: term, "key" or "key=value",
+// on the files row aliased by prefix.
+func labelClause(prefix string, term string) (string, []interface{}) {
+    id := prefix + "id"
+    if prefix == "" {
+        id = "files.id"
+    }
+    key, value, hasValue := strings.Cut(term, "=")
+    clause := "EXISTS (SELECT 1 FROM file_labels l WHERE l.file_id = " + id + " AND l.key = ?"
+    args := []interface{}{strings.ToLower(key)}
+    if hasValue {
+        clause += " AND lower(l.value) = lower(?)"
+        args = append(args, value)
+    }
+    return clause + ")", args
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+)
+
+// ftsMergePages is the work done per FTS5 'merge' command; merging repeats
+// until a command changes fewer than two pages.
+const ftsMergePages = 500
+
+// MaintenanceReport is the outcome of Maintain.
+type MaintenanceReport struct {
+    SizeBefore int64
+    SizeAfter  int64
+    Duration   time.Duration
+}
+
+// Maintain checks the database and compacts it: integrity_check, ANALYZE,
+// an incremental VACUUM and a merge of the full-text indexes on SQLite,
+// VACUUM ANALYZE on PostgreSQL. Multi-million-row SQLite files slow down
+// without it. It stops before changing anything if the check fails.
+func (d *Database) Maintain() (*MaintenanceReport, error) {
+    if d.readOnly {
+        return nil, fmt.Errorf("database is opened read-only")
+    }
+
+    start := time.Now()
+    report := &MaintenanceReport{}
+
+    // Before the vacuum, which reclaims the space; the purge writes in
+    // batches of its own
+    if err := d.pruneDeleted(context.Background()); err != nil {
+        return nil, fmt.Errorf("deleted file purge failed: %w", err)
+    }
+
+    err := d.write(context.Background(), func() error { return d.maintain(report) })
+    if err != nil {
+        return nil, err
+    }
+    if d.shards != nil {
+        for _, shard := range d.shardsOf(nil) {
+            shardReport, err := shard.Maintain()
+            if err != nil {
+                return nil, err
+            }
+            report.SizeBefore += shardReport.SizeBefore
+            report.SizeAfter += shardReport.SizeAfter
+        }
+    }
+    report.Duration = time.Since(start)
+
+    err = d.write(context.Background(), func() error {
+        _, err := d.exec(context.Background(), "INSERT INTO maintenance_runs (ran_at, duration_ms, size_before, size_after) VALUES (?, ?, ?, ?)",
+            time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), report.Duration.Milliseconds(), report.SizeBefore, report.SizeAfter)
+        return err
+    })
+    if err != nil {
+        log.Printf("Failed to record the maintenance run: %v", err)
+    }
+
+    return report, nil
+}
+
+// maintain runs the maintenance steps on the writer goroutine, so no
+// write from this process interleaves with the vacuum.
+func (d *Database) maintain(report *MaintenanceReport) error {
+    ctx := context.Background()
+
+    var err error
+    if report.SizeBefore, err = d.size(ctx); err != nil {
+        return err
+    }
+    log.Printf("Database size before maintenance: %s", FormatBytes(report.SizeBefore))
+
+    if err := d.pruneChanges(ctx); err != nil {
+        return fmt.Errorf("change feed pruning failed: %w", err)
+    }
+
+    if d.dialect.name() == "postgres" {
+        err = d.maintainPostgres(ctx)
+    } else {
+        err = d.maintainSQLite(ctx)
+    }
+    if err != nil {
+        return err
+    }
+
+    if report.SizeAfter, err = d.size(ctx); err != nil {
+        return err
+    }
+    log.Printf("Database size after maintenance: %s (%s reclaimed)",
+        FormatBytes(report.SizeAfter), FormatBytes(report.SizeBefore-report.SizeAfter))
+
+    return nil
+}
+
+// size returns the on-disk size of the database. For SQLite this includes
+// pages still in the WAL.
+func (d *Database) size(ctx context.Context) (int64, error) {
+    var size int64
+    if d.dialect.name() == "postgres" && d.instance != "" {
+        // Only the instance's own tables and their indexes
+        err := d.queryRow(ctx, `
+            SELECT COALESCE(SUM(pg_total_relation_size(c.oid)), 0)
+            FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+            WHERE n.nspname = current_schema() AND c.relkind = 'r'
+        `).Scan(&size)
+        return size, err
+    }
+    if d.dialect.name() == "postgres" {
+        err := d.queryRow(ctx, "SELECT pg_database_size(current_database())").Scan(&size)
+        return size, err
+    }
+
+    var pageCount, pageSize int64
+    if err := d.queryRow(ctx, "PRAGMA page_count").Scan(&pageCount); err != nil {
+        return 0, err
+    }
+    if err := d.queryRow(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+        return 0, err
+    }
+    return pageCount * pageSize, nil
+}
+
+func (d *Database) maintainSQLite(ctx context.Context) error {
+    log.Println("Running integrity check...")
+    rows, err := d.query(ctx, "PRAGMA integrity_check")
+    if err != nil {
+        return err
+    }
+    var problems []string
+    for rows.Next() {
+        var line string
+        if err := rows.Scan(&line); err != nil {
+            rows.Close()
+            return err
+        }
+        if line != "ok" {
+            problems = append(problems, line)
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    if len(problems) > 0 {
+        return fmt.Errorf("integrity check failed:\n%s", strings.Join(problems, "\n"))
+    }
+
+    log.Println("Merging full-text indexes...")
+    tables := []string{"files_fts"}
+    if d.fuzzy {
+        tables = append(tables, "files_trigram")
+    }
+    for _, table := range tables {
+        if err := d.mergeFTS(ctx, table); err != nil {
+            return fmt.Errorf("%s merge failed: %w", table, err)
+        }
+    }
+
+    log.Println("Analyzing...")
+    if _, err := d.exec(ctx, "ANALYZE"); err != nil {
+        return err
+    }
+
+    // Databases created before auto_vacuum was enabled need one full VACUUM
+    // to switch modes; after that, freed pages are returned incrementally.
+    var autoVacuum int
+    if err := d.queryRow(ctx, "PRAGMA auto_vacuum").Scan(&autoVacuum); err != nil {
+        return err
+    }
+    if autoVacuum != 2 {
+        log.Println("Enabling incremental vacuum (full VACUUM, this may take a while)...")
+        if err := d.enableIncrementalVacuum(ctx); err != nil {
+            return err
+        }
+    } else {
+        log.Println("Vacuuming...")
+        if _, err := d.exec(ctx, "PRAGMA incremental_vacuum"); err != nil {
+            return err
+        }
+    }
+
+    _, err = d.exec(ctx, "PRAGMA wal_checkpoint(TRUNCATE)")
+    return err
+}
+
+// enableIncrementalVacuum switches auto_vacuum modes. The pragma only
+// applies to its own connection, so the VACUUM must run on the same one.
+func (d *Database) enableIncrementalVacuum(ctx context.Context) error {
+    conn, err := d.db.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    if _, err := conn.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+        return err
+    }
+    _, err = conn.ExecContext(ctx, "VACUUM")
+    return err
+}
+
+// mergeFTS merges the b-tree segments of an FTS5 index. Progress is
+// measured with total_changes(), so it must run on a single connection.
+func (d *Database) mergeFTS(ctx context.Context, table string) error {
+    conn, err := d.db.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    merge := fmt.Sprintf("INSERT INTO %[1]s(%[1]s, rank) VALUES('merge', %d)", table, ftsMergePages)
+    for {
+        var before, after int64
+        if err := conn.QueryRowContext(ctx, "SELECT total_changes()").Scan(&before); err != nil {
+            return err
+        }
+        if _, err := conn.ExecContext(ctx, merge); err != nil {
+            return err
+        }
+        if err := conn.QueryRowContext(ctx, "SELECT total_changes()").Scan(&after); err != nil {
+            return err
+        }
+        if after-before < 2 {
+            return nil
+        }
+    }
+}
+
+func (d *Database) maintainPostgres(ctx context.Context) error {
+    log.Println("Running VACUUM ANALYZE...")
+    _, err := d.exec(ctx, "VACUUM ANALYZE")
+    return err
+}
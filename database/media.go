@@ -0,0 +1,147 @@
+package database
+
+import (
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// MediaInfo is what a video's file name says about it, read the way media
+// servers such as Jellyfin and Plex read release names like
+// "Show.Name.S01E02.1080p.WEB-DL.x265.mkv" or "Movie (2010) 2160p.mkv".
+type MediaInfo struct {
+    Title      string
+    Year       int
+    Season     int
+    Episode    int
+    Resolution string // 2160p, 1080p, ...
+    Codec      string // h264, h265, av1, ...
+}
+
+// videoExts are the extensions taken for videos when Drive reports a
+// generic MIME type for them.
+var videoExts = map[string]bool{
+    "mkv": true, "mp4": true, "m4v": true, "avi": true, "mov": true, "wmv": true,
+    "ts": true, "m2ts": true, "webm": true, "flv": true, "mpg": true, "mpeg": true,
+}
+
+var (
+    episodePattern    = regexp.MustCompile(`^s(\d{1,2})(?:e(\d{1,4})(?:-?e\d{1,4})*)?$`)
+    absolutePattern   = regexp.MustCompile(`^\d{2,3}$`)
+    crossPattern      = regexp.MustCompile(`^(\d{1,2})x(\d{2,3})$`)
+    resolutionPattern = regexp.MustCompile(`^(\d{3,4})[pi]$`)
+)
+
+var codecTags = map[string]string{
+    "x264": "h264", "h264": "h264", "avc": "h264",
+    "x265": "h265", "h265": "h265", "hevc": "h265",
+    "av1": "av1", "vp9": "vp9", "xvid": "xvid", "divx": "divx", "mpeg2": "mpeg2",
+}
+
+// releaseTags end the title like the tags ParseMedia extracts do.
+var releaseTags = map[string]bool{
+    "bluray": true, "bdrip": true, "brrip": true, "remux": true, "web": true,
+    "web-dl": true, "webdl": true, "webrip": true, "hdtv": true, "dvdrip": true,
+    "hdr": true, "hdr10": true, "dv": true, "10bit": true, "proper": true,
+    "repack": true, "extended": true, "uncut": true, "internal": true,
+}
+
+// IsVideo reports whether a file is a video, by MIME type or extension.
+func IsVideo(mimeType string, name string) bool {
+    return strings.HasPrefix(mimeType, "video/") || videoExts[FileExt(name)]
+}
+
+// ParseMedia reads the title, year, episode and quality tags from a video
+// file name. Fields the name does not mention are left zero.
+func ParseMedia(name string) MediaInfo {
+    var info MediaInfo
+
+    if ext := FileExt(name); ext != "" {
+        name = name[:len(name)-len(ext)-1]
+    }
+    // A leading [Group] tag names the release group, not the title
+    for strings.HasPrefix(name, "[") {
+        end := strings.Index(name, "]")
+        if end < 0 {
+            break
+        }
+        name = strings.TrimSpace(name[end+1:])
+    }
+    name = strings.NewReplacer("H.264", "H264", "h.264", "h264", "H.265", "H265", "h.265", "h265").Replace(name)
+
+    tokens := strings.FieldsFunc(name, func(r rune) bool {
+        return r == ' ' || r == '.' || r == '_'
+    })
+    titleEnd := len(tokens)
+    yearAt := -1
+    for i, token := range tokens {
+        tag := strings.ToLower(strings.Trim(token, "[]()-"))
+        tagged := true
+        // The release group follows the last tag: "x265-GROUP"
+        if dash := strings.LastIndex(tag, "-"); dash > 0 && i == len(tokens)-1 && !releaseTags[tag] {
+            tag = tag[:dash]
+        }
+
+        if m := episodePattern.FindStringSubmatch(tag); m != nil && info.Season == 0 {
+            info.Season, _ = strconv.Atoi(m[1])
+            info.Episode, _ = strconv.Atoi(m[2])
+        } else if m := crossPattern.FindStringSubmatch(tag); m != nil && info.Season == 0 {
+            info.Season, _ = strconv.Atoi(m[1])
+            info.Episode, _ = strconv.Atoi(m[2])
+        } else if i > 1 && tokens[i-1] == "-" && absolutePattern.MatchString(tag) && info.Episode == 0 {
+            // "Title - 01", as anime releases number episodes
+            info.Episode, _ = strconv.Atoi(tag)
+        } else if m := resolutionPattern.FindStringSubmatch(tag); m != nil {
+            info.Resolution = m[1] + "p"
+        } else if tag == "4k" || tag == "uhd" {
+            info.Resolution = "2160p"
+        } else if codec, ok := codecTags[tag]; ok {
+            info.Codec = codec
+        } else if releaseTags[tag] {
+            // Only ends the title
+        } else if year, err := strconv.Atoi(tag); err == nil && len(tag) == 4 && year >= 1900 && year <= 2099 && i > 0 && i < titleEnd {
+            // The last year before the tags, so "Blade Runner 2049 2017"
+            // keeps 2049 in the title
+            yearAt = i
+            continue
+        } else {
+            tagged = false
+        }
+        if tagged && i < titleEnd {
+            titleEnd = i
+        }
+    }
+    if yearAt >= 0 && yearAt < titleEnd {
+        info.Year, _ = strconv.Atoi(strings.Trim(tokens[yearAt], "[]()-"))
+        titleEnd = yearAt
+    }
+
+    info.Title = strings.Trim(strings.Join(tokens[:titleEnd], " "), " -([")
+    return info
+}
+
+// recordMedia is the media columns of a record. Non-videos store an empty
+// resolution rather than NULL, which marks rows written before the columns
+// existed.
+func recordMedia(record FileRecord) []interface{} {
+    if record.IsFolder || !IsVideo(record.MimeType, record.Name) {
+        return []interface{}{nil, nil, nil, nil, "", nil}
+    }
+    info := ParseMedia(record.Name)
+    return []interface{}{
+        nullString(info.Title),
+        nullInt(info.Year),
+        nullInt(info.Season),
+        nullInt(info.Episode),
+        info.Resolution,
+        nullString(info.Codec),
+    }
+}
+
+// nullInt stores zero as NULL.
+func nullInt(n int) interface{} {
+    if n == 0 {
+        return nil
+    }
+    return n
+}
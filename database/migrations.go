@@ -0,0 +1,210 @@
+package database
+
+import (
+    "database/sql"
+    "fmt"
+    "log"
+    "regexp"
+    "time"
+)
+
+// migration is one versioned change to the schema. Databases created by
+// this release already have the current schema from CREATE TABLE and run
+// every migration too, so each must tolerate finding its change made.
+type migration struct {
+    version     int
+    description string
+    up          func(tx *sql.Tx, dia dialect) error
+}
+
+// migrations, in version order. A new column goes into the CREATE TABLE
+// statements, for new databases, and into a new migration here, for
+// existing ones; released migrations are never changed.
+var migrations = []migration{
+    {1, "columns and indexes added before versioned migrations", migrateLegacyColumns},
+    {2, "files.deleted_at for files gone from their drive", migrateDeletedAt},
+    {3, "files.thumbnail_link for thumbnail previews", migrateThumbnailLink},
+    {4, "files rebuilt with rowids for the full-text indexes", migrateFilesRowID},
+}
+
+// migrate brings the schema to the latest version, running each pending
+// migration in a transaction with its schema_version row. Another process
+// migrating at the same time makes the same idempotent changes.
+func migrate(db *sql.DB, dia dialect) error {
+    current, err := schemaVersion(db)
+    if err != nil {
+        return err
+    }
+    latest := migrations[len(migrations)-1].version
+    if current > latest {
+        return fmt.Errorf("database schema version %d is newer than this release supports (%d)", current, latest)
+    }
+
+    for _, m := range migrations {
+        if m.version <= current {
+            continue
+        }
+        start := time.Now()
+        tx, err := db.Begin()
+        if err != nil {
+            return err
+        }
+        if err := m.up(tx, dia); err != nil {
+            tx.Rollback()
+            return fmt.Errorf("schema migration %d failed: %w", m.version, err)
+        }
+        _, err = tx.Exec(dia.rebind("INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?) ON CONFLICT (version) DO NOTHING"),
+            m.version, m.description, time.Now().UTC().Format(time.RFC3339))
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+        if err := tx.Commit(); err != nil {
+            return fmt.Errorf("schema migration %d failed: %w", m.version, err)
+        }
+        log.Printf("Schema migration %d applied in %v: %s", m.version, time.Since(start).Round(time.Millisecond), m.description)
+    }
+    return nil
+}
+
+// schemaVersion returns the version of the latest migration applied, zero
+// for a database from before versioned migrations.
+func schemaVersion(db *sql.DB) (int, error) {
+    var version int
+    err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+    return version, err
+}
+
+// SchemaVersion returns the schema version of the database.
+func (d *Database) SchemaVersion() (int, error) {
+    return schemaVersion(d.db)
+}
+
+// migrateLegacyColumns adds the columns added to files and
+// service_accounts before versioned migrations, and indexes them.
+func migrateLegacyColumns(tx *sql.Tx, dia dialect) error {
+    if err := dia.addColumns(tx, "files", []string{
+        "shortcut_target_id TEXT",
+        "shortcut_target_mime_type TEXT",
+        "shortcut_target_size INTEGER",
+        "created_time TEXT",
+        "last_modifying_user TEXT",
+        "owners TEXT",
+        "shared BOOLEAN DEFAULT FALSE",
+        "web_view_link TEXT",
+        "ext TEXT",
+        "export_links TEXT",
+        "revision_count INTEGER",
+        "revision_size BIGINT",
+        "media_title TEXT",
+        "media_year INTEGER",
+        "season INTEGER",
+        "episode INTEGER",
+        "resolution TEXT",
+        "codec TEXT",
+        "trashed BOOLEAN DEFAULT FALSE",
+        "trashed_time TEXT",
+        "md5_checksum TEXT",
+    }); err != nil {
+        return err
+    }
+    if err := dia.addColumns(tx, "service_accounts", []string{
+        "rate_limit REAL",
+        "budget_day TEXT",
+        "budget_used INTEGER DEFAULT 0",
+    }); err != nil {
+        return err
+    }
+
+    // Indexes on upgraded columns can only be created once they exist
+    if _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_created ON files(created_time DESC)"); err != nil {
+        return err
+    }
+    if _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_ext ON files(ext)"); err != nil {
+        return err
+    }
+    if _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_resolution ON files(resolution)"); err != nil {
+        return err
+    }
+    if _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_trashed ON files(trashed, teamdrive_id)"); err != nil {
+        return err
+    }
+    if _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_browse ON files(parent_id, is_folder DESC, name, id)"); err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// migrateDeletedAt adds the tombstone column of files and indexes it for
+// the recently deleted report and the retention purge.
+func migrateDeletedAt(tx *sql.Tx, dia dialect) error {
+    if err := dia.addColumns(tx, "files", []string{"deleted_at TEXT"}); err != nil {
+        return err
+    }
+    _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_deleted ON files(teamdrive_id, deleted_at)")
+    return err
+}
+
+// migrateThumbnailLink adds the thumbnail link of files.
+func migrateThumbnailLink(tx *sql.Tx, dia dialect) error {
+    return dia.addColumns(tx, "files", []string{"thumbnail_link TEXT"})
+}
+
+var (
+    withoutRowID   = regexp.MustCompile(`(?i)\)\s*WITHOUT\s+ROWID\s*$`)
+    filesTableName = regexp.MustCompile(`(?i)^CREATE\s+TABLE\s+"?files"?`)
+)
+
+// migrateFilesRowID rebuilds a files table created WITHOUT ROWID, as
+// releases before the search filters did, into a rowid table: the
+// full-text indexes join on files.rowid, which such a table lacks. The
+// indexes are dropped with it; InitDatabase finds them missing and
+// rebuilds them from the new table.
+func migrateFilesRowID(tx *sql.Tx, dia dialect) error {
+    if dia.name() != "sqlite" {
+        return nil
+    }
+    var schema string
+    if err := tx.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'files'").Scan(&schema); err != nil {
+        return err
+    }
+    if !withoutRowID.MatchString(schema) {
+        return nil
+    }
+
+    rows, err := tx.Query("SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = 'files' AND sql IS NOT NULL")
+    if err != nil {
+        return err
+    }
+    var indexes []string
+    for rows.Next() {
+        var index string
+        if err := rows.Scan(&index); err != nil {
+            rows.Close()
+            return err
+        }
+        indexes = append(indexes, index)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    // The renaming below fails while any view or trigger refers to files
+    statements := []string{
+        "DROP VIEW IF EXISTS files_fts_content",
+        "DROP TABLE IF EXISTS files_fts",
+        "DROP TABLE IF EXISTS files_trigram",
+        filesTableName.ReplaceAllString(withoutRowID.ReplaceAllString(schema, ")"), "CREATE TABLE files_rowid"),
+        "INSERT INTO files_rowid SELECT * FROM files",
+        "DROP TABLE files",
+        "ALTER TABLE files_rowid RENAME TO files",
+    }
+    for _, statement := range append(statements, indexes...) {
+        if _, err := tx.Exec(statement); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,90 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// legacySchema is the files table and full-text index of releases before
+// versioned migrations, which made files a WITHOUT ROWID table.
+const legacySchema = `
+CREATE TABLE files (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL COLLATE NOCASE,
+    parent_id TEXT,
+    teamdrive_id TEXT NOT NULL,
+    teamdrive_name TEXT NOT NULL,
+    size INTEGER DEFAULT 0,
+    modified_time TEXT,
+    mime_type TEXT,
+    is_folder BOOLEAN,
+    path TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+) WITHOUT ROWID;
+
+CREATE INDEX idx_parent ON files(parent_id);
+CREATE INDEX idx_size ON files(size DESC);
+
+INSERT INTO files (id, name, parent_id, teamdrive_id, teamdrive_name, size, modified_time, mime_type, is_folder, path) VALUES
+    ('f1', 'Holiday.Photos.2019.zip', 'D', 'D', 'Drive', 100, '2019-08-01T00:00:00.000Z', 'application/zip', FALSE, '/Holiday.Photos.2019.zip'),
+    ('f2', 'report.pdf', 'D', 'D', 'Drive', 10, '2020-01-01T00:00:00.000Z', 'application/pdf', FALSE, '/report.pdf');
+
+CREATE VIRTUAL TABLE files_fts USING fts5(
+    id UNINDEXED,
+    name,
+    path,
+    teamdrive_name UNINDEXED,
+    content='files',
+    content_rowid='rowid'
+);
+`
+
+func TestMigrateWithoutRowIDFiles(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "legacy.db")
+    legacy, err := sql.Open("sqlite3", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := legacy.Exec(legacySchema); err != nil {
+        t.Fatal(err)
+    }
+    legacy.Close()
+
+    db, err := InitDatabase(path, 4)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+
+    var schema string
+    if err := db.db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'files'").Scan(&schema); err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(strings.ToUpper(schema), "WITHOUT ROWID") {
+        t.Errorf("files is still a WITHOUT ROWID table: %s", schema)
+    }
+    var index int
+    db.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'idx_size'").Scan(&index)
+    if index != 1 {
+        t.Error("index idx_size lost in the rebuild")
+    }
+
+    // Both the index of the migrated rows and that of new ones are searched
+    if err := db.BatchInsert([]FileRecord{{ID: "f3", Name: "photos.txt", ModifiedTime: "2024-01-01T00:00:00.000Z", ParentID: "D", TeamDriveID: "D", TeamDriveName: "Drive", Path: "/photos.txt"}}); err != nil {
+        t.Fatal(err)
+    }
+    result, err := db.Search(context.Background(), SearchOptions{Query: "photos", Limit: 10})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var ids []string
+    for _, file := range result.Files {
+        ids = append(ids, file.ID)
+    }
+    if got := strings.Join(ids, ","); len(ids) != 2 || !strings.Contains(got, "f1") || !strings.Contains(got, "f3") {
+        t.Errorf("search for photos found %v, want f1 and f3", ids)
+    }
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "strings"
+)
+
+// Kinds of Move.
+const (
+    MoveKindMove   = "move"   // to another folder of the same drive, renamed or not
+    MoveKindRename = "rename" // renamed in place
+    MoveKindDrive  = "drive"  // to another drive
+)
+
+// Move is a file or folder found under a new parent, drive or name when it
+// was written again. Moving a folder records the folder alone, though the
+// paths of everything below it change too.
+type Move struct {
+    FileID         string `json:"file_id"`
+    Kind           string `json:"kind"`
+    TeamDriveID    string `json:"teamdrive_id"`
+    OldTeamDriveID string `json:"old_teamdrive_id"`
+    OldParentID    string `json:"old_parent_id,omitempty"`
+    NewParentID    string `json:"new_parent_id,omitempty"`
+    OldPath        string `json:"old_path"`
+    NewPath        string `json:"new_path"`
+    MovedAt        string `json:"moved_at"`
+}
+
+// moveColumns are the columns of the moves table, in Move order.
+const moveColumns = "file_id, kind, teamdrive_id, old_teamdrive_id, old_parent_id, new_parent_id, old_path, new_path, moved_at"
+
+// moveKind is the kind of move from prev to record, or "" if record is
+// where prev was.
+func moveKind(prev storedFile, record FileRecord) string {
+    switch {
+    case prev.parentID == "" || record.ParentID == "":
+        return ""
+    case prev.teamDriveID != record.TeamDriveID:
+        return MoveKindDrive
+    case prev.parentID != record.ParentID:
+        return MoveKindMove
+    case prev.name != record.Name:
+        return MoveKindRename
+    }
+    return ""
+}
+
+// GetMoves returns a page of the moves and renames into, out of or within a
+// drive, newest first, optionally of one kind, and their total count.
+func (d *Database) GetMoves(ctx context.Context, teamDriveID string, kind string, limit int, offset int) ([]Move, int, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.GetMoves(ctx, teamDriveID, kind, limit, offset)
+    }
+
+    where := " FROM moves WHERE (teamdrive_id = ? OR old_teamdrive_id = ?)"
+    args := []interface{}{teamDriveID, teamDriveID}
+    if kind != "" {
+        where += " AND kind = ?"
+        args = append(args, kind)
+    }
+
+    var total int
+    if err := d.queryRow(ctx, "SELECT COUNT(*)"+where, args...).Scan(&total); err != nil {
+        return nil, 0, err
+    }
+
+    rows, err := d.query(ctx, "SELECT "+moveColumns+where+" ORDER BY moved_at DESC, file_id LIMIT ? OFFSET ?",
+        append(args, limit, offset)...)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer rows.Close()
+
+    moves := make([]Move, 0)
+    for rows.Next() {
+        var m Move
+        var oldParentID, newParentID, oldPath, newPath sql.NullString
+        if err := rows.Scan(&m.FileID, &m.Kind, &m.TeamDriveID, &m.OldTeamDriveID,
+            &oldParentID, &newParentID, &oldPath, &newPath, &m.MovedAt); err != nil {
+            return nil, 0, err
+        }
+        m.OldParentID, m.NewParentID = oldParentID.String, newParentID.String
+        m.OldPath, m.NewPath = oldPath.String, newPath.String
+        moves = append(moves, m)
+    }
+    return moves, total, rows.Err()
+}
+
+// MoveFile applies a rename or move made in Drive to the index, so it
+// shows before the next scan: the record of fileID takes name and
+// parentID, the drive's ID for its root, and the paths of everything below
+// a folder follow. It is written in one transaction and recorded in the
+// moves and the change feed as a scan would. It returns the updated
+// record, or nil if fileID is not indexed.
+func (d *Database) MoveFile(ctx context.Context, fileID, name, parentID string) (*FileRecord, error) {
+    shard, err := d.fileShard(ctx, fileID)
+    if err != nil {
+        return nil, err
+    }
+    if shard != nil {
+        return shard.MoveFile(ctx, fileID, name, parentID)
+    }
+
+    var moved *FileRecord
+    err = d.write(ctx, func() error {
+        // Read in the writer, so no scan writes in between
+        record, err := d.GetFile(ctx, fileID)
+        if err != nil || record == nil {
+            return err
+        }
+
+        parentPath := ""
+        if parentID != record.TeamDriveID {
+            parent, err := d.GetFile(ctx, parentID)
+            if err != nil {
+                return err
+            }
+            if parent == nil || !parent.IsFolder || parent.TeamDriveID != record.TeamDriveID {
+                return fmt.Errorf("folder %s is not indexed in drive %s", parentID, record.TeamDriveID)
+            }
+            if parent.ID == record.ID || strings.HasPrefix(parent.Path, record.Path+"/") {
+                return fmt.Errorf("cannot move %s into itself", record.Path)
+            }
+            parentPath = parent.Path
+        }
+
+        records := []FileRecord{*record}
+        if record.IsFolder {
+            below, err := d.descendants(ctx, record.ID)
+            if err != nil {
+                return err
+            }
+            records = append(records, below...)
+        }
+
+        oldPath, newPath := record.Path, parentPath+"/"+name
+        records[0].Name, records[0].ParentID = name, parentID
+        for i := range records {
+            records[i].Path = newPath + strings.TrimPrefix(records[i].Path, oldPath)
+        }
+        if err := d.insertRecords(records, 0); err != nil {
+            return err
+        }
+        moved = &records[0]
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return moved, nil
+}
+
+// descendants returns the live files and folders below a folder, trashed
+// ones included.
+func (d *Database) descendants(ctx context.Context, folderID string) ([]FileRecord, error) {
+    rows, err := d.query(ctx, `
+        WITH RECURSIVE tree(id) AS (
+            SELECT id FROM files WHERE parent_id = ? AND deleted_at IS NULL
+
+            UNION ALL
+
+            SELECT f.id FROM files f JOIN tree t ON f.parent_id = t.id WHERE f.deleted_at IS NULL
+        )
+        SELECT `+selectColumns("")+` FROM files WHERE id IN (SELECT id FROM tree)
+    `, folderID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    return d.scanRows(rows)
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+    "encoding/json"
+    "strings"
+)
+
+// GoogleNativePrefix starts the MIME types of Docs, Sheets, Slides and the
+// other Google-native types, which have no stored bytes and can only be
+// downloaded by exporting them. Folders and shortcuts share it.
+const GoogleNativePrefix = "application/vnd.google-apps."
+
+// IsGoogleNative reports whether a file is an export-only Google file.
+func IsGoogleNative(mimeType string) bool {
+    return strings.HasPrefix(mimeType, GoogleNativePrefix) &&
+        mimeType != GoogleNativePrefix+"folder" && mimeType != ShortcutMimeType
+}
+
+// NativeKind is the kind of a Google-native file: document, spreadsheet,
+// presentation, drawing, form, ...
+func NativeKind(mimeType string) string {
+    return strings.TrimPrefix(mimeType, GoogleNativePrefix)
+}
+
+// nativeCondition is the SQL condition matching Google-native files.
+const nativeCondition = "(%[1]smime_type LIKE 'application/vnd.google-apps.%%' AND " +
+    "%[1]smime_type NOT IN ('application/vnd.google-apps.folder', 'application/vnd.google-apps.shortcut'))"
+
+// SetNativeSizeEstimates sets the assumed export size in bytes of each kind
+// of Google-native file, from which drive stats estimate what the drive
+// would take up downloaded. Kinds without an estimate count as zero.
+func (d *Database) SetNativeSizeEstimates(estimates map[string]int64) {
+    d.nativeEstimates = estimates
+}
+
+// encodeExportLinks stores export links as a JSON object of MIME type to
+// URL, NULL when there are none.
+func encodeExportLinks(links map[string]string) interface{} {
+    if len(links) == 0 {
+        return nil
+    }
+    data, _ := json.Marshal(links)
+    return string(data)
+}
+
+func decodeExportLinks(data string) map[string]string {
+    if data == "" {
+        return nil
+    }
+    var links map[string]string
+    json.Unmarshal([]byte(data), &links)
+    return links
+}
@@ -0,0 +1,205 @@
+package database
+
+import (
+    "context"
+    "sort"
+    "strings"
+    "time"
+)
+
+// orphanCondition selects files whose parent folder is missing from the
+// index. Children of a drive root are not orphans: roots are never stored.
+const orphanCondition = `f.deleted_at IS NULL
+        AND f.parent_id IS NOT NULL
+        AND f.parent_id <> f.teamdrive_id
+        AND NOT EXISTS (SELECT 1 FROM files p WHERE p.id = f.parent_id)`
+
+// MissingParent is a folder that indexed files point at but that is not in
+// the index itself, usually left behind by an interrupted scan or a folder
+// the scanning accounts could not list.
+type MissingParent struct {
+    ID            string `json:"id"`
+    TeamDriveID   string `json:"teamdrive_id"`
+    TeamDriveName string `json:"teamdrive_name"`
+    Path          string `json:"path"`
+    Orphans       int    `json:"orphans"`
+}
+
+// RescanRequest is a folder queued for rescanning. Its records are stored
+// under TeamDriveID, below Path.
+type RescanRequest struct {
+    FolderID      string `json:"folder_id"`
+    TeamDriveID   string `json:"teamdrive_id"`
+    TeamDriveName string `json:"teamdrive_name"`
+    Path          string `json:"path"`
+    QueuedAt      string `json:"queued_at"`
+}
+
+// orphanScope restricts orphan queries to the given drives; nil means all.
+func orphanScope(teamDriveIDs []string) (string, []interface{}) {
+    if teamDriveIDs == nil {
+        return "", nil
+    }
+    if len(teamDriveIDs) == 0 {
+        return " AND 1 = 0", nil
+    }
+    args := make([]interface{}, len(teamDriveIDs))
+    for i, id := range teamDriveIDs {
+        args[i] = id
+    }
+    return " AND f.teamdrive_id IN (?" + strings.Repeat(", ?", len(teamDriveIDs)-1) + ")", args
+}
+
+// GetOrphans returns a page of files whose parent is missing from the
+// index, and their total count.
+func (d *Database) GetOrphans(ctx context.Context, teamDriveIDs []string, limit int, offset int) ([]FileRecord, int, error) {
+    if d.shards != nil {
+        return mergePages(d, teamDriveIDs, limit, offset, func(shard *Database, n int) ([]FileRecord, int, error) {
+            return shard.GetOrphans(ctx, teamDriveIDs, n, 0)
+        }, func(a, b FileRecord) bool {
+            if a.TeamDriveName != b.TeamDriveName {
+                return a.TeamDriveName < b.TeamDriveName
+            }
+            return a.Path < b.Path
+        })
+    }
+
+    scope, args := orphanScope(teamDriveIDs)
+
+    var total int
+    if err := d.queryRow(ctx, "SELECT COUNT(*) FROM files f WHERE "+orphanCondition+scope, args...).Scan(&total); err != nil {
+        return nil, 0, err
+    }
+
+    rows, err := d.query(ctx, "SELECT "+selectColumns("f.")+" FROM files f WHERE "+orphanCondition+scope+
+        " ORDER BY f.teamdrive_name, f.path LIMIT ? OFFSET ?", append(args, limit, offset)...)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer rows.Close()
+
+    records, err := d.scanRows(rows)
+    if records == nil {
+        records = make([]FileRecord, 0)
+    }
+    return records, total, err
+}
+
+// GetMissingParents groups orphans by their missing parent, largest groups
+// first. Path is the parent's location, derived from its children's paths.
+func (d *Database) GetMissingParents(ctx context.Context, teamDriveIDs []string) ([]MissingParent, error) {
+    if d.shards != nil {
+        shards := d.shardsOf(teamDriveIDs)
+        lists := make([][]MissingParent, len(shards))
+        err := fanOut(shards, func(i int, shard *Database) error {
+            var err error
+            lists[i], err = shard.GetMissingParents(ctx, teamDriveIDs)
+            return err
+        })
+        if err != nil {
+            return nil, err
+        }
+        parents := make([]MissingParent, 0)
+        for _, list := range lists {
+            parents = append(parents, list...)
+        }
+        sort.SliceStable(parents, func(i, j int) bool {
+            if parents[i].Orphans != parents[j].Orphans {
+                return parents[i].Orphans > parents[j].Orphans
+            }
+            return parents[i].ID < parents[j].ID
+        })
+        return parents, nil
+    }
+
+    scope, args := orphanScope(teamDriveIDs)
+
+    rows, err := d.query(ctx, `
+        SELECT f.parent_id, f.teamdrive_id, MIN(f.teamdrive_name),
+            MIN(SUBSTR(f.path, 1, LENGTH(f.path) - LENGTH(f.name) - 1)), COUNT(*)
+        FROM files f
+        WHERE `+orphanCondition+scope+`
+        GROUP BY f.parent_id, f.teamdrive_id
+        ORDER BY COUNT(*) DESC, f.parent_id
+    `, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    parents := make([]MissingParent, 0)
+    for rows.Next() {
+        var parent MissingParent
+        if err := rows.Scan(&parent.ID, &parent.TeamDriveID, &parent.TeamDriveName, &parent.Path, &parent.Orphans); err != nil {
+            return nil, err
+        }
+        parents = append(parents, parent)
+    }
+
+    return parents, rows.Err()
+}
+
+// QueueRescan adds missing parents to the rescan queue, which the next scan
+// works through after the configured drives. Folders already queued are
+// requeued with the new path.
+func (d *Database) QueueRescan(ctx context.Context, parents []MissingParent) error {
+    return d.write(ctx, func() error {
+        tx, err := d.db.Begin()
+        if err != nil {
+            return err
+        }
+
+        stmt, err := tx.Prepare(d.dialect.rebind(upsertSQL("rescan_queue", "folder_id", []string{
+            "folder_id", "teamdrive_id", "teamdrive_name", "path", "queued_at",
+        })))
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+        defer stmt.Close()
+
+        now := time.Now().UTC().Format(time.RFC3339)
+        for _, parent := range parents {
+            if _, err := stmt.Exec(parent.ID, parent.TeamDriveID, parent.TeamDriveName, parent.Path, now); err != nil {
+                tx.Rollback()
+                return err
+            }
+        }
+
+        return tx.Commit()
+    })
+}
+
+// GetRescanQueue returns the queued folders, oldest first.
+func (d *Database) GetRescanQueue(ctx context.Context) ([]RescanRequest, error) {
+    rows, err := d.query(ctx, `
+        SELECT folder_id, teamdrive_id, teamdrive_name, COALESCE(path, ''), COALESCE(queued_at, '')
+        FROM rescan_queue
+        ORDER BY queued_at, folder_id
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    queue := make([]RescanRequest, 0)
+    for rows.Next() {
+        var req RescanRequest
+        if err := rows.Scan(&req.FolderID, &req.TeamDriveID, &req.TeamDriveName, &req.Path, &req.QueuedAt); err != nil {
+            return nil, err
+        }
+        queue = append(queue, req)
+    }
+
+    return queue, rows.Err()
+}
+
+// RemoveRescan drops a folder from the rescan queue.
+func (d *Database) RemoveRescan(folderID string) error {
+    ctx := context.Background()
+
+    return d.write(ctx, func() error {
+        _, err := d.exec(ctx, "DELETE FROM rescan_queue WHERE folder_id = ?", folderID)
+        return err
+    })
+}
@@ -0,0 +1,187 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "strings"
+)
+
+// Permission is one grant of access to a file or folder. On shared drives
+// only grants made on the item itself are stored: those inherited from a
+// parent folder are reported on the folder, and drive membership not at
+// all.
+type Permission struct {
+    ID           string `json:"id"`
+    Type         string `json:"type"` // user, group, domain or anyone
+    Role         string `json:"role"` // owner, organizer, fileOrganizer, writer, commenter or reader
+    EmailAddress string `json:"email_address,omitempty"`
+    // Domain is the domain of a domain grant, or of EmailAddress
+    Domain string `json:"domain,omitempty"`
+    // Discoverable items can be found by search, not only opened by link
+    Discoverable bool `json:"discoverable"`
+}
+
+// Grant is a permission together with the file it was made on, one row of
+// an access report.
+type Grant struct {
+    File       FileRecord `json:"file"`
+    Permission Permission `json:"permission"`
+}
+
+// permissionColumns are the columns of the permissions table after file_id
+// and teamdrive_id.
+const permissionColumns = "permission_id, type, role, email_address, domain, discoverable"
+
+// EmailDomain returns the lowercased domain of an email address, or "".
+func EmailDomain(email string) string {
+    at := strings.LastIndex(email, "@")
+    if at < 0 {
+        return ""
+    }
+    return strings.ToLower(email[at+1:])
+}
+
+// writePermissions replaces the stored permissions of the records whose
+// permissions were scanned, those with a non-nil Permissions.
+func writePermissions(tx *sql.Tx, dia dialect, records []FileRecord) error {
+    var del, insert *sql.Stmt
+    for _, record := range records {
+        if record.Permissions == nil {
+            continue
+        }
+        if del == nil {
+            var err error
+            if del, err = tx.Prepare(dia.rebind("DELETE FROM permissions WHERE file_id = ?")); err != nil {
+                return err
+            }
+            defer del.Close()
+            if insert, err = tx.Prepare(dia.rebind("INSERT INTO permissions (file_id, teamdrive_id, " + permissionColumns +
+                ") VALUES (?, ?, ?, ?, ?, ?, ?, ?)")); err != nil {
+                return err
+            }
+            defer insert.Close()
+        }
+
+        if _, err := del.Exec(record.ID); err != nil {
+            return err
+        }
+        for _, p := range record.Permissions {
+            if _, err := insert.Exec(record.ID, record.TeamDriveID, p.ID, p.Type, p.Role,
+                nullString(p.EmailAddress), nullString(p.Domain), p.Discoverable); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// GetPermissions returns the stored permissions of a file, none when its
+// permissions were never scanned.
+func (d *Database) GetPermissions(ctx context.Context, fileID string) ([]Permission, error) {
+    shard, err := d.fileShard(ctx, fileID)
+    if err != nil {
+        return nil, err
+    }
+    if shard != nil {
+        return shard.GetPermissions(ctx, fileID)
+    }
+
+    rows, err := d.query(ctx, "SELECT "+permissionColumns+" FROM permissions WHERE file_id = ? ORDER BY type, email_address, domain", fileID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var permissions []Permission
+    for rows.Next() {
+        p, err := scanPermission(rows)
+        if err != nil {
+            return nil, err
+        }
+        permissions = append(permissions, p)
+    }
+    return permissions, rows.Err()
+}
+
+func scanPermission(rows *sql.Rows) (Permission, error) {
+    var p Permission
+    var role, email, domain sql.NullString
+    err := rows.Scan(&p.ID, &p.Type, &role, &email, &domain, &p.Discoverable)
+    p.Role = role.String
+    p.EmailAddress = email.String
+    p.Domain = domain.String
+    return p, err
+}
+
+// GetPublicGrants returns a page of the grants to anyone with the link, in
+// the given drives (nil for all), and their total count.
+func (d *Database) GetPublicGrants(ctx context.Context, teamDriveIDs []string, limit int, offset int) ([]Grant, int, error) {
+    return d.grants(ctx, "p.type = 'anyone'", nil, teamDriveIDs, limit, offset)
+}
+
+// GetExternalGrants returns a page of the grants to users, groups and
+// domains outside internalDomains, in the given drives (nil for all), and
+// their total count. Grants to anyone with the link are reported by
+// GetPublicGrants.
+func (d *Database) GetExternalGrants(ctx context.Context, internalDomains []string, teamDriveIDs []string, limit int, offset int) ([]Grant, int, error) {
+    condition := "p.type IN ('user', 'group', 'domain') AND p.domain IS NOT NULL"
+    var args []interface{}
+    if len(internalDomains) > 0 {
+        condition += " AND p.domain NOT IN (?" + strings.Repeat(", ?", len(internalDomains)-1) + ")"
+        for _, domain := range internalDomains {
+            args = append(args, strings.ToLower(domain))
+        }
+    }
+    return d.grants(ctx, condition, args, teamDriveIDs, limit, offset)
+}
+
+// grants pages through the grants matching condition, ordered by file
+// location.
+func (d *Database) grants(ctx context.Context, condition string, args []interface{}, teamDriveIDs []string, limit int, offset int) ([]Grant, int, error) {
+    if d.shards != nil {
+        // Each shard appends its scope to args, so none may share its spare capacity
+        args := args[:len(args):len(args)]
+        return mergePages(d, teamDriveIDs, limit, offset, func(shard *Database, n int) ([]Grant, int, error) {
+            return shard.grants(ctx, condition, args, teamDriveIDs, n, 0)
+        }, func(a, b Grant) bool {
+            if a.File.TeamDriveName != b.File.TeamDriveName {
+                return a.File.TeamDriveName < b.File.TeamDriveName
+            }
+            if a.File.Path != b.File.Path {
+                return a.File.Path < b.File.Path
+            }
+            return a.Permission.ID < b.Permission.ID
+        })
+    }
+
+    scope, scopeArgs := orphanScope(teamDriveIDs)
+    where := " FROM permissions p JOIN files f ON f.id = p.file_id WHERE f.deleted_at IS NULL AND " + condition + scope
+    args = append(args, scopeArgs...)
+
+    var total int
+    if err := d.queryRow(ctx, "SELECT COUNT(*)"+where, args...).Scan(&total); err != nil {
+        return nil, 0, err
+    }
+
+    rows, err := d.query(ctx, "SELECT "+selectColumns("f.")+", p."+strings.ReplaceAll(permissionColumns, ", ", ", p.")+where+
+        " ORDER BY f.teamdrive_name, f.path, p.permission_id LIMIT ? OFFSET ?", append(args, limit, offset)...)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer rows.Close()
+
+    grants := make([]Grant, 0)
+    for rows.Next() {
+        var grant Grant
+        var role, email, domain sql.NullString
+        grant.File, err = scanRecord(rows, &grant.Permission.ID, &grant.Permission.Type, &role, &email, &domain, &grant.Permission.Discoverable)
+        if err != nil {
+            return nil, 0, err
+        }
+        grant.Permission.Role = role.String
+        grant.Permission.EmailAddress = email.String
+        grant.Permission.Domain = domain.String
+        grants = append(grants, grant)
+    }
+    return grants, total, rows.Err()
+}
@@ -0,0 +1,327 @@
+package database
+
+import (
+    "fmt"
+    "log"
+    "regexp"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+    "github.com/jackc/pgx/v5/stdlib"
+)
+
+// instanceIDPattern keeps instance IDs usable in schema names unquoted.
+var instanceIDPattern = regexp.MustCompile(`^[a-z0-9_]{1,48}$`)
+
+// ValidInstanceID reports whether id can namespace an instance's data.
+func ValidInstanceID(id string) bool {
+    return instanceIDPattern.MatchString(id)
+}
+
+// InitPostgres opens a PostgreSQL database, for deployments where several
+// scanner instances write into one shared index. A non-empty instanceID
+// keeps the tables in a schema of that instance's own, tds_<instanceID>,
+// so the instances of several organizations can share one server without
+// seeing each other's data; instances with the same ID share an index.
+func InitPostgres(dsn string, instanceID string) (*Database, error) {
+    config, err := pgx.ParseConfig(dsn)
+    if err != nil {
+        return nil, err
+    }
+    namespace := ""
+    if instanceID != "" {
+        if !ValidInstanceID(instanceID) {
+            return nil, fmt.Errorf("invalid instance ID %q: use 1-48 lowercase letters, digits and underscores", instanceID)
+        }
+        // Extensions stay in public, for every instance to find
+        namespace = "tds_" + instanceID
+        config.RuntimeParams["search_path"] = namespace + ", public"
+    }
+    db := stdlib.OpenDB(*config)
+
+    if err := db.Ping(); err != nil {
+        return nil, fmt.Errorf("postgres connection failed: %w", err)
+    }
+    if namespace != "" {
+        if _, err := db.Exec("CREATE SCHEMA IF NOT EXISTS " + namespace); err != nil {
+            return nil, fmt.Errorf("schema creation failed: %w", err)
+        }
+    }
+
+    db.SetMaxOpenConns(50)
+    db.SetMaxIdleConns(10)
+    db.SetConnMaxLifetime(time.Hour)
+
+    schema := `
+    CREATE TABLE IF NOT EXISTS files (
+        id TEXT PRIMARY KEY,
+        name TEXT NOT NULL,
+        parent_id TEXT,
+        teamdrive_id TEXT NOT NULL,
+        teamdrive_name TEXT NOT NULL,
+        size BIGINT DEFAULT 0,
+        modified_time TEXT,
+        mime_type TEXT,
+        is_folder BOOLEAN,
+        path TEXT,
+        shortcut_target_id TEXT,
+        shortcut_target_mime_type TEXT,
+        shortcut_target_size BIGINT,
+        created_time TEXT,
+        last_modifying_user TEXT,
+        owners TEXT,
+        shared BOOLEAN DEFAULT FALSE,
+        web_view_link TEXT,
+        export_links TEXT,
+        revision_count INTEGER,
+        revision_size BIGINT,
+        trashed BOOLEAN DEFAULT FALSE,
+        trashed_time TEXT,
+        md5_checksum TEXT,
+        ext TEXT,
+        media_title TEXT,
+        media_year INTEGER,
+        season INTEGER,
+        episode INTEGER,
+        resolution TEXT,
+        codec TEXT,
+        deleted_at TEXT,
+        thumbnail_link TEXT,
+        created_at TIMESTAMPTZ DEFAULT now(),
+        search_vector tsvector GENERATED ALWAYS AS (
+            to_tsvector('simple', coalesce(name, '') || ' ' || coalesce(path, ''))
+        ) STORED
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_parent ON files(parent_id);
+    CREATE INDEX IF NOT EXISTS idx_teamdrive ON files(teamdrive_id);
+    CREATE INDEX IF NOT EXISTS idx_name_lower ON files(lower(name));
+    CREATE INDEX IF NOT EXISTS idx_size ON files(size DESC);
+    CREATE INDEX IF NOT EXISTS idx_modified ON files(modified_time DESC);
+    CREATE INDEX IF NOT EXISTS idx_folder ON files(is_folder, parent_id);
+    CREATE INDEX IF NOT EXISTS idx_mime ON files(mime_type);
+    CREATE INDEX IF NOT EXISTS idx_teamdrive_size ON files(teamdrive_id, size DESC);
+    CREATE INDEX IF NOT EXISTS idx_teamdrive_modified ON files(teamdrive_id, modified_time DESC);
+    CREATE INDEX IF NOT EXISTS idx_search ON files USING GIN(search_vector);
+
+    CREATE TABLE IF NOT EXISTS service_accounts (
+        name TEXT PRIMARY KEY,
+        requests BIGINT DEFAULT 0,
+        failures BIGINT DEFAULT 0,
+        errors_401 BIGINT DEFAULT 0,
+        errors_403 BIGINT DEFAULT 0,
+        errors_429 BIGINT DEFAULT 0,
+        rate_limit REAL,
+        quarantined BOOLEAN DEFAULT FALSE,
+        quarantined_until TEXT,
+        last_error TEXT,
+        updated_at TEXT,
+        budget_day TEXT,
+        budget_used BIGINT DEFAULT 0
+    );
+
+    CREATE TABLE IF NOT EXISTS permissions (
+        file_id TEXT NOT NULL,
+        teamdrive_id TEXT NOT NULL,
+        permission_id TEXT NOT NULL,
+        type TEXT NOT NULL,
+        role TEXT,
+        email_address TEXT,
+        domain TEXT,
+        discoverable BOOLEAN DEFAULT FALSE,
+        PRIMARY KEY (file_id, permission_id)
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_permissions_type ON permissions(type, domain);
+
+    CREATE TABLE IF NOT EXISTS file_labels (
+        file_id TEXT NOT NULL,
+        teamdrive_id TEXT NOT NULL,
+        source TEXT NOT NULL,
+        key TEXT NOT NULL,
+        value TEXT,
+        PRIMARY KEY (file_id, source, key)
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_file_labels_key ON file_labels(key, value);
+
+    CREATE TABLE IF NOT EXISTS moves (
+        file_id TEXT NOT NULL,
+        kind TEXT NOT NULL,
+        teamdrive_id TEXT NOT NULL,
+        old_teamdrive_id TEXT NOT NULL,
+        old_parent_id TEXT,
+        new_parent_id TEXT,
+        old_path TEXT,
+        new_path TEXT,
+        moved_at TEXT NOT NULL
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_moves_teamdrive ON moves(teamdrive_id, moved_at);
+    CREATE INDEX IF NOT EXISTS idx_moves_old_teamdrive ON moves(old_teamdrive_id, moved_at);
+
+    CREATE TABLE IF NOT EXISTS changes (
+        seq BIGSERIAL PRIMARY KEY,
+        kind TEXT NOT NULL,
+        file_id TEXT NOT NULL,
+        teamdrive_id TEXT NOT NULL,
+        name TEXT NOT NULL,
+        path TEXT,
+        mime_type TEXT,
+        is_folder BOOLEAN,
+        size BIGINT DEFAULT 0,
+        modified_time TEXT,
+        changed_at TEXT NOT NULL
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_changes_teamdrive ON changes(teamdrive_id, seq);
+    CREATE INDEX IF NOT EXISTS idx_changes_changed ON changes(changed_at);
+
+    CREATE TABLE IF NOT EXISTS scans (
+        id BIGSERIAL PRIMARY KEY,
+        teamdrive_id TEXT NOT NULL,
+        started_at TEXT NOT NULL,
+        finished_at TEXT,
+        files BIGINT DEFAULT 0,
+        folders BIGINT DEFAULT 0,
+        size BIGINT DEFAULT 0
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_scans_teamdrive ON scans(teamdrive_id, id);
+
+    CREATE TABLE IF NOT EXISTS scan_files (
+        scan_id BIGINT NOT NULL,
+        file_id TEXT NOT NULL,
+        parent_id TEXT,
+        name TEXT NOT NULL,
+        path TEXT,
+        size BIGINT DEFAULT 0,
+        is_folder BOOLEAN,
+        PRIMARY KEY (scan_id, file_id)
+    );
+
+    CREATE TABLE IF NOT EXISTS maintenance_runs (
+        ran_at TEXT PRIMARY KEY,
+        duration_ms BIGINT NOT NULL,
+        size_before BIGINT NOT NULL,
+        size_after BIGINT NOT NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        description TEXT NOT NULL,
+        applied_at TEXT NOT NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS file_content (
+        file_id TEXT PRIMARY KEY,
+        teamdrive_id TEXT NOT NULL,
+        modified_time TEXT,
+        content TEXT NOT NULL,
+        indexed_at TEXT NOT NULL,
+        search_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_file_content_teamdrive ON file_content(teamdrive_id);
+    CREATE INDEX IF NOT EXISTS idx_content_search ON file_content USING GIN(search_vector);
+
+    CREATE TABLE IF NOT EXISTS teamdrives (
+        id TEXT PRIMARY KEY,
+        name TEXT NOT NULL,
+        discovered_at TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS stats_history (
+        teamdrive_id TEXT NOT NULL,
+        recorded_at TEXT NOT NULL,
+        total_files BIGINT,
+        total_folders BIGINT,
+        total_size BIGINT
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_stats_history ON stats_history(teamdrive_id, recorded_at);
+
+    CREATE TABLE IF NOT EXISTS saved_searches (
+        id TEXT PRIMARY KEY,
+        name TEXT NOT NULL,
+        params TEXT NOT NULL,
+        created_at TEXT,
+        updated_at TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS rescan_queue (
+        folder_id TEXT PRIMARY KEY,
+        teamdrive_id TEXT NOT NULL,
+        teamdrive_name TEXT NOT NULL,
+        path TEXT,
+        queued_at TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS download_jobs (
+        id TEXT PRIMARY KEY,
+        params TEXT NOT NULL,
+        dest TEXT NOT NULL,
+        concurrency INTEGER NOT NULL,
+        bandwidth BIGINT NOT NULL,
+        status TEXT NOT NULL,
+        error TEXT,
+        total_files BIGINT DEFAULT 0,
+        total_bytes BIGINT DEFAULT 0,
+        done_files BIGINT DEFAULT 0,
+        done_bytes BIGINT DEFAULT 0,
+        skipped_files BIGINT DEFAULT 0,
+        failed_files BIGINT DEFAULT 0,
+        created_at TEXT,
+        started_at TEXT,
+        finished_at TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS copy_jobs (
+        id TEXT PRIMARY KEY,
+        sources TEXT NOT NULL,
+        dest_teamdrive_id TEXT NOT NULL,
+        dest_folder_id TEXT NOT NULL,
+        concurrency INTEGER NOT NULL,
+        status TEXT NOT NULL,
+        error TEXT,
+        total_files BIGINT DEFAULT 0,
+        total_bytes BIGINT DEFAULT 0,
+        done_files BIGINT DEFAULT 0,
+        done_bytes BIGINT DEFAULT 0,
+        skipped_files BIGINT DEFAULT 0,
+        failed_files BIGINT DEFAULT 0,
+        created_at TEXT,
+        started_at TEXT,
+        finished_at TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS copy_items (
+        job_id TEXT NOT NULL,
+        source_id TEXT NOT NULL,
+        dest_id TEXT NOT NULL,
+        PRIMARY KEY (job_id, source_id)
+    );
+    `
+
+    if _, err := db.Exec(schema); err != nil {
+        return nil, fmt.Errorf("schema creation failed: %w", err)
+    }
+
+    if err := migrate(db, postgresDialect{}); err != nil {
+        return nil, err
+    }
+
+    if err := backfillDerived(db, postgresDialect{}); err != nil {
+        return nil, err
+    }
+
+    fuzzy := setupFuzzyPostgres(db)
+
+    if instanceID != "" {
+        log.Printf("Database initialized: PostgreSQL with full-text search, instance %s", instanceID)
+    } else {
+        log.Println("Database initialized: PostgreSQL with full-text search")
+    }
+
+    return &Database{db: db, dialect: postgresDialect{}, fuzzy: fuzzy, writeOptions: defaultWriteOptions, instance: instanceID}, nil
+}
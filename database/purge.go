@@ -0,0 +1,87 @@
+package database
+
+import (
+    "context"
+    "log"
+    "time"
+)
+
+// purgeBatchRows is the number of rows each transaction of
+// DeleteTeamDriveData removes, so scans and other writes are not held up
+// for the whole deletion.
+const purgeBatchRows = 5000
+
+// purgeTables select the rows of a drive in each table that holds any,
+// children before the rows they belong to. Permissions and labels go by
+// file, which their keys index.
+var purgeTables = []struct {
+    table     string
+    condition string
+}{
+    {"permissions", "file_id IN (SELECT id FROM files WHERE teamdrive_id = ?)"},
+    {"file_labels", "file_id IN (SELECT id FROM files WHERE teamdrive_id = ?)"},
+    {"file_content", "teamdrive_id = ?"},
+    {"files", "teamdrive_id = ?"},
+    {"moves", "teamdrive_id = ?"},
+    {"changes", "teamdrive_id = ?"},
+    {"scan_files", "scan_id IN (SELECT id FROM scans WHERE teamdrive_id = ?)"},
+    {"scans", "teamdrive_id = ?"},
+    {"stats_history", "teamdrive_id = ?"},
+    {"rescan_queue", "teamdrive_id = ?"},
+    {"teamdrives", "id = ?"},
+}
+
+// DeleteTeamDriveData removes everything indexed about a drive: its files
+// and their full-text entries, permissions, labels and text, its moves,
+// changes, scans, stats history and queued rescans, and its discovered
+// entry. It returns the rows removed from each table. It is safe to run
+// again after a failure, and the next scan of the drive indexes it from
+// scratch.
+func (d *Database) DeleteTeamDriveData(ctx context.Context, teamDriveID string) ([]TableRows, error) {
+    start := time.Now()
+    deleted := make([]TableRows, len(purgeTables))
+    databases := []*Database{d}
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        databases = append(databases, shard)
+    }
+
+    total := int64(0)
+    for i, purge := range purgeTables {
+        deleted[i].Table = purge.table
+        for _, db := range databases {
+            n, err := db.purgeRows(ctx, purge.table, purge.condition, teamDriveID)
+            deleted[i].Rows += n
+            total += n
+            if err != nil {
+                return deleted, err
+            }
+        }
+    }
+
+    log.Printf("Deleted %d rows of drive %s in %v", total, teamDriveID, time.Since(start).Round(time.Millisecond))
+    return deleted, nil
+}
+
+// purgeRows deletes the rows of table matching condition, purgeBatchRows
+// per transaction, and returns how many it deleted.
+func (d *Database) purgeRows(ctx context.Context, table string, condition string, args ...interface{}) (int64, error) {
+    rowID := d.dialect.rowID()
+    statement := "DELETE FROM " + table + " WHERE " + rowID + " IN (SELECT " + rowID + " FROM " + table + " WHERE " + condition + " LIMIT ?)"
+
+    total := int64(0)
+    for {
+        var n int64
+        err := d.write(ctx, func() error {
+            result, err := d.exec(ctx, statement, append(args, purgeBatchRows)...)
+            if err != nil {
+                return err
+            }
+            n, err = result.RowsAffected()
+            return err
+        })
+        total += n
+        if err != nil || n < purgeBatchRows {
+            return total, err
+        }
+    }
+}
@@ -0,0 +1,324 @@
+package database
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "unicode"
+)
+
+// ErrInvalidQuery is returned by Search for a query that cannot be
+// searched, with the reason appended.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// maxQueryLength caps the characters of a search query.
+const maxQueryLength = 1000
+
+// queryTerm is a word or quoted phrase of a search query.
+type queryTerm struct {
+    text   string
+    phrase bool
+    prefix bool   // word* matches words starting with text
+    field  string // "name" or "path"; empty searches both
+}
+
+// parsedQuery is the q parameter of a search taken apart. Every group must
+// match, through any one of its terms; no excluded term may. ext:, type:
+// and label: terms become filters rather than text to match.
+type parsedQuery struct {
+    groups     [][]queryTerm
+    excluded   []queryTerm
+    extensions []string
+    labels     []string
+    mimeType   string
+    isFolder   *bool
+}
+
+// parseQuery reads a search query: words, "quoted phrases", -exclusions,
+// OR between alternatives, and name:, path:, type:, ext: and label:
+// prefixes. It is lenient about what users type, such as an unclosed
+// quote, and only fails on queries that cannot be searched at all.
+func parseQuery(q string) (parsedQuery, error) {
+    var parsed parsedQuery
+    or := false // the previous token was OR
+
+    s := []rune(q)
+    if len(s) > maxQueryLength {
+        return parsed, fmt.Errorf("%w: longer than %d characters", ErrInvalidQuery, maxQueryLength)
+    }
+    // Control characters, NUL included, separate words like spaces
+    for i, r := range s {
+        if unicode.IsControl(r) {
+            s[i] = ' '
+        }
+    }
+
+    for i := 0; i < len(s); {
+        if unicode.IsSpace(s[i]) {
+            i++
+            continue
+        }
+
+        negate := false
+        if s[i] == '-' && i+1 < len(s) && !unicode.IsSpace(s[i+1]) {
+            negate = true
+            i++
+        }
+
+        // field: prefix, for the fields we know; "re:zero" stays a word
+        field := ""
+        if end := fieldEnd(s, i); end > 0 {
+            switch name := strings.ToLower(string(s[i:end])); name {
+            case "name", "path", "type", "ext", "label":
+                field = name
+                i = end + 1
+            }
+        }
+
+        var term queryTerm
+        if i < len(s) && s[i] == '"' {
+            end := i + 1
+            for end < len(s) && s[end] != '"' {
+                end++
+            }
+            term = queryTerm{text: string(s[i+1 : end]), phrase: true}
+            i = end + 1
+        } else {
+            end := i
+            for end < len(s) && !unicode.IsSpace(s[end]) {
+                end++
+            }
+            term = queryTerm{text: string(s[i:end])}
+            i = end
+            if !negate && field == "" {
+                switch term.text {
+                case "OR":
+                    or = len(parsed.groups) > 0
+                    continue
+                case "AND":
+                    continue
+                }
+            }
+            if strings.HasSuffix(term.text, "*") {
+                term.text = strings.TrimRight(term.text, "*")
+                term.prefix = true
+            }
+        }
+        if strings.TrimSpace(term.text) == "" {
+            continue
+        }
+
+        switch field {
+        case "ext":
+            if negate {
+                return parsed, fmt.Errorf("%w: ext: terms cannot be excluded", ErrInvalidQuery)
+            }
+            for _, ext := range strings.Split(term.text, ",") {
+                if ext = strings.ToLower(strings.TrimPrefix(ext, ".")); ext != "" {
+                    parsed.extensions = append(parsed.extensions, ext)
+                }
+            }
+            continue
+        case "label":
+            if negate {
+                return parsed, fmt.Errorf("%w: label: terms cannot be excluded", ErrInvalidQuery)
+            }
+            parsed.labels = append(parsed.labels, term.text)
+            continue
+        case "type":
+            if negate {
+                return parsed, fmt.Errorf("%w: type: terms cannot be excluded", ErrInvalidQuery)
+            }
+            if err := parsed.setType(term.text); err != nil {
+                return parsed, err
+            }
+            continue
+        }
+
+        term.field = field
+        switch {
+        case negate:
+            parsed.excluded = append(parsed.excluded, term)
+        case or:
+            last := len(parsed.groups) - 1
+            parsed.groups[last] = append(parsed.groups[last], term)
+        default:
+            parsed.groups = append(parsed.groups, []queryTerm{term})
+        }
+        or = false
+    }
+
+    if len(parsed.groups) == 0 && len(parsed.excluded) > 0 {
+        return parsed, fmt.Errorf("%w: a search needs at least one term that is not excluded", ErrInvalidQuery)
+    }
+    return parsed, nil
+}
+
+// fieldEnd returns the index of the colon ending a field name at s[i:], or
+// -1 when s[i:] does not start with one.
+func fieldEnd(s []rune, i int) int {
+    for j := i; j < len(s); j++ {
+        switch {
+        case s[j] == ':':
+            if j > i && j+1 < len(s) && !unicode.IsSpace(s[j+1]) {
+                return j
+            }
+            return -1
+        case !unicode.IsLetter(s[j]):
+            return -1
+        }
+    }
+    return -1
+}
+
+// setType applies a type: term: folder, file, a top-level MIME type such
+// as video, or a full MIME type.
+func (p *parsedQuery) setType(value string) error {
+    if p.mimeType != "" || p.isFolder != nil {
+        return fmt.Errorf("%w: only one type: term is allowed", ErrInvalidQuery)
+    }
+
+    value = strings.ToLower(value)
+    switch value {
+    case "folder", "folders":
+        isFolder := true
+        p.isFolder = &isFolder
+    case "file", "files":
+        isFolder := false
+        p.isFolder = &isFolder
+    case "video", "audio", "image", "text", "application", "font", "model":
+        p.mimeType = value + "/*"
+    default:
+        if !strings.Contains(value, "/") {
+            return fmt.Errorf("%w: unknown type %q (use folder, file, video, audio, image, text or a MIME type)", ErrInvalidQuery, value)
+        }
+        p.mimeType = value
+    }
+    return nil
+}
+
+// empty reports whether the query has no text to match, only filters.
+func (p parsedQuery) empty() bool {
+    return len(p.groups) == 0
+}
+
+// simple reports whether the query is plain words and phrases that must
+// all match, which a substring search can stand in for.
+func (p parsedQuery) simple() bool {
+    if len(p.excluded) > 0 {
+        return false
+    }
+    for _, group := range p.groups {
+        if len(group) > 1 || group[0].field == "path" {
+            return false
+        }
+    }
+    return true
+}
+
+// words returns the text of every term to match, for searches that do not
+// understand the query syntax.
+func (p parsedQuery) words() string {
+    var words []string
+    for _, group := range p.groups {
+        for _, term := range group {
+            words = append(words, term.text)
+        }
+    }
+    return strings.Join(words, " ")
+}
+
+// anyField returns the query with its name: and path: prefixes dropped, for
+// matching text that has neither.
+func (p parsedQuery) anyField() parsedQuery {
+    strip := func(terms []queryTerm) []queryTerm {
+        stripped := make([]queryTerm, len(terms))
+        for i, term := range terms {
+            term.field = ""
+            stripped[i] = term
+        }
+        return stripped
+    }
+    groups := make([][]queryTerm, len(p.groups))
+    for i, group := range p.groups {
+        groups[i] = strip(group)
+    }
+    p.groups, p.excluded = groups, strip(p.excluded)
+    return p
+}
+
+// fts5 renders the query as an SQLite FTS5 expression. Every term is
+// quoted, so nothing the user typed is read as FTS5 syntax.
+func (p parsedQuery) fts5() string {
+    groups := make([]string, len(p.groups))
+    for i, group := range p.groups {
+        terms := make([]string, len(group))
+        for j, term := range group {
+            terms[j] = term.fts5()
+        }
+        groups[i] = "(" + strings.Join(terms, " OR ") + ")"
+    }
+
+    match := strings.Join(groups, " AND ")
+    if len(p.excluded) > 0 {
+        match = "(" + match + ")"
+        for _, term := range p.excluded {
+            match += " NOT " + term.fts5()
+        }
+    }
+    return match
+}
+
+func (t queryTerm) fts5() string {
+    s := `"` + strings.ReplaceAll(t.text, `"`, `""`) + `"`
+    if t.prefix {
+        s += "*"
+    }
+    switch t.field {
+    case "name":
+        // The words column holds the name split into words
+        return "{name words} : " + s
+    case "path":
+        return "path : " + s
+    }
+    return s
+}
+
+// websearch renders the query for PostgreSQL's websearch_to_tsquery, which
+// indexes names and paths together and knows no prefixes.
+func (p parsedQuery) websearch() string {
+    var parts []string
+    for _, group := range p.groups {
+        terms := make([]string, len(group))
+        for i, term := range group {
+            terms[i] = term.websearch()
+        }
+        parts = append(parts, strings.Join(terms, " or "))
+    }
+    for _, term := range p.excluded {
+        parts = append(parts, "-"+term.websearch())
+    }
+    return strings.Join(parts, " ")
+}
+
+// websearch quotes words too, so a word holding "or" or a leading "-" is
+// not read as an operator.
+func (t queryTerm) websearch() string {
+    return `"` + strings.ReplaceAll(t.text, `"`, " ") + `"`
+}
+
+// queryError reports a full-text engine rejecting a match expression as
+// ErrInvalidQuery. The parser quotes every term, so this is a safety net
+// for input it did not foresee.
+func queryError(err error) error {
+    if err == nil {
+        return nil
+    }
+    message := err.Error()
+    for _, syntax := range []string{"fts5: syntax error", "unterminated string", "malformed MATCH", "syntax error in tsquery"} {
+        if strings.Contains(message, syntax) {
+            return fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+        }
+    }
+    return err
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "time"
+)
+
+// regexScanTimeout bounds a regex search. Go's regexp runs in linear time,
+// but every candidate row has to be read, so a broad search over a large
+// index is cut off and returned as partial.
+const regexScanTimeout = 5 * time.Second
+
+// searchRegex scans the rows passing opts' filters in result order and
+// keeps those whose name or path matches opts.Regex. It returns up to
+// opts.Limit+1 records after skipping skip matches, the number of matches
+// seen, and whether the scan hit the timeout.
+func (d *Database) searchRegex(ctx context.Context, opts SearchOptions, keys []sortKey, pageSQL string, pageArgs []interface{}, skip int) ([]FileRecord, int, bool, error) {
+    where, args := opts.filterClauses("")
+    whereSQL := ""
+    if len(where) > 0 {
+        whereSQL = " AND " + strings.Join(where, " AND ")
+    }
+
+    scanCtx, cancel := context.WithTimeout(ctx, regexScanTimeout)
+    defer cancel()
+
+    query := "SELECT " + selectColumns("") + " FROM files WHERE 1=1" + whereSQL + pageSQL +
+        " ORDER BY " + orderClause("", keys)
+    rows, err := d.db.QueryContext(scanCtx, d.dialect.rebind(query), append(args, pageArgs...)...)
+    if err != nil {
+        return nil, 0, false, err
+    }
+    defer rows.Close()
+
+    var records []FileRecord
+    matched := 0
+    for rows.Next() {
+        record, err := scanRecord(rows)
+        if err != nil {
+            return nil, 0, false, err
+        }
+        if !opts.Regex.MatchString(record.Name) && !opts.Regex.MatchString(record.Path) {
+            continue
+        }
+
+        matched++
+        if matched > skip && len(records) <= opts.Limit {
+            records = append(records, record)
+        }
+        if opts.NoCount && len(records) > opts.Limit {
+            break
+        }
+    }
+
+    // Running out of the caller's time is an error, not a partial result
+    if err := ctx.Err(); err != nil {
+        return nil, 0, false, err
+    }
+    if err := rows.Err(); err != nil {
+        if errors.Is(err, context.DeadlineExceeded) {
+            return records, matched, true, nil
+        }
+        return nil, 0, false, err
+    }
+    if scanCtx.Err() != nil {
+        return records, matched, true, nil
+    }
+
+    return records, matched, false, nil
+}
@@ -0,0 +1,342 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "log"
+    "time"
+)
+
+// Scan is one recorded full scan of a drive. Its manifest, the files and
+// folders it wrote, is what DiffScans compares. FinishedAt is empty while
+// the scan runs.
+type Scan struct {
+    ID          int64  `json:"id"`
+    TeamDriveID string `json:"teamdrive_id"`
+    StartedAt   string `json:"started_at"`
+    FinishedAt  string `json:"finished_at,omitempty"`
+    Files       int64  `json:"files"`
+    Folders     int64  `json:"folders"`
+    Size        int64  `json:"size"`
+    SizeHuman   string `json:"size_human"`
+}
+
+// ScanManifest records the manifest of a running scan. It is the sink the
+// scan writes to: records go to the index as through BatchInsert, and into
+// the manifest in the same transaction.
+type ScanManifest struct {
+    db          *Database
+    id          int64
+    teamDriveID string
+}
+
+// scanColumns are the columns of the scans table, in Scan order.
+const scanColumns = "id, teamdrive_id, started_at, finished_at, files, folders, size"
+
+// StartScan records the start of a full scan of a drive.
+func (d *Database) StartScan(teamDriveID string) (*ScanManifest, error) {
+    if d.shards != nil {
+        shard, err := d.writeShard(teamDriveID)
+        if err != nil {
+            return nil, err
+        }
+        return shard.StartScan(teamDriveID)
+    }
+
+    m := &ScanManifest{db: d, teamDriveID: teamDriveID}
+    now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+    err := d.write(context.Background(), func() error {
+        return d.queryRow(context.Background(), "INSERT INTO scans (teamdrive_id, started_at) VALUES (?, ?) RETURNING id",
+            teamDriveID, now).Scan(&m.id)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return m, nil
+}
+
+// ID returns the ID of the scan.
+func (m *ScanManifest) ID() int64 {
+    return m.id
+}
+
+// BatchInsert writes records to the index and the manifest.
+func (m *ScanManifest) BatchInsert(records []FileRecord) error {
+    return m.db.batchInsert(records, m.id)
+}
+
+// Finish completes the scan, totalling its manifest, marks the files of
+// the drive it did not find as deleted, and drops all but the newest keep
+// scans of the drive. A scan that failed is dropped instead, since its
+// manifest is incomplete.
+func (m *ScanManifest) Finish(scanErr error, keep int) error {
+    ctx := context.Background()
+    if scanErr != nil {
+        return m.db.write(ctx, func() error {
+            _, err := m.db.deleteScans(ctx, "id = ?", m.id)
+            return err
+        })
+    }
+
+    now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+    return m.db.write(ctx, func() error {
+        _, err := m.db.exec(ctx, `
+            UPDATE scans SET
+                finished_at = ?,
+                files = (SELECT COUNT(*) FROM scan_files WHERE scan_id = scans.id AND NOT is_folder),
+                folders = (SELECT COUNT(*) FROM scan_files WHERE scan_id = scans.id AND is_folder),
+                size = (SELECT COALESCE(SUM(size), 0) FROM scan_files WHERE scan_id = scans.id AND NOT is_folder)
+            WHERE id = ?
+        `, now, m.id)
+        if err != nil {
+            return err
+        }
+        if err := m.markDeleted(ctx, now); err != nil {
+            return err
+        }
+        if keep <= 0 {
+            return nil
+        }
+
+        var oldest int64
+        err = m.db.queryRow(ctx, "SELECT id FROM scans WHERE teamdrive_id = ? AND finished_at IS NOT NULL ORDER BY id DESC LIMIT 1 OFFSET ?",
+            m.teamDriveID, keep-1).Scan(&oldest)
+        if err == sql.ErrNoRows {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        n, err := m.db.deleteScans(ctx, "teamdrive_id = ? AND id < ?", m.teamDriveID, oldest)
+        if n > 0 {
+            log.Printf("Dropped %d old scan manifests of %s", n, m.teamDriveID)
+        }
+        return err
+    })
+}
+
+// markDeleted sets deleted_at on the files of the drive missing from the
+// manifest. Trashed files are never in it and keep their trashed flag
+// instead. A scan that found nothing marks nothing, as an emptied drive
+// more likely means the accounts lost access to it.
+func (m *ScanManifest) markDeleted(ctx context.Context, now string) error {
+    var found bool
+    if err := m.db.queryRow(ctx, "SELECT EXISTS (SELECT 1 FROM scan_files WHERE scan_id = ?)", m.id).Scan(&found); err != nil || !found {
+        return err
+    }
+
+    result, err := m.db.exec(ctx, `
+        UPDATE files SET deleted_at = ?
+        WHERE teamdrive_id = ? AND deleted_at IS NULL AND trashed = FALSE
+            AND NOT EXISTS (SELECT 1 FROM scan_files s WHERE s.scan_id = ? AND s.file_id = files.id)
+    `, now, m.teamDriveID, m.id)
+    if err != nil {
+        return err
+    }
+    if n, _ := result.RowsAffected(); n > 0 {
+        log.Printf("Marked %d files of %s no longer found as deleted", n, m.teamDriveID)
+    }
+    return nil
+}
+
+// deleteScans drops the scans matching condition and their manifests,
+// returning how many scans it dropped.
+func (d *Database) deleteScans(ctx context.Context, condition string, args ...interface{}) (int64, error) {
+    if _, err := d.exec(ctx, "DELETE FROM scan_files WHERE scan_id IN (SELECT id FROM scans WHERE "+condition+")", args...); err != nil {
+        return 0, err
+    }
+    result, err := d.exec(ctx, "DELETE FROM scans WHERE "+condition, args...)
+    if err != nil {
+        return 0, err
+    }
+    return result.RowsAffected()
+}
+
+// writeScanFiles adds records to the manifest of a scan. Trashed records
+// are left out, so a file trashed between two scans diffs as removed.
+func writeScanFiles(tx *sql.Tx, dia dialect, scanID int64, records []FileRecord) error {
+    columns := []string{"scan_id", "file_id", "parent_id", "name", "path", "size", "is_folder"}
+    var kept []FileRecord
+    for _, record := range records {
+        if !record.Trashed {
+            kept = append(kept, record)
+        }
+    }
+
+    for start := 0; start < len(kept); start += insertChunkRows {
+        chunk := kept[start:]
+        if len(chunk) > insertChunkRows {
+            chunk = chunk[:insertChunkRows]
+        }
+        args := make([]interface{}, 0, len(chunk)*len(columns))
+        for _, record := range chunk {
+            args = append(args, scanID, record.ID, nullString(record.ParentID), record.Name, record.Path, record.Size, record.IsFolder)
+        }
+        if _, err := tx.Exec(dia.rebind(upsertRowsSQL("scan_files", "scan_id, file_id", columns, len(chunk))), args...); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// GetScans returns the newest recorded scans of a drive, newest first.
+func (d *Database) GetScans(ctx context.Context, teamDriveID string, limit int) ([]Scan, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.GetScans(ctx, teamDriveID, limit)
+    }
+
+    rows, err := d.query(ctx, "SELECT "+scanColumns+" FROM scans WHERE teamdrive_id = ? ORDER BY id DESC LIMIT ?", teamDriveID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    scans := make([]Scan, 0)
+    for rows.Next() {
+        s, err := scanScan(rows)
+        if err != nil {
+            return nil, err
+        }
+        scans = append(scans, s)
+    }
+    return scans, rows.Err()
+}
+
+func scanScan(row interface{ Scan(...interface{}) error }) (Scan, error) {
+    var s Scan
+    var finishedAt sql.NullString
+    err := row.Scan(&s.ID, &s.TeamDriveID, &s.StartedAt, &finishedAt, &s.Files, &s.Folders, &s.Size)
+    s.FinishedAt = finishedAt.String
+    s.SizeHuman = FormatBytes(s.Size)
+    return s, err
+}
+
+// ScanDiff is what changed in a drive between two of its scans. The lists
+// hold up to the limit passed to DiffScans, ordered by path; the summary
+// counts them all.
+type ScanDiff struct {
+    From    Scan            `json:"from"`
+    To      Scan            `json:"to"`
+    Summary ScanDiffSummary `json:"summary"`
+    Added   []ScanDiffEntry `json:"added"`
+    Removed []ScanDiffEntry `json:"removed"`
+    Resized []ScanDiffEntry `json:"resized"`
+    Moved   []ScanDiffEntry `json:"moved"`
+}
+
+// ScanDiffSummary totals a ScanDiff. Sizes count files, not folders.
+type ScanDiffSummary struct {
+    Added       int64 `json:"added"`
+    Removed     int64 `json:"removed"`
+    Resized     int64 `json:"resized"`
+    Moved       int64 `json:"moved"`
+    AddedSize   int64 `json:"added_size"`
+    RemovedSize int64 `json:"removed_size"`
+    // ResizedDelta is the growth of the resized files, negative if they shrank
+    ResizedDelta int64 `json:"resized_delta"`
+    // SizeDelta is the growth of the drive as a whole
+    SizeDelta int64 `json:"size_delta"`
+}
+
+// ScanDiffEntry is a file or folder of a ScanDiff, with its path and size
+// in the later scan, or in the earlier one if it was removed. OldPath is
+// set for moves and OldSize for resizes.
+type ScanDiffEntry struct {
+    FileID   string `json:"file_id"`
+    Path     string `json:"path"`
+    IsFolder bool   `json:"is_folder"`
+    Size     int64  `json:"size"`
+    OldPath  string `json:"old_path,omitempty"`
+    OldSize  *int64 `json:"old_size,omitempty"`
+}
+
+// diffCategories select the entries of each ScanDiff list from the
+// manifests a (earlier) and b (later), each taking the later scan ID, then
+// the earlier one. A move is a new parent or name; the paths of what lies
+// below a moved folder change too, but it is not listed.
+var diffCategories = []struct {
+    columns string // file_id, path, is_folder, size, old_path, old_size
+    size    string // the summed size
+    from    string
+}{
+    {
+        "b.file_id, b.path, b.is_folder, b.size, NULL, NULL",
+        "CASE WHEN b.is_folder THEN 0 ELSE b.size END",
+        " FROM scan_files b WHERE b.scan_id = ? AND NOT EXISTS (SELECT 1 FROM scan_files a WHERE a.scan_id = ? AND a.file_id = b.file_id)",
+    },
+    {
+        "a.file_id, a.path, a.is_folder, a.size, NULL, NULL",
+        "CASE WHEN a.is_folder THEN 0 ELSE a.size END",
+        " FROM scan_files a WHERE NOT EXISTS (SELECT 1 FROM scan_files b WHERE b.scan_id = ? AND b.file_id = a.file_id) AND a.scan_id = ?",
+    },
+    {
+        "b.file_id, b.path, b.is_folder, b.size, NULL, a.size",
+        "b.size - a.size",
+        " FROM scan_files b JOIN scan_files a ON a.file_id = b.file_id WHERE b.scan_id = ? AND a.scan_id = ? AND NOT b.is_folder AND a.size <> b.size",
+    },
+    {
+        "b.file_id, b.path, b.is_folder, b.size, a.path, NULL",
+        "0",
+        " FROM scan_files b JOIN scan_files a ON a.file_id = b.file_id WHERE b.scan_id = ? AND a.scan_id = ?" +
+            " AND (COALESCE(a.parent_id, '') <> COALESCE(b.parent_id, '') OR a.name <> b.name)",
+    },
+}
+
+// DiffScans compares two finished scans of a drive, listing up to limit
+// entries of each kind. It returns nil if either is not a finished scan
+// of the drive.
+func (d *Database) DiffScans(ctx context.Context, teamDriveID string, fromID int64, toID int64, limit int) (*ScanDiff, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.DiffScans(ctx, teamDriveID, fromID, toID, limit)
+    }
+
+    diff := &ScanDiff{}
+    for _, s := range []struct {
+        id   int64
+        scan *Scan
+    }{{fromID, &diff.From}, {toID, &diff.To}} {
+        var err error
+        *s.scan, err = scanScan(d.queryRow(ctx, "SELECT "+scanColumns+" FROM scans WHERE id = ? AND teamdrive_id = ?", s.id, teamDriveID))
+        if err == sql.ErrNoRows || err == nil && s.scan.FinishedAt == "" {
+            return nil, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    counts := []*int64{&diff.Summary.Added, &diff.Summary.Removed, &diff.Summary.Resized, &diff.Summary.Moved}
+    sizes := []*int64{&diff.Summary.AddedSize, &diff.Summary.RemovedSize, &diff.Summary.ResizedDelta, new(int64)}
+    lists := []*[]ScanDiffEntry{&diff.Added, &diff.Removed, &diff.Resized, &diff.Moved}
+    for i, category := range diffCategories {
+        err := d.queryRow(ctx, "SELECT COUNT(*), COALESCE(SUM("+category.size+"), 0)"+category.from, toID, fromID).Scan(counts[i], sizes[i])
+        if err != nil {
+            return nil, err
+        }
+        if *lists[i], err = d.diffEntries(ctx, category.columns, category.from, toID, fromID, limit); err != nil {
+            return nil, err
+        }
+    }
+    diff.Summary.SizeDelta = diff.To.Size - diff.From.Size
+    return diff, nil
+}
+
+func (d *Database) diffEntries(ctx context.Context, columns string, from string, toID int64, fromID int64, limit int) ([]ScanDiffEntry, error) {
+    rows, err := d.query(ctx, "SELECT "+columns+from+" ORDER BY 2 LIMIT ?", toID, fromID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    entries := make([]ScanDiffEntry, 0)
+    for rows.Next() {
+        var e ScanDiffEntry
+        var path, oldPath sql.NullString
+        if err := rows.Scan(&e.FileID, &path, &e.IsFolder, &e.Size, &oldPath, &e.OldSize); err != nil {
+            return nil, err
+        }
+        e.Path, e.OldPath = path.String, oldPath.String
+        entries = append(entries, e)
+    }
+    return entries, rows.Err()
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "math/big"
+    "time"
+)
+
+// SavedSearch is a named set of search parameters. Params is the URL query
+// string accepted by /api/search, such as "q=report&mime_type=video/*".
+type SavedSearch struct {
+    ID        string `json:"id"`
+    Name      string `json:"name"`
+    Params    string `json:"params"`
+    CreatedAt string `json:"created_at"`
+    UpdatedAt string `json:"updated_at"`
+}
+
+const shortIDAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newShortID returns a short random ID suitable for links.
+func newShortID() (string, error) {
+    id := make([]byte, 8)
+    for i := range id {
+        n, err := rand.Int(rand.Reader, big.NewInt(int64(len(shortIDAlphabet))))
+        if err != nil {
+            return "", err
+        }
+        id[i] = shortIDAlphabet[n.Int64()]
+    }
+    return string(id), nil
+}
+
+// CreateSavedSearch stores a new saved search and returns it with its ID.
+func (d *Database) CreateSavedSearch(ctx context.Context, name, params string) (*SavedSearch, error) {
+    id, err := newShortID()
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now().UTC().Format(time.RFC3339)
+    search := &SavedSearch{ID: id, Name: name, Params: params, CreatedAt: now, UpdatedAt: now}
+
+    err = d.write(ctx, func() error {
+        _, err := d.exec(ctx, "INSERT INTO saved_searches (id, name, params, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+            search.ID, search.Name, search.Params, search.CreatedAt, search.UpdatedAt)
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    return search, nil
+}
+
+// UpdateSavedSearch replaces the name and parameters of a saved search. It
+// returns nil if no search has that ID.
+func (d *Database) UpdateSavedSearch(ctx context.Context, id, name, params string) (*SavedSearch, error) {
+    var updated int64
+    err := d.write(ctx, func() error {
+        result, err := d.exec(ctx, "UPDATE saved_searches SET name = ?, params = ?, updated_at = ? WHERE id = ?",
+            name, params, time.Now().UTC().Format(time.RFC3339), id)
+        if err != nil {
+            return err
+        }
+        updated, _ = result.RowsAffected()
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    if updated == 0 {
+        return nil, nil
+    }
+    return d.GetSavedSearch(ctx, id)
+}
+
+// DeleteSavedSearch removes a saved search, reporting whether it existed.
+func (d *Database) DeleteSavedSearch(ctx context.Context, id string) (bool, error) {
+    var deleted int64
+    err := d.write(ctx, func() error {
+        result, err := d.exec(ctx, "DELETE FROM saved_searches WHERE id = ?", id)
+        if err != nil {
+            return err
+        }
+        deleted, _ = result.RowsAffected()
+        return nil
+    })
+    return deleted > 0, err
+}
+
+// GetSavedSearch returns a saved search by ID, or nil if there is none.
+func (d *Database) GetSavedSearch(ctx context.Context, id string) (*SavedSearch, error) {
+    var search SavedSearch
+    err := d.queryRow(ctx, "SELECT id, name, params, created_at, updated_at FROM saved_searches WHERE id = ?", id).
+        Scan(&search.ID, &search.Name, &search.Params, &search.CreatedAt, &search.UpdatedAt)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &search, nil
+}
+
+// GetSavedSearches returns all saved searches ordered by name.
+func (d *Database) GetSavedSearches(ctx context.Context) ([]SavedSearch, error) {
+    rows, err := d.query(ctx, "SELECT id, name, params, created_at, updated_at FROM saved_searches ORDER BY name")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    searches := make([]SavedSearch, 0)
+    for rows.Next() {
+        var search SavedSearch
+        if err := rows.Scan(&search.ID, &search.Name, &search.Params, &search.CreatedAt, &search.UpdatedAt); err != nil {
+            return nil, err
+        }
+        searches = append(searches, search)
+    }
+
+    return searches, rows.Err()
+}
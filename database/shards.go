@@ -0,0 +1,500 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "hash/fnv"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// shardSet holds the databases of a sharded SQLite index, one file per
+// drive under dir. The Database they belong to is the catalog: it keeps
+// the drive list, accounts, saved searches, the rescan queue and the
+// change feed, and the shards table naming each drive's file. Its own
+// files table stays empty, so a drive without a shard reads as empty.
+//
+// Files moved between drives are seen as created in one shard and left in
+// the other until it is rescanned; moves of kind drive are not recorded.
+type shardSet struct {
+    dir         string
+    cacheSizeMB int
+
+    mu       sync.Mutex
+    open     map[string]*Database // by drive ID
+    deferred bool                 // DeferIndexing is in effect
+}
+
+// EnableSharding stores each drive's files in a SQLite database of its own
+// under dir, so very large installs avoid one monolithic file; searches
+// across drives fan out to every shard and merge the results. Call it
+// after the other setters, whose settings the shards take over. Only
+// SQLite databases can be sharded.
+func (d *Database) EnableSharding(dir string, cacheSizeMB int) error {
+    if d.dialect.name() != "sqlite" {
+        return fmt.Errorf("sharding needs the sqlite driver")
+    }
+    if !d.readOnly {
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            return err
+        }
+    }
+
+    d.shards = &shardSet{dir: dir, cacheSizeMB: cacheSizeMB, open: make(map[string]*Database)}
+    d.shards.mu.Lock()
+    defer d.shards.mu.Unlock()
+    if err := d.openShards(); err != nil {
+        return err
+    }
+    log.Printf("Sharded index: %d drive databases in %s", len(d.shards.open), dir)
+    return nil
+}
+
+// openShards opens the shards listed in the catalog that are not open
+// yet. The caller holds shards.mu.
+func (d *Database) openShards() error {
+    rows, err := d.query(context.Background(), "SELECT teamdrive_id, file FROM shards")
+    if err != nil {
+        return err
+    }
+    files := make(map[string]string)
+    for rows.Next() {
+        var id, file string
+        if err := rows.Scan(&id, &file); err != nil {
+            rows.Close()
+            return err
+        }
+        files[id] = file
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    for id, file := range files {
+        if d.shards.open[id] != nil {
+            continue
+        }
+        if err := d.openShard(id, file); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// openShard opens the database of one drive with the catalog's settings.
+// The caller holds shards.mu.
+func (d *Database) openShard(teamDriveID string, file string) error {
+    path := filepath.Join(d.shards.dir, file)
+    var shard *Database
+    var err error
+    if d.readOnly {
+        shard, err = OpenReadOnly(path, d.shards.cacheSizeMB)
+    } else {
+        shard, err = InitDatabase(path, d.shards.cacheSizeMB)
+    }
+    if err != nil {
+        return fmt.Errorf("shard of %s: %w", teamDriveID, err)
+    }
+
+    shard.catalog = d
+    shard.writeOptions = d.writeOptions
+    shard.cache = nil
+    if d.cache != nil {
+        shard.SetResultCache(d.cache.options)
+    }
+    shard.nativeEstimates = d.nativeEstimates
+    shard.changeFeed = d.changeFeed
+    shard.deletedRetention = d.deletedRetention
+    if d.shards.deferred {
+        if err := shard.DeferIndexing(); err != nil {
+            return err
+        }
+    }
+    d.shards.open[teamDriveID] = shard
+    return nil
+}
+
+// shardFileName names the database file of a drive. Drive IDs are safe
+// file names already; other target IDs get a hash to stay unique.
+func shardFileName(teamDriveID string) string {
+    safe := strings.Map(func(r rune) rune {
+        if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+            return r
+        }
+        return '_'
+    }, teamDriveID)
+    if safe != teamDriveID || safe == "" {
+        h := fnv.New32a()
+        h.Write([]byte(teamDriveID))
+        safe = fmt.Sprintf("%s-%08x", safe, h.Sum32())
+    }
+    return safe + ".db"
+}
+
+// driveShard returns the shard of a drive, or nil when the index is not
+// sharded or the drive has none, in which case the catalog's empty tables
+// answer. Shards created by another process since are picked up.
+func (d *Database) driveShard(teamDriveID string) *Database {
+    if d.shards == nil {
+        return nil
+    }
+    d.shards.mu.Lock()
+    defer d.shards.mu.Unlock()
+    if shard := d.shards.open[teamDriveID]; shard != nil {
+        return shard
+    }
+    if err := d.openShards(); err != nil {
+        log.Printf("Failed to open the shards: %v", err)
+    }
+    return d.shards.open[teamDriveID]
+}
+
+// writeShard returns the shard of a drive, creating it if needed.
+func (d *Database) writeShard(teamDriveID string) (*Database, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard, nil
+    }
+    if d.readOnly {
+        return nil, fmt.Errorf("database is opened read-only")
+    }
+
+    d.shards.mu.Lock()
+    defer d.shards.mu.Unlock()
+    if shard := d.shards.open[teamDriveID]; shard != nil {
+        return shard, nil
+    }
+    file := shardFileName(teamDriveID)
+    err := d.write(context.Background(), func() error {
+        _, err := d.exec(context.Background(), "INSERT INTO shards (teamdrive_id, file) VALUES (?, ?) ON CONFLICT (teamdrive_id) DO NOTHING",
+            teamDriveID, file)
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    if err := d.openShard(teamDriveID, file); err != nil {
+        return nil, err
+    }
+    log.Printf("Created shard %s for drive %s", file, teamDriveID)
+    return d.shards.open[teamDriveID], nil
+}
+
+// shardsOf returns the open shards of the given drives, nil meaning all,
+// ordered by drive ID.
+func (d *Database) shardsOf(teamDriveIDs []string) []*Database {
+    d.shards.mu.Lock()
+    defer d.shards.mu.Unlock()
+    if err := d.openShards(); err != nil {
+        log.Printf("Failed to open the shards: %v", err)
+    }
+
+    ids := teamDriveIDs
+    if ids == nil {
+        for id := range d.shards.open {
+            ids = append(ids, id)
+        }
+    }
+    ids = append([]string(nil), ids...)
+    sort.Strings(ids)
+
+    var shards []*Database
+    for _, id := range ids {
+        if shard := d.shards.open[id]; shard != nil {
+            shards = append(shards, shard)
+        }
+    }
+    return shards
+}
+
+// fileShard returns the shard holding a file or folder, or a drive root
+// given its drive ID, or nil if none does.
+func (d *Database) fileShard(ctx context.Context, fileID string) (*Database, error) {
+    if d.shards == nil {
+        return nil, nil
+    }
+    if shard := d.driveShard(fileID); shard != nil {
+        return shard, nil
+    }
+    for _, shard := range d.shardsOf(nil) {
+        var one int
+        err := shard.queryRow(ctx, "SELECT 1 FROM files WHERE id = ?", fileID).Scan(&one)
+        if err == nil {
+            return shard, nil
+        }
+        if err != sql.ErrNoRows {
+            return nil, err
+        }
+    }
+    return nil, nil
+}
+
+// fanOut runs fn on each of shards at the same time, passing its index,
+// and returns the first error.
+func fanOut(shards []*Database, fn func(i int, shard *Database) error) error {
+    errs := make([]error, len(shards))
+    var wg sync.WaitGroup
+    for i, shard := range shards {
+        wg.Add(1)
+        go func(i int, shard *Database) {
+            defer wg.Done()
+            errs[i] = fn(i, shard)
+        }(i, shard)
+    }
+    wg.Wait()
+    for _, err := range errs {
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// mergePages serves a page of a report from the shards of the given
+// drives. load returns a shard's first rows, up to the count it is given,
+// in the order less defines, and its total.
+func mergePages[T any](d *Database, teamDriveIDs []string, limit int, offset int,
+    load func(shard *Database, limit int) ([]T, int, error), less func(a, b T) bool) ([]T, int, error) {
+    shards := d.shardsOf(teamDriveIDs)
+    pages := make([][]T, len(shards))
+    totals := make([]int, len(shards))
+    err := fanOut(shards, func(i int, shard *Database) error {
+        var err error
+        pages[i], totals[i], err = load(shard, offset+limit)
+        return err
+    })
+    if err != nil {
+        return nil, 0, err
+    }
+
+    var rows []T
+    total := 0
+    for i := range shards {
+        rows = append(rows, pages[i]...)
+        total += totals[i]
+    }
+
+    sort.SliceStable(rows, func(i, j int) bool { return less(rows[i], rows[j]) })
+    if offset > len(rows) {
+        offset = len(rows)
+    }
+    rows = rows[offset:]
+    if len(rows) > limit {
+        rows = rows[:limit]
+    }
+    return rows, total, nil
+}
+
+// batchInsertShards splits records by drive and writes each part to its
+// shard.
+func (d *Database) batchInsertShards(records []FileRecord) error {
+    byDrive := make(map[string][]FileRecord)
+    for _, record := range records {
+        byDrive[record.TeamDriveID] = append(byDrive[record.TeamDriveID], record)
+    }
+    for teamDriveID, part := range byDrive {
+        shard, err := d.writeShard(teamDriveID)
+        if err != nil {
+            return err
+        }
+        if err := shard.BatchInsert(part); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// addChanges appends the changes a shard committed to the catalog's feed.
+// They are logged and dropped on failure, since the records they describe
+// are already written.
+func (d *Database) addChanges(changes []Change) {
+    err := d.write(context.Background(), func() error {
+        tx, err := d.db.Begin()
+        if err != nil {
+            return err
+        }
+        if err := writeChanges(tx, d.dialect, changes); err != nil {
+            tx.Rollback()
+            return err
+        }
+        return tx.Commit()
+    })
+    if err != nil {
+        log.Printf("Failed to add %d changes to the feed: %v", len(changes), err)
+    }
+}
+
+// searchShards runs a search on the shards it concerns and merges their
+// pages. Relevance has no common scale across shards, so relevance-ordered
+// results are interleaved, each shard's best first.
+func (d *Database) searchShards(ctx context.Context, opts SearchOptions) (*SearchResult, error) {
+    if opts.TeamDriveID != "" {
+        if shard := d.driveShard(opts.TeamDriveID); shard != nil {
+            return shard.Search(ctx, opts)
+        }
+        return d.search(ctx, opts)
+    }
+    if opts.ParentID != "" {
+        shard, err := d.fileShard(ctx, opts.ParentID)
+        if err != nil {
+            return nil, err
+        }
+        if shard != nil {
+            return shard.Search(ctx, opts)
+        }
+        return d.search(ctx, opts)
+    }
+
+    parsed, _, err := opts.withQueryTerms()
+    if err != nil {
+        return nil, err
+    }
+    keys := parsed.sortKeys(parsed.Query == "" || parsed.Regex != nil)
+
+    // Keyset cursors apply to every shard as they are; offsets are taken
+    // from the merged results
+    shardOpts := opts
+    offset := opts.Offset
+    if opts.Cursor != "" {
+        cursor, err := decodeCursor(opts.Cursor)
+        if err != nil {
+            return nil, err
+        }
+        offset = cursor.Offset
+        if len(cursor.Keys) == 0 {
+            shardOpts.Cursor = ""
+        }
+    }
+    skip := 0
+    shardOpts.Offset = 0
+    if shardOpts.Cursor == "" {
+        skip = offset
+        shardOpts.Limit = offset + opts.Limit
+    }
+
+    var drives []string
+    if len(opts.TeamDriveIDs) > 0 {
+        drives = opts.TeamDriveIDs
+    }
+    shards := d.shardsOf(drives)
+    results := make([]*SearchResult, len(shards))
+    err = fanOut(shards, func(i int, shard *Database) error {
+        var err error
+        results[i], err = shard.Search(ctx, shardOpts)
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    result := &SearchResult{Limit: opts.Limit, Offset: offset}
+    pages := make([][]FileRecord, len(results))
+    for i, page := range results {
+        pages[i] = page.Files
+        result.TotalCount += page.TotalCount
+        result.HasMore = result.HasMore || page.HasMore
+        result.Fuzzy = result.Fuzzy || page.Fuzzy
+        result.Partial = result.Partial || page.Partial
+        result.Substring = result.Substring || page.Substring
+    }
+
+    var records []FileRecord
+    if keys != nil {
+        for _, page := range pages {
+            records = append(records, page...)
+        }
+        sort.SliceStable(records, func(i, j int) bool { return compareRecords(keys, records[i], records[j]) < 0 })
+    } else {
+        for i := 0; ; i++ {
+            added := false
+            for _, page := range pages {
+                if i < len(page) {
+                    records = append(records, page[i])
+                    added = true
+                }
+            }
+            if !added {
+                break
+            }
+        }
+    }
+
+    if skip > len(records) {
+        skip = len(records)
+    }
+    records = records[skip:]
+    if len(records) > opts.Limit {
+        records = records[:opts.Limit]
+        result.HasMore = true
+    }
+    if records == nil {
+        records = []FileRecord{}
+    }
+    result.Files = records
+    result.NextOffset = offset + len(records)
+
+    if result.HasMore && len(records) > 0 {
+        next := pageCursor{Sort: opts.sortSignature(), Offset: result.NextOffset}
+        if keys != nil {
+            last := records[len(records)-1]
+            for _, key := range keys {
+                next.Keys = append(next.Keys, key.value(last))
+            }
+        }
+        result.NextCursor = next.encode()
+    }
+    return result, nil
+}
+
+// compareRecords orders two records as ORDER BY keys would on SQLite,
+// where names compare case-insensitively (NOCASE) and the rest bytewise.
+func compareRecords(keys []sortKey, a FileRecord, b FileRecord) int {
+    for _, key := range keys {
+        c := 0
+        switch va := key.value(a).(type) {
+        case bool:
+            vb := key.value(b).(bool)
+            if va != vb {
+                c = -1
+                if va {
+                    c = 1
+                }
+            }
+        case int64:
+            vb := key.value(b).(int64)
+            if va < vb {
+                c = -1
+            } else if va > vb {
+                c = 1
+            }
+        case string:
+            vb := key.value(b).(string)
+            if key.column == "name" {
+                va, vb = foldASCII(va), foldASCII(vb)
+            }
+            c = strings.Compare(va, vb)
+        }
+        if key.desc {
+            c = -c
+        }
+        if c != 0 {
+            return c
+        }
+    }
+    return 0
+}
+
+// foldASCII lowercases ASCII letters only, like SQLite's NOCASE.
+func foldASCII(s string) string {
+    return strings.Map(func(r rune) rune {
+        if r >= 'A' && r <= 'Z' {
+            return r + 'a' - 'A'
+        }
+        return r
+    }, s)
+}
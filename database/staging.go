@@ -0,0 +1,263 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Staging collects the records of one drive's scan in a temporary SQLite
+// database of its own, so concurrent scans write in parallel instead of
+// queuing on the index's writer. Merge copies them into the index at the
+// end with ATTACH and INSERT ... SELECT, in one transaction.
+type Staging struct {
+    target      *Database // the index, or the drive's shard
+    scanID      int64     // the manifest to fill, if any
+    teamDriveID string
+    path        string
+
+    mu sync.Mutex
+    db *sql.DB
+}
+
+// stagingTables are the tables a staging database copies from the index.
+var stagingTables = []string{"files", "permissions", "file_labels"}
+
+// stagingSchema lists the files whose permissions and labels were scanned,
+// so merging replaces only theirs.
+const stagingSchema = `
+    CREATE TABLE permissions_scanned (file_id TEXT PRIMARY KEY);
+    CREATE TABLE labels_scanned (file_id TEXT PRIMARY KEY);
+`
+
+// StartStaging creates a staging database in dir for a scan of a drive.
+// Its records reach the index, and manifest when it is not nil, on Merge.
+// Files left in dir by a process that died mid-scan can be deleted.
+func (d *Database) StartStaging(dir string, teamDriveID string, manifest *ScanManifest) (*Staging, error) {
+    ctx := context.Background()
+
+    s := &Staging{target: d, teamDriveID: teamDriveID}
+    if manifest != nil {
+        s.target, s.scanID = manifest.db, manifest.id
+    } else if d.shards != nil {
+        shard, err := d.writeShard(teamDriveID)
+        if err != nil {
+            return nil, err
+        }
+        s.target = shard
+    }
+    if s.target.dialect.name() != "sqlite" {
+        return nil, fmt.Errorf("staging needs the sqlite driver")
+    }
+    if s.target.readOnly {
+        return nil, fmt.Errorf("database is opened read-only")
+    }
+
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    file, err := os.CreateTemp(dir, "staging-"+strings.TrimSuffix(shardFileName(teamDriveID), ".db")+"-*.db")
+    if err != nil {
+        return nil, err
+    }
+    file.Close()
+    s.path = file.Name()
+
+    // Nothing is lost with the file if the process dies, so it skips the
+    // journal and fsyncs
+    if s.db, err = sql.Open("sqlite3", s.path+"?_journal_mode=OFF&_synchronous=OFF"); err != nil {
+        os.Remove(s.path)
+        return nil, err
+    }
+    s.db.SetMaxOpenConns(1)
+
+    // The index's own definitions, with whatever columns upgrades added
+    for _, table := range stagingTables {
+        var schema string
+        err := s.target.queryRow(ctx, "SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&schema)
+        if err == nil {
+            _, err = s.db.Exec(schema)
+        }
+        if err != nil {
+            s.discard()
+            return nil, fmt.Errorf("staging table %s: %w", table, err)
+        }
+    }
+    if _, err := s.db.Exec(stagingSchema); err != nil {
+        s.discard()
+        return nil, err
+    }
+    return s, nil
+}
+
+// BatchInsert writes records to the staging database.
+func (s *Staging) BatchInsert(records []FileRecord) error {
+    records = uniqueRecords(records)
+    dia := s.target.dialect
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    if err := writeFiles(tx, dia, records); err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := writePermissions(tx, dia, records); err != nil {
+        tx.Rollback()
+        return err
+    }
+    if err := writeLabels(tx, dia, records); err != nil {
+        tx.Rollback()
+        return err
+    }
+    for _, record := range records {
+        if record.Permissions != nil {
+            if _, err := tx.Exec("INSERT OR IGNORE INTO permissions_scanned (file_id) VALUES (?)", record.ID); err != nil {
+                tx.Rollback()
+                return err
+            }
+        }
+        if record.Labels != nil {
+            if _, err := tx.Exec("INSERT OR IGNORE INTO labels_scanned (file_id) VALUES (?)", record.ID); err != nil {
+                tx.Rollback()
+                return err
+            }
+        }
+    }
+    return tx.Commit()
+}
+
+// Merge copies the staged records into the index, recording moves and
+// changes as BatchInsert does, and deletes the staging database.
+func (s *Staging) Merge() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    defer s.discard()
+
+    if err := s.db.Close(); err != nil {
+        return err
+    }
+    start := time.Now()
+
+    var changes []Change
+    var count int
+    err := s.target.write(context.Background(), func() error {
+        var err error
+        changes, count, err = s.target.mergeStaging(s.path, s.scanID)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    if s.target.catalog != nil && len(changes) > 0 {
+        s.target.catalog.addChanges(changes)
+    }
+
+    log.Printf("DB: Merged %d staged records of %s in %v", count, s.teamDriveID, time.Since(start).Round(time.Millisecond))
+    return nil
+}
+
+// discard closes and deletes the staging database.
+func (s *Staging) discard() {
+    s.db.Close()
+    if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+        log.Printf("Failed to delete staging database %s: %v", s.path, err)
+    }
+}
+
+// mergeStaging attaches a staging database and copies its tables in one
+// transaction, returning the changes for the feed and the number of
+// records. ATTACH holds for one connection only, so all of it runs on one.
+func (d *Database) mergeStaging(path string, scanID int64) ([]Change, int, error) {
+    ctx := context.Background()
+
+    conn, err := d.db.Conn(ctx)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer conn.Close()
+
+    if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS staged", path); err != nil {
+        return nil, 0, err
+    }
+    defer conn.ExecContext(ctx, "DETACH DATABASE staged")
+
+    tx, err := conn.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, 0, err
+    }
+    changes, count, err := d.mergeStaged(tx, scanID)
+    if err != nil {
+        tx.Rollback()
+        return nil, 0, err
+    }
+    return changes, count, tx.Commit()
+}
+
+func (d *Database) mergeStaged(tx *sql.Tx, scanID int64) ([]Change, int, error) {
+    // Moves and changes compare each record with the row it replaces, so
+    // they are worked out a chunk at a time before the copy
+    var changes []Change
+    count := 0
+    for after := ""; ; {
+        rows, err := tx.Query("SELECT "+selectColumns("")+" FROM staged.files WHERE id > ? ORDER BY id LIMIT ?", after, insertChunkRows)
+        if err != nil {
+            return nil, 0, err
+        }
+        records, err := d.scanRows(rows)
+        rows.Close()
+        if err != nil {
+            return nil, 0, err
+        }
+        if len(records) == 0 {
+            break
+        }
+
+        chunk, err := writeHistory(tx, d.dialect, records, d.changeFeed)
+        if err != nil {
+            return nil, 0, err
+        }
+        changes = append(changes, chunk...)
+        count += len(records)
+        after = records[len(records)-1].ID
+    }
+    if d.catalog == nil {
+        if err := writeChanges(tx, d.dialect, changes); err != nil {
+            return nil, 0, err
+        }
+    }
+
+    labelColumns := "file_id, source, key, teamdrive_id, value"
+    statements := []string{
+        upsertSelectSQL("files", "id", fileColumns, "SELECT "+selectColumns("")+" FROM staged.files WHERE TRUE"),
+        "DELETE FROM permissions WHERE file_id IN (SELECT file_id FROM staged.permissions_scanned)",
+        "INSERT INTO permissions (file_id, teamdrive_id, " + permissionColumns + ") SELECT file_id, teamdrive_id, " + permissionColumns + " FROM staged.permissions",
+        "DELETE FROM file_labels WHERE file_id IN (SELECT file_id FROM staged.labels_scanned)",
+        "INSERT INTO file_labels (" + labelColumns + ") SELECT " + labelColumns + " FROM staged.file_labels",
+    }
+    for _, statement := range statements {
+        if _, err := tx.Exec(statement); err != nil {
+            return nil, 0, err
+        }
+    }
+
+    if scanID > 0 {
+        // As writeScanFiles, leaving out trashed records
+        _, err := tx.Exec(upsertSelectSQL("scan_files", "scan_id, file_id",
+            []string{"scan_id", "file_id", "parent_id", "name", "path", "size", "is_folder"},
+            "SELECT ?, id, NULLIF(parent_id, ''), name, path, size, is_folder FROM staged.files WHERE NOT trashed"), scanID)
+        if err != nil {
+            return nil, 0, err
+        }
+    }
+    return changes, count, nil
+}
@@ -0,0 +1,185 @@
+package database
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+)
+
+// Stats are the totals of a drive and the shape of its tree. TotalFiles
+// includes the Google-native files, which add nothing to TotalSize; with
+// size estimates set, EstimatedTotalSize adds what they would take up
+// exported. Trashed items are only counted in Trash.
+type Stats struct {
+    TeamDriveID         string        `json:"teamdrive_id"`
+    TotalFiles          int64         `json:"total_files"`
+    TotalFolders        int64         `json:"total_folders"`
+    TotalSize           int64         `json:"total_size"`
+    TotalSizeHuman      string        `json:"total_size_human"`
+    AverageFileSize     int64         `json:"average_file_size"` // of files other than Google-native ones
+    LargestFile         *FileRecord   `json:"largest_file,omitempty"`
+    LastScan            string        `json:"last_scan,omitempty"` // end of the latest scan, from stats_history
+    FilesByDepth        []DepthCount  `json:"files_by_depth"`
+    NativeFiles         int64         `json:"native_files"`
+    NativeByKind        []NativeCount `json:"native_by_kind"`
+    EstimatedNativeSize int64         `json:"estimated_native_size,omitempty"`
+    EstimatedTotalSize  int64         `json:"estimated_total_size,omitempty"`
+    Revisions           RevisionStats `json:"revisions"`
+    Trash               TrashStats    `json:"trash"`
+}
+
+// RevisionStats totals the revisions of the files whose revisions were
+// counted. OldSize is what revisions other than the current ones take up
+// of the quota.
+type RevisionStats struct {
+    Files        int64  `json:"files"`
+    Revisions    int64  `json:"revisions"`
+    Size         int64  `json:"size"`
+    OldSize      int64  `json:"old_size"`
+    OldSizeHuman string `json:"old_size_human"`
+}
+
+// NativeCount is the number of Google-native files of a kind, and their
+// estimated export size when an estimate is set for it.
+type NativeCount struct {
+    Kind          string `json:"kind"`
+    Files         int64  `json:"files"`
+    EstimatedSize int64  `json:"estimated_size,omitempty"`
+}
+
+// DepthCount is the number of files at a depth of a drive's tree; files in
+// the root are at depth 1.
+type DepthCount struct {
+    Depth int   `json:"depth"`
+    Files int64 `json:"files"`
+}
+
+// pathDepth is the SQL expression for the depth of a row from its path,
+// which starts with a slash for Drive targets and not for the others.
+const pathDepth = `LENGTH(COALESCE(path, '')) - LENGTH(REPLACE(COALESCE(path, ''), '/', '')) +
+    CASE WHEN path LIKE '/%' THEN 0 ELSE 1 END`
+
+// GetTeamDriveStats returns the totals of a drive. Results are served from
+// the result cache while the database is unchanged, and must not be
+// modified.
+func (d *Database) GetTeamDriveStats(ctx context.Context, teamDriveID string) (*Stats, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.GetTeamDriveStats(ctx, teamDriveID)
+    }
+
+    stats, err := d.cached(ctx, "stats\x00"+teamDriveID, func() (interface{}, error) {
+        return d.teamDriveStats(ctx, teamDriveID)
+    }, nil)
+    if err != nil {
+        return nil, err
+    }
+    return stats.(*Stats), nil
+}
+
+func (d *Database) teamDriveStats(ctx context.Context, teamDriveID string) (*Stats, error) {
+    stats := &Stats{TeamDriveID: teamDriveID, FilesByDepth: []DepthCount{}, NativeByKind: []NativeCount{}}
+
+    err := d.queryRow(ctx, `
+        SELECT
+            COALESCE(SUM(CASE WHEN is_folder THEN 0 ELSE 1 END), 0),
+            COALESCE(SUM(CASE WHEN is_folder THEN 1 ELSE 0 END), 0),
+            COALESCE(SUM(CASE WHEN is_folder THEN 0 ELSE size END), 0)
+        FROM files
+        WHERE teamdrive_id = ? AND trashed = FALSE AND deleted_at IS NULL
+    `, teamDriveID).Scan(&stats.TotalFiles, &stats.TotalFolders, &stats.TotalSize)
+    if err != nil {
+        return nil, err
+    }
+    stats.TotalSizeHuman = FormatBytes(stats.TotalSize)
+
+    rows, err := d.query(ctx, `SELECT mime_type, COUNT(*)
+        FROM files
+        WHERE teamdrive_id = ? AND trashed = FALSE AND deleted_at IS NULL AND `+fmt.Sprintf(nativeCondition, "")+`
+        GROUP BY mime_type
+        ORDER BY COUNT(*) DESC, mime_type`, teamDriveID)
+    if err != nil {
+        return nil, err
+    }
+    for rows.Next() {
+        var mimeType string
+        var count NativeCount
+        if err := rows.Scan(&mimeType, &count.Files); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        count.Kind = NativeKind(mimeType)
+        count.EstimatedSize = count.Files * d.nativeEstimates[count.Kind]
+        stats.NativeFiles += count.Files
+        stats.EstimatedNativeSize += count.EstimatedSize
+        stats.NativeByKind = append(stats.NativeByKind, count)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    if len(d.nativeEstimates) > 0 {
+        stats.EstimatedTotalSize = stats.TotalSize + stats.EstimatedNativeSize
+    }
+    if files := stats.TotalFiles - stats.NativeFiles; files > 0 {
+        stats.AverageFileSize = stats.TotalSize / files
+    }
+
+    rows, err = d.query(ctx, "SELECT "+selectColumns("")+` FROM files
+        WHERE teamdrive_id = ? AND is_folder = FALSE AND trashed = FALSE AND deleted_at IS NULL
+        ORDER BY size DESC
+        LIMIT 1`, teamDriveID)
+    if err != nil {
+        return nil, err
+    }
+    largest, err := d.scanRows(rows)
+    rows.Close()
+    if err != nil {
+        return nil, err
+    }
+    if len(largest) > 0 {
+        stats.LargestFile = &largest[0]
+    }
+
+    err = d.queryRow(ctx, `
+        SELECT
+            COUNT(*),
+            COALESCE(SUM(revision_count), 0),
+            COALESCE(SUM(revision_size), 0),
+            COALESCE(SUM(CASE WHEN revision_size > size THEN revision_size - size ELSE 0 END), 0)
+        FROM files
+        WHERE teamdrive_id = ? AND revision_count IS NOT NULL AND trashed = FALSE AND deleted_at IS NULL
+    `, teamDriveID).Scan(&stats.Revisions.Files, &stats.Revisions.Revisions, &stats.Revisions.Size, &stats.Revisions.OldSize)
+    if err != nil {
+        return nil, err
+    }
+    stats.Revisions.OldSizeHuman = FormatBytes(stats.Revisions.OldSize)
+
+    if stats.Trash, err = d.GetTrashStats(ctx, teamDriveID); err != nil {
+        return nil, err
+    }
+
+    var lastScan sql.NullString
+    err = d.queryRow(ctx, "SELECT MAX(recorded_at) FROM stats_history WHERE teamdrive_id = ?", teamDriveID).Scan(&lastScan)
+    if err != nil {
+        return nil, err
+    }
+    stats.LastScan = lastScan.String
+
+    rows, err = d.query(ctx, "SELECT "+pathDepth+` AS depth, COUNT(*)
+        FROM files
+        WHERE teamdrive_id = ? AND is_folder = FALSE AND trashed = FALSE AND deleted_at IS NULL
+        GROUP BY depth
+        ORDER BY depth`, teamDriveID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var count DepthCount
+        if err := rows.Scan(&count.Depth, &count.Files); err != nil {
+            return nil, err
+        }
+        stats.FilesByDepth = append(stats.FilesByDepth, count)
+    }
+    return stats, rows.Err()
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+    "context"
+    "strings"
+)
+
+// minSubstringLength is the shortest term worth a substring search; any
+// shorter and nearly every name matches.
+const minSubstringLength = 3
+
+// substringTerms returns the words of a full-text query to look for inside
+// names, or nil when none is long enough. FTS syntax is dropped: quotes,
+// prefix stars, exclusions and operators.
+func substringTerms(query string) []string {
+    var terms []string
+    long := false
+    for _, word := range strings.Fields(query) {
+        switch word {
+        case "AND", "OR", "NOT":
+            continue
+        }
+        if strings.HasPrefix(word, "-") {
+            continue
+        }
+        word = strings.Trim(word, `"*()^+`)
+        if word == "" {
+            continue
+        }
+        terms = append(terms, strings.ToLower(word))
+        long = long || len(word) >= minSubstringLength
+    }
+    if !long {
+        return nil
+    }
+    return terms
+}
+
+// escapeLike escapes the LIKE wildcards in s for ESCAPE '\'.
+func escapeLike(s string) string {
+    return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// searchSubstring finds names containing every term, for queries the
+// full-text index has no match for: it only knows whole words and their
+// prefixes, so "venger" misses "Avengers". Rows are returned in keys
+// order, or by name without one, after skipping skip rows; pageSQL refers
+// to the table as f. count is zero when opts.NoCount is set.
+func (d *Database) searchSubstring(ctx context.Context, opts SearchOptions, terms []string, keys []sortKey, pageSQL string, pageArgs []interface{}, skip int) ([]FileRecord, int, error) {
+    where, args := opts.filterClauses("f.")
+    for _, term := range terms {
+        where = append(where, `lower(f.name) LIKE ? ESCAPE '\'`)
+        args = append(args, "%"+escapeLike(term)+"%")
+    }
+    whereSQL := " AND " + strings.Join(where, " AND ")
+
+    if keys == nil {
+        keys = []sortKey{{column: "name"}, {column: "id"}}
+    }
+    query := "SELECT " + selectColumns("f.") + " FROM files f WHERE 1=1" + whereSQL + pageSQL +
+        " ORDER BY " + orderClause("f.", keys) + " LIMIT ? OFFSET ?"
+    queryArgs := append(append([]interface{}{}, args...), pageArgs...)
+    queryArgs = append(queryArgs, opts.Limit+1, skip)
+
+    rows, err := d.query(ctx, query, queryArgs...)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer rows.Close()
+
+    records, err := d.scanRows(rows)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    count := 0
+    if !opts.NoCount {
+        if err := d.queryRow(ctx, "SELECT COUNT(*) FROM files f WHERE 1=1"+whereSQL, args...).Scan(&count); err != nil {
+            return nil, 0, err
+        }
+    }
+    return records, count, nil
+}
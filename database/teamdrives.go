@@ -0,0 +1,81 @@
+package database
+
+import (
+    "context"
+    "time"
+)
+
+// TeamDrive is a shared drive known to the index, either configured or
+// discovered through the Drive API.
+type TeamDrive struct {
+    ID   string `json:"id"`
+    Name string `json:"name"`
+}
+
+// SaveTeamDrives records discovered drives, updating the names of drives
+// that are already known.
+func (d *Database) SaveTeamDrives(drives []TeamDrive) error {
+    return d.write(context.Background(), func() error {
+        tx, err := d.db.Begin()
+        if err != nil {
+            return err
+        }
+
+        stmt, err := tx.Prepare(d.dialect.rebind(upsertSQL("teamdrives", "id", []string{
+            "id", "name", "discovered_at",
+        })))
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+        defer stmt.Close()
+
+        now := time.Now().UTC().Format(time.RFC3339)
+        for _, drive := range drives {
+            if _, err := stmt.Exec(drive.ID, drive.Name, now); err != nil {
+                tx.Rollback()
+                return err
+            }
+        }
+
+        return tx.Commit()
+    })
+}
+
+// GetTeamDrives returns all discovered drives ordered by name.
+func (d *Database) GetTeamDrives(ctx context.Context) ([]TeamDrive, error) {
+    rows, err := d.query(ctx, "SELECT id, name FROM teamdrives ORDER BY name")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    drives := make([]TeamDrive, 0)
+    for rows.Next() {
+        var drive TeamDrive
+        if err := rows.Scan(&drive.ID, &drive.Name); err != nil {
+            return nil, err
+        }
+        drives = append(drives, drive)
+    }
+
+    return drives, rows.Err()
+}
+
+// MergeTeamDrives appends the drives from extra whose IDs are not already in
+// base, so configured names take precedence over discovered ones.
+func MergeTeamDrives(base []TeamDrive, extra []TeamDrive) []TeamDrive {
+    seen := make(map[string]bool, len(base))
+    merged := make([]TeamDrive, 0, len(base)+len(extra))
+    for _, drive := range base {
+        seen[drive.ID] = true
+        merged = append(merged, drive)
+    }
+    for _, drive := range extra {
+        if !seen[drive.ID] {
+            seen[drive.ID] = true
+            merged = append(merged, drive)
+        }
+    }
+    return merged
+}
@@ -0,0 +1,92 @@
+package database
+
+import "context"
+
+// SearchOptions.Trash values. Trashed files are only stored by scans that
+// include the trash.
+const (
+    TrashInclude = "include" // search trashed files along with the others
+    TrashOnly    = "only"    // search the trash alone
+)
+
+// TrashStats totals the trashed items of a drive. Size is the storage that
+// emptying the trash would free.
+type TrashStats struct {
+    Files     int64  `json:"files"`
+    Folders   int64  `json:"folders"`
+    Size      int64  `json:"size"`
+    SizeHuman string `json:"size_human"`
+}
+
+// trashRoot matches the items trashed themselves rather than with their
+// folder, the ones the Drive trash lists.
+const trashRoot = "f.trashed = TRUE AND NOT EXISTS (SELECT 1 FROM files p WHERE p.id = f.parent_id AND p.trashed = TRUE)"
+
+// GetTrashStats totals the trash of a drive.
+func (d *Database) GetTrashStats(ctx context.Context, teamDriveID string) (TrashStats, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.GetTrashStats(ctx, teamDriveID)
+    }
+
+    var trash TrashStats
+    err := d.queryRow(ctx, `
+        SELECT
+            COALESCE(SUM(CASE WHEN is_folder THEN 0 ELSE 1 END), 0),
+            COALESCE(SUM(CASE WHEN is_folder THEN 1 ELSE 0 END), 0),
+            COALESCE(SUM(CASE WHEN is_folder THEN 0 ELSE size END), 0)
+        FROM files
+        WHERE trashed = TRUE AND teamdrive_id = ?
+    `, teamDriveID).Scan(&trash.Files, &trash.Folders, &trash.Size)
+    trash.SizeHuman = FormatBytes(trash.Size)
+    return trash, err
+}
+
+// GetTrash returns a page of the trash of a drive, most recently trashed
+// first, and its total count. Items trashed with their folder are counted
+// in the folder's TotalSize instead of being listed.
+func (d *Database) GetTrash(ctx context.Context, teamDriveID string, limit int, offset int) ([]FileRecord, int, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.GetTrash(ctx, teamDriveID, limit, offset)
+    }
+
+    var total int
+    if err := d.queryRow(ctx, "SELECT COUNT(*) FROM files f WHERE f.teamdrive_id = ? AND "+trashRoot, teamDriveID).Scan(&total); err != nil {
+        return nil, 0, err
+    }
+
+    rows, err := d.query(ctx, "SELECT "+selectColumns("f.")+" FROM files f WHERE f.teamdrive_id = ? AND "+trashRoot+
+        " ORDER BY f.trashed_time DESC, f.path LIMIT ? OFFSET ?", teamDriveID, limit, offset)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer rows.Close()
+
+    records, err := d.scanRows(rows)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    var folders []string
+    for i := range records {
+        if records[i].IsFolder {
+            folders = append(folders, records[i].ID)
+        } else {
+            records[i].TotalSize = records[i].Size
+        }
+    }
+    if len(folders) > 0 {
+        sizes, err := d.folderSizes(ctx, folders)
+        if err != nil {
+            return nil, 0, err
+        }
+        for i := range records {
+            if size, ok := sizes[records[i].ID]; ok {
+                records[i].TotalSize, records[i].ChildCount = size.total, size.count
+            }
+        }
+    }
+    if records == nil {
+        records = []FileRecord{}
+    }
+    return records, total, nil
+}
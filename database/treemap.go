@@ -0,0 +1,158 @@
+package database
+
+import (
+    "context"
+    "sort"
+)
+
+// TreemapNode is one folder in a treemap of a drive. Size and Files cover
+// the whole subtree. Files sitting directly in a folder with children
+// shown are grouped into a "(files)" child, and children beyond the
+// largest few into "(other)", so child sizes always add up to the parent.
+type TreemapNode struct {
+    ID       string         `json:"id,omitempty"`
+    Name     string         `json:"name"`
+    Size     int64          `json:"size"`
+    Files    int64          `json:"files"`
+    Children []*TreemapNode `json:"children,omitempty"`
+
+    parentID    string
+    directSize  int64
+    directFiles int64
+}
+
+// GetTreemap returns the folder hierarchy of a drive down to depth levels
+// below the root, keeping the maxChildren largest children of each folder.
+// It reads every folder of the drive and the per-folder file totals once
+// and aggregates in memory, rather than recursing in SQL per folder.
+func (d *Database) GetTreemap(ctx context.Context, teamDriveID string, depth int, maxChildren int) (*TreemapNode, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.GetTreemap(ctx, teamDriveID, depth, maxChildren)
+    }
+
+    root := &TreemapNode{ID: teamDriveID, Name: teamDriveID}
+    nodes := map[string]*TreemapNode{teamDriveID: root}
+
+    rows, err := d.query(ctx, `
+        SELECT id, name, COALESCE(parent_id, ''), teamdrive_name
+        FROM files
+        WHERE teamdrive_id = ? AND is_folder = TRUE AND trashed = FALSE AND deleted_at IS NULL
+    `, teamDriveID)
+    if err != nil {
+        return nil, err
+    }
+    for rows.Next() {
+        node := &TreemapNode{}
+        var teamDriveName string
+        if err := rows.Scan(&node.ID, &node.Name, &node.parentID, &teamDriveName); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        root.Name = teamDriveName
+        nodes[node.ID] = node
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    rows, err = d.query(ctx, `
+        SELECT COALESCE(parent_id, ''), COALESCE(SUM(size), 0), COUNT(*)
+        FROM files
+        WHERE teamdrive_id = ? AND is_folder = FALSE AND trashed = FALSE AND deleted_at IS NULL
+        GROUP BY parent_id
+    `, teamDriveID)
+    if err != nil {
+        return nil, err
+    }
+    for rows.Next() {
+        var parentID string
+        var size, files int64
+        if err := rows.Scan(&parentID, &size, &files); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        if node, ok := nodes[parentID]; ok {
+            node.directSize = size
+            node.directFiles = files
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    // Folders whose parent was not indexed hang off the root
+    for id, node := range nodes {
+        if id == teamDriveID {
+            continue
+        }
+        parent, ok := nodes[node.parentID]
+        if !ok {
+            parent = root
+        }
+        parent.Children = append(parent.Children, node)
+    }
+
+    root.total()
+    root.prune(depth, maxChildren)
+    return root, nil
+}
+
+// total fills in subtree sizes. It walks iteratively, since Drive folder
+// trees can be deep enough to make recursion costly.
+func (n *TreemapNode) total() {
+    var order []*TreemapNode
+    stack := []*TreemapNode{n}
+    visited := make(map[*TreemapNode]bool)
+    for len(stack) > 0 {
+        node := stack[len(stack)-1]
+        stack = stack[:len(stack)-1]
+        if visited[node] {
+            continue
+        }
+        visited[node] = true
+        order = append(order, node)
+        stack = append(stack, node.Children...)
+    }
+
+    for i := len(order) - 1; i >= 0; i-- {
+        node := order[i]
+        node.Size, node.Files = node.directSize, node.directFiles
+        for _, child := range node.Children {
+            node.Size += child.Size
+            node.Files += child.Files
+        }
+    }
+}
+
+// prune cuts the tree below depth and folds small children together.
+func (n *TreemapNode) prune(depth int, maxChildren int) {
+    if depth <= 0 || len(n.Children) == 0 {
+        n.Children = nil
+        return
+    }
+
+    sort.Slice(n.Children, func(i, j int) bool {
+        return n.Children[i].Size > n.Children[j].Size
+    })
+
+    if maxChildren > 0 && len(n.Children) > maxChildren {
+        other := &TreemapNode{Name: "(other)"}
+        for _, child := range n.Children[maxChildren:] {
+            other.Size += child.Size
+            other.Files += child.Files
+        }
+        n.Children = append(n.Children[:maxChildren], other)
+    }
+
+    for _, child := range n.Children {
+        if child.ID != "" {
+            child.prune(depth-1, maxChildren)
+        }
+    }
+
+    if n.directFiles > 0 {
+        n.Children = append(n.Children, &TreemapNode{Name: "(files)", Size: n.directSize, Files: n.directFiles})
+    }
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+    "bufio"
+    "context"
+    "database/sql"
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// ManifestEntry is one file of a backup manifest. MD5 is optional.
+type ManifestEntry struct {
+    Path string `json:"path"`
+    Size int64  `json:"size"`
+    MD5  string `json:"md5,omitempty"`
+}
+
+// Statuses of a VerifyProblem.
+const (
+    VerifyMissing      = "missing"       // no file at the path
+    VerifySizeMismatch = "size_mismatch" // a file of another size
+    VerifyMD5Mismatch  = "md5_mismatch"  // the right size, other content
+)
+
+// VerifyProblem is a manifest entry the index does not match, with the
+// closest indexed file at its path, if any.
+type VerifyProblem struct {
+    Path        string `json:"path"`
+    Size        int64  `json:"size"`
+    MD5         string `json:"md5,omitempty"`
+    Status      string `json:"status"`
+    FileID      string `json:"file_id,omitempty"`
+    IndexedSize int64  `json:"indexed_size,omitempty"`
+    IndexedMD5  string `json:"indexed_md5,omitempty"`
+}
+
+// VerifyReport is the outcome of VerifyManifest. Problems lists up to the
+// limit passed to it, ordered by path; the counts cover them all.
+type VerifyReport struct {
+    TeamDriveID  string `json:"teamdrive_id"`
+    Root         string `json:"root,omitempty"`
+    Checked      int    `json:"checked"`
+    Matched      int    `json:"matched"`
+    Missing      int    `json:"missing"`
+    SizeMismatch int    `json:"size_mismatch"`
+    MD5Mismatch  int    `json:"md5_mismatch"`
+    // SizeOnly counts the matches made on size alone, for lack of a
+    // checksum in the manifest or the index
+    SizeOnly int `json:"size_only"`
+    // Extra counts the indexed files under Root the manifest lacks
+    Extra    int             `json:"extra"`
+    Problems []VerifyProblem `json:"problems"`
+}
+
+// ReadManifest parses a backup manifest: CSV with a header naming the
+// path, size and optional md5 columns, or JSON, either an array of
+// ManifestEntry objects or one object per line.
+func ReadManifest(r io.Reader, format string) ([]ManifestEntry, error) {
+    switch format {
+    case "csv":
+        return readManifestCSV(r)
+    case "json":
+        return readManifestJSON(r)
+    }
+    return nil, fmt.Errorf("unknown manifest format %q: use csv or json", format)
+}
+
+func readManifestCSV(r io.Reader) ([]ManifestEntry, error) {
+    reader := csv.NewReader(r)
+    reader.FieldsPerRecord = -1
+    header, err := reader.Read()
+    if err != nil {
+        return nil, fmt.Errorf("manifest header: %w", err)
+    }
+    columns := map[string]int{"path": -1, "size": -1, "md5": -1}
+    for i, name := range header {
+        name = strings.ToLower(strings.TrimSpace(name))
+        if _, ok := columns[name]; ok {
+            columns[name] = i
+        }
+    }
+    if columns["path"] < 0 || columns["size"] < 0 {
+        return nil, fmt.Errorf("manifest header needs path and size columns")
+    }
+
+    field := func(row []string, name string) string {
+        if i := columns[name]; i >= 0 && i < len(row) {
+            return strings.TrimSpace(row[i])
+        }
+        return ""
+    }
+    var entries []ManifestEntry
+    for line := 2; ; line++ {
+        row, err := reader.Read()
+        if err == io.EOF {
+            return entries, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        size, err := strconv.ParseInt(field(row, "size"), 10, 64)
+        if err != nil {
+            return nil, fmt.Errorf("manifest line %d: invalid size %q", line, field(row, "size"))
+        }
+        entries = append(entries, ManifestEntry{Path: field(row, "path"), Size: size, MD5: field(row, "md5")})
+    }
+}
+
+func readManifestJSON(r io.Reader) ([]ManifestEntry, error) {
+    buffered := bufio.NewReader(r)
+    first, err := firstNonSpace(buffered)
+    if err != nil {
+        return nil, fmt.Errorf("empty manifest")
+    }
+
+    decoder := json.NewDecoder(buffered)
+    var entries []ManifestEntry
+    if first == '[' {
+        err := decoder.Decode(&entries)
+        return entries, err
+    }
+    for {
+        var entry ManifestEntry
+        err := decoder.Decode(&entry)
+        if err == io.EOF {
+            return entries, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        entries = append(entries, entry)
+    }
+}
+
+// firstNonSpace peeks at the first byte of r that is not white space.
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+    for {
+        b, err := r.ReadByte()
+        if err != nil {
+            return 0, err
+        }
+        if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+            return b, r.UnreadByte()
+        }
+    }
+}
+
+// manifestPath turns a manifest path, relative to root, into an index
+// path.
+func manifestPath(root string, path string) string {
+    path = strings.TrimPrefix(strings.ReplaceAll(path, "\\", "/"), "./")
+    return root + "/" + strings.TrimPrefix(path, "/")
+}
+
+// VerifyManifest checks a backup manifest against the index of a drive.
+// Manifest paths are relative to root, a folder path of the drive such as
+// "/Backups/2024", or to the drive itself when root is empty.
+func (d *Database) VerifyManifest(ctx context.Context, teamDriveID string, root string, entries []ManifestEntry, limit int) (*VerifyReport, error) {
+    if shard := d.driveShard(teamDriveID); shard != nil {
+        return shard.VerifyManifest(ctx, teamDriveID, root, entries, limit)
+    }
+
+    root = strings.TrimSuffix(root, "/")
+    report := &VerifyReport{TeamDriveID: teamDriveID, Root: root}
+
+    // Each path keeps its best match: Drive allows several files with one
+    // name in a folder
+    problems := make(map[string]*VerifyProblem, len(entries))
+    for _, entry := range entries {
+        problems[manifestPath(root, entry.Path)] = &VerifyProblem{Path: entry.Path, Size: entry.Size, MD5: entry.MD5, Status: VerifyMissing}
+    }
+    report.Checked = len(problems)
+    rank := map[string]int{"": 0, VerifyMD5Mismatch: 1, VerifySizeMismatch: 2, VerifyMissing: 3}
+
+    rows, err := d.query(ctx, "SELECT id, path, size, md5_checksum FROM files WHERE teamdrive_id = ? AND trashed = FALSE AND deleted_at IS NULL AND NOT is_folder", teamDriveID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var id string
+        var path, md5 sql.NullString
+        var size int64
+        if err := rows.Scan(&id, &path, &size, &md5); err != nil {
+            return nil, err
+        }
+        problem, ok := problems[path.String]
+        if !ok {
+            if strings.HasPrefix(path.String, root+"/") {
+                report.Extra++
+            }
+            continue
+        }
+
+        status := ""
+        switch {
+        case size != problem.Size:
+            status = VerifySizeMismatch
+        case problem.MD5 != "" && md5.String != "" && !strings.EqualFold(problem.MD5, md5.String):
+            status = VerifyMD5Mismatch
+        }
+        if rank[status] < rank[problem.Status] {
+            problem.Status, problem.FileID, problem.IndexedSize, problem.IndexedMD5 = status, id, size, md5.String
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    report.Problems = make([]VerifyProblem, 0)
+    for _, problem := range problems {
+        switch problem.Status {
+        case "":
+            report.Matched++
+            if problem.MD5 == "" || problem.IndexedMD5 == "" {
+                report.SizeOnly++
+            }
+            continue
+        case VerifyMissing:
+            report.Missing++
+        case VerifySizeMismatch:
+            report.SizeMismatch++
+        case VerifyMD5Mismatch:
+            report.MD5Mismatch++
+        }
+        report.Problems = append(report.Problems, *problem)
+    }
+    sort.Slice(report.Problems, func(i, j int) bool { return report.Problems[i].Path < report.Problems[j].Path })
+    if len(report.Problems) > limit {
+        report.Problems = report.Problems[:limit]
+    }
+    return report, nil
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+    "context"
+    "errors"
+    "log"
+    "math/rand"
+    "time"
+
+    "github.com/mattn/go-sqlite3"
+)
+
+// maxBusyBackoff caps the delay between retries of a busy write.
+const maxBusyBackoff = 5 * time.Second
+
+// WriteOptions tunes how writes reach the database. All writes go through
+// one goroutine, so scans of several drives queue up instead of contending
+// for the SQLite write lock; a write that still hits SQLITE_BUSY, because
+// another process holds the lock, is retried.
+type WriteOptions struct {
+    QueueSize   int           // writes waiting for the writer before callers block
+    BusyRetries int           // retries of a write that failed with SQLITE_BUSY
+    BusyBackoff time.Duration // delay before the first retry, doubled for each further one, plus jitter
+}
+
+var defaultWriteOptions = WriteOptions{
+    QueueSize:   64,
+    BusyRetries: 8,
+    BusyBackoff: 50 * time.Millisecond,
+}
+
+// writeJob is one write for the writer goroutine. fn is run again on retry,
+// so it must undo its partial work (roll back) when it fails.
+type writeJob struct {
+    fn   func() error
+    done chan error
+}
+
+// SetWriteOptions replaces the defaults for zero fields of opts. It must be
+// called before the first write.
+func (d *Database) SetWriteOptions(opts WriteOptions) {
+    if opts.QueueSize > 0 {
+        d.writeOptions.QueueSize = opts.QueueSize
+    }
+    if opts.BusyRetries > 0 {
+        d.writeOptions.BusyRetries = opts.BusyRetries
+    }
+    if opts.BusyBackoff > 0 {
+        d.writeOptions.BusyBackoff = opts.BusyBackoff
+    }
+}
+
+// write runs fn on the writer goroutine and returns its error. If ctx ends
+// first, write returns without waiting; fn should use ctx so it fails fast
+// once it is run.
+func (d *Database) write(ctx context.Context, fn func() error) error {
+    d.writerOnce.Do(d.startWriter)
+
+    job := writeJob{fn: fn, done: make(chan error, 1)}
+    select {
+    case d.writes <- job:
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+
+    select {
+    case err := <-job.done:
+        return err
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func (d *Database) startWriter() {
+    d.writes = make(chan writeJob, d.writeOptions.QueueSize)
+    d.writerDone = make(chan struct{})
+
+    go func() {
+        defer close(d.writerDone)
+        for job := range d.writes {
+            err := d.retryBusy(job.fn)
+            d.generation.Add(1)
+            job.done <- err
+        }
+    }()
+}
+
+// stopWriter finishes the queued writes and stops the writer goroutine.
+func (d *Database) stopWriter() {
+    started := true
+    d.writerOnce.Do(func() { started = false })
+    if started {
+        close(d.writes)
+        <-d.writerDone
+    }
+}
+
+func (d *Database) retryBusy(fn func() error) error {
+    err := fn()
+    delay := d.writeOptions.BusyBackoff
+    for attempt := 1; err != nil && isBusy(err) && attempt <= d.writeOptions.BusyRetries; attempt++ {
+        wait := delay + time.Duration(rand.Int63n(int64(delay)+1))
+        log.Printf("Database busy, retrying write in %v (%d/%d)", wait.Round(time.Millisecond),
+            attempt, d.writeOptions.BusyRetries)
+        time.Sleep(wait)
+
+        err = fn()
+        if delay *= 2; delay > maxBusyBackoff {
+            delay = maxBusyBackoff
+        }
+    }
+    return err
+}
+
+// isBusy reports whether err is SQLite's lock contention error.
+func isBusy(err error) bool {
+    var sqliteErr sqlite3.Error
+    if errors.As(err, &sqliteErr) {
+        return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+    }
+    return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "text/tabwriter"
+
+    "teamdrive-scanner/database"
+)
+
+// diffFlags are the scan IDs of diff mode; the drive, format and limit
+// are shared with query mode.
+type diffFlags struct {
+    from int64
+    to   int64
+}
+
+// runDiff compares two recorded scans of a drive and writes what was
+// added, removed, resized and moved between them to stdout. Without
+// -from and -to it compares the two latest scans.
+func runDiff(config *Config, db *database.Database, query queryFlags, flags diffFlags) {
+    switch query.format {
+    case "table", "json":
+    default:
+        log.Fatalf("Invalid -format %q: use table or json", query.format)
+    }
+    if query.teamDrive == "" {
+        log.Fatalf("-teamdrive is required in diff mode")
+    }
+    if query.limit <= 0 {
+        log.Fatalf("-limit must be positive")
+    }
+
+    ctx := context.Background()
+    td := teamDriveID(config, query.teamDrive)
+    if flags.from == 0 || flags.to == 0 {
+        scans, err := db.GetScans(ctx, td, 1000)
+        if err != nil {
+            log.Fatalf("Failed to list scans: %v", err)
+        }
+        for _, scan := range scans {
+            switch {
+            case scan.FinishedAt == "":
+            case flags.to == 0:
+                flags.to = scan.ID
+            case flags.from == 0 && scan.ID < flags.to:
+                flags.from = scan.ID
+            }
+        }
+        if flags.from == 0 || flags.to == 0 {
+            log.Fatalf("Not enough recorded scans of %s: set scanner.keep_scans and scan it again", query.teamDrive)
+        }
+    }
+
+    diff, err := db.DiffScans(ctx, td, flags.from, flags.to, query.limit)
+    if err != nil {
+        log.Fatalf("Diff failed: %v", err)
+    }
+    if diff == nil {
+        log.Fatalf("Scans %d and %d are not both finished scans of %s", flags.from, flags.to, query.teamDrive)
+    }
+
+    if query.format == "json" {
+        encoder := json.NewEncoder(os.Stdout)
+        encoder.SetIndent("", "  ")
+        if err := encoder.Encode(diff); err != nil {
+            log.Fatalf("Failed to write diff: %v", err)
+        }
+        return
+    }
+
+    s := diff.Summary
+    fmt.Printf("Scan %d (%s) -> %d (%s)\n", diff.From.ID, diff.From.StartedAt, diff.To.ID, diff.To.StartedAt)
+    fmt.Printf("Added %d (%s), removed %d (%s), resized %d (%s), moved %d; drive size %s -> %s\n\n",
+        s.Added, database.FormatBytes(s.AddedSize), s.Removed, database.FormatBytes(s.RemovedSize),
+        s.Resized, signedBytes(s.ResizedDelta), s.Moved, diff.From.SizeHuman, diff.To.SizeHuman)
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "CHANGE\tSIZE\tPATH\t")
+    for _, e := range diff.Added {
+        fmt.Fprintf(w, "added\t%s\t%s\t\n", entrySize(e), e.Path)
+    }
+    for _, e := range diff.Removed {
+        fmt.Fprintf(w, "removed\t%s\t%s\t\n", entrySize(e), e.Path)
+    }
+    for _, e := range diff.Resized {
+        fmt.Fprintf(w, "resized\t%s\t%s\t\n", signedBytes(e.Size-*e.OldSize), e.Path)
+    }
+    for _, e := range diff.Moved {
+        fmt.Fprintf(w, "moved\t%s\t%s -> %s\t\n", entrySize(e), e.OldPath, e.Path)
+    }
+    w.Flush()
+    if s.Added > int64(len(diff.Added)) || s.Removed > int64(len(diff.Removed)) ||
+        s.Resized > int64(len(diff.Resized)) || s.Moved > int64(len(diff.Moved)) {
+        fmt.Printf("\nShowing up to %d of each kind of change; raise -limit for more\n", query.limit)
+    }
+}
+
+func entrySize(e database.ScanDiffEntry) string {
+    if e.IsFolder {
+        return "-"
+    }
+    return database.FormatBytes(e.Size)
+}
+
+// signedBytes formats a change in size with its sign.
+func signedBytes(delta int64) string {
+    if delta < 0 {
+        return "-" + database.FormatBytes(-delta)
+    }
+    return "+" + database.FormatBytes(delta)
+}
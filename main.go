@@ -1,132 +1,1142 @@
 package main
 
 import (
+    "context"
     "encoding/json"
+    "errors"
     "flag"
+    "fmt"
     "log"
+    "net/http"
+    "net/http/pprof"
     "os"
+    "os/signal"
+    "path/filepath"
+    "strings"
     "sync"
+    "syscall"
+    "text/tabwriter"
+    "time"
 
     "teamdrive-scanner/database"
+    "teamdrive-scanner/notify"
     "teamdrive-scanner/scanner"
     "teamdrive-scanner/web"
+
+    "github.com/BurntSushi/toml"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "gopkg.in/yaml.v3"
+
+    // Budget time zones must resolve on systems without zoneinfo
+    _ "time/tzdata"
 )
 
+// TeamDrive is a scan target. Type is teamdrive (default), mydrive,
+// folder, s3, local or rclone; see the scanner.Target* constants.
 type TeamDrive struct {
     ID   string `json:"id"`
     Name string `json:"name"`
+    Type string `json:"type"`
+
+    // Bucket of an s3 target
+    S3 scanner.S3Config `json:"s3"`
+    // Directory or mount point of a local target
+    Path string `json:"path"`
+    // remote:path of an rclone target, and extra flags for rclone lsjson
+    Remote      string   `json:"remote"`
+    RcloneFlags []string `json:"rclone_flags"`
+
+    // Optional overrides of the scanner section for this drive
+    WorkersPerAccount int      `json:"workers_per_account"`
+    PageSize          int64    `json:"page_size"`
+    Rate              float64  `json:"rate"`
+    Include           []string `json:"include"`
+    Exclude           []string `json:"exclude"`
 }
 
 type Config struct {
     ServiceAccountsDir string      `json:"service_accounts_dir"`
     TeamDrives         []TeamDrive `json:"teamdrives"`
+    Auth               struct {
+        Mode            string `json:"mode"`
+        OAuthClientFile string `json:"oauth_client_file"`
+        OAuthTokenFile  string `json:"oauth_token_file"`
+        // WriteAccess loads the credentials with full Drive access instead
+        // of read-only, for copy jobs and renaming and moving through the API
+        WriteAccess bool `json:"write_access"`
+    } `json:"auth"`
     Scanner            struct {
         WorkersPerAccount    int `json:"workers_per_account"`
         RatePerAccount       int `json:"rate_per_account"`
         PageSize             int64 `json:"page_size"`
         BatchInsertSize      int `json:"batch_insert_size"`
         ConcurrentTeamDrives int `json:"concurrent_teamdrives"`
+        ResolveShortcuts     bool `json:"resolve_shortcuts"`
+        MetricsAddr          string `json:"metrics_addr"`
+        Schedule             string `json:"schedule"`
+        Include              []string `json:"include"`
+        Exclude              []string `json:"exclude"`
+        MimeTypes            []string `json:"mime_types"`
+        Extensions           []string `json:"extensions"`
+        SkipGoogleNative     bool     `json:"skip_google_native"`
+        MinFileSize          int64    `json:"min_file_size"`
+        MaxFileSize          int64    `json:"max_file_size"`
+        ScanOnStart          bool   `json:"scan_on_start"`
+        DeferIndexing        bool   `json:"defer_indexing"`
+        RclonePath           string `json:"rclone_path"`
+        // MemoryLimitMB holds workers back while the process's RSS is
+        // above it; zero disables the watchdog
+        MemoryLimitMB int64 `json:"memory_limit_mb"`
+        // DailyBudgetPerAccount caps each account's API calls per day,
+        // counted from midnight in BudgetTimezone; zero is unlimited
+        DailyBudgetPerAccount int64  `json:"daily_budget_per_account"`
+        BudgetTimezone        string `json:"budget_timezone"`
+        // TrackRevisions counts the revisions of the files matching
+        // RevisionMimeTypes and RevisionExtensions, or of every file when
+        // both are empty, at one API call per file
+        TrackRevisions     bool     `json:"track_revisions"`
+        RevisionMimeTypes  []string `json:"revision_mime_types"`
+        RevisionExtensions []string `json:"revision_extensions"`
+        // IndexContent extracts the text of the documents of Drive targets
+        // after each scan, for searches with mode=content: files of
+        // ContentMimeTypes (Docs, Sheets, Slides, PDFs and text files when
+        // empty) of at most ContentMaxSize bytes, at one download each
+        IndexContent     bool     `json:"index_content"`
+        ContentMimeTypes []string `json:"content_mime_types"`
+        ContentMaxSize   int64    `json:"content_max_size"`
+        // ScanPermissions lists who has access to "folders" or to "all"
+        // items, at one API call each; empty skips permissions
+        ScanPermissions string `json:"scan_permissions"`
+        // Labels are the Drive labels to index, name -> label ID; files
+        // are searched by them as label:name or label:name.field=value
+        Labels map[string]string `json:"labels"`
+        // IncludeTrash also indexes trashed items, which are kept out of
+        // browsing, searches and stats but reported under /api/trash
+        IncludeTrash bool `json:"include_trash"`
+        // KeepScans keeps the manifests of this many full scans per drive,
+        // for diffing with -mode diff or /api/scans; zero keeps none. Files
+        // a recorded scan no longer finds are marked deleted
+        KeepScans int `json:"keep_scans"`
+        // StagingDir has each drive's scan write to a temporary SQLite
+        // database in this directory, merged into the index when the scan
+        // ends, so concurrent scans do not queue on its writer; empty
+        // writes to the index directly
+        StagingDir string `json:"staging_dir"`
     } `json:"scanner"`
     Database struct {
+        Driver      string `json:"driver"`
         Path        string `json:"path"`
+        DSN         string `json:"dsn"`
         CacheSizeMB int    `json:"cache_size_mb"`
+        ReadOnly    bool   `json:"read_only"`
+        // InstanceID keeps this instance's tables apart from other
+        // organizations' in a shared PostgreSQL database; API keys with
+        // another web.api_keys instance read that instance's data
+        InstanceID string `json:"instance_id"`
+        // Writer queue and SQLITE_BUSY retries; zero keeps the defaults
+        WriteQueueSize int `json:"write_queue_size"`
+        BusyRetries    int `json:"busy_retries"`
+        BusyRetryMs    int `json:"busy_retry_ms"`
+        // Cache of search and stats results; zero keeps the defaults and a
+        // negative size disables it
+        ResultCacheSize       int `json:"result_cache_size"`
+        ResultCacheTTLSeconds int `json:"result_cache_ttl_seconds"`
+        // Assumed export size in bytes of Google-native files by kind
+        // ("document", "spreadsheet", ...), for estimated totals in stats
+        NativeSizeEstimates map[string]int64 `json:"native_size_estimates"`
+        // ChangeFeed logs the files each scan creates, modifies and trashes
+        // for /api/changes; maintenance drops entries older than
+        // ChangeRetentionDays, or none when zero
+        ChangeFeed          bool `json:"change_feed"`
+        ChangeRetentionDays int  `json:"change_retention_days"`
+        // DeletedRetentionDays keeps the files marked deleted for
+        // /api/deleted this long before maintenance purges them; zero
+        // keeps them all
+        DeletedRetentionDays int `json:"deleted_retention_days"`
+        // CheckpointIntervalSeconds runs a PASSIVE WAL checkpoint this
+        // often while scanning, so the SQLite log stays small; zero leaves
+        // it to SQLite
+        CheckpointIntervalSeconds int `json:"checkpoint_interval_seconds"`
+        // ShardDir stores each drive's files in a SQLite database of its
+        // own in this directory, next to the catalog at Path; empty keeps
+        // one database
+        ShardDir string `json:"shard_dir"`
     } `json:"database"`
     Web struct {
-        Port int    `json:"port"`
-        Host string `json:"host"`
+        Port    int          `json:"port"`
+        Host    string       `json:"host"`
+        APIKeys []web.APIKey `json:"api_keys"`
+        RateLimit struct {
+            RequestsPerMinute float64 `json:"requests_per_minute"`
+            Burst             int     `json:"burst"`
+        } `json:"rate_limit"`
+        TLS struct {
+            Cert             string   `json:"cert"`
+            Key              string   `json:"key"`
+            AutocertDomains  []string `json:"autocert_domains"`
+            AutocertCacheDir string   `json:"autocert_cache_dir"`
+            AutocertEmail    string   `json:"autocert_email"`
+        } `json:"tls"`
+        QueryTimeoutSeconds int `json:"query_timeout_seconds"`
+        // InternalDomains are the organization's own email domains; the
+        // external access report lists grants to any other
+        InternalDomains []string `json:"internal_domains"`
+        // ThumbnailCacheMB is the memory kept for thumbnails served by
+        // /api/thumbnail; 0 uses the default, -1 disables the cache
+        ThumbnailCacheMB int `json:"thumbnail_cache_mb"`
+        // ZipMaxMB caps the files of one /api/zip archive; 0 uses the
+        // default, -1 disables the endpoint
+        ZipMaxMB int `json:"zip_max_mb"`
     } `json:"web"`
+    // Downloads enables download jobs in daemon mode, which mirror the
+    // files of a search to a directory under Dir; Concurrency and
+    // Bandwidth (bytes a second, zero for no limit) are the defaults of
+    // jobs that set none
+    Downloads struct {
+        Dir         string `json:"dir"`
+        Concurrency int    `json:"concurrency"`
+        Bandwidth   int64  `json:"bandwidth"`
+    } `json:"downloads"`
+    Notify notify.Config `json:"notify"`
+
+    notifier *notify.Notifier
 }
 
 func main() {
-    configPath := flag.String("config", "config.json", "Path to config file")
-    mode := flag.String("mode", "web", "Mode: scan or web")
+    configPath := flag.String("config", "config.json", "Path to config file (.json, .yaml or .toml)")
+    mode := flag.String("mode", "web", "Mode: scan, web, daemon, dump, export, import, maintain, stats, query, diff, verify or strm")
+    discover := flag.Bool("discover", false, "Discover all shared drives visible to the service accounts before running")
+    output := flag.String("output", "-", "Dump mode: NDJSON output file, - for stdout; strm mode: directory for .strm files, or an .m3u playlist")
+    snapshot := flag.String("snapshot", "index.jsonl.gz", "Export/import mode: snapshot file, - for stdout/stdin")
+    flag.Var(&configOverrides, "set", "Override a config value, e.g. -set web.port=9090 (repeatable; "+
+        "takes precedence over TDS_* environment variables such as TDS_WEB_PORT, which override the config file)")
+    pprofAddr := flag.String("pprof", "", "Serve /debug/pprof on this address (e.g. localhost:6060) for profiling")
+    dryRun := flag.Bool("dry-run", false, "Scan mode: traverse the targets and report counts, sizes and timings without writing to the database")
+    var query queryFlags
+    flag.StringVar(&query.query, "q", "", "Query mode: search terms, as typed in the web UI")
+    flag.StringVar(&query.teamDrive, "teamdrive", "", "Query and strm modes: limit results to this drive ID or configured name (strm: comma-separated list); diff and verify modes: the drive to compare")
+    flag.StringVar(&query.format, "format", "table", "Query mode: output format, table, json or csv; diff and verify modes: table or json")
+    flag.IntVar(&query.limit, "limit", 50, "Query mode: maximum number of results; diff mode: maximum files listed per kind of change; verify mode: maximum problems listed")
+    var diff diffFlags
+    flag.Int64Var(&diff.from, "from", 0, "Diff mode: ID of the earlier scan; zero for the one before -to")
+    flag.Int64Var(&diff.to, "to", 0, "Diff mode: ID of the later scan; zero for the latest")
+    manifest := flag.String("manifest", "", "Verify mode: backup manifest to check, CSV (.csv) with path, size and md5 columns, or JSON")
+    manifestRoot := flag.String("root", "", "Verify mode: folder path of the drive the manifest paths are relative to, e.g. /Backups")
+    strmURL := flag.String("strm-url", defaultStrmURL, "Strm mode: URL written for each video, with {id} replaced by its Drive file ID")
+    validate := flag.Bool("validate-config", false, "Check the config for missing fields, out-of-range values and missing directories, then exit")
     flag.Parse()
 
     config, err := loadConfig(*configPath)
+    if *validate && err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
     if err != nil {
         log.Fatalf("Failed to load config: %v", err)
     }
 
-    db, err := database.InitDatabase(config.Database.Path, config.Database.CacheSizeMB)
+    if *validate {
+        problems := checkEnvironment(config)
+        for _, problem := range problems {
+            fmt.Fprintln(os.Stderr, problem)
+        }
+        if len(problems) > 0 {
+            os.Exit(1)
+        }
+        fmt.Printf("%s is valid: %d scan targets\n", *configPath, len(config.TeamDrives))
+        return
+    }
+
+    if *pprofAddr != "" {
+        go servePprof(*pprofAddr)
+    }
+    if config.Scanner.MemoryLimitMB > 0 {
+        go scanner.WatchMemory(context.Background(), config.Scanner.MemoryLimitMB<<20)
+    }
+
+    if *dryRun {
+        if *mode != "scan" {
+            log.Fatalf("-dry-run only applies to -mode scan")
+        }
+        runDryRun(config)
+        return
+    }
+
+    // dump never touches the database
+    if *mode == "dump" {
+        runDump(config, *output)
+        return
+    }
+
+    // read_only only applies to the web server and reads; scans always
+    // need to write
+    readOnly := config.Database.ReadOnly && (*mode == "web" || *mode == "export" || *mode == "stats" || *mode == "query" || *mode == "diff" || *mode == "verify" || *mode == "strm")
+    db, err := openDatabase(config, readOnly)
     if err != nil {
         log.Fatalf("Failed to initialize database: %v", err)
     }
     defer db.Close()
 
+    switch *mode {
+    case "export":
+        runExport(db, *snapshot)
+        return
+    case "import":
+        runImport(config, db, *snapshot)
+        return
+    case "maintain":
+        runMaintain(db)
+        return
+    }
+
+    if *discover {
+        runDiscover(config, db)
+    }
+    loadDiscoveredTeamDrives(config, db)
+
     switch *mode {
     case "scan":
         runScan(config, db)
     case "web":
-        runWeb(config, db)
+        runWeb(config, db, *configPath)
+    case "daemon":
+        runDaemon(config, db, *configPath)
+    case "stats":
+        runStats(config, db)
+    case "query":
+        runQuery(config, db, query)
+    case "diff":
+        runDiff(config, db, query, diff)
+    case "verify":
+        runVerify(config, db, query, *manifest, *manifestRoot)
+    case "strm":
+        runStrm(config, db, *output, query.teamDrive, *strmURL)
     default:
-        log.Fatalf("Invalid mode: %s. Use 'scan' or 'web'", *mode)
+        log.Fatalf("Invalid mode: %s. Use 'scan', 'web', 'daemon', 'dump', 'export', 'import', 'maintain', 'stats', 'query', 'diff', 'verify' or 'strm'", *mode)
+    }
+}
+
+// servePprof serves the runtime profiles on their own listener, kept off
+// the web server so they are never exposed with it.
+func servePprof(addr string) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/debug/pprof/", pprof.Index)
+    mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+    mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+    mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+    mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+    log.Printf("Serving profiles on http://%s/debug/pprof/", addr)
+    if err := http.ListenAndServe(addr, mux); err != nil {
+        log.Printf("Profiling server error: %v", err)
     }
 }
 
+// loadConfig reads the config file and applies the environment and -set
+// overrides. Without any overrides the file must exist; with them it is
+// optional, so containers can be configured from the environment alone.
 func loadConfig(path string) (*Config, error) {
+    var config Config
+
     data, err := os.ReadFile(path)
-    if err != nil {
+    switch {
+    case err == nil:
+        if err := decodeConfig(path, data, &config); err != nil {
+            return nil, fmt.Errorf("%s: %w", path, err)
+        }
+    case !os.IsNotExist(err) || len(configOverrides) == 0 && !hasEnvOverrides():
         return nil, err
     }
 
-    var config Config
-    if err := json.Unmarshal(data, &config); err != nil {
+    if err := applyOverrides(&config, os.Environ(), configOverrides); err != nil {
+        return nil, err
+    }
+
+    applyDefaults(&config)
+    if problems := validateConfig(&config); len(problems) > 0 {
+        return nil, fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+    }
+
+    config.notifier, err = notify.New(config.Notify)
+    if err != nil {
         return nil, err
     }
 
     return &config, nil
 }
 
+// decodeConfig parses a JSON, YAML or TOML config, chosen by the file's
+// extension. YAML and TOML are converted to JSON first, so every format
+// uses the json field names.
+func decodeConfig(path string, data []byte, config *Config) error {
+    var tree interface{}
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".yaml", ".yml":
+        if err := yaml.Unmarshal(data, &tree); err != nil {
+            return err
+        }
+    case ".toml":
+        var table map[string]interface{}
+        if _, err := toml.Decode(string(data), &table); err != nil {
+            return err
+        }
+        tree = table
+    default:
+        return json.Unmarshal(data, config)
+    }
+
+    data, err := json.Marshal(tree)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, config)
+}
+
+// initPool loads the credentials selected by auth.mode: the service account
+// directory (default) or a single OAuth user.
+func initPool(config *Config) (*scanner.ServiceAccountPool, error) {
+    var pool *scanner.ServiceAccountPool
+    var err error
+    switch config.Auth.Mode {
+    case "", "service_accounts":
+        pool, err = scanner.InitServiceAccountPool(config.ServiceAccountsDir, config.Scanner.RatePerAccount, config.Auth.WriteAccess)
+    case "oauth":
+        pool, err = scanner.InitUserPool(config.Auth.OAuthClientFile, config.Auth.OAuthTokenFile, config.Scanner.RatePerAccount,
+            config.Auth.WriteAccess)
+    default:
+        return nil, fmt.Errorf("unknown auth mode: %s (use service_accounts or oauth)", config.Auth.Mode)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    setBudget(config, pool)
+    return pool, nil
+}
+
+// setBudget applies the daily API call budget to pool.
+func setBudget(config *Config, pool *scanner.ServiceAccountPool) {
+    location, err := time.LoadLocation(config.Scanner.BudgetTimezone)
+    if err != nil {
+        location = time.UTC
+    }
+    pool.SetBudget(config.Scanner.DailyBudgetPerAccount, location)
+}
+
+// runDiscover lists the shared drives visible to the service accounts and
+// stores them, so later runs pick them up without editing config.json.
+func runDiscover(config *Config, db *database.Database) {
+    pool, err := initPool(config)
+    if err != nil {
+        log.Fatalf("Failed to initialize service account pool: %v", err)
+    }
+
+    drives, err := scanner.DiscoverTeamDrives(context.Background(), pool)
+    if err != nil {
+        log.Fatalf("Team Drive discovery failed: %v", err)
+    }
+    if err := db.SaveTeamDrives(drives); err != nil {
+        log.Fatalf("Failed to save discovered Team Drives: %v", err)
+    }
+
+    log.Printf("Discovered %d Team Drives", len(drives))
+}
+
+// loadDiscoveredTeamDrives appends previously discovered drives that are not
+// in config.json to the configured list.
+func loadDiscoveredTeamDrives(config *Config, db *database.Database) {
+    discovered, err := db.GetTeamDrives(context.Background())
+    if err != nil {
+        log.Printf("Failed to load discovered Team Drives: %v", err)
+        return
+    }
+
+    for _, drive := range database.MergeTeamDrives(teamDriveList(config), discovered)[len(config.TeamDrives):] {
+        config.TeamDrives = append(config.TeamDrives, TeamDrive{ID: drive.ID, Name: drive.Name})
+    }
+}
+
+// teamDriveList converts the configured drives for the database and web
+// packages.
+func teamDriveList(config *Config) []database.TeamDrive {
+    drives := make([]database.TeamDrive, 0, len(config.TeamDrives))
+    for _, td := range config.TeamDrives {
+        drives = append(drives, database.TeamDrive{ID: td.ID, Name: td.Name})
+    }
+    return drives
+}
+
+// lazyPool returns the service account pool for the web server's calls to
+// Drive, loading it on first use.
+func lazyPool(config *Config) func() (*scanner.ServiceAccountPool, error) {
+    var once sync.Once
+    var pool *scanner.ServiceAccountPool
+    var poolErr error
+
+    return func() (*scanner.ServiceAccountPool, error) {
+        once.Do(func() {
+            pool, poolErr = initPool(config)
+        })
+        return pool, poolErr
+    }
+}
+
+func openDatabase(config *Config, readOnly bool) (*database.Database, error) {
+    var db *database.Database
+    var err error
+
+    switch config.Database.Driver {
+    case "", "sqlite":
+        if readOnly {
+            db, err = database.OpenReadOnly(config.Database.Path, config.Database.CacheSizeMB)
+        } else {
+            db, err = database.InitDatabase(config.Database.Path, config.Database.CacheSizeMB)
+        }
+    case "postgres":
+        db, err = database.InitPostgres(config.Database.DSN, config.Database.InstanceID)
+    default:
+        return nil, fmt.Errorf("unknown database driver: %s (use sqlite or postgres)", config.Database.Driver)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    db.SetWriteOptions(database.WriteOptions{
+        QueueSize:   config.Database.WriteQueueSize,
+        BusyRetries: config.Database.BusyRetries,
+        BusyBackoff: time.Duration(config.Database.BusyRetryMs) * time.Millisecond,
+    })
+    db.SetResultCache(database.ResultCacheOptions{
+        Size: config.Database.ResultCacheSize,
+        TTL:  time.Duration(config.Database.ResultCacheTTLSeconds) * time.Second,
+    })
+    db.SetNativeSizeEstimates(config.Database.NativeSizeEstimates)
+    db.SetChangeFeed(config.Database.ChangeFeed, time.Duration(config.Database.ChangeRetentionDays)*24*time.Hour)
+    db.SetDeletedRetention(time.Duration(config.Database.DeletedRetentionDays) * 24 * time.Hour)
+    if config.Database.ShardDir != "" {
+        if err := db.EnableSharding(config.Database.ShardDir, config.Database.CacheSizeMB); err != nil {
+            db.Close()
+            return nil, err
+        }
+    }
+    return db, nil
+}
+
 func runScan(config *Config, db *database.Database) {
     log.Println("=== Starting Multi-TeamDrive Scan ===")
-    log.Printf("Service Accounts: %s", config.ServiceAccountsDir)
+    if config.Auth.Mode == "oauth" {
+        log.Printf("Auth: OAuth user token %s", config.Auth.OAuthTokenFile)
+    } else {
+        log.Printf("Service Accounts: %s", config.ServiceAccountsDir)
+    }
     log.Printf("Team Drives: %d", len(config.TeamDrives))
     log.Printf("Concurrent Team Drives: %d", config.Scanner.ConcurrentTeamDrives)
 
-    pool, err := scanner.InitServiceAccountPool(config.ServiceAccountsDir, config.Scanner.RatePerAccount)
+    pool, err := initPool(config)
     if err != nil {
         log.Fatalf("Failed to initialize service account pool: %v", err)
     }
     log.Printf("Loaded %d service accounts", pool.Count())
 
+    if config.Scanner.MetricsAddr != "" {
+        go func() {
+            log.Printf("Serving scan metrics on http://%s/metrics", config.Scanner.MetricsAddr)
+            mux := http.NewServeMux()
+            mux.Handle("/metrics", promhttp.Handler())
+            if err := http.ListenAndServe(config.Scanner.MetricsAddr, mux); err != nil {
+                log.Printf("Metrics server error: %v", err)
+            }
+        }()
+    }
+
+    monitorCtx, stopMonitor := context.WithCancel(context.Background())
+    monitorDone := make(chan struct{})
+    go func() {
+        defer close(monitorDone)
+        pool.MonitorHealth(monitorCtx, db)
+    }()
+    go pool.WatchAccounts(monitorCtx)
+
+    // Ctrl-C stops the scans cleanly, keeping what they found and queueing
+    // the rest for the next scan; a second Ctrl-C quits at once
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    go func() {
+        <-ctx.Done()
+        stop()
+        log.Println("Interrupted, saving progress (Ctrl-C again to quit immediately)")
+    }()
+
+    handlePauseSignals()
+
+    stopCheckpoints := db.StartCheckpointer(time.Duration(config.Database.CheckpointIntervalSeconds) * time.Second)
+    start := time.Now()
+    withDeferredIndexing(config, db, func() {
+        scanTeamDrives(ctx, config, db, pool)
+        scanRescanQueue(ctx, config, db, pool, start)
+    })
+
+    stopCheckpoints()
+    stopMonitor()
+    <-monitorDone
+    log.Println("=== All Scans Complete ===")
+}
+
+// scanTeamDrives scans every configured Team Drive, running up to
+// concurrent_teamdrives scans at once, and returns when all are done or
+// ctx is canceled.
+func scanTeamDrives(ctx context.Context, config *Config, sink scanner.RecordSink, pool *scanner.ServiceAccountPool) {
     var wg sync.WaitGroup
     semaphore := make(chan struct{}, config.Scanner.ConcurrentTeamDrives)
 
     for _, td := range config.TeamDrives {
-        wg.Add(1)
         semaphore <- struct{}{}
+        if ctx.Err() != nil {
+            break
+        }
+        wg.Add(1)
 
         go func(td TeamDrive) {
             defer wg.Done()
             defer func() { <-semaphore }()
 
             log.Printf("Starting scan: %s", td.Name)
+            start := time.Now()
 
-            scanConfig := scanner.ScanConfig{
-                TeamDriveID:       td.ID,
-                TeamDriveName:     td.Name,
-                WorkersPerAccount: config.Scanner.WorkersPerAccount,
-                PageSize:          config.Scanner.PageSize,
-                BatchInsertSize:   config.Scanner.BatchInsertSize,
+            scanConfig, err := scanConfigFor(config, td)
+            if db, ok := sink.(*database.Database); ok && err == nil {
+                scanConfig.ExpectedItems = expectedItems(db, td.ID)
             }
 
-            if err := scanner.ScanTeamDrive(scanConfig, db, pool); err != nil {
+            // The manifest of a full scan is kept for diffing
+            target := sink
+            var manifest *database.ScanManifest
+            if db, ok := sink.(*database.Database); ok && err == nil && config.Scanner.KeepScans > 0 {
+                if manifest, err = db.StartScan(td.ID); err == nil {
+                    target = manifest
+                }
+            }
+            // Staged records are merged even if the scan fails, as they
+            // would have been written directly
+            var staging *database.Staging
+            if db, ok := sink.(*database.Database); ok && err == nil && config.Scanner.StagingDir != "" {
+                if staging, err = db.StartStaging(config.Scanner.StagingDir, td.ID, manifest); err == nil {
+                    target = staging
+                }
+            }
+            if err == nil {
+                err = providerFor(config, td, scanConfig, pool).Scan(ctx, target)
+            }
+            if staging != nil {
+                if mergeErr := staging.Merge(); mergeErr != nil && err == nil {
+                    err = fmt.Errorf("merging staged records: %w", mergeErr)
+                }
+            }
+            if manifest != nil {
+                if err := manifest.Finish(err, config.Scanner.KeepScans); err != nil {
+                    log.Printf("Failed to record scan %d of %s: %v", manifest.ID(), td.Name, err)
+                }
+            }
+            var interrupted *scanner.InterruptedError
+            if db, ok := sink.(*database.Database); ok && errors.As(err, &interrupted) {
+                saveCheckpoint(db, td, interrupted.Folders)
+            }
+            if err != nil {
                 log.Printf("Error scanning %s: %v", td.Name, err)
-            } else {
-                log.Printf("Completed scan: %s", td.Name)
+                notifyScan(config, sink, td, start, err)
+                return
+            }
+            log.Printf("Completed scan: %s", td.Name)
+
+            if db, ok := sink.(*database.Database); ok {
+                if err := db.RecordStatsHistory(scanConfig.TeamDriveID); err != nil {
+                    log.Printf("Failed to record stats history for %s: %v", td.Name, err)
+                }
+            }
+            notifyScan(config, sink, td, start, nil)
+
+            if db, ok := sink.(*database.Database); ok && scanConfig.Content != nil {
+                if err := scanner.IndexContent(ctx, scanConfig, db, pool); err != nil {
+                    log.Printf("Failed to index the text of %s: %v", td.Name, err)
+                }
             }
         }(td)
     }
 
     wg.Wait()
-    log.Println("=== All Scans Complete ===")
 }
 
-func runWeb(config *Config, db *database.Database) {
+// saveCheckpoint queues the folders an interrupted scan did not finish,
+// so the next scan completes them.
+func saveCheckpoint(db *database.Database, td TeamDrive, folders []scanner.UnfinishedFolder) {
+    parents := make([]database.MissingParent, len(folders))
+    for i, folder := range folders {
+        parents[i] = database.MissingParent{
+            ID:            folder.ID,
+            TeamDriveID:   td.ID,
+            TeamDriveName: td.Name,
+            Path:          folder.Path,
+        }
+    }
+
+    if err := db.QueueRescan(context.Background(), parents); err != nil {
+        log.Printf("Failed to save the unfinished folders of %s: %v", td.Name, err)
+        return
+    }
+    log.Printf("Scan of %s canceled: %d unfinished folders queued for the next scan", td.Name, len(folders))
+}
+
+// expectedItems returns the number of records the last scan of a drive
+// left in the index, zero if it has not been scanned.
+func expectedItems(db *database.Database, teamDriveID string) int64 {
+    stats, err := db.GetTeamDriveStats(context.Background(), teamDriveID)
+    if err != nil {
+        return 0
+    }
+    return stats.TotalFiles + stats.TotalFolders
+}
+
+// notifyScan reports the end of a scan of td to the configured webhooks,
+// with the drive's totals when the scan went to the database.
+func notifyScan(config *Config, sink scanner.RecordSink, td TeamDrive, start time.Time, scanErr error) {
+    event := notify.Event{
+        Event:         notify.ScanCompleted,
+        TeamDriveID:   td.ID,
+        TeamDriveName: td.Name,
+        StartedAt:     start,
+        FinishedAt:    time.Now(),
+    }
+    event.DurationSeconds = event.FinishedAt.Sub(start).Seconds()
+    if scanErr != nil {
+        event.Event = notify.ScanFailed
+        event.Error = scanErr.Error()
+    }
+
+    if db, ok := sink.(*database.Database); ok {
+        stats, err := db.GetTeamDriveStats(context.Background(), td.ID)
+        if err != nil {
+            log.Printf("Failed to read stats of %s for notifications: %v", td.Name, err)
+        } else {
+            event.Files = stats.TotalFiles
+            event.Folders = stats.TotalFolders
+            event.Size = stats.TotalSize
+            event.SizeHuman = stats.TotalSizeHuman
+        }
+    }
+
+    config.notifier.Notify(event)
+}
+
+// providerFor returns the provider that scans a target of td's type.
+func providerFor(config *Config, td TeamDrive, scanConfig scanner.ScanConfig, pool *scanner.ServiceAccountPool) scanner.SourceProvider {
+    switch td.Type {
+    case scanner.TargetS3:
+        return &scanner.S3Provider{Target: scanConfig, Bucket: td.S3}
+    case scanner.TargetLocal:
+        return &scanner.LocalProvider{Target: scanConfig, Root: td.Path}
+    case scanner.TargetRclone:
+        return &scanner.RcloneProvider{
+            Target: scanConfig,
+            Remote: td.Remote,
+            Binary: config.Scanner.RclonePath,
+            Flags:  td.RcloneFlags,
+        }
+    default:
+        return &scanner.DriveProvider{Target: scanConfig, Pool: pool}
+    }
+}
+
+// withDeferredIndexing runs scan with full-text indexing deferred to a
+// single rebuild at the end, when scanner.defer_indexing is set.
+func withDeferredIndexing(config *Config, db *database.Database, scan func()) {
+    if !config.Scanner.DeferIndexing {
+        scan()
+        return
+    }
+
+    if err := db.DeferIndexing(); err != nil {
+        log.Printf("Failed to defer indexing, indexing during the scan: %v", err)
+    }
+    scan()
+    if err := db.RebuildIndexes(); err != nil {
+        log.Printf("Full-text index rebuild failed: %v", err)
+    }
+}
+
+// scanRescanQueue rescans the folders queued through /api/orphans/requeue,
+// using the settings of the drive they belong to. Each folder is attempted
+// once; failures are logged and can be requeued.
+func scanRescanQueue(ctx context.Context, config *Config, db *database.Database, pool *scanner.ServiceAccountPool, since time.Time) {
+    queue, err := db.GetRescanQueue(context.Background())
+    if err != nil {
+        log.Printf("Failed to read rescan queue: %v", err)
+        return
+    }
+
+    for _, req := range queue {
+        if ctx.Err() != nil {
+            return
+        }
+        // Folders queued during this run, such as those of a scan canceled
+        // a moment ago, wait for the next one
+        if queuedAt, err := time.Parse(time.RFC3339, req.QueuedAt); err == nil && !queuedAt.Before(since.Truncate(time.Second)) {
+            continue
+        }
+
+        td := TeamDrive{ID: req.TeamDriveID, Name: req.TeamDriveName}
+        for _, configured := range config.TeamDrives {
+            if configured.ID == req.TeamDriveID {
+                td = configured
+                break
+            }
+        }
+
+        log.Printf("Rescanning %s%s (%s)", td.Name, req.Path, req.FolderID)
+
+        scanConfig, err := scanConfigFor(config, td)
+        if err == nil {
+            scanConfig.RootID = req.FolderID
+            scanConfig.RootPath = req.Path
+            err = (&scanner.DriveProvider{Target: scanConfig, Pool: pool}).Scan(ctx, db)
+        }
+        // An interrupted rescan stays queued
+        if errors.As(err, new(*scanner.InterruptedError)) {
+            return
+        }
+        if err != nil {
+            log.Printf("Error rescanning %s: %v", req.FolderID, err)
+        }
+
+        if err := db.RemoveRescan(req.FolderID); err != nil {
+            log.Printf("Failed to dequeue %s: %v", req.FolderID, err)
+        }
+    }
+}
+
+// runDump scans every configured drive and streams the records as NDJSON
+// to output instead of writing them to the database.
+func runDump(config *Config, output string) {
+    out := os.Stdout
+    if output != "-" {
+        file, err := os.Create(output)
+        if err != nil {
+            log.Fatalf("Failed to create output file: %v", err)
+        }
+        defer file.Close()
+        out = file
+    }
+
+    pool, err := initPool(config)
+    if err != nil {
+        log.Fatalf("Failed to initialize service account pool: %v", err)
+    }
+    log.Printf("Loaded %d service accounts", pool.Count())
+
+    scanTeamDrives(context.Background(), config, scanner.NewNDJSONSink(out), pool)
+    log.Println("=== Dump Complete ===")
+}
+
+// runDryRun traverses every target without touching the database and
+// prints what a scan would index, how long the traversal took and roughly
+// how many list calls it costs.
+func runDryRun(config *Config) {
+    log.Println("=== Starting Dry Run (nothing is written) ===")
+
+    // Only Drive targets need accounts
+    var pool *scanner.ServiceAccountPool
+    for _, td := range config.TeamDrives {
+        if !isDriveTarget(td.Type) {
+            continue
+        }
+        var err error
+        if pool, err = initPool(config); err != nil {
+            log.Fatalf("Failed to initialize service account pool: %v", err)
+        }
+        log.Printf("Loaded %d service accounts", pool.Count())
+        break
+    }
+
+    // A dry run is not a scan as far as anyone listening is concerned
+    config.notifier = nil
+
+    sink := scanner.NewCountingSink()
+    start := time.Now()
+    scanTeamDrives(context.Background(), config, sink, pool)
+    elapsed := time.Since(start)
+
+    targets := make(map[string]TeamDrive)
+    for _, td := range config.TeamDrives {
+        targets[td.ID] = td
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "TARGET\tFOLDERS\tFILES\tSIZE\tTRAVERSAL\tLIST CALLS\t")
+    var folders, files, size, calls int64
+    for _, count := range sink.Counts() {
+        estimate := "-"
+        td := targets[count.TeamDriveID]
+        if scanConfig, err := scanConfigFor(config, td); err == nil && isDriveTarget(td.Type) {
+            // One call per folder plus one per further page of entries
+            n := count.Folders + (count.Files+count.Folders)/scanConfig.PageSize
+            estimate = fmt.Sprint(n)
+            calls += n
+        }
+        fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%v\t%s\t\n", count.TeamDriveName, count.Folders, count.Files,
+            database.FormatBytes(count.Size), count.Last.Sub(count.First).Round(time.Second), estimate)
+        folders += count.Folders
+        files += count.Files
+        size += count.Size
+    }
+    fmt.Fprintf(w, "TOTAL\t%d\t%d\t%s\t%v\t%d\t\n", folders, files, database.FormatBytes(size),
+        elapsed.Round(time.Second), calls)
+    w.Flush()
+
+    if elapsed > 0 {
+        fmt.Printf("\n%.0f entries/s; a real scan takes at least %v, plus the time to write %d records\n",
+            float64(folders+files)/elapsed.Seconds(), elapsed.Round(time.Second), folders+files)
+    }
+}
+
+// isDriveTarget reports whether a target type is scanned through the
+// Drive API.
+func isDriveTarget(targetType string) bool {
+    switch targetType {
+    case "", scanner.TargetTeamDrive, scanner.TargetMyDrive, scanner.TargetFolder:
+        return true
+    }
+    return false
+}
+
+// runExport writes the whole index to a gzip-compressed JSONL snapshot.
+func runExport(db *database.Database, path string) {
+    out := os.Stdout
+    if path != "-" {
+        file, err := os.Create(path)
+        if err != nil {
+            log.Fatalf("Failed to create snapshot file: %v", err)
+        }
+        defer file.Close()
+        out = file
+    }
+
+    start := time.Now()
+    count, err := db.ExportSnapshot(out)
+    if err != nil {
+        log.Fatalf("Export failed after %d records: %v", count, err)
+    }
+    log.Printf("Exported %d records in %v", count, time.Since(start).Round(time.Millisecond))
+}
+
+// runImport loads a snapshot written by runExport, or dump output, into the
+// configured database.
+func runImport(config *Config, db *database.Database, path string) {
+    in := os.Stdin
+    if path != "-" {
+        file, err := os.Open(path)
+        if err != nil {
+            log.Fatalf("Failed to open snapshot file: %v", err)
+        }
+        defer file.Close()
+        in = file
+    }
+
+    start := time.Now()
+    count, err := db.ImportSnapshot(in, config.Scanner.BatchInsertSize)
+    if err != nil {
+        log.Fatalf("Import failed after %d records: %v", count, err)
+    }
+    log.Printf("Imported %d records in %v", count, time.Since(start).Round(time.Millisecond))
+}
+
+// runMaintain checks and compacts the database. Run it while no scan is
+// writing to the same file.
+func runMaintain(db *database.Database) {
+    log.Println("=== Starting Database Maintenance ===")
+    report, err := db.Maintain()
+    if err != nil {
+        log.Fatalf("Maintenance failed: %v", err)
+    }
+    log.Printf("=== Maintenance Complete in %v: %d -> %d bytes ===",
+        report.Duration.Round(time.Millisecond), report.SizeBefore, report.SizeAfter)
+}
+
+// runStats writes the stats of every configured drive to stdout as JSON.
+func runStats(config *Config, db *database.Database) {
+    all := make([]*database.Stats, 0, len(config.TeamDrives))
+    for _, td := range config.TeamDrives {
+        stats, err := db.GetTeamDriveStats(context.Background(), td.ID)
+        if err != nil {
+            log.Fatalf("Failed to read stats of %s: %v", td.Name, err)
+        }
+        all = append(all, stats)
+    }
+
+    encoder := json.NewEncoder(os.Stdout)
+    encoder.SetIndent("", "  ")
+    if err := encoder.Encode(all); err != nil {
+        log.Fatalf("Failed to write stats: %v", err)
+    }
+}
+
+// tlsConfig maps the web.tls section onto the server's TLS settings.
+func tlsConfig(config *Config) web.TLSConfig {
+    return web.TLSConfig{
+        CertFile:         config.Web.TLS.Cert,
+        KeyFile:          config.Web.TLS.Key,
+        AutocertDomains:  config.Web.TLS.AutocertDomains,
+        AutocertCacheDir: config.Web.TLS.AutocertCacheDir,
+        AutocertEmail:    config.Web.TLS.AutocertEmail,
+    }
+}
+
+// scanConfigFor builds the scan settings for one drive, applying its
+// overrides on top of the scanner section.
+func scanConfigFor(config *Config, td TeamDrive) (scanner.ScanConfig, error) {
+    scanConfig := scanner.ScanConfig{
+        TeamDriveID:       td.ID,
+        TeamDriveName:     td.Name,
+        Type:              td.Type,
+        WorkersPerAccount: config.Scanner.WorkersPerAccount,
+        PageSize:          config.Scanner.PageSize,
+        BatchInsertSize:   config.Scanner.BatchInsertSize,
+        ResolveShortcuts:  config.Scanner.ResolveShortcuts,
+        Permissions:       config.Scanner.ScanPermissions,
+        Labels:            config.Scanner.Labels,
+        IncludeTrash:      config.Scanner.IncludeTrash,
+        RateLimit:         td.Rate,
+    }
+
+    if len(config.Scanner.MimeTypes) > 0 || len(config.Scanner.Extensions) > 0 || config.Scanner.SkipGoogleNative ||
+        config.Scanner.MinFileSize > 0 || config.Scanner.MaxFileSize > 0 {
+        scanConfig.FileFilter = &scanner.FileFilter{
+            MimeTypes:        config.Scanner.MimeTypes,
+            Extensions:       config.Scanner.Extensions,
+            SkipGoogleNative: config.Scanner.SkipGoogleNative,
+            MinSize:          config.Scanner.MinFileSize,
+            MaxSize:          config.Scanner.MaxFileSize,
+        }
+    }
+    if config.Scanner.TrackRevisions {
+        scanConfig.RevisionFilter = &scanner.FileFilter{
+            MimeTypes:  config.Scanner.RevisionMimeTypes,
+            Extensions: config.Scanner.RevisionExtensions,
+        }
+    }
+    if config.Scanner.IndexContent && isDriveTarget(td.Type) {
+        scanConfig.Content = &scanner.ContentConfig{
+            MimeTypes: config.Scanner.ContentMimeTypes,
+            MaxSize:   config.Scanner.ContentMaxSize,
+        }
+    }
+
+    if td.WorkersPerAccount > 0 {
+        scanConfig.WorkersPerAccount = td.WorkersPerAccount
+    }
+    if td.PageSize > 0 {
+        scanConfig.PageSize = td.PageSize
+    }
+
+    // Global rules apply to every drive in addition to the drive's own
+    include := append(append([]string{}, config.Scanner.Include...), td.Include...)
+    exclude := append(append([]string{}, config.Scanner.Exclude...), td.Exclude...)
+    if len(include) > 0 || len(exclude) > 0 {
+        filter, err := scanner.NewPathFilter(include, exclude)
+        if err != nil {
+            return scanConfig, err
+        }
+        scanConfig.Filter = filter
+    }
+
+    return scanConfig, nil
+}
+
+// webConfig maps the web section onto the server's options. accounts
+// gives the service account pool for drive discovery, thumbnails,
+// downloads and, with auth.write_access, moves; nil disables them.
+func webConfig(config *Config, prefork bool, accounts func() (*scanner.ServiceAccountPool, error)) web.Config {
+    var discover func() ([]database.TeamDrive, error)
+    var thumbnail func(ctx context.Context, fileID, link string) ([]byte, string, error)
+    var download func(ctx context.Context, teamDrive, fileID, byteRange string) (*http.Response, error)
+    var move func(ctx context.Context, teamDrive, fileID, name, oldParent, newParent string) error
+    if accounts != nil {
+        discover = func() ([]database.TeamDrive, error) {
+            pool, err := accounts()
+            if err != nil {
+                return nil, err
+            }
+            return scanner.DiscoverTeamDrives(context.Background(), pool)
+        }
+        thumbnail = func(ctx context.Context, fileID, link string) ([]byte, string, error) {
+            pool, err := accounts()
+            if err != nil {
+                return nil, "", err
+            }
+            return scanner.FetchThumbnail(ctx, pool, fileID, link)
+        }
+        download = func(ctx context.Context, teamDrive, fileID, byteRange string) (*http.Response, error) {
+            pool, err := accounts()
+            if err != nil {
+                return nil, err
+            }
+            return scanner.OpenDownload(ctx, pool, teamDrive, fileID, byteRange)
+        }
+    }
+    if accounts != nil && config.Auth.WriteAccess {
+        move = func(ctx context.Context, teamDrive, fileID, name, oldParent, newParent string) error {
+            pool, err := accounts()
+            if err != nil {
+                return err
+            }
+            return scanner.MoveFile(ctx, pool, teamDrive, fileID, name, oldParent, newParent)
+        }
+    }
+
+    return web.Config{
+        Prefork:            prefork,
+        Discover:           discover,
+        Thumbnail:          thumbnail,
+        Download:           download,
+        Move:               move,
+        ThumbnailCacheSize: int64(config.Web.ThumbnailCacheMB) << 20,
+        ZipMaxSize:         int64(config.Web.ZipMaxMB) << 20,
+        APIKeys:            config.Web.APIKeys,
+        RateLimit:          config.Web.RateLimit.RequestsPerMinute,
+        RateBurst:          config.Web.RateLimit.Burst,
+        TLS:                tlsConfig(config),
+        QueryTimeout:       time.Duration(config.Web.QueryTimeoutSeconds) * time.Second,
+        InternalDomains:    config.Web.InternalDomains,
+        Instance:           config.Database.InstanceID,
+        OpenInstance:       instanceOpener(config),
+    }
+}
+
+// instanceOpener opens the databases of the other instances sharing the
+// PostgreSQL backend with this instance's database settings, or is nil
+// for SQLite.
+func instanceOpener(config *Config) func(string) (*database.Database, error) {
+    if config.Database.Driver != "postgres" {
+        return nil
+    }
+    return func(instanceID string) (*database.Database, error) {
+        other := *config
+        other.Database.InstanceID = instanceID
+        return openDatabase(&other, false)
+    }
+}
+
+// runWeb serves the web interface, applying changes to config.json while
+// running. Under prefork every process watches the file itself.
+func runWeb(config *Config, db *database.Database, configPath string) {
     log.Printf("Starting web server on %s:%d", config.Web.Host, config.Web.Port)
-    log.Printf("Access at: http://localhost:%d", config.Web.Port)
 
-    server := web.NewServer(db, config.TeamDrives)
+    server := web.NewServer(db, teamDriveList(config), webConfig(config, true, lazyPool(config)))
+
+    go watchConfig(configPath, config, func(next *Config) {
+        loadDiscoveredTeamDrives(next, db)
+        server.Reload(teamDriveList(next), webConfig(next, true, nil))
+        log.Printf("Config reloaded: %d Team Drives", len(next.TeamDrives))
+    })
+
     if err := server.Start(config.Web.Host, config.Web.Port); err != nil {
         log.Fatalf("Server error: %v", err)
     }
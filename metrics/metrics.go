@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	FilesScanned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tds_files_scanned_total",
+		Help: "Files and folders discovered by the scanner.",
+	}, []string{"teamdrive"})
+
+	APICalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tds_api_calls_total",
+		Help: "Drive API calls issued by the scanner.",
+	}, []string{"teamdrive"})
+
+	APIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tds_api_errors_total",
+		Help: "Failed Drive API calls by HTTP status code.",
+	}, []string{"code"})
+
+	APIRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tds_api_retries_total",
+		Help: "Drive API calls retried, by reason: rate_limit, daily_limit, server_error or network.",
+	}, []string{"reason"})
+
+	APIRetryWait = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tds_api_retry_wait_seconds_total",
+		Help: "Time workers spent backing off before retries.",
+	})
+
+	AccountSwitches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tds_account_switches_total",
+		Help: "Folder listings moved to another service account, by reason: rate_limit or daily_limit.",
+	}, []string{"reason"})
+
+	DBInsertDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tds_db_insert_duration_seconds",
+		Help:    "Time spent writing one batch to the database.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	})
+
+	DBBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tds_db_batch_size",
+		Help:    "Records per database batch insert.",
+		Buckets: prometheus.ExponentialBuckets(10, 4, 8),
+	})
+
+	DBCheckpointDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tds_db_checkpoint_duration_seconds",
+		Help:    "Time spent in one scheduled PASSIVE WAL checkpoint.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	})
+
+	DBWALFrames = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tds_db_wal_frames",
+		Help: "Frames in the SQLite write-ahead log at the last scheduled checkpoint.",
+	})
+
+	// DBCheckpointBacklog stays high while readers hold old snapshots,
+	// which keeps the WAL from being reused.
+	DBCheckpointBacklog = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tds_db_checkpoint_backlog_frames",
+		Help: "WAL frames the last scheduled checkpoint could not copy back to the database.",
+	})
+
+	ResultCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tds_result_cache_lookups_total",
+		Help: "Search and stats lookups in the result cache, by hit or miss.",
+	}, []string{"result"})
+
+	FolderQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tds_folder_queue_depth",
+		Help: "Folders waiting to be listed.",
+	}, []string{"teamdrive"})
+
+	ResultQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tds_result_queue_depth",
+		Help: "Records waiting to be written to the database.",
+	}, []string{"teamdrive"})
+
+	ResultQueueCapacity = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tds_result_queue_capacity",
+		Help: "Records that may wait for the database before workers block.",
+	}, []string{"teamdrive"})
+
+	ResultQueueBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tds_result_queue_blocked_seconds_total",
+		Help: "Time workers spent waiting for room in the result queue.",
+	}, []string{"teamdrive"})
+
+	AccountRateLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tds_account_rate_limit",
+		Help: "Current requests/sec allowed for a service account.",
+	}, []string{"account"})
+
+	// AccountLimiterSaturation is 1 when an account's token bucket is
+	// empty and 0 when it is full.
+	AccountLimiterSaturation = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tds_account_limiter_saturation",
+		Help: "Fraction of a service account's rate limiter burst in use.",
+	}, []string{"account"})
+
+	AccountQuarantined = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tds_account_quarantined",
+		Help: "1 if the service account is quarantined.",
+	}, []string{"account"})
+
+	AccountBudgetUsed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tds_account_budget_used",
+		Help: "API calls a service account made today, counted against its daily budget.",
+	}, []string{"account"})
+
+	AccountWorkers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tds_account_workers",
+		Help: "Scan workers currently pinned to a service account.",
+	}, []string{"account"})
+
+	MemoryResident = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tds_memory_resident_bytes",
+		Help: "Resident set size sampled by the memory watchdog.",
+	})
+
+	MemoryThrottled = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tds_memory_throttled",
+		Help: "1 while workers are held back for being over the memory limit.",
+	})
+
+	ScansPaused = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tds_scans_paused",
+		Help: "1 while scans are paused.",
+	})
+)
@@ -0,0 +1,122 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Base URLs of the chat APIs
+var (
+	discordAPI  = "https://discord.com/api/v10"
+	telegramAPI = "https://api.telegram.org"
+)
+
+// DiscordConfig posts scan summaries to a Discord channel, either through
+// a bot (BotToken and ChannelID) or a channel webhook (WebhookURL).
+type DiscordConfig struct {
+	BotToken   string `json:"bot_token"`
+	ChannelID  string `json:"channel_id"`
+	WebhookURL string `json:"webhook_url"`
+	// ErrorsOnly sends failed scans only.
+	ErrorsOnly bool `json:"errors_only"`
+}
+
+// TelegramConfig posts scan summaries to a Telegram chat through a bot.
+type TelegramConfig struct {
+	BotToken   string `json:"bot_token"`
+	ChatID     string `json:"chat_id"`
+	ErrorsOnly bool   `json:"errors_only"`
+}
+
+// Summary formats an event as a one-line chat message.
+func Summary(event Event) string {
+	duration := time.Duration(event.DurationSeconds * float64(time.Second)).Round(time.Second)
+	name := event.TeamDriveName
+	if name == "" {
+		name = event.TeamDriveID
+	}
+
+	if event.Event == ScanFailed {
+		return fmt.Sprintf("❌ Scan of %s failed after %v: %s", name, duration, event.Error)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "✅ Scan of %s completed in %v", name, duration)
+	if event.Files > 0 || event.Folders > 0 {
+		fmt.Fprintf(&b, ": %d files, %d folders, %s", event.Files, event.Folders, event.SizeHuman)
+	}
+	return b.String()
+}
+
+func chatEvents(errorsOnly bool) []string {
+	if errorsOnly {
+		return []string{ScanFailed}
+	}
+	return nil
+}
+
+// jsonRequest builds a POST of payload as JSON.
+func jsonRequest(ctx context.Context, url string, payload interface{}) (*http.Request, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func discordChannel(config DiscordConfig) (channel, error) {
+	url := config.WebhookURL
+	if url == "" {
+		if config.BotToken == "" || config.ChannelID == "" {
+			return channel{}, fmt.Errorf("set webhook_url, or bot_token and channel_id")
+		}
+		url = discordAPI + "/channels/" + config.ChannelID + "/messages"
+	}
+
+	return channel{
+		name:   "Discord notification",
+		events: chatEvents(config.ErrorsOnly),
+		request: func(ctx context.Context, event Event) (*http.Request, error) {
+			req, err := jsonRequest(ctx, url, map[string]interface{}{
+				"content": Summary(event),
+				// Drive names must not ping anyone
+				"allowed_mentions": map[string]interface{}{"parse": []string{}},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if config.WebhookURL == "" {
+				req.Header.Set("Authorization", "Bot "+config.BotToken)
+			}
+			return req, nil
+		},
+	}, nil
+}
+
+func telegramChannel(config TelegramConfig) (channel, error) {
+	if config.BotToken == "" || config.ChatID == "" {
+		return channel{}, fmt.Errorf("bot_token and chat_id are required")
+	}
+	url := telegramAPI + "/bot" + config.BotToken + "/sendMessage"
+
+	return channel{
+		name:   "Telegram notification",
+		events: chatEvents(config.ErrorsOnly),
+		request: func(ctx context.Context, event Event) (*http.Request, error) {
+			return jsonRequest(ctx, url, map[string]interface{}{
+				"chat_id":                  config.ChatID,
+				"text":                     Summary(event),
+				"disable_web_page_preview": true,
+			})
+		},
+	}, nil
+}
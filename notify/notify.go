@@ -0,0 +1,235 @@
+// Package notify tells other systems about finished scans: webhooks for
+// downstream automation, and Discord and Telegram messages for people
+// running the scanner unattended.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Event types
+const (
+	ScanCompleted = "scan_completed"
+	ScanFailed    = "scan_failed"
+)
+
+const (
+	sendTimeout  = 10 * time.Second
+	sendAttempts = 3
+)
+
+// Event describes the end of a scan of one target. The totals are those of
+// the index after the scan and are zero when it was not written to the
+// database.
+type Event struct {
+	Event           string    `json:"event"`
+	TeamDriveID     string    `json:"teamdrive_id"`
+	TeamDriveName   string    `json:"teamdrive_name"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Error           string    `json:"error,omitempty"`
+	Files           int64     `json:"files"`
+	Folders         int64     `json:"folders"`
+	Size            int64     `json:"size"`
+	SizeHuman       string    `json:"size_human"`
+}
+
+// Config is the notify section of config.json.
+type Config struct {
+	Webhooks []Webhook       `json:"webhooks"`
+	Discord  *DiscordConfig  `json:"discord"`
+	Telegram *TelegramConfig `json:"telegram"`
+}
+
+// Webhook is an HTTP endpoint called for scan events. Template is a Go
+// text/template executed with the Event; the json function quotes a value,
+// e.g. {"text": {{json .TeamDriveName}}}. Without a template the Event is
+// sent as JSON.
+type Webhook struct {
+	URL      string            `json:"url"`
+	Method   string            `json:"method"`
+	Headers  map[string]string `json:"headers"`
+	Template string            `json:"template"`
+	// Events limits the hook to these event types; empty means all.
+	Events []string `json:"events"`
+}
+
+// Notifier delivers events to the configured channels. A nil Notifier
+// delivers nothing.
+type Notifier struct {
+	client   *http.Client
+	channels []channel
+}
+
+// channel is one destination: a webhook or a chat integration.
+type channel struct {
+	name    string
+	events  []string
+	request func(ctx context.Context, event Event) (*http.Request, error)
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// New checks the configuration and compiles the payload templates.
+func New(config Config) (*Notifier, error) {
+	n := &Notifier{client: &http.Client{Timeout: sendTimeout}}
+
+	for i, hook := range config.Webhooks {
+		ch, err := webhookChannel(hook)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %d: %w", i+1, err)
+		}
+		n.channels = append(n.channels, ch)
+	}
+	if config.Discord != nil {
+		ch, err := discordChannel(*config.Discord)
+		if err != nil {
+			return nil, fmt.Errorf("discord: %w", err)
+		}
+		n.channels = append(n.channels, ch)
+	}
+	if config.Telegram != nil {
+		ch, err := telegramChannel(*config.Telegram)
+		if err != nil {
+			return nil, fmt.Errorf("telegram: %w", err)
+		}
+		n.channels = append(n.channels, ch)
+	}
+
+	return n, nil
+}
+
+func webhookChannel(hook Webhook) (channel, error) {
+	if hook.URL == "" {
+		return channel{}, fmt.Errorf("no url")
+	}
+	if hook.Method == "" {
+		hook.Method = http.MethodPost
+	}
+
+	target, err := url.Parse(hook.URL)
+	if err != nil {
+		return channel{}, err
+	}
+
+	var tmpl *template.Template
+	if hook.Template != "" {
+		tmpl, err = template.New(hook.URL).Funcs(templateFuncs).Parse(hook.Template)
+		if err != nil {
+			return channel{}, fmt.Errorf("invalid template: %w", err)
+		}
+	}
+
+	return channel{
+		name:   "Webhook to " + target.Host,
+		events: hook.Events,
+		request: func(ctx context.Context, event Event) (*http.Request, error) {
+			var body bytes.Buffer
+			if tmpl != nil {
+				if err := tmpl.Execute(&body, event); err != nil {
+					return nil, fmt.Errorf("template: %w", err)
+				}
+			} else if err := json.NewEncoder(&body).Encode(event); err != nil {
+				return nil, err
+			}
+
+			req, err := http.NewRequestWithContext(ctx, hook.Method, hook.URL, &body)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			for k, v := range hook.Headers {
+				req.Header.Set(k, v)
+			}
+			return req, nil
+		},
+	}, nil
+}
+
+// Notify delivers event to every channel subscribed to it. Failures are
+// logged; a scan never fails because a notification did.
+func (n *Notifier) Notify(event Event) {
+	if n == nil {
+		return
+	}
+
+	for _, ch := range n.channels {
+		if !ch.wants(event.Event) {
+			continue
+		}
+		if err := n.send(ch, event); err != nil {
+			log.Printf("%s failed: %v", ch.name, err)
+		}
+	}
+}
+
+func (ch channel) wants(event string) bool {
+	if len(ch.events) == 0 {
+		return true
+	}
+	for _, e := range ch.events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// send delivers one event, retrying network errors, 429 and 5xx responses.
+func (n *Notifier) send(ch channel, event Event) error {
+	var err error
+	for attempt := 1; attempt <= sendAttempts; attempt++ {
+		var retry bool
+		if retry, err = n.post(ch, event); err == nil || !retry {
+			return err
+		}
+		if attempt < sendAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return err
+}
+
+func (n *Notifier) post(ch channel, event Event) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
+	req, err := ch.request(ctx, event)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", "teamdrive-scanner")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		// The URL may hold a token, keep it out of the logs
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+			fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return false, nil
+}
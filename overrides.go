@@ -0,0 +1,187 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+)
+
+// envPrefix starts the environment variables that override config values:
+// database.path is TDS_DATABASE_PATH, web.rate_limit.burst is
+// TDS_WEB_RATE_LIMIT_BURST.
+const envPrefix = "TDS_"
+
+// configOverrides holds the -set flags, applied on every (re)load.
+var configOverrides setFlags
+
+// setFlags collects repeated -set key=value flags.
+type setFlags []string
+
+func (f *setFlags) String() string {
+    return strings.Join(*f, ", ")
+}
+
+func (f *setFlags) Set(value string) error {
+    if !strings.Contains(value, "=") {
+        return fmt.Errorf("expected key=value, e.g. web.port=8080")
+    }
+    *f = append(*f, value)
+    return nil
+}
+
+// applyOverrides applies TDS_* environment variables and then -set flags
+// on top of the config file, so the precedence is file < env < flags.
+// Values are parsed by the type of the field: comma-separated lists for
+// string lists, JSON for everything else that is not a scalar.
+func applyOverrides(config *Config, environ []string, sets []string) error {
+    keys := make(map[string]string)
+    for _, key := range configKeys(reflect.TypeOf(*config), "") {
+        keys[envPrefix+strings.ToUpper(strings.ReplaceAll(key, ".", "_"))] = key
+    }
+
+    for _, env := range environ {
+        name, value, _ := strings.Cut(env, "=")
+        if !strings.HasPrefix(name, envPrefix) {
+            continue
+        }
+        key, ok := keys[name]
+        if !ok {
+            log.Printf("Ignoring unknown config variable %s", name)
+            continue
+        }
+        if err := setConfigValue(config, key, value); err != nil {
+            return fmt.Errorf("%s: %w", name, err)
+        }
+    }
+
+    for _, set := range sets {
+        key, value, _ := strings.Cut(set, "=")
+        if err := setConfigValue(config, strings.TrimSpace(key), value); err != nil {
+            return fmt.Errorf("-set %s: %w", key, err)
+        }
+    }
+
+    return nil
+}
+
+// hasEnvOverrides reports whether any TDS_* variable is set.
+func hasEnvOverrides() bool {
+    for _, env := range os.Environ() {
+        if strings.HasPrefix(env, envPrefix) {
+            return true
+        }
+    }
+    return false
+}
+
+// configKeys lists the dotted keys of every settable value below t.
+func configKeys(t reflect.Type, prefix string) []string {
+    var keys []string
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        name := jsonName(field)
+        if name == "" {
+            continue
+        }
+        key := prefix + name
+
+        ft := field.Type
+        if ft.Kind() == reflect.Pointer {
+            ft = ft.Elem()
+        }
+        if ft.Kind() == reflect.Struct {
+            keys = append(keys, configKeys(ft, key+".")...)
+        } else {
+            keys = append(keys, key)
+        }
+    }
+    return keys
+}
+
+func jsonName(field reflect.StructField) string {
+    if !field.IsExported() {
+        return ""
+    }
+    name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+    if name == "-" {
+        return ""
+    }
+    return name
+}
+
+// setConfigValue sets the value at a dotted key such as web.port.
+func setConfigValue(config *Config, key string, value string) error {
+    v := reflect.ValueOf(config).Elem()
+    for _, name := range strings.Split(key, ".") {
+        if v.Kind() == reflect.Pointer {
+            if v.IsNil() {
+                v.Set(reflect.New(v.Type().Elem()))
+            }
+            v = v.Elem()
+        }
+        if v.Kind() != reflect.Struct {
+            return fmt.Errorf("unknown config key %q", key)
+        }
+
+        found := false
+        for i := 0; i < v.NumField(); i++ {
+            if jsonName(v.Type().Field(i)) == name {
+                v = v.Field(i)
+                found = true
+                break
+            }
+        }
+        if !found {
+            return fmt.Errorf("unknown config key %q", key)
+        }
+    }
+
+    return setValue(v, value)
+}
+
+func setValue(v reflect.Value, value string) error {
+    switch v.Kind() {
+    case reflect.String:
+        v.SetString(value)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(value)
+        if err != nil {
+            return err
+        }
+        v.SetBool(b)
+    case reflect.Int, reflect.Int64:
+        n, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            return err
+        }
+        v.SetInt(n)
+    case reflect.Float64:
+        f, err := strconv.ParseFloat(value, 64)
+        if err != nil {
+            return err
+        }
+        v.SetFloat(f)
+    default:
+        if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(value, "[") {
+            var items []string
+            for _, item := range strings.Split(value, ",") {
+                if item = strings.TrimSpace(item); item != "" {
+                    items = append(items, item)
+                }
+            }
+            v.Set(reflect.ValueOf(items))
+            return nil
+        }
+        // Lists of objects and the like are given as JSON
+        target := reflect.New(v.Type())
+        if err := json.Unmarshal([]byte(value), target.Interface()); err != nil {
+            return fmt.Errorf("invalid JSON value: %w", err)
+        }
+        v.Set(target.Elem())
+    }
+    return nil
+}
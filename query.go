@@ -0,0 +1,109 @@
+package main
+
+import (
+    "context"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+
+    "teamdrive-scanner/database"
+)
+
+// queryFlags are the command line options of query mode.
+type queryFlags struct {
+    query     string
+    teamDrive string // ID or configured name; empty searches every drive
+    format    string // table, json or csv
+    limit     int
+}
+
+// runQuery searches the index and writes the matches to stdout, for
+// scripts and SSH sessions without the web server.
+func runQuery(config *Config, db *database.Database, flags queryFlags) {
+    switch flags.format {
+    case "table", "json", "csv":
+    default:
+        log.Fatalf("Invalid -format %q: use table, json or csv", flags.format)
+    }
+    if flags.limit <= 0 {
+        log.Fatalf("-limit must be positive")
+    }
+
+    opts := database.SearchOptions{
+        Query:   flags.query,
+        Limit:   flags.limit,
+        NoCount: flags.format != "table",
+    }
+    if flags.teamDrive != "" {
+        opts.TeamDriveID = teamDriveID(config, flags.teamDrive)
+    }
+
+    result, err := db.Search(context.Background(), opts)
+    if errors.Is(err, database.ErrInvalidQuery) {
+        log.Fatalf("%v", err)
+    }
+    if err != nil {
+        log.Fatalf("Search failed: %v", err)
+    }
+
+    switch flags.format {
+    case "json":
+        err = json.NewEncoder(os.Stdout).Encode(result.Files)
+    case "csv":
+        err = writeQueryCSV(result.Files)
+    default:
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "NAME\tSIZE\tMODIFIED\tDRIVE\tPATH\t")
+        for _, file := range result.Files {
+            size := database.FormatBytes(file.Size)
+            if file.IsFolder {
+                size = "-"
+            }
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t\n", file.Name, size, file.ModifiedTime, file.TeamDriveName, file.Path)
+        }
+        w.Flush()
+        if result.HasMore {
+            fmt.Printf("\nShowing %d of %d matches; raise -limit for more\n", len(result.Files), result.TotalCount)
+        }
+    }
+    if err != nil {
+        log.Fatalf("Failed to write results: %v", err)
+    }
+}
+
+// teamDriveID resolves a drive given by ID or configured name.
+func teamDriveID(config *Config, idOrName string) string {
+    for _, td := range config.TeamDrives {
+        if strings.EqualFold(td.Name, idOrName) {
+            return td.ID
+        }
+    }
+    return idOrName
+}
+
+func writeQueryCSV(files []database.FileRecord) error {
+    w := csv.NewWriter(os.Stdout)
+    w.Write([]string{"id", "name", "size", "modified_time", "mime_type", "is_folder", "teamdrive_id", "teamdrive_name", "path", "web_view_link"})
+    for _, file := range files {
+        w.Write([]string{
+            file.ID,
+            file.Name,
+            strconv.FormatInt(file.Size, 10),
+            file.ModifiedTime,
+            file.MimeType,
+            strconv.FormatBool(file.IsFolder),
+            file.TeamDriveID,
+            file.TeamDriveName,
+            file.Path,
+            file.WebViewLink,
+        })
+    }
+    w.Flush()
+    return w.Error()
+}
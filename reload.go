@@ -0,0 +1,76 @@
+package main
+
+import (
+    "log"
+    "os"
+    "os/signal"
+    "reflect"
+    "syscall"
+    "time"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 5 * time.Second
+
+// watchConfig calls apply with the reloaded config whenever the file at
+// path changes or the process receives SIGHUP. A config that fails to load
+// is logged and ignored, so a typo never takes a running server down.
+func watchConfig(path string, current *Config, apply func(*Config)) {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+
+    modTime := configModTime(path)
+    ticker := time.NewTicker(configPollInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-hup:
+            log.Printf("SIGHUP received, reloading %s", path)
+        case <-ticker.C:
+            changed := configModTime(path)
+            if changed.Equal(modTime) {
+                continue
+            }
+            modTime = changed
+            log.Printf("%s changed, reloading", path)
+        }
+
+        next, err := loadConfig(path)
+        if err != nil {
+            log.Printf("Config reload failed, keeping the running config: %v", err)
+            continue
+        }
+        for _, setting := range restartRequired(current, next) {
+            log.Printf("Config reload: %s changes take effect after a restart", setting)
+        }
+        apply(next)
+        current = next
+    }
+}
+
+func configModTime(path string) time.Time {
+    info, err := os.Stat(path)
+    if err != nil {
+        return time.Time{}
+    }
+    return info.ModTime()
+}
+
+// restartRequired lists the changed settings that a reload cannot apply.
+func restartRequired(old *Config, next *Config) []string {
+    var settings []string
+    if old.ServiceAccountsDir != next.ServiceAccountsDir || old.Auth != next.Auth {
+        settings = append(settings, "service account and auth")
+    }
+    if !reflect.DeepEqual(old.Database, next.Database) {
+        settings = append(settings, "database")
+    }
+    if old.Web.Host != next.Web.Host || old.Web.Port != next.Web.Port || !reflect.DeepEqual(old.Web.TLS, next.Web.TLS) {
+        settings = append(settings, "web listen and TLS")
+    }
+    if old.Scanner.MetricsAddr != next.Scanner.MetricsAddr {
+        settings = append(settings, "scanner.metrics_addr")
+    }
+    return settings
+}
@@ -0,0 +1,384 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"teamdrive-scanner/database"
+	"teamdrive-scanner/metrics"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// quarantineThreshold is the number of consecutive auth/quota failures
+	// after which an account is taken out of rotation.
+	quarantineThreshold = 5
+	quarantineBase      = time.Minute
+	quarantineMax       = 30 * time.Minute
+	healthInterval      = 30 * time.Second
+
+	// Adaptive throttling: halve an account's rate on quota errors and
+	// ramp back up by a tenth of the configured rate after a streak of
+	// successful calls.
+	throttleDecrease = 0.5
+	throttleIncrease = 0.1
+	throttleMinRate  = 0.5
+	rampUpStreak     = 50
+)
+
+type serviceAccount struct {
+	name    string
+	file    string // key file in the pool's directory; empty for OAuth
+	client  DriveClient
+	limiter *rate.Limiter
+
+	workers atomic.Int32 // workers pinned to the account
+	dropped atomic.Bool  // removed from the pool by WatchAccounts
+
+	requests  atomic.Int64
+	failures  atomic.Int64
+	errors401 atomic.Int64
+	errors403 atomic.Int64
+	errors429 atomic.Int64
+
+	// maxRate is the configured requests/sec; the limiter runs at or
+	// below it depending on recent quota errors.
+	maxRate float64
+
+	mu                  sync.Mutex
+	successStreak       int
+	consecutiveFailures int
+	quarantines         int
+	quarantinedUntil    time.Time
+	lastError           string
+	authFailures        int // consecutive 401s and token errors
+
+	// API calls made on budgetDay, charged against the pool's budget
+	budget     *dailyBudget
+	budgetDay  string
+	budgetUsed int64
+	budgetOut  bool // Google reported the daily quota used up
+}
+
+func newServiceAccount(name string, client DriveClient, ratePerAccount int, budget *dailyBudget) *serviceAccount {
+	return &serviceAccount{
+		name:    name,
+		client:  client,
+		limiter: rate.NewLimiter(rate.Limit(ratePerAccount), ratePerAccount*2),
+		maxRate: float64(ratePerAccount),
+		budget:  budget,
+	}
+}
+
+// accountName returns the client_email of a credentials file, falling back
+// to the file name.
+func accountName(credentials []byte, fileName string) string {
+	var key struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if err := json.Unmarshal(credentials, &key); err == nil && key.ClientEmail != "" {
+		return key.ClientEmail
+	}
+	return fileName
+}
+
+func (a *serviceAccount) recordSuccess() {
+	a.requests.Add(1)
+	a.countCall()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.consecutiveFailures = 0
+	a.authFailures = 0
+	a.successStreak++
+	if a.successStreak >= rampUpStreak {
+		a.successStreak = 0
+		a.rampUpLocked()
+	}
+}
+
+// isRateLimited reports whether err is a per-user rate limit response that
+// should slow the account down.
+func isRateLimited(gerr *googleapi.Error) bool {
+	if gerr.Code == 429 {
+		return true
+	}
+	if gerr.Code != 403 {
+		return false
+	}
+	for _, item := range gerr.Errors {
+		if item.Reason == "userRateLimitExceeded" || item.Reason == "rateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *serviceAccount) throttleLocked() {
+	current := float64(a.limiter.Limit())
+	next := current * throttleDecrease
+	if next < throttleMinRate {
+		next = throttleMinRate
+	}
+	if next == current {
+		return
+	}
+
+	a.setRateLocked(next)
+	log.Printf("Service account %s throttled to %.1f req/s", a.name, next)
+}
+
+func (a *serviceAccount) rampUpLocked() {
+	current := float64(a.limiter.Limit())
+	if current >= a.maxRate {
+		return
+	}
+
+	next := current + a.maxRate*throttleIncrease
+	if next > a.maxRate {
+		next = a.maxRate
+	}
+	a.setRateLocked(next)
+}
+
+func (a *serviceAccount) setRateLocked(r float64) {
+	burst := int(r * 2)
+	if burst < 1 {
+		burst = 1
+	}
+	a.limiter.SetLimit(rate.Limit(r))
+	a.limiter.SetBurst(burst)
+}
+
+// setMaxRate changes the configured requests/sec. A throttled account
+// keeps its lower rate and ramps up to the new maximum.
+func (a *serviceAccount) setMaxRate(r float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	current := float64(a.limiter.Limit())
+	if current > r || current >= a.maxRate {
+		a.setRateLocked(r)
+	}
+	a.maxRate = r
+}
+
+// SetRate changes the per-account request rate of a running pool.
+func (p *ServiceAccountPool) SetRate(ratePerAccount int) {
+	p.rate.Store(int64(ratePerAccount))
+	for _, account := range p.all() {
+		account.setMaxRate(float64(ratePerAccount))
+	}
+}
+
+// recordFailure counts a failed call. Only 401, 403 and 429 responses count
+// towards quarantine; transient server and network errors are not the
+// account's fault.
+func (a *serviceAccount) recordFailure(err error) {
+	a.requests.Add(1)
+	a.countCall()
+	a.failures.Add(1)
+
+	// A key that was deleted or disabled fails before any request is sent
+	var tokenErr *oauth2.RetrieveError
+	if errors.As(err, &tokenErr) {
+		metrics.APIErrors.WithLabelValues("token").Inc()
+		a.mu.Lock()
+		a.lastError = err.Error()
+		a.authFailures++
+		a.mu.Unlock()
+		return
+	}
+
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		metrics.APIErrors.WithLabelValues("other").Inc()
+		return
+	}
+	metrics.APIErrors.WithLabelValues(strconv.Itoa(gerr.Code)).Inc()
+
+	switch gerr.Code {
+	case 401:
+		a.errors401.Add(1)
+		a.mu.Lock()
+		a.authFailures++
+		a.mu.Unlock()
+	case 403:
+		a.errors403.Add(1)
+	case 429:
+		a.errors429.Add(1)
+	default:
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.successStreak = 0
+	if isRateLimited(gerr) {
+		a.throttleLocked()
+	}
+
+	a.lastError = err.Error()
+	a.consecutiveFailures++
+	if a.consecutiveFailures >= quarantineThreshold && !a.isQuarantinedLocked() {
+		a.quarantineLocked()
+		log.Printf("Service account %s quarantined for %v after %d consecutive failures",
+			a.name, time.Until(a.quarantinedUntil).Round(time.Second), a.consecutiveFailures)
+	}
+}
+
+// quarantineLocked takes the account out of rotation, doubling the
+// quarantine on every repeated offence.
+func (a *serviceAccount) quarantineLocked() {
+	duration := quarantineBase << uint(a.quarantines)
+	if duration > quarantineMax || duration <= 0 {
+		duration = quarantineMax
+	}
+	a.quarantines++
+	a.quarantinedUntil = time.Now().Add(duration)
+}
+
+// isQuarantinedLocked reports whether the account is out of rotation. An
+// account stays quarantined past quarantinedUntil until a probe succeeds.
+func (a *serviceAccount) isQuarantinedLocked() bool {
+	return a.quarantines > 0
+}
+
+func (a *serviceAccount) isQuarantined() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.isQuarantinedLocked()
+}
+
+// probe checks a quarantined account whose quarantine has expired with a
+// cheap About call and reinstates it on success.
+func (a *serviceAccount) probe(ctx context.Context) {
+	a.mu.Lock()
+	due := a.quarantines > 0 && !time.Now().Before(a.quarantinedUntil)
+	a.mu.Unlock()
+	if !due {
+		return
+	}
+
+	_, err := a.client.About(ctx)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err != nil {
+		a.lastError = err.Error()
+		a.quarantineLocked()
+		log.Printf("Service account %s still failing, quarantined for %v: %v",
+			a.name, time.Until(a.quarantinedUntil).Round(time.Second), err)
+		return
+	}
+
+	a.quarantines = 0
+	a.quarantinedUntil = time.Time{}
+	a.consecutiveFailures = 0
+	log.Printf("Service account %s reinstated", a.name)
+}
+
+func (a *serviceAccount) status() database.AccountStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	status := database.AccountStatus{
+		Name:        a.name,
+		Requests:    a.requests.Load(),
+		Failures:    a.failures.Load(),
+		Errors401:   a.errors401.Load(),
+		Errors403:   a.errors403.Load(),
+		Errors429:   a.errors429.Load(),
+		RateLimit:   float64(a.limiter.Limit()),
+		Quarantined: a.isQuarantinedLocked(),
+		LastError:   a.lastError,
+		UpdatedAt:   time.Now().UTC().Format(time.RFC3339),
+		BudgetDay:   a.budgetDay,
+		BudgetUsed:  a.budgetUsed,
+	}
+	if status.Quarantined {
+		status.QuarantinedUntil = a.quarantinedUntil.UTC().Format(time.RFC3339)
+	}
+
+	return status
+}
+
+// Statuses returns a health snapshot of every account in the pool.
+func (p *ServiceAccountPool) Statuses() []database.AccountStatus {
+	statuses := make([]database.AccountStatus, 0, len(p.all()))
+	for _, account := range p.all() {
+		statuses = append(statuses, account.status())
+	}
+	return statuses
+}
+
+func (p *ServiceAccountPool) sampleMetrics() {
+	for _, account := range p.all() {
+		limit := float64(account.limiter.Limit())
+		burst := float64(account.limiter.Burst())
+		saturation := 0.0
+		if burst > 0 {
+			saturation = 1 - account.limiter.Tokens()/burst
+			if saturation < 0 {
+				saturation = 0
+			}
+		}
+
+		quarantined := 0.0
+		if account.isQuarantined() {
+			quarantined = 1
+		}
+
+		metrics.AccountRateLimit.WithLabelValues(account.name).Set(limit)
+		metrics.AccountLimiterSaturation.WithLabelValues(account.name).Set(saturation)
+		metrics.AccountQuarantined.WithLabelValues(account.name).Set(quarantined)
+		metrics.AccountBudgetUsed.WithLabelValues(account.name).Set(float64(account.status().BudgetUsed))
+		metrics.AccountWorkers.WithLabelValues(account.name).Set(float64(account.workers.Load()))
+	}
+}
+
+// MonitorHealth re-probes quarantined accounts and persists the pool status
+// to the database until ctx is cancelled. Calls counted against the daily
+// budget by earlier runs are restored first.
+func (p *ServiceAccountPool) MonitorHealth(ctx context.Context, db *database.Database) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+
+	if statuses, err := db.GetAccountStatuses(ctx); err != nil {
+		log.Printf("Failed to restore service account budgets: %v", err)
+	} else {
+		p.restoreBudget(statuses)
+	}
+
+	save := func() {
+		if err := db.SaveAccountStatuses(p.Statuses()); err != nil {
+			log.Printf("Failed to save service account status: %v", err)
+		}
+	}
+
+	save()
+	for {
+		select {
+		case <-ticker.C:
+			for _, account := range p.all() {
+				account.probe(ctx)
+			}
+			save()
+		case <-ctx.Done():
+			save()
+			return
+		}
+	}
+}
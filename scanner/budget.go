@@ -0,0 +1,142 @@
+package scanner
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"teamdrive-scanner/database"
+)
+
+// dailyBudget caps the API calls each account of a pool makes per day, so
+// scans stop short of Google's daily quotas instead of running into a storm
+// of 403s. Days start at midnight in the budget's time zone.
+type dailyBudget struct {
+	limit    atomic.Int64 // calls per account and day; 0 is unlimited
+	location atomic.Pointer[time.Location]
+
+	mu         sync.Mutex
+	waitLogged time.Time // the reset the last "budget used up" log was for
+}
+
+func (b *dailyBudget) today() string {
+	return time.Now().In(b.zone()).Format("2006-01-02")
+}
+
+func (b *dailyBudget) zone() *time.Location {
+	if loc := b.location.Load(); loc != nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// nextReset returns the start of the next day in the budget's time zone.
+func (b *dailyBudget) nextReset() time.Time {
+	now := time.Now().In(b.zone())
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+}
+
+// SetBudget limits every account to perAccount API calls a day, counted
+// from midnight in location; zero lifts the limit. Calls made earlier today
+// still count.
+func (p *ServiceAccountPool) SetBudget(perAccount int64, location *time.Location) {
+	p.budget.limit.Store(perAccount)
+	p.budget.location.Store(location)
+}
+
+// countCall charges one API call to the account's budget.
+func (a *serviceAccount) countCall() {
+	day := a.budget.today()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.budgetDay != day {
+		a.budgetDay = day
+		a.budgetUsed = 0
+		a.budgetOut = false
+	}
+	a.budgetUsed++
+}
+
+// hasBudget reports whether the account may make another call today.
+func (a *serviceAccount) hasBudget() bool {
+	day := a.budget.today()
+	limit := a.budget.limit.Load()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.budgetDay != day {
+		return true
+	}
+	return !a.budgetOut && (limit <= 0 || a.budgetUsed < limit)
+}
+
+// exhaustBudget takes the account out of use for the rest of the day,
+// when Google reports its daily quota used up before the budget is.
+func (a *serviceAccount) exhaustBudget() {
+	day := a.budget.today()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.budgetOut || a.budgetDay != day {
+		log.Printf("Service account %s is out of daily quota until %s",
+			a.name, a.budget.nextReset().Format("2006-01-02 15:04 MST"))
+	}
+	if a.budgetDay != day {
+		a.budgetDay = day
+		a.budgetUsed = 0
+	}
+	a.budgetOut = true
+}
+
+// waitForBudget blocks until the next daily reset, for when no account
+// has calls left, or until ctx ends.
+func (p *ServiceAccountPool) waitForBudget(ctx context.Context) error {
+	reset := p.budget.nextReset()
+
+	p.budget.mu.Lock()
+	if !p.budget.waitLogged.Equal(reset) {
+		p.budget.waitLogged = reset
+		log.Printf("Every account is out of daily quota, scans wait until %s",
+			reset.Format("2006-01-02 15:04 MST"))
+	}
+	p.budget.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(reset))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// restoreBudget picks up the calls the accounts made today in earlier
+// runs, as saved with their status.
+func (p *ServiceAccountPool) restoreBudget(statuses []database.AccountStatus) {
+	used := make(map[string]database.AccountStatus, len(statuses))
+	for _, status := range statuses {
+		used[status.Name] = status
+	}
+
+	for _, account := range p.all() {
+		status, ok := used[account.name]
+		if !ok {
+			continue
+		}
+		account.mu.Lock()
+		if account.budgetDay == "" {
+			account.budgetDay = status.BudgetDay
+			account.budgetUsed = status.BudgetUsed
+		} else if account.budgetDay == status.BudgetDay {
+			account.budgetUsed += status.BudgetUsed
+		}
+		account.mu.Unlock()
+	}
+}
@@ -0,0 +1,271 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// DriveClient is the part of the Drive API the scanner uses. The default
+// implementation wraps *drive.Service; other backends (fakes for tests,
+// caches, other clouds) implement it to be scanned the same way. Errors
+// should be *googleapi.Error where a status code applies, so rate limits
+// and quota errors are handled like Drive's.
+type DriveClient interface {
+	// List returns one page of the children of a folder.
+	List(ctx context.Context, req ListRequest) (*drive.FileList, error)
+	// Get returns a single file with the given fields.
+	Get(ctx context.Context, fileID string, fields string) (*drive.File, error)
+	// Revisions returns every stored revision of a file, the current one
+	// included.
+	Revisions(ctx context.Context, fileID string) ([]*drive.Revision, error)
+	// Permissions returns every permission of a file, folder or shared
+	// drive, inherited ones included.
+	Permissions(ctx context.Context, fileID string) ([]*drive.Permission, error)
+	// Changes returns one page of changes to a drive since pageToken; an
+	// empty pageToken starts from the drive's current state.
+	Changes(ctx context.Context, driveID string, pageToken string) (*drive.ChangeList, error)
+	// Drives returns every shared drive the client can see.
+	Drives(ctx context.Context) ([]*drive.Drive, error)
+	// About returns the authenticated user, as a cheap health check.
+	About(ctx context.Context) (*drive.About, error)
+	// Download returns the response to a download of a file, of
+	// byteRange, an HTTP Range header value, when set; the caller closes
+	// its body.
+	Download(ctx context.Context, fileID string, byteRange string) (*http.Response, error)
+	// Export returns a Google-native file converted to mimeType; the
+	// caller closes the reader.
+	Export(ctx context.Context, fileID string, mimeType string) (io.ReadCloser, error)
+	// Thumbnail returns the image at a file's thumbnailLink and its
+	// content type; the caller closes the reader.
+	Thumbnail(ctx context.Context, link string) (io.ReadCloser, string, error)
+	// Copy copies a file into the folder parentID on Drive's side,
+	// returning the copy. Folders cannot be copied.
+	Copy(ctx context.Context, fileID string, parentID string) (*drive.File, error)
+	// CreateFolder creates a folder named name in parentID.
+	CreateFolder(ctx context.Context, parentID string, name string) (*drive.File, error)
+	// Update renames a file to name, when set, and moves it from the
+	// folder removeParent to addParent, when they are set, returning the
+	// file as it is now.
+	Update(ctx context.Context, fileID string, name string, addParent string, removeParent string) (*drive.File, error)
+}
+
+// ListRequest selects a page of a folder listing. Corpora and DriveID
+// follow the Drive API: "drive" with a DriveID for shared drives, "user"
+// for My Drive, "allDrives" for folders anywhere.
+type ListRequest struct {
+	FolderID  string
+	Corpora   string
+	DriveID   string
+	PageSize  int64
+	PageToken string
+	// Labels are the IDs of the Drive labels to return with each file
+	Labels []string
+	// Trashed lists trashed children along with the others
+	Trashed bool
+}
+
+// ClientFactory creates the client of one service account from its
+// credentials file. Tests substitute one that talks to a fake server.
+type ClientFactory func(ctx context.Context, credentials []byte) (DriveClient, error)
+
+// CredentialsClient is the ClientFactory for real service account keys,
+// with read-only access.
+func CredentialsClient(ctx context.Context, credentials []byte) (DriveClient, error) {
+	return credentialsClient(ctx, credentials, drive.DriveReadonlyScope)
+}
+
+// WriteCredentialsClient is CredentialsClient with full access, for
+// copying, renaming and moving files.
+func WriteCredentialsClient(ctx context.Context, credentials []byte) (DriveClient, error) {
+	return credentialsClient(ctx, credentials, drive.DriveScope)
+}
+
+func credentialsClient(ctx context.Context, credentials []byte, scope string) (DriveClient, error) {
+	client, _, err := htransport.NewClient(ctx,
+		option.WithCredentialsJSON(credentials),
+		option.WithScopes(scope),
+	)
+	if err != nil {
+		return nil, err
+	}
+	service, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, err
+	}
+	return NewServiceClient(service, client), nil
+}
+
+// NewServiceClient returns a DriveClient backed by the Drive API. client
+// is the authorized HTTP client of the service, for the requests outside
+// the API such as thumbnails.
+func NewServiceClient(service *drive.Service, client *http.Client) DriveClient {
+	return &serviceClient{service: service, http: client}
+}
+
+type serviceClient struct {
+	service *drive.Service
+	http    *http.Client
+}
+
+func (c *serviceClient) List(ctx context.Context, req ListRequest) (*drive.FileList, error) {
+	q := fmt.Sprintf("'%s' in parents", req.FolderID)
+	if !req.Trashed {
+		q += " and trashed=false"
+	}
+	call := c.service.Files.List().
+		Q(q).
+		PageSize(req.PageSize).
+		SupportsAllDrives(true).
+		IncludeItemsFromAllDrives(true).
+		Fields(fileListFields).
+		PageToken(req.PageToken).
+		Corpora(req.Corpora)
+	if req.DriveID != "" {
+		call = call.DriveId(req.DriveID)
+	}
+	if len(req.Labels) > 0 {
+		call = call.IncludeLabels(strings.Join(req.Labels, ","))
+	}
+	return call.Context(ctx).Do()
+}
+
+func (c *serviceClient) Get(ctx context.Context, fileID string, fields string) (*drive.File, error) {
+	return c.service.Files.Get(fileID).
+		SupportsAllDrives(true).
+		Fields(googleapi.Field(fields)).
+		Context(ctx).
+		Do()
+}
+
+func (c *serviceClient) Revisions(ctx context.Context, fileID string) ([]*drive.Revision, error) {
+	var revisions []*drive.Revision
+	err := c.service.Revisions.List(fileID).
+		Fields("nextPageToken, revisions(id, size)").
+		PageSize(1000).
+		Pages(ctx, func(page *drive.RevisionList) error {
+			revisions = append(revisions, page.Revisions...)
+			return nil
+		})
+	return revisions, err
+}
+
+func (c *serviceClient) Permissions(ctx context.Context, fileID string) ([]*drive.Permission, error) {
+	var permissions []*drive.Permission
+	err := c.service.Permissions.List(fileID).
+		SupportsAllDrives(true).
+		Fields("nextPageToken, permissions(id, type, role, emailAddress, domain, allowFileDiscovery, permissionDetails(inherited))").
+		PageSize(100).
+		Pages(ctx, func(page *drive.PermissionList) error {
+			permissions = append(permissions, page.Permissions...)
+			return nil
+		})
+	return permissions, err
+}
+
+func (c *serviceClient) Changes(ctx context.Context, driveID string, pageToken string) (*drive.ChangeList, error) {
+	if pageToken == "" {
+		start := c.service.Changes.GetStartPageToken().SupportsAllDrives(true)
+		if driveID != "" {
+			start = start.DriveId(driveID)
+		}
+		token, err := start.Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		pageToken = token.StartPageToken
+	}
+
+	call := c.service.Changes.List(pageToken).
+		SupportsAllDrives(true).
+		IncludeItemsFromAllDrives(true).
+		PageSize(1000)
+	if driveID != "" {
+		call = call.DriveId(driveID)
+	}
+	return call.Context(ctx).Do()
+}
+
+func (c *serviceClient) Drives(ctx context.Context) ([]*drive.Drive, error) {
+	var drives []*drive.Drive
+	err := c.service.Drives.List().
+		PageSize(100).
+		Fields("nextPageToken, drives(id, name)").
+		Pages(ctx, func(list *drive.DriveList) error {
+			drives = append(drives, list.Drives...)
+			return nil
+		})
+	return drives, err
+}
+
+func (c *serviceClient) About(ctx context.Context) (*drive.About, error) {
+	return c.service.About.Get().Fields("user").Context(ctx).Do()
+}
+
+func (c *serviceClient) Download(ctx context.Context, fileID string, byteRange string) (*http.Response, error) {
+	call := c.service.Files.Get(fileID).SupportsAllDrives(true)
+	if byteRange != "" {
+		call.Header().Set("Range", byteRange)
+	}
+	return call.Context(ctx).Download()
+}
+
+func (c *serviceClient) Export(ctx context.Context, fileID string, mimeType string) (io.ReadCloser, error) {
+	resp, err := c.service.Files.Export(fileID, mimeType).Context(ctx).Download()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *serviceClient) Copy(ctx context.Context, fileID string, parentID string) (*drive.File, error) {
+	return c.service.Files.Copy(fileID, &drive.File{Parents: []string{parentID}}).
+		SupportsAllDrives(true).
+		Fields("id, name, size").
+		Context(ctx).
+		Do()
+}
+
+func (c *serviceClient) CreateFolder(ctx context.Context, parentID string, name string) (*drive.File, error) {
+	return c.service.Files.Create(&drive.File{Name: name, MimeType: FolderMimeType, Parents: []string{parentID}}).
+		SupportsAllDrives(true).
+		Fields("id, name").
+		Context(ctx).
+		Do()
+}
+
+func (c *serviceClient) Update(ctx context.Context, fileID string, name string, addParent string, removeParent string) (*drive.File, error) {
+	call := c.service.Files.Update(fileID, &drive.File{Name: name}).
+		SupportsAllDrives(true).
+		Fields("id, name, parents")
+	if addParent != "" {
+		call = call.AddParents(addParent)
+	}
+	if removeParent != "" {
+		call = call.RemoveParents(removeParent)
+	}
+	return call.Context(ctx).Do()
+}
+
+func (c *serviceClient) Thumbnail(ctx context.Context, link string) (io.ReadCloser, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := googleapi.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, "", err
+	}
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
@@ -0,0 +1,289 @@
+package scanner
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"teamdrive-scanner/database"
+)
+
+// ContentConfig selects the documents whose text IndexContent extracts.
+type ContentConfig struct {
+	// MimeTypes are the types whose text is indexed, "text/*" matching
+	// every subtype; see ContentSupported. Empty indexes
+	// DefaultContentTypes.
+	MimeTypes []string
+	// MaxSize skips files of more bytes, and cuts the exports of
+	// Google-native files, which report no size, there. Zero uses
+	// defaultContentMaxSize.
+	MaxSize int64
+}
+
+// DefaultContentTypes are the documents indexed when no types are
+// configured.
+var DefaultContentTypes = []string{
+	"application/vnd.google-apps.document",
+	"application/vnd.google-apps.presentation",
+	"application/vnd.google-apps.spreadsheet",
+	"application/pdf",
+	"text/*",
+}
+
+const (
+	defaultContentMaxSize = 10 << 20
+	// contentWorkers download documents in parallel, paced by the
+	// accounts' limiters like a scan's listings
+	contentWorkers = 4
+	// contentPage is how many candidates are read from the index at a
+	// time, and contentBatch how many texts are written at a time
+	contentPage  = 1000
+	contentBatch = 100
+	// officePartLimit caps the bytes read from each XML part of an Office
+	// document, against archives that inflate without end
+	officePartLimit = 32 << 20
+)
+
+// contentExports maps the Google-native types whose text is indexed to
+// the format they are exported in.
+var contentExports = map[string]string{
+	"application/vnd.google-apps.document":     "text/plain",
+	"application/vnd.google-apps.presentation": "text/plain",
+	"application/vnd.google-apps.spreadsheet":  "text/csv",
+}
+
+// officeParts maps the Office Open XML types to the name prefix of the
+// archive parts that hold their text.
+var officeParts = map[string]string{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   "word/document.xml",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": "ppt/slides/slide",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         "xl/sharedStrings.xml",
+}
+
+// ContentSupported reports whether the text of files of mimeType can be
+// extracted: Google Docs, Sheets and Slides, PDFs, Word, PowerPoint and
+// Excel files, and plain text. Of "type/*" patterns only "text/*" is.
+func ContentSupported(mimeType string) bool {
+	_, exported := contentExports[mimeType]
+	_, office := officeParts[mimeType]
+	return exported || office || mimeType == "application/pdf" || strings.HasPrefix(mimeType, "text/")
+}
+
+// IndexContent extracts the text of the documents of a Drive target that
+// config.Content selects, at one download or export each, and stores it
+// for content searches. Documents are fetched again only once modified.
+// Files that cannot be fetched are logged and tried again on the next
+// run; those without text are stored empty and are not.
+func IndexContent(ctx context.Context, config ScanConfig, db *database.Database, pool *ServiceAccountPool) error {
+	if config.Content == nil {
+		return nil
+	}
+	mimeTypes := config.Content.MimeTypes
+	if len(mimeTypes) == 0 {
+		mimeTypes = DefaultContentTypes
+	}
+	maxSize := config.Content.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultContentMaxSize
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := time.Now()
+
+	jobs := make(chan database.FileRecord)
+	listed := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		for after := ""; ; {
+			page, err := db.ContentCandidates(ctx, config.TeamDriveID, mimeTypes, maxSize, after, contentPage)
+			if err != nil {
+				listed <- err
+				return
+			}
+			for _, record := range page {
+				select {
+				case jobs <- record:
+				case <-ctx.Done():
+					listed <- ctx.Err()
+					return
+				}
+			}
+			if len(page) < contentPage {
+				listed <- nil
+				return
+			}
+			after = page[len(page)-1].ID
+		}
+	}()
+
+	results := make(chan database.FileContent)
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < contentWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for record := range jobs {
+				if err := pauseGate.wait(ctx); err != nil {
+					continue
+				}
+				text, err := fetchText(ctx, config, pool, record, maxSize)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("[%s] Cannot index the text of %s: %v", config.TeamDriveName, record.Path, err)
+						failed.Add(1)
+					}
+					continue
+				}
+				results <- database.FileContent{FileID: record.ID, ModifiedTime: record.ModifiedTime, Text: text}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// What was fetched is kept if the run is canceled
+	var saveErr error
+	indexed := 0
+	batch := make([]database.FileContent, 0, contentBatch)
+	flush := func() {
+		if saveErr == nil {
+			if saveErr = db.SaveContent(context.Background(), config.TeamDriveID, batch); saveErr != nil {
+				cancel()
+			} else {
+				indexed += len(batch)
+			}
+		}
+		batch = batch[:0]
+	}
+	for content := range results {
+		batch = append(batch, content)
+		if len(batch) >= contentBatch {
+			flush()
+		}
+	}
+	flush()
+
+	err := <-listed
+	if saveErr != nil {
+		err = saveErr
+	}
+	log.Printf("[%s] Indexed the text of %d documents (%d failed) in %v", config.TeamDriveName,
+		indexed, failed.Load(), time.Since(start).Round(time.Millisecond))
+	return err
+}
+
+// fetchText downloads a document, or exports a Google-native one, and
+// extracts its text. Rate limits, server and network errors are retried.
+func fetchText(ctx context.Context, config ScanConfig, pool *ServiceAccountPool, record database.FileRecord, maxSize int64) (string, error) {
+	var data []byte
+	err := callWithRetry(ctx, pool, config.Type == TargetMyDrive, config.TeamDriveName, func(account *serviceAccount) error {
+		var err error
+		data, err = download(ctx, account.client, record, maxSize)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return extractText(record.MimeType, data)
+}
+
+// download reads up to maxSize bytes of a file, exported as text when it
+// is Google-native.
+func download(ctx context.Context, client DriveClient, record database.FileRecord, maxSize int64) ([]byte, error) {
+	var body io.ReadCloser
+	if format, ok := contentExports[record.MimeType]; ok {
+		var err error
+		if body, err = client.Export(ctx, record.ID, format); err != nil {
+			return nil, err
+		}
+	} else {
+		resp, err := client.Download(ctx, record.ID, "")
+		if err != nil {
+			return nil, err
+		}
+		body = resp.Body
+	}
+	defer body.Close()
+	return io.ReadAll(io.LimitReader(body, maxSize))
+}
+
+// extractText returns the text of a document of mimeType.
+func extractText(mimeType string, data []byte) (string, error) {
+	if _, ok := contentExports[mimeType]; ok || strings.HasPrefix(mimeType, "text/") {
+		return strings.TrimPrefix(strings.ToValidUTF8(string(data), ""), "\ufeff"), nil
+	}
+	if mimeType == "application/pdf" {
+		return pdfText(data), nil
+	}
+	if part, ok := officeParts[mimeType]; ok {
+		return officeText(data, part)
+	}
+	return "", fmt.Errorf("cannot extract text from %s", mimeType)
+}
+
+// officeText returns the text of the XML parts of an Office Open XML
+// document whose names start with part, one paragraph or cell per line.
+func officeText(data []byte, part string) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	var parts []*zip.File
+	for _, file := range archive.File {
+		if strings.HasPrefix(file.Name, part) && strings.HasSuffix(file.Name, ".xml") {
+			parts = append(parts, file)
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Name < parts[j].Name })
+
+	var text strings.Builder
+	for _, file := range parts {
+		r, err := file.Open()
+		if err != nil {
+			return "", err
+		}
+		err = xmlText(&text, io.LimitReader(r, officePartLimit))
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return text.String(), nil
+}
+
+// xmlText writes the character data of an XML document to text, ending a
+// line after each paragraph (p) and shared string (si).
+func xmlText(text *strings.Builder, r io.Reader) error {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if t.Name.Local == "p" || t.Name.Local == "si" {
+				text.WriteByte('\n')
+			}
+		}
+	}
+}
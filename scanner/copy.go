@@ -0,0 +1,291 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"teamdrive-scanner/database"
+)
+
+// CopyJobs runs the copy jobs of this process: each copies files and
+// folders from the index to a folder of another drive with files.copy, so
+// no content passes through the process. Folders are recreated, as Drive
+// does not copy them. Every copy made is recorded, so a canceled or
+// interrupted job resumes without copying an item twice. The accounts
+// need write access to both drives; the copies are indexed by the
+// destination's next scan.
+type CopyJobs struct {
+	jobSet
+
+	db   *database.Database
+	pool *ServiceAccountPool
+}
+
+// NewCopyJobs returns a runner copying through pool.
+func NewCopyJobs(db *database.Database, pool *ServiceAccountPool) *CopyJobs {
+	return &CopyJobs{jobSet: jobSet{kind: "copy"}, db: db, pool: pool}
+}
+
+// Resume starts the jobs left queued or running when the process last
+// stopped.
+func (j *CopyJobs) Resume(ctx context.Context) error {
+	jobs, err := j.db.UnfinishedCopyJobs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		log.Printf("Resuming copy job %s", job.ID)
+		if err := j.Start(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start runs a job in the background.
+func (j *CopyJobs) Start(job database.CopyJob) error {
+	return j.start(job.ID, func(ctx context.Context) { j.run(ctx, job) })
+}
+
+// copyPlan is what a job copies: its folders in the order they are
+// created, parents first, and its files.
+type copyPlan struct {
+	items   map[string]bool
+	folders []database.FileRecord
+	files   []database.FileRecord
+	missing int // sources no longer in the index
+}
+
+// plan lists the items of a job's sources from the index, each once
+// though a source is below another. Shortcuts are left out: files.copy
+// refuses them.
+func (j *CopyJobs) plan(ctx context.Context, job database.CopyJob) (*copyPlan, error) {
+	plan := &copyPlan{items: make(map[string]bool)}
+	add := func(record database.FileRecord) {
+		if plan.items[record.ID] {
+			return
+		}
+		plan.items[record.ID] = true
+		switch {
+		case record.IsShortcut:
+		case record.IsFolder:
+			plan.folders = append(plan.folders, record)
+		default:
+			plan.files = append(plan.files, record)
+		}
+	}
+	for _, id := range job.Sources {
+		source, err := j.db.GetFile(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if source == nil {
+			plan.missing++
+			continue
+		}
+		add(*source)
+		if !source.IsFolder {
+			continue
+		}
+		tree, err := j.db.FolderTree(ctx, source.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range tree {
+			add(record)
+		}
+	}
+	// Sorted by path, parents come before their children
+	sort.SliceStable(plan.folders, func(a, b int) bool {
+		return plan.folders[a].Path < plan.folders[b].Path
+	})
+	return plan, nil
+}
+
+func storeCopyProgress(job *database.CopyJob, p *jobProgress) {
+	job.DoneFiles = p.doneFiles.Load()
+	job.DoneBytes = p.doneBytes.Load()
+	job.SkippedFiles = p.skipped.Load()
+	job.FailedFiles = p.failed.Load()
+}
+
+func (j *CopyJobs) run(ctx context.Context, job database.CopyJob) {
+	job.Status = database.JobRunning
+	job.Error = ""
+	job.StartedAt = time.Now().UTC().Format(time.RFC3339)
+	job.FinishedAt = ""
+	job.TotalFiles, job.TotalBytes = 0, 0
+	var progress jobProgress
+	storeCopyProgress(&job, &progress)
+
+	save := func() {
+		if err := j.db.UpdateCopyJob(context.Background(), &job); err != nil {
+			log.Printf("Failed to save copy job %s: %v", job.ID, err)
+		}
+	}
+	finish := func(status string, err error) {
+		storeCopyProgress(&job, &progress)
+		job.Status = status
+		if err != nil {
+			job.Error = err.Error()
+		}
+		job.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+		save()
+		log.Printf("Copy job %s %s: %d/%d files, %d skipped, %d failed", job.ID, status,
+			job.DoneFiles, job.TotalFiles, job.SkippedFiles, job.FailedFiles)
+	}
+	fail := func(err error) {
+		if ctx.Err() != nil {
+			finish(database.JobCanceled, nil)
+		} else {
+			finish(database.JobFailed, err)
+		}
+	}
+	save()
+
+	plan, err := j.plan(ctx, job)
+	if err != nil {
+		fail(err)
+		return
+	}
+	copied, err := j.db.CopiedItems(ctx, job.ID)
+	if err != nil {
+		fail(err)
+		return
+	}
+	for _, record := range plan.files {
+		job.TotalFiles++
+		job.TotalBytes += record.Size
+	}
+	progress.failed.Add(int64(plan.missing))
+	storeCopyProgress(&job, &progress)
+	save()
+
+	// Items go into the copies of their parents, and the sources not below
+	// another into the destination folder
+	parentOf := func(record database.FileRecord) (string, error) {
+		if !plan.items[record.ParentID] {
+			return job.DestFolderID, nil
+		}
+		if parent, ok := copied[record.ParentID]; ok {
+			return parent, nil
+		}
+		return "", fmt.Errorf("parent folder of %s was not copied", record.Path)
+	}
+
+	// Folders are created one at a time, as their children need them
+	for _, folder := range plan.folders {
+		if _, ok := copied[folder.ID]; ok {
+			continue
+		}
+		if err := pauseGate.wait(ctx); err != nil {
+			fail(err)
+			return
+		}
+		parent, err := parentOf(folder)
+		if err != nil {
+			// A folder the index lost the parent of; its files fail below
+			log.Printf("Copy job %s: %v", job.ID, err)
+			continue
+		}
+		var created string
+		err = callWithRetry(ctx, j.pool, false, folder.TeamDriveName, func(account *serviceAccount) error {
+			file, err := account.client.CreateFolder(ctx, parent, folder.Name)
+			if err == nil {
+				created = file.Id
+			}
+			return err
+		})
+		if err == nil {
+			err = j.db.RecordCopiedItem(context.Background(), job.ID, folder.ID, created)
+		}
+		if err != nil {
+			fail(fmt.Errorf("creating folder %s: %w", folder.Path, err))
+			return
+		}
+		copied[folder.ID] = created
+	}
+
+	concurrency := job.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	files := make(chan database.FileRecord)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for record := range files {
+				if err := pauseGate.wait(ctx); err != nil {
+					continue
+				}
+				if err := j.copyFile(ctx, job.ID, record, parentOf); err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Copy job %s: cannot copy %s: %v", job.ID, record.Path, err)
+						progress.failed.Add(1)
+					}
+					continue
+				}
+				progress.doneFiles.Add(1)
+				progress.doneBytes.Add(record.Size)
+			}
+		}()
+	}
+	stopSaving := progress.saveEvery(func() {
+		storeCopyProgress(&job, &progress)
+		save()
+	})
+
+feed:
+	for _, record := range plan.files {
+		if _, ok := copied[record.ID]; ok {
+			progress.skipped.Add(1)
+			progress.doneFiles.Add(1)
+			progress.doneBytes.Add(record.Size)
+			continue
+		}
+		select {
+		case files <- record:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(files)
+	wg.Wait()
+	stopSaving()
+
+	switch {
+	case ctx.Err() != nil:
+		finish(database.JobCanceled, nil)
+	case progress.failed.Load() > 0:
+		finish(database.JobCompleted, fmt.Errorf("%d files failed; resume the job to retry them", progress.failed.Load()))
+	default:
+		finish(database.JobCompleted, nil)
+	}
+}
+
+// copyFile copies one file into the copy of its parent and records the
+// copy. Rate limits, server and network errors are retried.
+func (j *CopyJobs) copyFile(ctx context.Context, jobID string, record database.FileRecord, parentOf func(database.FileRecord) (string, error)) error {
+	parent, err := parentOf(record)
+	if err != nil {
+		return err
+	}
+	var created string
+	err = callWithRetry(ctx, j.pool, false, record.TeamDriveName, func(account *serviceAccount) error {
+		file, err := account.client.Copy(ctx, record.ID, parent)
+		if err == nil {
+			created = file.Id
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return j.db.RecordCopiedItem(context.Background(), jobID, record.ID, created)
+}
@@ -0,0 +1,48 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"teamdrive-scanner/database"
+)
+
+// DiscoverTeamDrives lists the shared drives visible to every account in
+// the pool and returns their union. Accounts that fail are logged and
+// skipped; an error is returned only if no account could list drives.
+func DiscoverTeamDrives(ctx context.Context, pool *ServiceAccountPool) ([]database.TeamDrive, error) {
+	seen := make(map[string]bool)
+	drives := make([]database.TeamDrive, 0)
+	var lastErr error
+	succeeded := 0
+
+	for _, account := range pool.all() {
+		if err := account.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		list, err := account.client.Drives(ctx)
+		if err != nil {
+			account.recordFailure(err)
+			log.Printf("Drive discovery failed for %s: %v", account.name, err)
+			lastErr = err
+			continue
+		}
+		account.recordSuccess()
+		succeeded++
+
+		for _, d := range list {
+			if !seen[d.Id] {
+				seen[d.Id] = true
+				drives = append(drives, database.TeamDrive{ID: d.Id, Name: d.Name})
+			}
+		}
+	}
+
+	if succeeded == 0 && lastErr != nil {
+		return nil, fmt.Errorf("drive discovery failed: %w", lastErr)
+	}
+
+	return drives, nil
+}
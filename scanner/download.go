@@ -0,0 +1,33 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+)
+
+// OpenDownload starts a download of a file through the pool's accounts, of
+// byteRange, an HTTP Range header value, when set, and counts it under
+// teamDrive. Failures before Drive responds are retried like a scan's
+// calls; the caller closes the response body.
+func OpenDownload(ctx context.Context, pool *ServiceAccountPool, teamDrive, fileID, byteRange string) (*http.Response, error) {
+	var resp *http.Response
+	err := callWithRetry(ctx, pool, false, teamDrive, func(account *serviceAccount) error {
+		var err error
+		resp, err = account.client.Download(ctx, fileID, byteRange)
+		return err
+	})
+	return resp, err
+}
+
+// APIStatus returns the HTTP status Drive failed a call with, or zero for
+// errors without one, such as network errors.
+func APIStatus(err error) int {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return 0
+}
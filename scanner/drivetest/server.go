@@ -0,0 +1,544 @@
+// Package drivetest provides an in-memory fake of the Google Drive API for
+// exercising the scanner without credentials: traversal, paging, retries
+// and rate limiting all run against a tree built in code.
+package drivetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"teamdrive-scanner/scanner"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+const (
+	// ModifiedTime is the modification time of every fake file, so scans
+	// are reproducible.
+	ModifiedTime = "2024-01-01T00:00:00.000Z"
+
+	basePath = "/drive/v3/"
+)
+
+var parentQuery = regexp.MustCompile(`'([^']+)' in parents`)
+
+// Server is a fake Drive API v3 serving files.list by parent, files.get
+// and downloads, files.export, files.copy, files.create of folders,
+// files.update of names and parents, revisions.list, permissions.list,
+// drives.list, about.get and thumbnails from an in-memory tree.
+type Server struct {
+	*httptest.Server
+
+	// MaxPageSize caps the files returned per page below the requested
+	// page size, to force paging on small trees. Zero honours the request.
+	MaxPageSize int
+
+	mu          sync.Mutex
+	files       map[string]*drive.File
+	children    map[string][]string
+	revisions   map[string][]*drive.Revision
+	permissions map[string][]*drive.Permission
+	contents    map[string][]byte
+	thumbnails  map[string][]byte
+	generation  int // of the thumbnail links, which expire when it changes
+	drives      []*drive.Drive
+	created     int // files made by files.copy and files.create
+	failures    []failure
+	broken      map[string]int // folders whose listings always fail, by code
+	requests    map[string]int
+}
+
+// failure is a queued error response; an empty reason picks the usual one
+// for the code.
+type failure struct {
+	code   int
+	reason string
+}
+
+func NewServer() *Server {
+	s := &Server{
+		files:       make(map[string]*drive.File),
+		children:    make(map[string][]string),
+		revisions:   make(map[string][]*drive.Revision),
+		permissions: make(map[string][]*drive.Permission),
+		contents:    make(map[string][]byte),
+		thumbnails:  make(map[string][]byte),
+		broken:      make(map[string]int),
+		requests:    make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(basePath+"files", s.listFiles)
+	mux.HandleFunc(basePath+"files/", s.getFile)
+	mux.HandleFunc(basePath+"drives", s.listDrives)
+	mux.HandleFunc(basePath+"about", s.about)
+	mux.HandleFunc("/thumbnails/", s.getThumbnail)
+
+	s.Server = httptest.NewServer(s.intercept(mux))
+	return s
+}
+
+// Service returns a Drive client for the fake server.
+func (s *Server) Service(ctx context.Context) (*drive.Service, error) {
+	return drive.NewService(ctx,
+		option.WithEndpoint(s.URL+basePath),
+		option.WithHTTPClient(s.Client()),
+	)
+}
+
+// Factory is a scanner.ClientFactory that ignores the credentials, so
+// every account of a pool talks to this server.
+func (s *Server) Factory(ctx context.Context, credentials []byte) (scanner.DriveClient, error) {
+	service, err := s.Service(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return scanner.NewServiceClient(service, s.Client()), nil
+}
+
+// WriteAccounts creates n dummy service account files in dir for
+// scanner.NewServiceAccountPool.
+func WriteAccounts(dir string, n int) error {
+	for i := 1; i <= n; i++ {
+		data := fmt.Sprintf(`{"type": "service_account", "client_email": "sa%d@drivetest.invalid"}`, i)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("sa%d.json", i)), []byte(data), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddDrive registers a shared drive for drives.list. Its ID is the parent
+// of the drive's top-level files.
+func (s *Server) AddDrive(id, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drives = append(s.drives, &drive.Drive{Id: id, Name: name})
+}
+
+// AddFolder adds a folder below parentID.
+func (s *Server) AddFolder(parentID, id, name string) *drive.File {
+	return s.add(parentID, &drive.File{Id: id, Name: name, MimeType: scanner.FolderMimeType})
+}
+
+// AddFile adds a file below parentID.
+func (s *Server) AddFile(parentID, id, name string, size int64) *drive.File {
+	return s.add(parentID, &drive.File{Id: id, Name: name, MimeType: "application/octet-stream", Size: size})
+}
+
+// AddDocument adds a file of type mimeType below parentID whose download,
+// or export in any format for Google-native types, is content.
+func (s *Server) AddDocument(parentID, id, name, mimeType string, content []byte) *drive.File {
+	file := &drive.File{Id: id, Name: name, MimeType: mimeType}
+	if !strings.HasPrefix(mimeType, "application/vnd.google-apps.") {
+		file.Size = int64(len(content))
+	}
+	s.mu.Lock()
+	s.contents[id] = content
+	s.mu.Unlock()
+	return s.add(parentID, file)
+}
+
+// SetThumbnail gives a file a thumbnailLink serving image.
+func (s *Server) SetThumbnail(fileID string, image []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.thumbnails[fileID] = image
+	s.files[fileID].ThumbnailLink = s.thumbnailLink(fileID)
+}
+
+// ExpireThumbnails makes the thumbnail links handed out so far fail, as
+// Drive's do after a few hours, and lists new ones.
+func (s *Server) ExpireThumbnails() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	for id := range s.thumbnails {
+		s.files[id].ThumbnailLink = s.thumbnailLink(id)
+	}
+}
+
+func (s *Server) thumbnailLink(fileID string) string {
+	return fmt.Sprintf("%s/thumbnails/%s?v=%d", s.URL, fileID, s.generation)
+}
+
+// AddRevision adds an older revision of size bytes to a file. Files have
+// one revision, of their own size, until one is added.
+func (s *Server) AddRevision(fileID string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := strconv.Itoa(len(s.revisions[fileID]) + 1)
+	s.revisions[fileID] = append(s.revisions[fileID], &drive.Revision{Id: id, Size: size})
+}
+
+// AddPermission adds a permission to a file or folder. Mark it inherited
+// with PermissionDetails, as Drive does on shared drives.
+func (s *Server) AddPermission(fileID string, permission *drive.Permission) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.permissions[fileID] = append(s.permissions[fileID], permission)
+}
+
+func (s *Server) add(parentID string, file *drive.File) *drive.File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.insert(parentID, file)
+	return file
+}
+
+func (s *Server) insert(parentID string, file *drive.File) {
+	file.Parents = []string{parentID}
+	file.ModifiedTime = ModifiedTime
+	file.CreatedTime = ModifiedTime
+	s.files[file.Id] = file
+	s.children[parentID] = append(s.children[parentID], file.Id)
+}
+
+// Fail makes the next len(codes) requests fail with the given HTTP status
+// codes, in order. 403 and 429 are reported as rate limit errors, 429 with
+// a Retry-After of one second.
+func (s *Server) Fail(codes ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, code := range codes {
+		s.failures = append(s.failures, failure{code: code})
+	}
+}
+
+// FailWith makes the next request fail with code and the given error
+// reason, e.g. 403 dailyLimitExceeded.
+func (s *Server) FailWith(code int, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failure{code: code, reason: reason})
+}
+
+// FailFolder makes every listing of folder id fail with code, until the
+// test ends.
+func (s *Server) FailFolder(id string, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.broken[id] = code
+}
+
+// Requests returns the number of requests served per endpoint (files.list,
+// files.get, files.export, files.copy, files.create, files.update,
+// revisions.list, permissions.list, drives.list, about.get,
+// thumbnails.get), failed ones included.
+func (s *Server) Requests() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int, len(s.requests))
+	for k, v := range s.requests {
+		counts[k] = v
+	}
+	return counts
+}
+
+// intercept counts requests and serves queued failures.
+func (s *Server) intercept(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[endpoint(r.Method, r.URL.Path)]++
+		var fail failure
+		if len(s.failures) > 0 {
+			fail = s.failures[0]
+			s.failures = s.failures[1:]
+		}
+		s.mu.Unlock()
+
+		if fail.code != 0 {
+			writeError(w, fail.code, fail.reason)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func endpoint(method, path string) string {
+	path = strings.TrimPrefix(path, basePath)
+	switch {
+	case strings.HasPrefix(path, "/thumbnails/"):
+		return "thumbnails.get"
+	case path == "files" && method == http.MethodPost:
+		return "files.create"
+	case path == "files":
+		return "files.list"
+	case strings.HasPrefix(path, "files/") && method == http.MethodPatch:
+		return "files.update"
+	case strings.HasPrefix(path, "files/") && strings.HasSuffix(path, "/copy"):
+		return "files.copy"
+	case strings.HasPrefix(path, "files/") && strings.HasSuffix(path, "/revisions"):
+		return "revisions.list"
+	case strings.HasPrefix(path, "files/") && strings.HasSuffix(path, "/permissions"):
+		return "permissions.list"
+	case strings.HasPrefix(path, "files/") && strings.HasSuffix(path, "/export"):
+		return "files.export"
+	case strings.HasPrefix(path, "files/"):
+		return "files.get"
+	case path == "drives":
+		return "drives.list"
+	default:
+		return path + ".get"
+	}
+}
+
+func (s *Server) listFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.createFolder(w, r)
+		return
+	}
+	match := parentQuery.FindStringSubmatch(r.URL.Query().Get("q"))
+	if match == nil {
+		writeError(w, http.StatusBadRequest, "")
+		return
+	}
+
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	if pageSize <= 0 || pageSize > 1000 {
+		pageSize = 100
+	}
+	if s.MaxPageSize > 0 && pageSize > s.MaxPageSize {
+		pageSize = s.MaxPageSize
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+
+	s.mu.Lock()
+	if code := s.broken[match[1]]; code != 0 {
+		s.mu.Unlock()
+		writeError(w, code, "")
+		return
+	}
+	ids := s.children[match[1]]
+	if strings.Contains(r.URL.Query().Get("q"), "trashed=false") {
+		var live []string
+		for _, id := range ids {
+			if !s.files[id].Trashed {
+				live = append(live, id)
+			}
+		}
+		ids = live
+	}
+	list := &drive.FileList{Files: make([]*drive.File, 0, pageSize)}
+	for i := offset; i < len(ids) && i < offset+pageSize; i++ {
+		list.Files = append(list.Files, s.files[ids[i]])
+	}
+	if offset+pageSize < len(ids) {
+		list.NextPageToken = strconv.Itoa(offset + pageSize)
+	}
+	writeJSON(w, list)
+	s.mu.Unlock()
+}
+
+func (s *Server) getFile(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, basePath+"files/")
+	id, revisions := strings.CutSuffix(id, "/revisions")
+	id, permissions := strings.CutSuffix(id, "/permissions")
+	id, export := strings.CutSuffix(id, "/export")
+	id, copied := strings.CutSuffix(id, "/copy")
+	if copied {
+		s.copyFile(w, r, id)
+		return
+	}
+	if r.Method == http.MethodPatch {
+		s.updateFile(w, r, id)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "")
+		return
+	}
+	if permissions {
+		writeJSON(w, &drive.PermissionList{Permissions: append([]*drive.Permission{}, s.permissions[id]...)})
+		return
+	}
+	if revisions {
+		list := append([]*drive.Revision(nil), s.revisions[id]...)
+		list = append(list, &drive.Revision{Id: "head", Size: file.Size})
+		writeJSON(w, &drive.RevisionList{Revisions: list})
+		return
+	}
+	native := strings.HasPrefix(file.MimeType, "application/vnd.google-apps.")
+	if export || r.URL.Query().Get("alt") == "media" {
+		// Drive exports only Google-native files and downloads the others
+		if export != native {
+			writeError(w, http.StatusForbidden, "fileNotDownloadable")
+			return
+		}
+		// Downloads honour Range headers; exports do not
+		if export {
+			w.Write(s.contents[id])
+		} else {
+			http.ServeContent(w, r, file.Name, time.Time{}, bytes.NewReader(s.contents[id]))
+		}
+		return
+	}
+	writeJSON(w, file)
+}
+
+func (s *Server) getThumbnail(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/thumbnails/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	image, ok := s.thumbnails[id]
+	if !ok || r.URL.Query().Get("v") != strconv.Itoa(s.generation) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(image))
+	w.Write(image)
+}
+
+// copyFile serves files.copy of a file into the parent in the request.
+func (s *Server) copyFile(w http.ResponseWriter, r *http.Request, id string) {
+	var req drive.File
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Parents) != 1 {
+		writeError(w, http.StatusBadRequest, "")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, ok := s.files[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "")
+		return
+	}
+	if file.MimeType == scanner.FolderMimeType {
+		writeError(w, http.StatusForbidden, "fileNotCopyable")
+		return
+	}
+	copied := *file
+	s.created++
+	copied.Id = fmt.Sprintf("copy%d", s.created)
+	if req.Name != "" {
+		copied.Name = req.Name
+	}
+	s.insert(req.Parents[0], &copied)
+	s.contents[copied.Id] = s.contents[id]
+	writeJSON(w, &copied)
+}
+
+// updateFile serves files.update of a file's name and parents.
+func (s *Server) updateFile(w http.ResponseWriter, r *http.Request, id string) {
+	var req drive.File
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "")
+		return
+	}
+	add, remove := r.URL.Query().Get("addParents"), r.URL.Query().Get("removeParents")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, ok := s.files[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "")
+		return
+	}
+	if (add == "") != (remove == "") || remove != "" && file.Parents[0] != remove {
+		writeError(w, http.StatusBadRequest, "")
+		return
+	}
+	if req.Name != "" {
+		file.Name = req.Name
+	}
+	if add != "" {
+		children := s.children[remove]
+		for i, child := range children {
+			if child == id {
+				s.children[remove] = append(children[:i:i], children[i+1:]...)
+				break
+			}
+		}
+		file.Parents = []string{add}
+		s.children[add] = append(s.children[add], id)
+	}
+	writeJSON(w, file)
+}
+
+// createFolder serves files.create of a folder.
+func (s *Server) createFolder(w http.ResponseWriter, r *http.Request) {
+	var req drive.File
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Parents) != 1 || req.MimeType != scanner.FolderMimeType {
+		writeError(w, http.StatusBadRequest, "")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.created++
+	folder := &drive.File{Id: fmt.Sprintf("folder%d", s.created), Name: req.Name, MimeType: scanner.FolderMimeType}
+	s.insert(req.Parents[0], folder)
+	writeJSON(w, folder)
+}
+
+func (s *Server) listDrives(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	drives := append([]*drive.Drive(nil), s.drives...)
+	sort.Slice(drives, func(i, j int) bool { return drives[i].Name < drives[j].Name })
+	writeJSON(w, &drive.DriveList{Drives: drives})
+}
+
+func (s *Server) about(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, &drive.About{User: &drive.User{EmailAddress: "user@drivetest.invalid"}})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds in the Drive API's error format.
+func writeError(w http.ResponseWriter, code int, reason string) {
+	switch {
+	case reason != "":
+	case code == http.StatusBadRequest:
+		reason = "badRequest"
+	case code == http.StatusUnauthorized:
+		reason = "authError"
+	case code == http.StatusForbidden:
+		reason = "userRateLimitExceeded"
+	case code == http.StatusNotFound:
+		reason = "notFound"
+	case code == http.StatusTooManyRequests:
+		reason = "rateLimitExceeded"
+	default:
+		reason = "backendError"
+	}
+	if code == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "1")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": http.StatusText(code),
+			"errors":  []map[string]string{{"reason": reason, "message": http.StatusText(code)}},
+		},
+	})
+}
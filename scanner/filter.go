@@ -0,0 +1,272 @@
+package scanner
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PathFilter decides which paths a scan records and descends into. Paths
+// are relative to the scan root and start with "/", e.g. "/Media/a.mkv".
+//
+// Patterns are globs where * and ? match within one path segment and **
+// matches any number of segments. A pattern without a leading "/" matches
+// at any depth, so "node_modules/**" behaves like "/**/node_modules/**".
+// Patterns prefixed with "re:" are regular expressions matched against the
+// whole path instead.
+type PathFilter struct {
+	include []pathRule
+	exclude []pathRule
+}
+
+// pathRule is one compiled pattern: either glob segments or a regexp.
+type pathRule struct {
+	glob []string
+	re   *regexp.Regexp
+}
+
+func compileRule(pattern string) (pathRule, error) {
+	if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return pathRule{}, fmt.Errorf("invalid path regexp %q: %w", expr, err)
+		}
+		return pathRule{re: re}, nil
+	}
+
+	glob, err := compileGlob(pattern)
+	if err != nil {
+		return pathRule{}, err
+	}
+	return pathRule{glob: glob}, nil
+}
+
+func (r pathRule) match(p string, segments []string) bool {
+	if r.re != nil {
+		return r.re.MatchString(p)
+	}
+	return matchSegments(r.glob, segments)
+}
+
+// matchBelow reports whether some path below the folder p could match.
+// Regexps cannot be checked for prefixes, so they always could.
+func (r pathRule) matchBelow(segments []string) bool {
+	if r.re != nil {
+		return true
+	}
+	return matchPrefix(r.glob, segments)
+}
+
+// NewPathFilter compiles include and exclude patterns. With no include
+// patterns everything not excluded is scanned.
+func NewPathFilter(include []string, exclude []string) (*PathFilter, error) {
+	f := &PathFilter{}
+	for _, pattern := range include {
+		rule, err := compileRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, rule)
+	}
+	for _, pattern := range exclude {
+		rule, err := compileRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, rule)
+	}
+	return f, nil
+}
+
+func compileGlob(pattern string) ([]string, error) {
+	anchored := strings.HasPrefix(pattern, "/")
+	segments := splitPath(pattern)
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("empty path pattern %q", pattern)
+	}
+	for _, segment := range segments {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+		}
+	}
+	if !anchored && segments[0] != "**" {
+		segments = append([]string{"**"}, segments...)
+	}
+	return segments, nil
+}
+
+func splitPath(p string) []string {
+	var segments []string
+	for _, segment := range strings.Split(p, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// allowFile reports whether a file at p is recorded.
+func (f *PathFilter) allowFile(p string) bool {
+	if f == nil {
+		return true
+	}
+	segments := splitPath(p)
+	if f.excluded(p, segments) {
+		return false
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, rule := range f.include {
+		if rule.match(p, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowFolder reports whether a folder at p is recorded and descended into.
+// Folders outside every include pattern are still walked if something
+// below them could match.
+func (f *PathFilter) allowFolder(p string) bool {
+	if f == nil {
+		return true
+	}
+	segments := splitPath(p)
+	if f.excluded(p, segments) {
+		return false
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, rule := range f.include {
+		if rule.match(p, segments) || rule.matchBelow(segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether p matches an exclude rule. Excluded folders are
+// not listed at all, which is what saves API quota.
+func (f *PathFilter) excluded(p string, segments []string) bool {
+	for _, rule := range f.exclude {
+		if rule.match(p, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches a compiled glob against a whole path.
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+// matchPrefix reports whether some path below the folder segments could
+// match pattern.
+func matchPrefix(pattern []string, segments []string) bool {
+	if len(segments) == 0 {
+		return len(pattern) > 0
+	}
+	if len(pattern) == 0 {
+		return false
+	}
+	if pattern[0] == "**" {
+		return true
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchPrefix(pattern[1:], segments[1:])
+}
+
+// FileFilter restricts which files are indexed by type. Folders are never
+// filtered here so traversal still reaches matching files below them.
+type FileFilter struct {
+	// MimeTypes allows only these types; "video/*" allows every subtype.
+	MimeTypes []string
+	// Extensions allows only these file extensions, without the dot and
+	// case-insensitive.
+	Extensions []string
+	// SkipGoogleNative drops Docs, Sheets, Slides and other export-only
+	// Google formats.
+	SkipGoogleNative bool
+	// MinSize and MaxSize bound the file size in bytes; zero disables the
+	// bound. Google-native files report size 0 and are only affected by
+	// MinSize.
+	MinSize int64
+	MaxSize int64
+}
+
+const googleNativePrefix = "application/vnd.google-apps."
+
+// allow reports whether a file with the given name, MIME type and size is
+// indexed.
+func (f *FileFilter) allow(name string, mimeType string, size int64) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.MinSize > 0 && size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && size > f.MaxSize {
+		return false
+	}
+
+	if f.SkipGoogleNative && strings.HasPrefix(mimeType, googleNativePrefix) {
+		return false
+	}
+
+	if len(f.MimeTypes) > 0 {
+		allowed := false
+		for _, pattern := range f.MimeTypes {
+			if pattern == mimeType ||
+				strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*")) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	if len(f.Extensions) > 0 {
+		ext := strings.TrimPrefix(path.Ext(name), ".")
+		allowed := false
+		for _, candidate := range f.Extensions {
+			if strings.EqualFold(strings.TrimPrefix(candidate, "."), ext) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
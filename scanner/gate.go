@@ -0,0 +1,64 @@
+package scanner
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gate holds workers back before their next Drive API call while it is
+// closed.
+type gate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	shut   bool
+	metric prometheus.Gauge // 1 while closed
+}
+
+func newGate(metric prometheus.Gauge) *gate {
+	g := &gate{metric: metric}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+func (g *gate) closed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.shut
+}
+
+func (g *gate) set(closed bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.shut = closed
+	if closed {
+		g.metric.Set(1)
+	} else {
+		g.metric.Set(0)
+		g.cond.Broadcast()
+	}
+}
+
+// wait blocks while the gate is closed or until ctx ends.
+func (g *gate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.shut {
+		return nil
+	}
+	// Wake up on cancellation too
+	stop := context.AfterFunc(ctx, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.cond.Broadcast()
+	})
+	defer stop()
+
+	for g.shut && ctx.Err() == nil {
+		g.cond.Wait()
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,94 @@
+package scanner
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// UnfinishedFolder is a folder a canceled scan had not finished listing.
+// Path is its recorded path, "" for the target root.
+type UnfinishedFolder struct {
+	ID   string
+	Path string
+}
+
+// InterruptedError is returned by a Drive scan that was canceled.
+// Everything recorded before the cancellation has been written; rescanning
+// Folders completes the index.
+type InterruptedError struct {
+	Err     error
+	Folders []UnfinishedFolder
+}
+
+func (e *InterruptedError) Error() string {
+	return "scan interrupted: " + e.Err.Error()
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// unfinishedFolders collects the folders workers gave up on.
+type unfinishedFolders struct {
+	mu      sync.Mutex
+	folders []UnfinishedFolder
+}
+
+func (u *unfinishedFolders) add(job folderJob) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.folders = append(u.folders, UnfinishedFolder{ID: job.ID, Path: job.Path})
+}
+
+// roots returns the unfinished folders that are not below another one: a
+// rescan of a folder covers everything under it.
+func (u *unfinishedFolders) roots() []UnfinishedFolder {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	paths := make(map[string]bool, len(u.folders))
+	for _, folder := range u.folders {
+		paths[folder.Path] = true
+	}
+
+	var roots []UnfinishedFolder
+	for _, folder := range u.folders {
+		if !underAny(folder.Path, paths) {
+			roots = append(roots, folder)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Path < roots[j].Path })
+	return roots
+}
+
+// underAny reports whether p lies below one of paths, "" being the root.
+func underAny(p string, paths map[string]bool) bool {
+	for p != "" {
+		if i := strings.LastIndex(p, "/"); i >= 0 {
+			p = p[:i]
+		} else {
+			p = ""
+		}
+		if _, ok := paths[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CancelScan cancels the running Drive scans of a target, reporting
+// whether there were any.
+func CancelScan(teamDriveID string) bool {
+	runningScans.Lock()
+	defer runningScans.Unlock()
+
+	canceled := false
+	for stats := range runningScans.stats {
+		if stats.TeamDriveID == teamDriveID {
+			stats.cancel()
+			canceled = true
+		}
+	}
+	return canceled
+}
@@ -0,0 +1,92 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// jobSaveInterval is how often a running job's progress is stored.
+const jobSaveInterval = 2 * time.Second
+
+// jobSet tracks the running jobs of one kind, for canceling them.
+type jobSet struct {
+	kind string // for errors, "download" or "copy"
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+}
+
+// start runs a job in the background, refusing one already running.
+func (s *jobSet) start(id string, run func(ctx context.Context)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.running[id]; ok {
+		return fmt.Errorf("%s job %s is already running", s.kind, id)
+	}
+	if s.running == nil {
+		s.running = make(map[string]context.CancelFunc)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.running[id] = cancel
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, id)
+			s.mu.Unlock()
+			cancel()
+		}()
+		run(ctx)
+	}()
+	return nil
+}
+
+// Cancel stops a running job, reporting whether it was running.
+func (s *jobSet) Cancel(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cancel, ok := s.running[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// Running reports whether a job is running.
+func (s *jobSet) Running(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.running[id]
+	return ok
+}
+
+// jobProgress counts a run's progress for storing while workers update it.
+type jobProgress struct {
+	doneFiles, doneBytes, skipped, failed atomic.Int64
+}
+
+// saveEvery calls save every jobSaveInterval until the returned stop,
+// which waits for a save in progress.
+func (p *jobProgress) saveEvery(save func()) (stop func()) {
+	done, saved := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(saved)
+		ticker := time.NewTicker(jobSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				save()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-saved
+	}
+}
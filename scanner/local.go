@@ -0,0 +1,85 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LocalProvider catalogs a local directory or network mount. Records are
+// stored under Target.TeamDriveID, the mount's label, with paths relative
+// to Root. Symlinks are recorded but not followed.
+type LocalProvider struct {
+	Target ScanConfig
+	Root   string
+}
+
+func (p *LocalProvider) Scan(ctx context.Context, sink RecordSink) error {
+	root, err := filepath.Abs(p.Root)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
+	}
+
+	tree := newFlatTree(p.Target, sink)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if path == root {
+			return err
+		}
+		// Unreadable entries are skipped rather than failing the scan
+		if err != nil {
+			log.Printf("[%s] Skipping %s: %v", p.Target.TeamDriveName, path, err)
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			log.Printf("[%s] Skipping %s: %v", p.Target.TeamDriveName, path, err)
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		entry := flatEntry{
+			Path:         rel,
+			IsDir:        d.IsDir(),
+			ModifiedTime: info.ModTime().UTC().Format(time.RFC3339),
+			Link:         (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String(),
+		}
+		if !entry.IsDir {
+			entry.Size = info.Size()
+		}
+		if err := tree.add(entry); err != nil {
+			return err
+		}
+
+		// Excluded folders are not walked at all
+		if entry.IsDir && !tree.folders[rel] {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tree.finish()
+}
@@ -0,0 +1,69 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"teamdrive-scanner/metrics"
+)
+
+// memoryGate holds workers back while the process is over its memory
+// limit. It is process-wide: all scans share the memory.
+var memoryGate = newGate(metrics.MemoryThrottled)
+
+// WatchMemory samples the resident set size every second until ctx ends.
+// While it exceeds limit bytes, workers issue no new Drive API calls and
+// freed memory is returned to the OS, so the backlog drains before the
+// scan goes on. The Go heap is also given limit as its soft limit.
+func WatchMemory(ctx context.Context, limit int64) {
+	debug.SetMemoryLimit(limit)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer memoryGate.set(false)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		rss := residentMemory()
+		metrics.MemoryResident.Set(float64(rss))
+
+		over := rss > limit
+		if over != memoryGate.closed() {
+			if over {
+				log.Printf("Memory use %d MB is over the %d MB limit, holding workers back", rss>>20, limit>>20)
+				debug.FreeOSMemory()
+			} else {
+				log.Printf("Memory use %d MB is under the limit again, resuming workers", rss>>20)
+			}
+			memoryGate.set(over)
+		}
+	}
+}
+
+// residentMemory returns the process's resident set size, read from
+// /proc on Linux. Elsewhere it falls back to the memory the Go runtime
+// holds from the OS.
+func residentMemory() int64 {
+	if data, err := os.ReadFile("/proc/self/statm"); err == nil {
+		if fields := bytes.Fields(data); len(fields) > 1 {
+			if pages, err := strconv.ParseInt(string(fields[1]), 10, 64); err == nil {
+				return pages * int64(os.Getpagesize())
+			}
+		}
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.Sys - stats.HeapReleased)
+}
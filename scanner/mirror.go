@@ -0,0 +1,446 @@
+package scanner
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"teamdrive-scanner/database"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// mirrorPage is how many search results a job reads at a time
+	mirrorPage = 1000
+	// mirrorChunk caps the bytes read at a time, and so the burst of a
+	// bandwidth limit
+	mirrorChunk = 256 << 10
+	// partSuffix marks a file still being downloaded
+	partSuffix = ".part"
+)
+
+// DownloadJobs runs the download jobs of this process: each mirrors the
+// files a search finds to a directory under root, as
+// <dest>/<drive name>/<path>. Files already there with the size and
+// modification time of the index are skipped, and partial downloads are
+// continued with Range requests, so a canceled or interrupted job resumes
+// where it stopped.
+type DownloadJobs struct {
+	jobSet
+
+	db          *database.Database
+	pool        *ServiceAccountPool
+	root        string
+	concurrency int
+	bandwidth   int64
+	parse       func(params string) (database.SearchOptions, error)
+}
+
+// NewDownloadJobs returns a runner downloading through pool into root.
+// concurrency and bandwidth are the defaults of new jobs, and parse turns
+// a job's search parameters into search options.
+func NewDownloadJobs(db *database.Database, pool *ServiceAccountPool, root string, concurrency int, bandwidth int64,
+	parse func(params string) (database.SearchOptions, error)) *DownloadJobs {
+	return &DownloadJobs{
+		jobSet:      jobSet{kind: "download"},
+		db:          db,
+		pool:        pool,
+		root:        root,
+		concurrency: concurrency,
+		bandwidth:   bandwidth,
+		parse:       parse,
+	}
+}
+
+// Defaults returns the concurrency and bandwidth of jobs that set none.
+func (j *DownloadJobs) Defaults() (int, int64) {
+	return j.concurrency, j.bandwidth
+}
+
+// Resume starts the jobs left queued or running when the process last
+// stopped.
+func (j *DownloadJobs) Resume(ctx context.Context) error {
+	jobs, err := j.db.UnfinishedDownloadJobs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		log.Printf("Resuming download job %s", job.ID)
+		if err := j.Start(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start runs a job in the background.
+func (j *DownloadJobs) Start(job database.DownloadJob) error {
+	return j.start(job.ID, func(ctx context.Context) { j.run(ctx, job) })
+}
+
+// mirrorTarget is a file of a job and where it goes.
+type mirrorTarget struct {
+	record database.FileRecord
+	path   string
+}
+
+// storeProgress copies a run's progress to its job.
+func storeProgress(job *database.DownloadJob, p *jobProgress) {
+	job.DoneFiles = p.doneFiles.Load()
+	job.DoneBytes = p.doneBytes.Load()
+	job.SkippedFiles = p.skipped.Load()
+	job.FailedFiles = p.failed.Load()
+}
+
+func (j *DownloadJobs) run(ctx context.Context, job database.DownloadJob) {
+	// Progress is counted afresh on each run, the files finished before
+	// being found up to date
+	job.Status = database.JobRunning
+	job.Error = ""
+	job.StartedAt = time.Now().UTC().Format(time.RFC3339)
+	job.FinishedAt = ""
+	job.TotalFiles, job.TotalBytes = 0, 0
+	var progress jobProgress
+	storeProgress(&job, &progress)
+
+	save := func() {
+		if err := j.db.UpdateDownloadJob(context.Background(), &job); err != nil {
+			log.Printf("Failed to save download job %s: %v", job.ID, err)
+		}
+	}
+	finish := func(status string, err error) {
+		storeProgress(&job, &progress)
+		job.Status = status
+		if err != nil {
+			job.Error = err.Error()
+		}
+		job.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+		save()
+		log.Printf("Download job %s %s: %d/%d files, %d skipped, %d failed", job.ID, status,
+			job.DoneFiles, job.TotalFiles, job.SkippedFiles, job.FailedFiles)
+	}
+	save()
+
+	dir := filepath.Join(j.root, filepath.FromSlash(job.Dest))
+	targets, err := j.list(ctx, job.Params, dir)
+	if err == nil {
+		err = os.MkdirAll(dir, 0o755)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			finish(database.JobCanceled, nil)
+		} else {
+			finish(database.JobFailed, err)
+		}
+		return
+	}
+	for _, target := range targets {
+		job.TotalFiles++
+		job.TotalBytes += target.record.Size
+	}
+	save()
+
+	var limiter *rate.Limiter
+	if job.Bandwidth > 0 {
+		burst := int(min(job.Bandwidth, mirrorChunk))
+		limiter = rate.NewLimiter(rate.Limit(job.Bandwidth), burst)
+	}
+	concurrency := job.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	jobs := make(chan mirrorTarget)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range jobs {
+				if err := pauseGate.wait(ctx); err != nil {
+					continue
+				}
+				err := j.mirror(ctx, target, limiter, &progress)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Download job %s: cannot download %s: %v", job.ID, target.record.Path, err)
+						progress.failed.Add(1)
+					}
+					continue
+				}
+				progress.doneFiles.Add(1)
+			}
+		}()
+	}
+
+	stopSaving := progress.saveEvery(func() {
+		storeProgress(&job, &progress)
+		save()
+	})
+
+feed:
+	for _, target := range targets {
+		select {
+		case jobs <- target:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	stopSaving()
+
+	switch {
+	case ctx.Err() != nil:
+		finish(database.JobCanceled, nil)
+	case progress.failed.Load() > 0:
+		finish(database.JobCompleted, fmt.Errorf("%d files failed; resume the job to retry them", progress.failed.Load()))
+	default:
+		finish(database.JobCompleted, nil)
+	}
+}
+
+// list returns the files of a job's search that have content to download,
+// leaving out folders, shortcuts and Google-native files. Files of the
+// same drive and path get their ID added to their name.
+func (j *DownloadJobs) list(ctx context.Context, params, dir string) ([]mirrorTarget, error) {
+	opts, err := j.parse(params)
+	if err != nil {
+		return nil, err
+	}
+	noFolders, noNative := false, false
+	opts.IsFolder, opts.Native = &noFolders, &noNative
+	opts.Limit, opts.Offset, opts.Cursor, opts.NoCount = mirrorPage, 0, "", true
+
+	var targets []mirrorTarget
+	seen := make(map[string]bool)
+	for {
+		result, err := j.db.Search(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range result.Files {
+			if record.IsFolder || record.IsShortcut || record.IsNative || database.IsGoogleNative(record.MimeType) {
+				continue
+			}
+			path := mirrorPath(dir, record.TeamDriveName, record.Path)
+			if seen[path] {
+				ext := filepath.Ext(path)
+				path = strings.TrimSuffix(path, ext) + " (" + record.ID + ")" + ext
+			}
+			seen[path] = true
+			targets = append(targets, mirrorTarget{record: record, path: path})
+		}
+		if !result.HasMore {
+			return targets, nil
+		}
+		if result.NextCursor != "" {
+			opts.Cursor = result.NextCursor
+		} else {
+			opts.Offset = result.NextOffset
+		}
+	}
+}
+
+// mirrorPath places an index path under dir and the drive's directory.
+// Components that would leave it, or that cannot be file names, are
+// replaced.
+func mirrorPath(dir, teamDrive, path string) string {
+	parts := append([]string{teamDrive}, strings.Split(strings.Trim(path, "/"), "/")...)
+	for i, part := range parts {
+		part = strings.ReplaceAll(part, "\x00", "")
+		part = strings.ReplaceAll(part, string(filepath.Separator), "_")
+		switch part {
+		case "", ".", "..":
+			part = "_"
+		}
+		parts[i] = part
+	}
+	return filepath.Join(append([]string{dir}, parts...)...)
+}
+
+// mirror downloads one file to its path unless it is there already.
+// Transfers cut off midway are continued from the partial file a few
+// times before giving up.
+func (j *DownloadJobs) mirror(ctx context.Context, target mirrorTarget, limiter *rate.Limiter, progress *jobProgress) error {
+	record := target.record
+	modified, _ := time.Parse(time.RFC3339, record.ModifiedTime)
+	if info, err := os.Stat(target.path); err == nil && info.Size() == record.Size && (modified.IsZero() || info.ModTime().Equal(modified)) {
+		progress.doneBytes.Add(info.Size())
+		progress.skipped.Add(1)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target.path), 0o755); err != nil {
+		return err
+	}
+
+	part := target.path + partSuffix
+	counted := &fileProgress{job: progress}
+	var err error
+	for attempt := 0; attempt < retryAttempts; attempt++ {
+		var retry bool
+		if retry, err = j.transfer(ctx, record, part, limiter, counted); err == nil || !retry || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(part, target.path); err != nil {
+		return err
+	}
+	if !modified.IsZero() {
+		return os.Chtimes(target.path, modified, modified)
+	}
+	return nil
+}
+
+// transfer downloads what the partial file lacks of a file and checks the
+// result, reporting whether an error is worth continuing from.
+func (j *DownloadJobs) transfer(ctx context.Context, record database.FileRecord, part string, limiter *rate.Limiter, counted *fileProgress) (bool, error) {
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	have, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	counted.set(have)
+
+	// A partial file as long as the file was finished before the process
+	// stopped, and only needs checking
+	if have != record.Size {
+		if retry, err := j.fetch(ctx, record, f, have, limiter, counted); err != nil {
+			return retry, err
+		}
+	}
+	if record.MD5Checksum != "" {
+		sum, err := fileMD5(f)
+		if err != nil {
+			return false, err
+		}
+		if sum != record.MD5Checksum {
+			// The next attempt starts over
+			counted.set(0)
+			if err := f.Truncate(0); err != nil {
+				return false, err
+			}
+			return true, errors.New("checksum mismatch")
+		}
+	}
+	return false, nil
+}
+
+// fetch appends the rest of a file to the have bytes of f, or rewrites f
+// when Drive sends the whole file.
+func (j *DownloadJobs) fetch(ctx context.Context, record database.FileRecord, f *os.File, have int64, limiter *rate.Limiter, counted *fileProgress) (bool, error) {
+	byteRange := ""
+	if have > 0 && have < record.Size {
+		byteRange = "bytes=" + strconv.FormatInt(have, 10) + "-"
+	}
+	resp, err := OpenDownload(ctx, j.pool, record.TeamDriveName, record.ID, byteRange)
+	if byteRange != "" && APIStatus(err) == http.StatusRequestedRangeNotSatisfiable {
+		// The file shrank since it was indexed; fetch it whole
+		byteRange = ""
+		resp, err = OpenDownload(ctx, j.pool, record.TeamDriveName, record.ID, "")
+	}
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if byteRange == "" || resp.StatusCode != http.StatusPartialContent {
+		if err := f.Truncate(0); err != nil {
+			return false, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		counted.set(0)
+		have = 0
+	}
+
+	body := io.Reader(resp.Body)
+	if limiter != nil {
+		body = &throttledReader{ctx: ctx, r: body, limiter: limiter}
+	}
+	written, err := io.Copy(counted.writer(f), body)
+	if err != nil {
+		return true, err
+	}
+	if size := have + written; size != record.Size {
+		return true, fmt.Errorf("downloaded %d bytes, expected %d", size, record.Size)
+	}
+	return false, nil
+}
+
+func fileMD5(f *os.File) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileProgress is what one file has added to its job's bytes, so attempts
+// that start over take theirs back.
+type fileProgress struct {
+	job     *jobProgress
+	counted int64
+}
+
+// set makes the file count n bytes.
+func (p *fileProgress) set(n int64) {
+	p.job.doneBytes.Add(n - p.counted)
+	p.counted = n
+}
+
+func (p *fileProgress) writer(w io.Writer) io.Writer {
+	return writerFunc(func(b []byte) (int, error) {
+		n, err := w.Write(b)
+		p.set(p.counted + int64(n))
+		return n, err
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
+
+// throttledReader paces reads to a job's bandwidth limit.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if burst := t.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.limiter.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
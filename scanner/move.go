@@ -0,0 +1,17 @@
+package scanner
+
+import "context"
+
+// MoveFile renames a file or folder in Drive to name, when set, and moves
+// it from the folder oldParent to newParent, when they differ, through the
+// pool's accounts, counting the call under teamDrive. The accounts need
+// write access.
+func MoveFile(ctx context.Context, pool *ServiceAccountPool, teamDrive, fileID, name, oldParent, newParent string) error {
+	if oldParent == newParent {
+		oldParent, newParent = "", ""
+	}
+	return callWithRetry(ctx, pool, false, teamDrive, func(account *serviceAccount) error {
+		_, err := account.client.Update(ctx, fileID, name, newParent, oldParent)
+		return err
+	})
+}
@@ -0,0 +1,147 @@
+package scanner
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// InitUserPool builds a single-account pool that authenticates as a user
+// through OAuth instead of service accounts. clientFile is the OAuth client
+// JSON downloaded from the Cloud Console; tokenFile caches the user's token
+// and is created through a browser flow on first use. write asks for full
+// access instead of read-only; a token cached without it keeps read-only
+// access until tokenFile is removed and the user authorizes again.
+func InitUserPool(clientFile string, tokenFile string, ratePerAccount int, write bool) (*ServiceAccountPool, error) {
+	clientJSON, err := os.ReadFile(clientFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read OAuth client file: %w", err)
+	}
+
+	scope := drive.DriveReadonlyScope
+	if write {
+		scope = drive.DriveScope
+	}
+	oauthConfig, err := google.ConfigFromJSON(clientJSON, scope)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OAuth client file: %w", err)
+	}
+
+	token, err := loadToken(tokenFile)
+	if err != nil {
+		log.Printf("No usable OAuth token in %s, starting browser authorization", tokenFile)
+		token, err = authorizeInBrowser(oauthConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := saveToken(tokenFile, token); err != nil {
+			return nil, fmt.Errorf("cannot save OAuth token: %w", err)
+		}
+		log.Printf("OAuth token saved to %s", tokenFile)
+	}
+
+	ctx := context.Background()
+	httpClient := oauth2.NewClient(ctx, oauthConfig.TokenSource(ctx, token))
+	service, err := drive.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		return nil, err
+	}
+
+	client := NewServiceClient(service, httpClient)
+	about, err := client.About(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("OAuth token rejected: %w", err)
+	}
+
+	pool := &ServiceAccountPool{budget: &dailyBudget{}}
+	pool.accounts.Store(&[]*serviceAccount{newServiceAccount(about.User.EmailAddress, client, ratePerAccount, pool.budget)})
+	return pool, nil
+}
+
+func loadToken(path string) (*oauth2.Token, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+	if token.RefreshToken == "" && !token.Valid() {
+		return nil, fmt.Errorf("token has expired and cannot be refreshed")
+	}
+
+	return &token, nil
+}
+
+func saveToken(path string, token *oauth2.Token) error {
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// authorizeInBrowser runs the OAuth loopback flow: it listens on a local
+// port, prints the consent URL and exchanges the code Google redirects back
+// with.
+func authorizeInBrowser(oauthConfig *oauth2.Config) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	oauthConfig.RedirectURL = "http://" + listener.Addr().String()
+
+	stateBytes := make([]byte, 16)
+	if _, err := rand.Read(stateBytes); err != nil {
+		return nil, err
+	}
+	state := hex.EncodeToString(stateBytes)
+
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("state") != state {
+			http.Error(w, "Invalid state", http.StatusBadRequest)
+			return
+		}
+		if e := r.URL.Query().Get("error"); e != "" {
+			fmt.Fprintln(w, "Authorization failed. You can close this window.")
+			errs <- fmt.Errorf("authorization denied: %s", e)
+			return
+		}
+		fmt.Fprintln(w, "Authorization complete. You can close this window.")
+		codes <- r.URL.Query().Get("code")
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	url := oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+	fmt.Printf("\nOpen this URL in a browser to authorize Drive access:\n\n%s\n\n", url)
+
+	select {
+	case code := <-codes:
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return oauthConfig.Exchange(ctx, code)
+	case err := <-errs:
+		return nil, err
+	case <-time.After(5 * time.Minute):
+		return nil, fmt.Errorf("timed out waiting for authorization")
+	}
+}
@@ -0,0 +1,49 @@
+package scanner
+
+import (
+	"log"
+
+	"teamdrive-scanner/metrics"
+)
+
+// pauseGate holds back the Drive scans of this process while they are
+// paused. Their queues and counters stay in memory, so a resumed scan goes
+// on where it stopped.
+var pauseGate = newGate(metrics.ScansPaused)
+
+// PauseScans stops running and future Drive scans from issuing API calls
+// until ResumeScans. Calls already in flight complete.
+func PauseScans() {
+	if !pauseGate.closed() {
+		log.Println("Scans paused")
+	}
+	pauseGate.set(true)
+}
+
+// ResumeScans lets paused scans go on.
+func ResumeScans() {
+	if pauseGate.closed() {
+		log.Println("Scans resumed")
+	}
+	pauseGate.set(false)
+}
+
+// ScansPaused reports whether scans are paused.
+func ScansPaused() bool {
+	return pauseGate.closed()
+}
+
+// Control exposes the scans of this process to the web server.
+type Control struct{}
+
+func (Control) Running() []Progress            { return RunningScans() }
+func (Control) Cancel(teamDriveID string) bool { return CancelScan(teamDriveID) }
+func (Control) Paused() bool                   { return ScansPaused() }
+
+func (Control) Pause(paused bool) {
+	if paused {
+		PauseScans()
+	} else {
+		ResumeScans()
+	}
+}
@@ -0,0 +1,271 @@
+package scanner
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// pdfStreamLimit caps the bytes inflated from each PDF stream.
+const pdfStreamLimit = 16 << 20
+
+// pdfKerningSpace is how far back, in thousandths of a text unit, a TJ
+// adjustment has to move for it to stand for a space between words.
+const pdfKerningSpace = -200
+
+// pdfSkipped marks the streams that hold no page text: images, fonts,
+// object and cross-reference streams.
+var pdfSkipped = [][]byte{
+	[]byte("/Image"), []byte("/Length1"), []byte("/Length2"), []byte("/FontFile"),
+	[]byte("/ObjStm"), []byte("/XRef"), []byte("/Metadata"),
+}
+
+// pdfText returns the text a PDF draws, as far as a small parser can tell:
+// the strings shown by the text operators of its content streams, inflated
+// when Flate-compressed. Text in fonts with their own encodings comes out
+// garbled, and scanned pages, being images, have none.
+func pdfText(data []byte) string {
+	var text strings.Builder
+	for pos := 0; ; {
+		i := bytes.Index(data[pos:], []byte("stream"))
+		if i < 0 {
+			break
+		}
+		start := pos + i
+		pos = start + len("stream")
+		if start >= 3 && string(data[start-3:start]) == "end" {
+			continue
+		}
+
+		// The stream's dictionary follows the "obj" keyword before it
+		dict := data[:start]
+		if obj := bytes.LastIndex(dict, []byte("obj")); obj >= 0 {
+			dict = dict[obj:]
+		}
+		if pos < len(data) && data[pos] == '\r' {
+			pos++
+		}
+		if pos < len(data) && data[pos] == '\n' {
+			pos++
+		}
+		end := bytes.Index(data[pos:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := data[pos : pos+end]
+		pos += end + len("endstream")
+
+		if skipStream(dict) {
+			continue
+		}
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			r, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			// A damaged stream still gives what inflated before the damage
+			stream, _ = io.ReadAll(io.LimitReader(r, pdfStreamLimit))
+			r.Close()
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			continue
+		}
+		showText(&text, stream)
+	}
+	return text.String()
+}
+
+func skipStream(dict []byte) bool {
+	for _, marker := range pdfSkipped {
+		if bytes.Contains(dict, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// showText writes the strings a content stream shows between BT and ET.
+// Moving to the next line ends a line of text; other moves and wide TJ
+// adjustments separate words.
+func showText(text *strings.Builder, stream []byte) {
+	var shown []string // operands since the last operator
+	inText := false
+	for i := 0; i < len(stream); {
+		c := stream[i]
+		switch {
+		case c == '(':
+			s, next := literalString(stream, i)
+			shown = append(shown, s)
+			i = next
+		case c == '<' && i+1 < len(stream) && stream[i+1] == '<':
+			// A dictionary operand, as of marked content
+			i += 2
+		case c == '<':
+			s, next := hexString(stream, i)
+			shown = append(shown, s)
+			i = next
+		case c == '%':
+			for i < len(stream) && stream[i] != '\n' && stream[i] != '\r' {
+				i++
+			}
+		case c == '-' || c == '.' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(stream) && (stream[j] == '.' || stream[j] >= '0' && stream[j] <= '9') {
+				j++
+			}
+			if n, err := strconv.ParseFloat(string(stream[i:j]), 64); err == nil && n < pdfKerningSpace && len(shown) > 0 {
+				shown = append(shown, " ")
+			}
+			i = j
+		case c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '\'' || c == '"' || c == '*':
+			j := i + 1
+			for j < len(stream) && (stream[j] >= 'A' && stream[j] <= 'Z' || stream[j] >= 'a' && stream[j] <= 'z' || stream[j] == '*') {
+				j++
+			}
+			switch op := string(stream[i:j]); op {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				text.WriteByte('\n')
+			case "Tj", "TJ":
+				if inText {
+					text.WriteString(strings.Join(shown, ""))
+				}
+			case "'", "\"":
+				if inText {
+					text.WriteByte('\n')
+					text.WriteString(strings.Join(shown, ""))
+				}
+			case "T*":
+				text.WriteByte('\n')
+			case "Td", "TD", "Tm":
+				if inText {
+					text.WriteByte(' ')
+				}
+			}
+			shown = shown[:0]
+			i = j
+		default:
+			i++
+		}
+	}
+}
+
+// literalString reads the (string) at stream[i], returning its text and
+// the position after it.
+func literalString(stream []byte, i int) (string, int) {
+	var s []byte
+	depth := 0
+	for i++; i < len(stream); i++ {
+		c := stream[i]
+		switch c {
+		case '\\':
+			i++
+			if i >= len(stream) {
+				break
+			}
+			switch e := stream[i]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// A line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					n := 0
+					for k := 0; k < 3 && i < len(stream) && stream[i] >= '0' && stream[i] <= '7'; k++ {
+						n = n*8 + int(stream[i]-'0')
+						i++
+					}
+					i--
+					s = append(s, byte(n))
+				} else {
+					s = append(s, e)
+				}
+			}
+		case '(':
+			depth++
+			s = append(s, c)
+		case ')':
+			if depth == 0 {
+				return decodePDFString(s), i + 1
+			}
+			depth--
+			s = append(s, c)
+		default:
+			s = append(s, c)
+		}
+	}
+	return decodePDFString(s), i
+}
+
+// hexString reads the <hex string> at stream[i], returning its text and
+// the position after it.
+func hexString(stream []byte, i int) (string, int) {
+	var s []byte
+	digit, high := 0, false
+	for i++; i < len(stream) && stream[i] != '>'; i++ {
+		n, err := strconv.ParseUint(string(stream[i]), 16, 8)
+		if err != nil {
+			continue
+		}
+		if high {
+			s = append(s, byte(digit<<4|int(n)))
+		} else {
+			digit = int(n)
+		}
+		high = !high
+	}
+	if high {
+		s = append(s, byte(digit<<4))
+	}
+	return decodePDFString(s), i + 1
+}
+
+// decodePDFString turns the bytes of a PDF string into text: UTF-16 with a
+// byte order mark, or two-byte codes whose high bytes are all zero, as
+// fonts with Identity encodings often use, or else one byte per
+// character. Control characters become spaces.
+func decodePDFString(s []byte) string {
+	var runes []rune
+	switch {
+	case len(s) >= 2 && s[0] == 0xfe && s[1] == 0xff:
+		units := make([]uint16, 0, len(s)/2)
+		for i := 2; i+1 < len(s); i += 2 {
+			units = append(units, uint16(s[i])<<8|uint16(s[i+1]))
+		}
+		runes = utf16.Decode(units)
+	case len(s) >= 2 && len(s)%2 == 0 && zeroHighBytes(s):
+		for i := 1; i < len(s); i += 2 {
+			runes = append(runes, rune(s[i]))
+		}
+	default:
+		runes = make([]rune, len(s))
+		for i, b := range s {
+			runes[i] = rune(b)
+		}
+	}
+	for i, r := range runes {
+		if unicode.IsControl(r) {
+			runes[i] = ' '
+		}
+	}
+	return string(runes)
+}
+
+func zeroHighBytes(s []byte) bool {
+	for i := 0; i < len(s); i += 2 {
+		if s[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package scanner
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Progress is a snapshot of a running Drive scan.
+type Progress struct {
+	TeamDriveID       string    `json:"teamdrive_id"`
+	TeamDriveName     string    `json:"teamdrive_name"`
+	StartedAt         time.Time `json:"started_at"`
+	ElapsedSeconds    float64   `json:"elapsed_seconds"`
+	Items             int64     `json:"items"`
+	FoldersDiscovered int64     `json:"folders_discovered"`
+	FoldersCompleted  int64     `json:"folders_completed"`
+	// ExpectedItems is the size of the drive at its previous scan, zero
+	// when it has none.
+	ExpectedItems int64 `json:"expected_items"`
+	// Percent and ETASeconds are estimated from ExpectedItems when known,
+	// else from the share of discovered folders already listed, which
+	// runs ahead early in a scan. Estimate says which: history or folders.
+	Percent    float64 `json:"percent"`
+	ETASeconds float64 `json:"eta_seconds"`
+	Estimate   string  `json:"estimate"`
+	Paused     bool    `json:"paused"`
+}
+
+// runningScans holds the stats of scans in progress in this process.
+var runningScans = struct {
+	sync.Mutex
+	stats map[*Stats]bool
+}{stats: make(map[*Stats]bool)}
+
+func trackScan(stats *Stats) {
+	runningScans.Lock()
+	defer runningScans.Unlock()
+	runningScans.stats[stats] = true
+}
+
+func untrackScan(stats *Stats) {
+	runningScans.Lock()
+	defer runningScans.Unlock()
+	delete(runningScans.stats, stats)
+}
+
+// RunningScans returns the progress of the Drive scans running in this
+// process, oldest first.
+func RunningScans() []Progress {
+	runningScans.Lock()
+	defer runningScans.Unlock()
+
+	scans := make([]Progress, 0, len(runningScans.stats))
+	for stats := range runningScans.stats {
+		scans = append(scans, stats.progress())
+	}
+	sort.Slice(scans, func(i, j int) bool { return scans[i].StartedAt.Before(scans[j].StartedAt) })
+	return scans
+}
+
+// progress estimates how far the scan is. The share done is capped at 99%
+// until the scan ends: the drive may have grown since its last scan, and
+// an unlisted folder may hold any number of subfolders.
+func (s *Stats) progress() Progress {
+	elapsed := time.Since(s.StartTime)
+	p := Progress{
+		TeamDriveID:       s.TeamDriveID,
+		TeamDriveName:     s.TeamDriveName,
+		StartedAt:         s.StartTime,
+		ElapsedSeconds:    elapsed.Seconds(),
+		Items:             s.FilesProcessed.Load(),
+		FoldersDiscovered: s.FoldersQueued.Load() + 1, // the root
+		FoldersCompleted:  s.FoldersCompleted.Load(),
+		ExpectedItems:     s.ExpectedItems,
+		Paused:            pauseGate.closed(),
+	}
+
+	var done float64
+	if p.ExpectedItems > 0 {
+		p.Estimate = "history"
+		done = float64(p.Items) / float64(p.ExpectedItems)
+	} else {
+		p.Estimate = "folders"
+		done = float64(p.FoldersCompleted) / float64(p.FoldersDiscovered)
+	}
+	if done > 0.99 {
+		done = 0.99
+	}
+
+	p.Percent = done * 100
+	if done > 0 {
+		p.ETASeconds = elapsed.Seconds() * (1 - done) / done
+	}
+	return p
+}
@@ -0,0 +1,218 @@
+package scanner
+
+import (
+	"context"
+	"log"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"teamdrive-scanner/database"
+)
+
+// FolderMimeType is the MIME type of Drive folders, which every provider
+// uses for its directories.
+const FolderMimeType = "application/vnd.google-apps.folder"
+
+// SourceProvider catalogs one scan target into a sink. Every provider maps
+// its source onto the same records, with the target's ID as TeamDriveID,
+// so the index, search and web interface treat all sources alike.
+type SourceProvider interface {
+	Scan(ctx context.Context, sink RecordSink) error
+}
+
+// DriveProvider scans a Google Drive target with a pool of accounts.
+type DriveProvider struct {
+	Target ScanConfig
+	Pool   *ServiceAccountPool
+}
+
+func (p *DriveProvider) Scan(ctx context.Context, sink RecordSink) error {
+	return scanTeamDrive(ctx, p.Target, sink, p.Pool)
+}
+
+// flatEntry is one object or directory of a source that lists its whole
+// tree at once rather than folder by folder.
+type flatEntry struct {
+	Path         string // slash-separated, relative to the target root
+	IsDir        bool
+	Size         int64
+	ModifiedTime string // RFC 3339
+	MimeType     string
+	Link         string // web_view_link; empty for none
+}
+
+// flatTree turns flat listings into the folder tree the index expects. It
+// records every folder the first time something below it is seen, and
+// applies the target's filters as a folder-by-folder walk would: nothing
+// below an excluded folder is recorded.
+type flatTree struct {
+	target  ScanConfig
+	sink    RecordSink
+	batch   []database.FileRecord
+	folders map[string]bool // folder path -> allowed
+
+	start    time.Time
+	recorded int64
+	excluded int64
+}
+
+func newFlatTree(target ScanConfig, sink RecordSink) *flatTree {
+	if target.BatchInsertSize <= 0 {
+		target.BatchInsertSize = 1000
+	}
+	return &flatTree{
+		target:  target,
+		sink:    sink,
+		batch:   make([]database.FileRecord, 0, target.BatchInsertSize),
+		folders: make(map[string]bool),
+		start:   time.Now(),
+	}
+}
+
+// id returns the record ID of the entry at p. Folder IDs end in "/" so an
+// object and a prefix of the same name stay distinct.
+func (t *flatTree) id(p string, isDir bool) string {
+	if p == "" {
+		return t.target.TeamDriveID
+	}
+	if isDir {
+		p += "/"
+	}
+	return t.target.TeamDriveID + ":" + p
+}
+
+func (t *flatTree) add(entry flatEntry) error {
+	p := strings.Trim(entry.Path, "/")
+	if p == "" {
+		return nil
+	}
+	parent := path.Dir(p)
+	if parent == "." {
+		parent = ""
+	}
+
+	allowed, err := t.folder(parent)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		t.excluded++
+		return nil
+	}
+
+	if entry.IsDir {
+		// Seen before as a prefix: record it again with its metadata
+		if seen, ok := t.folders[p]; ok {
+			if !seen {
+				return nil
+			}
+			return t.record(p, entry)
+		}
+		if !t.target.Filter.allowFolder("/" + p) {
+			t.folders[p] = false
+			t.excluded++
+			return nil
+		}
+		t.folders[p] = true
+		return t.record(p, entry)
+	}
+
+	if entry.MimeType == "" {
+		entry.MimeType = mimeType(p)
+	}
+	if !t.target.Filter.allowFile("/"+p) ||
+		!t.target.FileFilter.allow(path.Base(p), entry.MimeType, entry.Size) {
+		t.excluded++
+		return nil
+	}
+	return t.record(p, entry)
+}
+
+// folder makes sure the folder at p and its ancestors are recorded, and
+// reports whether entries below it are allowed.
+func (t *flatTree) folder(p string) (bool, error) {
+	if p == "" {
+		return true, nil
+	}
+	if allowed, ok := t.folders[p]; ok {
+		return allowed, nil
+	}
+
+	parent := path.Dir(p)
+	if parent == "." {
+		parent = ""
+	}
+	allowed, err := t.folder(parent)
+	if err != nil {
+		return false, err
+	}
+	allowed = allowed && t.target.Filter.allowFolder("/"+p)
+	t.folders[p] = allowed
+	if !allowed {
+		t.excluded++
+		return false, nil
+	}
+	return true, t.record(p, flatEntry{IsDir: true})
+}
+
+func (t *flatTree) record(p string, entry flatEntry) error {
+	parent := path.Dir(p)
+	if parent == "." {
+		parent = ""
+	}
+
+	record := database.FileRecord{
+		ID:            t.id(p, entry.IsDir),
+		Name:          path.Base(p),
+		ParentID:      t.id(parent, true),
+		TeamDriveID:   t.target.TeamDriveID,
+		TeamDriveName: t.target.TeamDriveName,
+		Size:          entry.Size,
+		ModifiedTime:  entry.ModifiedTime,
+		MimeType:      entry.MimeType,
+		IsFolder:      entry.IsDir,
+		Path:          t.target.RootPath + "/" + p,
+		WebViewLink:   entry.Link,
+	}
+	if entry.IsDir {
+		record.Size = 0
+		record.MimeType = FolderMimeType
+	}
+
+	t.batch = append(t.batch, record)
+	t.recorded++
+	if len(t.batch) >= t.target.BatchInsertSize {
+		return t.flush()
+	}
+	return nil
+}
+
+func (t *flatTree) flush() error {
+	if len(t.batch) == 0 {
+		return nil
+	}
+	err := t.sink.BatchInsert(t.batch)
+	t.batch = t.batch[:0]
+	return err
+}
+
+// mimeType guesses the MIME type of a file from its extension.
+func mimeType(p string) string {
+	if t := mime.TypeByExtension(path.Ext(p)); t != "" {
+		t, _, _ = strings.Cut(t, ";")
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// finish writes the last batch and logs the totals.
+func (t *flatTree) finish() error {
+	if err := t.flush(); err != nil {
+		return err
+	}
+	log.Printf("[%s] Recorded %d entries (%d excluded) in %v", t.target.TeamDriveName,
+		t.recorded, t.excluded, time.Since(t.start).Round(time.Millisecond))
+	return nil
+}
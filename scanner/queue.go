@@ -0,0 +1,109 @@
+package scanner
+
+import "sync"
+
+// folderJob is a folder waiting to be listed. Path is the folder's location
+// relative to the scan root, "" for the root itself.
+type folderJob struct {
+	ID   string
+	Path string
+}
+
+// folderQueue is an unbounded work queue of folders that knows when a
+// traversal is finished. Every pushed folder counts as pending until the
+// worker that popped it calls done; pushes for subfolders happen before
+// their parent is marked done, so pending only reaches zero once the whole
+// tree has been listed. Workers never block on push, which rules out the
+// deadlock of workers waiting on a full channel that only they drain.
+type folderQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	items   []folderJob
+	pending int
+	closed  bool
+}
+
+func newFolderQueue() *folderQueue {
+	q := &folderQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push schedules a folder for listing. Pushes after close are dropped.
+func (q *folderQueue) push(job folderJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.items = append(q.items, job)
+	q.pending++
+	q.cond.Signal()
+}
+
+// pop blocks until a folder is available or the queue is closed. Folders
+// are taken LIFO so traversal is depth-first, which keeps the backlog small
+// on wide trees.
+func (q *folderQueue) pop() (folderJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return folderJob{}, false
+	}
+
+	last := len(q.items) - 1
+	job := q.items[last]
+	q.items[last] = folderJob{}
+	q.items = q.items[:last]
+	return job, true
+}
+
+// done marks a popped folder as finished and closes the queue when nothing
+// is left pending.
+func (q *folderQueue) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending--
+	if q.pending == 0 {
+		q.closeLocked()
+	}
+}
+
+// close aborts the traversal, releasing all waiting workers.
+func (q *folderQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closeLocked()
+}
+
+func (q *folderQueue) closeLocked() {
+	q.closed = true
+	q.items = nil
+	q.cond.Broadcast()
+}
+
+// join adds a worker to wg unless the traversal is already over. Workers
+// only leave once the queue is closed, so wg cannot be at zero here.
+func (q *folderQueue) join(wg *sync.WaitGroup) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	wg.Add(1)
+	return true
+}
+
+// depth returns the number of folders waiting to be listed.
+func (q *folderQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
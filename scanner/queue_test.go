@@ -0,0 +1,172 @@
+package scanner
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// traverse lists a synthetic tree from root through q with workers
+// goroutines, as scan workers do, and returns how often each folder was
+// listed. It fails the test if the traversal does not finish.
+func traverse(t *testing.T, q *folderQueue, root string, children func(id string) []string, workers int) map[string]int {
+	t.Helper()
+
+	var mu sync.Mutex
+	listed := make(map[string]int)
+	var wg sync.WaitGroup
+	q.push(folderJob{ID: root})
+	for i := 0; i < workers; i++ {
+		if !q.join(&wg) {
+			break
+		}
+		go func() {
+			defer wg.Done()
+			for {
+				job, ok := q.pop()
+				if !ok {
+					return
+				}
+				mu.Lock()
+				listed[job.ID]++
+				mu.Unlock()
+				for _, child := range children(job.ID) {
+					q.push(folderJob{ID: child, Path: job.Path + "/" + child})
+				}
+				q.done()
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("traversal did not finish")
+	}
+	return listed
+}
+
+func checkListedOnce(t *testing.T, listed map[string]int, want int) {
+	t.Helper()
+	if len(listed) != want {
+		t.Errorf("listed %d folders, want %d", len(listed), want)
+	}
+	for id, n := range listed {
+		if n != 1 {
+			t.Errorf("folder %s listed %d times", id, n)
+		}
+	}
+}
+
+func TestFolderQueueDeepTree(t *testing.T) {
+	const depth = 10000
+	children := func(id string) []string {
+		var level int
+		fmt.Sscanf(id, "d%d", &level)
+		if level == depth-1 {
+			return nil
+		}
+		return []string{fmt.Sprintf("d%d", level+1)}
+	}
+
+	q := newFolderQueue()
+	checkListedOnce(t, traverse(t, q, "d0", children, 8), depth)
+	if q.depth() != 0 {
+		t.Errorf("depth = %d after the traversal, want 0", q.depth())
+	}
+}
+
+func TestFolderQueueWideTree(t *testing.T) {
+	const width = 200
+	// The root has width children, each with width leaves
+	children := func(id string) []string {
+		if strings.HasPrefix(id, "l") {
+			return nil
+		}
+		out := make([]string, width)
+		for i := range out {
+			if id == "root" {
+				out[i] = fmt.Sprintf("c%d", i)
+			} else {
+				out[i] = fmt.Sprintf("l%s-%d", id, i)
+			}
+		}
+		return out
+	}
+
+	q := newFolderQueue()
+	checkListedOnce(t, traverse(t, q, "root", children, 16), 1+width+width*width)
+}
+
+func TestFolderQueueCloseReleasesWorkers(t *testing.T) {
+	q := newFolderQueue()
+	q.push(folderJob{ID: "root"})
+
+	const workers = 8
+	var wg sync.WaitGroup
+	popped := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		if !q.join(&wg) {
+			t.Fatal("join failed on an open queue")
+		}
+		go func() {
+			defer wg.Done()
+			for {
+				if _, ok := q.pop(); !ok {
+					return
+				}
+				// Hold the folder without finishing it, so the others wait
+				popped <- struct{}{}
+			}
+		}()
+	}
+	<-popped
+
+	q.close()
+	released := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(released)
+	}()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close did not release the workers")
+	}
+
+	q.push(folderJob{ID: "late"})
+	if q.depth() != 0 {
+		t.Errorf("push after close queued a folder")
+	}
+}
+
+func TestFolderQueueJoinAfterClose(t *testing.T) {
+	var wg sync.WaitGroup
+
+	q := newFolderQueue()
+	q.close()
+	if q.join(&wg) {
+		t.Error("join after close = true, want false")
+	}
+
+	// A traversal that finishes closes the queue too
+	q = newFolderQueue()
+	q.push(folderJob{ID: "root"})
+	if _, ok := q.pop(); !ok {
+		t.Fatal("pop failed on an open queue")
+	}
+	q.done()
+	if q.join(&wg) {
+		t.Error("join after the traversal finished = true, want false")
+	}
+	if _, ok := q.pop(); ok {
+		t.Error("pop after the traversal finished = true, want false")
+	}
+}
@@ -0,0 +1,124 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// RcloneProvider catalogs any rclone remote by running rclone lsjson, for
+// storage the Drive client cannot reach (OneDrive, Dropbox, SFTP, crypt
+// remotes, ...). The remote must be configured in rclone already.
+type RcloneProvider struct {
+	Target ScanConfig
+	Remote string   // remote:path as rclone takes it
+	Binary string   // rclone executable; empty looks up rclone in PATH
+	Flags  []string // extra flags for lsjson, e.g. --fast-list
+}
+
+// rcloneItem is one entry of rclone lsjson output.
+type rcloneItem struct {
+	Path     string
+	Size     int64
+	MimeType string
+	ModTime  time.Time
+	IsDir    bool
+}
+
+func (p *RcloneProvider) Scan(ctx context.Context, sink RecordSink) error {
+	if p.Remote == "" {
+		return fmt.Errorf("rclone target %s has no remote", p.Target.TeamDriveID)
+	}
+	binary := p.Binary
+	if binary == "" {
+		binary = "rclone"
+	}
+
+	args := append([]string{"lsjson", "--recursive"}, p.Flags...)
+	cmd := exec.CommandContext(ctx, binary, append(args, p.Remote)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot run rclone: %w", err)
+	}
+
+	// Keep the last error line for the returned error, log everything
+	lastLine := make(chan string, 1)
+	go func() {
+		var last string
+		lines := bufio.NewScanner(stderr)
+		for lines.Scan() {
+			last = lines.Text()
+			log.Printf("[%s] rclone: %s", p.Target.TeamDriveName, last)
+		}
+		lastLine <- last
+	}()
+
+	tree := newFlatTree(p.Target, sink)
+	scanErr := p.decode(stdout, tree)
+	if scanErr != nil {
+		// Stop rclone rather than waiting for the rest of the listing
+		cmd.Process.Kill()
+	}
+	last := <-lastLine
+
+	// A failing rclone usually leaves its output truncated; report why it
+	// failed rather than the truncation, unless it was killed above
+	waitErr := cmd.Wait()
+	if waitErr != nil && (scanErr == nil || cmd.ProcessState.Exited()) {
+		return fmt.Errorf("rclone lsjson %s failed: %w: %s", p.Remote, waitErr, strings.TrimSpace(last))
+	}
+	if scanErr != nil {
+		return scanErr
+	}
+
+	return tree.finish()
+}
+
+// decode streams the JSON array rclone writes, so remotes with millions of
+// objects are not held in memory.
+func (p *RcloneProvider) decode(stdout io.Reader, tree *flatTree) error {
+	decoder := json.NewDecoder(stdout)
+	if _, err := decoder.Token(); err != nil {
+		return fmt.Errorf("invalid rclone output: %w", err)
+	}
+
+	for decoder.More() {
+		var item rcloneItem
+		if err := decoder.Decode(&item); err != nil {
+			return fmt.Errorf("invalid rclone output: %w", err)
+		}
+
+		entry := flatEntry{
+			Path:     item.Path,
+			IsDir:    item.IsDir,
+			Size:     item.Size,
+			MimeType: item.MimeType,
+		}
+		// Google Docs and similar report -1 for unknown sizes
+		if entry.Size < 0 {
+			entry.Size = 0
+		}
+		if !item.ModTime.IsZero() {
+			entry.ModifiedTime = item.ModTime.UTC().Format(time.RFC3339)
+		}
+		if err := tree.add(entry); err != nil {
+			return err
+		}
+	}
+
+	_, err := decoder.Token()
+	return err
+}
@@ -0,0 +1,141 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"teamdrive-scanner/metrics"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	retryAttempts = 5
+	retryBase     = time.Second
+	retryCap      = 64 * time.Second
+
+	// rotateAfter is the number of rate limits in a row after which a
+	// listing moves to another account instead of backing off again.
+	rotateAfter = 2
+)
+
+// Reasons a call is retried, as counted in tds_api_retries_total.
+const (
+	retryRateLimit   = "rate_limit"
+	retryDailyLimit  = "daily_limit"
+	retryServerError = "server_error"
+	retryNetwork     = "network"
+)
+
+// retryReason classifies a failed call, returning "" for errors a retry
+// will not fix, such as a folder that no longer exists.
+func retryReason(err error) string {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return retryNetwork
+	}
+
+	switch {
+	case isDailyLimit(gerr):
+		return retryDailyLimit
+	case isRateLimited(gerr):
+		return retryRateLimit
+	case gerr.Code >= 500:
+		return retryServerError
+	}
+	return ""
+}
+
+// isDailyLimit reports whether err says the account's daily quota is used
+// up, which waiting a few seconds will not change.
+func isDailyLimit(gerr *googleapi.Error) bool {
+	if gerr.Code != 403 {
+		return false
+	}
+	for _, item := range gerr.Errors {
+		if item.Reason == "dailyLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfter returns the wait a response's Retry-After header asks for,
+// zero if there is none.
+func retryAfter(err error) time.Duration {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Header == nil {
+		return 0
+	}
+
+	value := gerr.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := time.Parse(time.RFC1123, value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// backoff returns the wait before retry attempt+1: a random duration up to
+// an exponentially growing ceiling ("full jitter"), so workers throttled at
+// the same moment do not retry in lockstep. A server's Retry-After wins if
+// it is longer.
+func backoff(attempt int, after time.Duration) time.Duration {
+	ceiling := retryBase << uint(attempt)
+	if ceiling > retryCap || ceiling <= 0 {
+		ceiling = retryCap
+	}
+	delay := time.Duration(rand.Int63n(int64(ceiling)) + 1)
+	if after > delay {
+		return after
+	}
+	return delay
+}
+
+// callWithRetry makes one call through the pool's accounts, paced by their
+// limiters and counted under teamDrive, retrying rate limits, server and
+// network errors on the next account. An account out of daily quota fails
+// the call rather than waiting for the reset. pin makes every attempt
+// with the first account, as My Drive targets need.
+func callWithRetry(ctx context.Context, pool *ServiceAccountPool, pin bool, teamDrive string, call func(account *serviceAccount) error) error {
+	var err error
+	for attempt := 0; attempt < retryAttempts; attempt++ {
+		account := pool.getNext()
+		if pin {
+			account = pool.all()[0]
+		}
+		if account == nil {
+			return errors.New("no service accounts loaded")
+		}
+		if err := account.limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		metrics.APICalls.WithLabelValues(teamDrive).Inc()
+		if err = call(account); err == nil {
+			account.recordSuccess()
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		account.recordFailure(err)
+
+		reason := retryReason(err)
+		if reason == "" || reason == retryDailyLimit || attempt == retryAttempts-1 {
+			break
+		}
+		metrics.APIRetries.WithLabelValues(reason).Inc()
+		select {
+		case <-time.After(backoff(attempt, retryAfter(err))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
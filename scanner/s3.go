@@ -0,0 +1,262 @@
+package scanner
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config locates a bucket of an S3-compatible store: AWS, Backblaze B2,
+// MinIO, Wasabi and the like. Buckets are addressed path-style. Without
+// keys the bucket is listed anonymously.
+type S3Config struct {
+	// Endpoint defaults to AWS in Region, e.g. for B2 use
+	// https://s3.us-west-002.backblazeb2.com
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// S3Provider catalogs the objects of a bucket. Keys are split on "/" into
+// folders; records are stored under Target.TeamDriveID.
+type S3Provider struct {
+	Target ScanConfig
+	Bucket S3Config
+	Client *http.Client // nil uses http.DefaultClient
+}
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (p *S3Provider) Scan(ctx context.Context, sink RecordSink) error {
+	if p.Bucket.Bucket == "" {
+		return fmt.Errorf("s3 target %s has no bucket", p.Target.TeamDriveID)
+	}
+
+	tree := newFlatTree(p.Target, sink)
+	prefix := p.Bucket.Prefix
+	token := ""
+	for {
+		page, err := p.list(ctx, prefix, token)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range page.Contents {
+			key := strings.TrimPrefix(object.Key, prefix)
+			entry := flatEntry{
+				Path:         key,
+				IsDir:        strings.HasSuffix(key, "/"),
+				Size:         object.Size,
+				ModifiedTime: object.LastModified.UTC().Format(time.RFC3339),
+			}
+			if !entry.IsDir {
+				entry.Link = p.objectURL(object.Key)
+			}
+			if err := tree.add(entry); err != nil {
+				return err
+			}
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+
+	return tree.finish()
+}
+
+// endpoint returns the base URL of the store.
+func (p *S3Provider) endpoint() string {
+	if p.Bucket.Endpoint != "" {
+		return strings.TrimSuffix(p.Bucket.Endpoint, "/")
+	}
+	return "https://s3." + p.region() + ".amazonaws.com"
+}
+
+func (p *S3Provider) region() string {
+	if p.Bucket.Region != "" {
+		return p.Bucket.Region
+	}
+	return "us-east-1"
+}
+
+func (p *S3Provider) objectURL(key string) string {
+	return p.endpoint() + "/" + s3Escape(p.Bucket.Bucket, true) + "/" + s3Escape(key, false)
+}
+
+// list fetches one ListObjectsV2 page, retrying throttled requests.
+func (p *S3Provider) list(ctx context.Context, prefix string, token string) (*listBucketResult, error) {
+	query := map[string]string{"list-type": "2", "max-keys": "1000"}
+	if prefix != "" {
+		query["prefix"] = prefix
+	}
+	if token != "" {
+		query["continuation-token"] = token
+	}
+
+	maxRetries := 5
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		result, retry, err := p.get(ctx, "/"+p.Bucket.Bucket, query)
+		if err == nil || !retry || attempt == maxRetries {
+			return result, err
+		}
+		log.Printf("[%s] %v, retrying in %v", p.Target.TeamDriveName, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// get sends a signed GET and decodes the listing. retry reports whether
+// the error is worth retrying.
+func (p *S3Provider) get(ctx context.Context, path string, query map[string]string) (result *listBucketResult, retry bool, err error) {
+	base, err := url.Parse(p.endpoint())
+	if err != nil {
+		return nil, false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.URL.Path = path
+	req.URL.RawPath = s3Escape(path, false)
+	req.URL.RawQuery = canonicalQuery(query)
+	if p.Bucket.AccessKeyID != "" {
+		signS3(req, p.Bucket.AccessKeyID, p.Bucket.SecretAccessKey, p.region(), time.Now())
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr s3Error
+		xml.Unmarshal(body, &apiErr)
+		retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return nil, retry, fmt.Errorf("s3 list of %s failed: %s %s %s",
+			p.Bucket.Bucket, resp.Status, apiErr.Code, apiErr.Message)
+	}
+
+	result = &listBucketResult{}
+	if err := xml.Unmarshal(body, result); err != nil {
+		return nil, false, fmt.Errorf("invalid s3 listing: %w", err)
+	}
+	return result, false, nil
+}
+
+// signS3 adds AWS Signature Version 4 headers to a request without a body.
+func signS3(req *http.Request, accessKey string, secretKey string, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + emptyPayloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by key, as SigV4 signs
+// them.
+func canonicalQuery(query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = s3Escape(k, true) + "=" + s3Escape(query[k], true)
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and "/"
+// unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !escapeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -6,152 +6,397 @@ import (
 	"io/ioutil"
 	"log"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"teamdrive-scanner/database"
+	"teamdrive-scanner/metrics"
 
 	"golang.org/x/time/rate"
 	"google.golang.org/api/drive/v3"
-	"google.golang.org/api/googleapi"
-	"google.golang.org/api/option"
 )
 
+// resultQueueBatches is how many batches of records may wait for the
+// database writer.
+const resultQueueBatches = 4
+
+// slowFlush is how long a batch insert may take before it is logged as a
+// stall.
+const slowFlush = 30 * time.Second
+
+// fileListFields is the field mask for folder listings.
+const fileListFields = "nextPageToken, files(id, name, size, modifiedTime, mimeType, " +
+	"shortcutDetails(targetId, targetMimeType), createdTime, lastModifyingUser(emailAddress, displayName), " +
+	"owners(emailAddress), shared, webViewLink, exportLinks, properties, appProperties, labelInfo, trashed, trashedTime, md5Checksum, thumbnailLink)"
+
 type ServiceAccountPool struct {
-	services []*drive.Service
-	limiters []*rate.Limiter
+	// accounts is replaced, never modified, when accounts come and go
+	accounts atomic.Pointer[[]*serviceAccount]
 	current  atomic.Int32
+	budget   *dailyBudget
+
+	// Where the accounts were loaded from, for WatchAccounts; dir is
+	// empty for an OAuth pool
+	dir       string
+	newClient ClientFactory
+	rate      atomic.Int64
+	mu        sync.Mutex
+	rejected  map[string]time.Time // key file -> mod time of a dropped key
 }
 
+// Scan target types. A teamdrive target is a shared drive ID; mydrive scans
+// the My Drive of the first account in the pool (use "root" as ID); folder
+// scans the tree below an arbitrary folder ID the accounts can read. s3,
+// local and rclone targets are buckets, mount points and rclone remotes
+// scanned by S3Provider, LocalProvider and RcloneProvider, with the ID as
+// their label.
+const (
+	TargetTeamDrive = "teamdrive"
+	TargetMyDrive   = "mydrive"
+	TargetFolder    = "folder"
+	TargetS3        = "s3"
+	TargetLocal     = "local"
+	TargetRclone    = "rclone"
+)
+
+// Permission scan modes of ScanConfig.Permissions.
+const (
+	PermissionsFolders = "folders"
+	PermissionsAll     = "all"
+)
+
 type ScanConfig struct {
+	// TeamDriveID is the root folder of the scan and the key its records
+	// are stored under, whatever the target type.
 	TeamDriveID       string
+	Type              string
 	TeamDriveName     string
 	WorkersPerAccount int
 	PageSize          int64
 	BatchInsertSize   int
+	ResolveShortcuts  bool
+	// RateLimit caps this scan's requests/sec across all accounts, on top
+	// of the per-account limits. Zero means no extra cap.
+	RateLimit float64
+	// Filter restricts which paths are indexed; nil indexes everything.
+	Filter *PathFilter
+	// FileFilter restricts which file types are indexed; nil indexes all.
+	FileFilter *FileFilter
+	// RevisionFilter selects the files whose revisions are counted, at one
+	// extra API call each; nil counts none.
+	RevisionFilter *FileFilter
+	// Content selects the documents whose text IndexContent indexes after
+	// the scan, at one download each; nil indexes none.
+	Content *ContentConfig
+	// Permissions lists the permissions of folders (PermissionsFolders)
+	// or of every item (PermissionsAll), at one extra API call each.
+	// Empty lists none.
+	Permissions string
+	// Labels maps the names Drive labels are stored and searched under to
+	// their label IDs. Only these labels are fetched; custom properties
+	// always are.
+	Labels map[string]string
+	// IncludeTrash also indexes trashed items, flagged as such, and the
+	// contents of trashed folders.
+	IncludeTrash bool
+	// RootID and RootPath rescan a single folder of the target, indexing
+	// the folder itself and everything below RootPath. Empty scans the
+	// whole target.
+	RootID   string
+	RootPath string
+	// ExpectedItems is the number of records the target's previous scan
+	// produced, for progress estimates. Zero estimates from folders.
+	ExpectedItems int64
 }
 
 type Stats struct {
-	TeamDriveName   string
-	FilesProcessed  atomic.Int64
-	FoldersQueued   atomic.Int64
-	APICallsTotal   atomic.Int64
-	APICallsSuccess atomic.Int64
-	APICallsFailed  atomic.Int64
-	DBInserts       atomic.Int64
-	StartTime       time.Time
+	TeamDriveID      string
+	TeamDriveName    string
+	ExpectedItems    int64
+	FilesProcessed   atomic.Int64
+	FoldersQueued    atomic.Int64
+	FoldersCompleted atomic.Int64
+	APICallsTotal    atomic.Int64
+	APICallsSuccess  atomic.Int64
+	APICallsFailed   atomic.Int64
+	FoldersFailed    atomic.Int64 // folders not listed to the end
+	DBInserts        atomic.Int64
+	DBInsertsFailed  atomic.Int64 // records of batches the sink rejected
+	Excluded         atomic.Int64
+	QueueBlocked     atomic.Int64 // nanoseconds workers waited on the writer
+	StartTime        time.Time
+
+	cancel context.CancelFunc
 }
 
 type Worker struct {
 	id          int
 	pool        *ServiceAccountPool
-	jobQueue    chan string // ✅ fixed from <-chan to chan
+	queue       *folderQueue
 	resultQueue chan<- database.FileRecord
 	wg          *sync.WaitGroup
 	ctx         context.Context
 	stats       *Stats
 	config      ScanConfig
+	limiter     *rate.Limiter // per-scan cap, nil when unset
+	unfinished  *unfinishedFolders
+	account     *serviceAccount // the account the worker is pinned to
+}
+
+// InitServiceAccountPool loads the service account keys in saDir, with
+// read-only access unless write is set.
+func InitServiceAccountPool(saDir string, ratePerAccount int, write bool) (*ServiceAccountPool, error) {
+	if write {
+		return NewServiceAccountPool(saDir, ratePerAccount, WriteCredentialsClient)
+	}
+	return NewServiceAccountPool(saDir, ratePerAccount, CredentialsClient)
 }
 
-func InitServiceAccountPool(saDir string, ratePerAccount int) (*ServiceAccountPool, error) {
+// NewServiceAccountPool loads every credentials file in saDir, creating
+// each account's client with newClient.
+func NewServiceAccountPool(saDir string, ratePerAccount int, newClient ClientFactory) (*ServiceAccountPool, error) {
 	files, err := ioutil.ReadDir(saDir)
 	if err != nil {
 		return nil, fmt.Errorf("cannot read service accounts directory: %w", err)
 	}
 
 	pool := &ServiceAccountPool{
-		services: make([]*drive.Service, 0),
-		limiters: make([]*rate.Limiter, 0),
+		budget:    &dailyBudget{},
+		dir:       saDir,
+		newClient: newClient,
+		rejected:  make(map[string]time.Time),
 	}
+	pool.rate.Store(int64(ratePerAccount))
 
-	ctx := context.Background()
-
+	accounts := make([]*serviceAccount, 0)
 	for _, file := range files {
 		if filepath.Ext(file.Name()) != ".json" {
 			continue
 		}
-
-		credPath := filepath.Join(saDir, file.Name())
-		credentials, err := ioutil.ReadFile(credPath)
-		if err != nil {
-			log.Printf("Skipping %s: %v", file.Name(), err)
-			continue
-		}
-
-		service, err := drive.NewService(ctx,
-			option.WithCredentialsJSON(credentials),
-			option.WithScopes(drive.DriveReadonlyScope),
-		)
+		account, err := pool.load(file.Name())
 		if err != nil {
 			log.Printf("Skipping %s: %v", file.Name(), err)
 			continue
 		}
-
-		pool.services = append(pool.services, service)
-		pool.limiters = append(pool.limiters,
-			rate.NewLimiter(rate.Limit(ratePerAccount), ratePerAccount*2))
+		accounts = append(accounts, account)
 	}
 
-	if len(pool.services) == 0 {
+	if len(accounts) == 0 {
 		return nil, fmt.Errorf("no valid service accounts found in %s", saDir)
 	}
+	pool.accounts.Store(&accounts)
 
 	return pool, nil
 }
 
-func (p *ServiceAccountPool) getNext() (*drive.Service, *rate.Limiter) {
-	idx := int(p.current.Add(1)-1) % len(p.services)
-	if idx < 0 {
-		idx = 0
+// load creates the account of a key file in the pool's directory.
+func (p *ServiceAccountPool) load(fileName string) (*serviceAccount, error) {
+	credentials, err := ioutil.ReadFile(filepath.Join(p.dir, fileName))
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := p.newClient(context.Background(), credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	account := newServiceAccount(accountName(credentials, fileName), client, int(p.rate.Load()), p.budget)
+	account.file = fileName
+	return account, nil
+}
+
+// all returns the accounts currently in the pool.
+func (p *ServiceAccountPool) all() []*serviceAccount {
+	return *p.accounts.Load()
+}
+
+// getNext returns the next account in round-robin order, skipping
+// quarantined accounts and those out of daily budget. If every account is
+// quarantined it falls back to plain round-robin rather than stalling the
+// scan; if none has budget left it returns one anyway, for the caller to
+// wait for the reset with.
+func (p *ServiceAccountPool) getNext() *serviceAccount {
+	accounts := p.all()
+	var quarantined, exhausted *serviceAccount
+	for i := 0; i < len(accounts); i++ {
+		idx := int(uint32(p.current.Add(1)-1)) % len(accounts)
+		account := accounts[idx]
+		switch {
+		case !account.hasBudget():
+			if exhausted == nil {
+				exhausted = account
+			}
+		case !account.isQuarantined():
+			return account
+		case quarantined == nil:
+			quarantined = account
+		}
+	}
+	if quarantined != nil {
+		return quarantined
+	}
+	return exhausted
+}
+
+// leastLoaded returns the healthy account with the most limiter tokens to
+// spare per pinned worker, other than exclude. Without one it falls back
+// to getNext's choice.
+func (p *ServiceAccountPool) leastLoaded(exclude *serviceAccount) *serviceAccount {
+	accounts := p.all()
+	var best *serviceAccount
+	bestScore := 0.0
+	// Start at a rotating offset so ties are spread across the pool
+	offset := int(uint32(p.current.Add(1) - 1))
+	for i := range accounts {
+		account := accounts[(offset+i)%len(accounts)]
+		if account == exclude || !account.hasBudget() || account.isQuarantined() {
+			continue
+		}
+		score := account.limiter.Tokens() / float64(account.workers.Load()+1)
+		if best == nil || score > bestScore {
+			best, bestScore = account, score
+		}
 	}
-	return p.services[idx], p.limiters[idx]
+	if best != nil {
+		return best
+	}
+	return p.getNext()
 }
 
 func (p *ServiceAccountPool) Count() int {
-	return len(p.services)
+	return len(p.all())
+}
+
+// ScanTeamDrive traverses one scan target and writes every record to sink.
+func ScanTeamDrive(config ScanConfig, sink RecordSink, pool *ServiceAccountPool) error {
+	return scanTeamDrive(context.Background(), config, sink, pool)
 }
 
-func ScanTeamDrive(config ScanConfig, db *database.Database, pool *ServiceAccountPool) error {
-	ctx := context.Background()
+func scanTeamDrive(ctx context.Context, config ScanConfig, sink RecordSink, pool *ServiceAccountPool) error {
+	switch config.Type {
+	case "":
+		config.Type = TargetTeamDrive
+	case TargetTeamDrive, TargetMyDrive, TargetFolder:
+	default:
+		return fmt.Errorf("unknown target type %q (use teamdrive, mydrive or folder)", config.Type)
+	}
+
 	stats := &Stats{
+		TeamDriveID:   config.TeamDriveID,
 		TeamDriveName: config.TeamDriveName,
 		StartTime:     time.Now(),
 	}
+	// A folder rescan is too small a part of the target to compare with it
+	if config.RootID == "" {
+		stats.ExpectedItems = config.ExpectedItems
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stats.cancel = cancel
+	trackScan(stats)
+	defer untrackScan(stats)
 
 	totalWorkers := pool.Count() * config.WorkersPerAccount
 	log.Printf("[%s] Starting with %d workers (%d SAs × %d workers/SA)",
 		config.TeamDriveName, totalWorkers, pool.Count(), config.WorkersPerAccount)
 
-	jobQueue := make(chan string, totalWorkers*10)
-	resultQueue := make(chan database.FileRecord, 100000)
+	var root *database.FileRecord
+	if config.RootID != "" && config.RootID != config.TeamDriveID {
+		record, err := fetchFolder(ctx, config, pool)
+		if err != nil {
+			return fmt.Errorf("cannot get folder %s: %w", config.RootID, err)
+		}
+		root = record
+	}
+
+	if config.BatchInsertSize <= 0 {
+		config.BatchInsertSize = 1000
+	}
+
+	// Workers block once the writer is this many batches behind, so a
+	// stalled database holds up the scan instead of filling memory
+	queue := newFolderQueue()
+	resultQueue := make(chan database.FileRecord, resultQueueBatches*config.BatchInsertSize)
+	metrics.ResultQueueCapacity.WithLabelValues(config.TeamDriveName).Set(float64(cap(resultQueue)))
 
 	dbDone := make(chan struct{})
-	go dbWriter(db, resultQueue, dbDone, stats, config.BatchInsertSize)
+	go dbWriter(sink, resultQueue, dbDone, stats, config.BatchInsertSize)
+
+	var scanLimiter *rate.Limiter
+	if config.RateLimit > 0 {
+		burst := int(config.RateLimit)
+		if burst < 1 {
+			burst = 1
+		}
+		scanLimiter = rate.NewLimiter(rate.Limit(config.RateLimit), burst)
+	}
+
+	// seed root folder
+	if root != nil {
+		resultQueue <- *root
+		stats.FilesProcessed.Add(1)
+		queue.push(folderJob{ID: root.ID, Path: root.Path})
+	} else {
+		queue.push(folderJob{ID: config.TeamDriveID})
+	}
 
+	unfinished := &unfinishedFolders{}
 	var wg sync.WaitGroup
-	for i := 0; i < totalWorkers; i++ {
-		wg.Add(1)
-		worker := Worker{
-			id:          i,
-			pool:        pool,
-			jobQueue:    jobQueue,
-			resultQueue: resultQueue,
-			wg:          &wg,
-			ctx:         ctx,
-			stats:       stats,
-			config:      config,
+	started := 0
+	startWorkers := func(total int) {
+		for ; started < total && queue.join(&wg); started++ {
+			worker := Worker{
+				id:          started,
+				pool:        pool,
+				queue:       queue,
+				resultQueue: resultQueue,
+				wg:          &wg,
+				ctx:         ctx,
+				stats:       stats,
+				config:      config,
+				limiter:     scanLimiter,
+				unfinished:  unfinished,
+			}
+			go worker.start()
 		}
-		go worker.start()
 	}
+	startWorkers(totalWorkers)
 
 	stopStats := make(chan struct{})
 	go logStats(stats, stopStats)
+	go sampleMetrics(config.TeamDriveName, queue, resultQueue, pool, stopStats)
+
+	// Accounts added to the pool mid-scan get workers of their own. Workers
+	// are not stopped when accounts leave; they move to the others.
+	if config.Type != TargetMyDrive {
+		go func() {
+			ticker := time.NewTicker(accountPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if total := pool.Count() * config.WorkersPerAccount; total > started {
+						before := started
+						startWorkers(total)
+						if started > before {
+							log.Printf("[%s] Started %d more workers for new service accounts",
+								config.TeamDriveName, started-before)
+						}
+					}
+				case <-stopStats:
+					return
+				}
+			}
+		}()
+	}
 
-	// seed root folder
-	jobQueue <- config.TeamDriveID
-
-	// wait for workers
+	// workers exit once every folder has been listed, or has failed to
+	// because the scan was canceled
 	wg.Wait()
 	close(resultQueue)
 	<-dbDone
@@ -159,52 +404,115 @@ func ScanTeamDrive(config ScanConfig, db *database.Database, pool *ServiceAccoun
 
 	printFinalStats(stats, pool.Count())
 
+	if err := ctx.Err(); err != nil {
+		return &InterruptedError{Err: err, Folders: unfinished.roots()}
+	}
+	// Whatever sits below a folder that failed to list, or in a batch that
+	// failed to write, is missing from the scan without being gone
+	if folders, records := stats.FoldersFailed.Load(), stats.DBInsertsFailed.Load(); folders > 0 || records > 0 {
+		return fmt.Errorf("scan incomplete: %d folders could not be listed and %d records could not be written",
+			folders, records)
+	}
 	return nil
 }
 
 func (w *Worker) start() {
 	defer w.wg.Done()
+	defer w.pin(nil)
+
+	for {
+		job, ok := w.queue.pop()
+		if !ok {
+			return
+		}
 
-	for folderID := range w.jobQueue {
-		if err := w.listFolder(folderID); err != nil {
+		if err := w.listFolder(job); err != nil && w.ctx.Err() != nil {
+			// Canceled: every folder still queued ends up here in turn
+			w.unfinished.add(job)
+		} else if err != nil {
 			log.Printf("[%s] Worker-%d: Error listing %s: %v",
-				w.config.TeamDriveName, w.id, folderID, err)
+				w.config.TeamDriveName, w.id, job.ID, err)
 			w.stats.APICallsFailed.Add(1)
+			w.stats.FoldersFailed.Add(1)
 		}
+		w.stats.FoldersCompleted.Add(1)
+		w.queue.done()
 	}
 }
 
-func (w *Worker) listFolder(folderID string) error {
-	service, limiter := w.pool.getNext()
+func (w *Worker) listFolder(job folderJob) error {
+	folderID := job.ID
+
+	// A folder is listed to the end on one account, which may take it a
+	// few pages past its daily budget
+	account := w.nextAccount()
+	for !account.hasBudget() {
+		if err := w.pool.waitForBudget(w.ctx); err != nil {
+			return err
+		}
+		account = w.nextAccount()
+	}
 	pageToken := ""
 
 	for {
-		if err := limiter.Wait(w.ctx); err != nil {
+		if err := pauseGate.wait(w.ctx); err != nil {
+			return err
+		}
+		if err := memoryGate.wait(w.ctx); err != nil {
+			return err
+		}
+		if w.limiter != nil {
+			if err := w.limiter.Wait(w.ctx); err != nil {
+				return err
+			}
+		}
+		if err := account.limiter.Wait(w.ctx); err != nil {
 			return err
 		}
 
-		query := fmt.Sprintf("'%s' in parents and trashed=false", folderID)
 		w.stats.APICallsTotal.Add(1)
+		metrics.APICalls.WithLabelValues(w.config.TeamDriveName).Inc()
+
+		req := ListRequest{
+			FolderID:  folderID,
+			PageSize:  w.config.PageSize,
+			PageToken: pageToken,
+			Trashed:   w.config.IncludeTrash,
+		}
+		for _, id := range w.config.Labels {
+			req.Labels = append(req.Labels, id)
+		}
+		switch w.config.Type {
+		case TargetMyDrive:
+			req.Corpora = "user"
+		case TargetFolder:
+			req.Corpora = "allDrives"
+		default:
+			req.Corpora = "drive"
+			req.DriveID = w.config.TeamDriveID
+		}
 
-		call := service.Files.List().
-			Q(query).
-			PageSize(w.config.PageSize).
-			SupportsAllDrives(true).
-			IncludeItemsFromAllDrives(true).
-			Corpora("drive").
-			DriveId(w.config.TeamDriveID).
-			Fields("nextPageToken, files(id, name, size, modifiedTime, mimeType)").
-			PageToken(pageToken)
-
-		fileList, err := w.executeWithRetry(call, limiter)
+		fileList, next, err := w.executeWithRetry(req, account)
+		if w.config.Type != TargetMyDrive {
+			w.pin(next)
+		}
 		if err != nil {
 			return err
 		}
+		account = next
 
 		w.stats.APICallsSuccess.Add(1)
 
 		for _, file := range fileList.Files {
-			isFolder := file.MimeType == "application/vnd.google-apps.folder"
+			isFolder := file.MimeType == FolderMimeType
+			filePath := job.Path + "/" + file.Name
+
+			if isFolder && !w.config.Filter.allowFolder(filePath) ||
+				!isFolder && !w.config.Filter.allowFile(filePath) ||
+				!isFolder && !w.config.FileFilter.allow(file.Name, file.MimeType, file.Size) {
+				w.stats.Excluded.Add(1)
+				continue
+			}
 
 			record := database.FileRecord{
 				ID:            file.Id,
@@ -216,15 +524,53 @@ func (w *Worker) listFolder(folderID string) error {
 				ModifiedTime:  file.ModifiedTime,
 				MimeType:      file.MimeType,
 				IsFolder:      isFolder,
-				Path:          file.Name,
+				Path:          filePath,
+				CreatedTime:   file.CreatedTime,
+				Shared:        file.Shared,
+				WebViewLink:   file.WebViewLink,
+				IsNative:      database.IsGoogleNative(file.MimeType),
+				ExportLinks:   file.ExportLinks,
+				Labels:        w.fileLabels(file),
+				Trashed:       file.Trashed,
+				TrashedTime:   file.TrashedTime,
+				MD5Checksum:   file.Md5Checksum,
+				ThumbnailLink: file.ThumbnailLink,
+			}
+			if user := file.LastModifyingUser; user != nil {
+				record.LastModifyingUser = user.EmailAddress
+				if record.LastModifyingUser == "" {
+					record.LastModifyingUser = user.DisplayName
+				}
+			}
+			for _, owner := range file.Owners {
+				if owner.EmailAddress != "" {
+					record.Owners = append(record.Owners, owner.EmailAddress)
+				}
+			}
+
+			// Shortcuts are recorded but never descended into, even when
+			// they point at folders, to avoid cycles and duplicates.
+			if file.MimeType == database.ShortcutMimeType && file.ShortcutDetails != nil {
+				record.IsShortcut = true
+				record.ShortcutTargetID = file.ShortcutDetails.TargetId
+				record.ShortcutTargetMimeType = file.ShortcutDetails.TargetMimeType
+				if w.config.ResolveShortcuts {
+					w.resolveShortcut(account, &record)
+				}
+			} else if !isFolder && w.config.RevisionFilter != nil && w.config.RevisionFilter.allow(file.Name, file.MimeType, file.Size) {
+				w.countRevisions(account, &record)
+			}
+			if w.config.Permissions == PermissionsAll || isFolder && w.config.Permissions == PermissionsFolders {
+				w.listPermissions(account, &record)
 			}
 
-			w.resultQueue <- record
+			w.enqueue(record)
 			w.stats.FilesProcessed.Add(1)
+			metrics.FilesScanned.WithLabelValues(w.config.TeamDriveName).Inc()
 
 			if isFolder {
 				w.stats.FoldersQueued.Add(1)
-				w.jobQueue <- file.Id // ✅ no goroutine, safe enqueue
+				w.queue.push(folderJob{ID: file.Id, Path: filePath})
 			}
 		}
 
@@ -237,39 +583,327 @@ func (w *Worker) listFolder(folderID string) error {
 	return nil
 }
 
-func (w *Worker) executeWithRetry(call *drive.FilesListCall, limiter *rate.Limiter) (*drive.FileList, error) {
-	maxRetries := 5
-	baseDelay := time.Second
+// nextAccount picks the account for the next folder. A worker stays on its
+// account while it is healthy, so its calls are paced by that account's
+// limiter alone; it moves to the least loaded account once it is not.
+// Every account has its own My Drive, so those scans stay on one account.
+func (w *Worker) nextAccount() *serviceAccount {
+	if w.config.Type == TargetMyDrive {
+		return w.pool.all()[0]
+	}
+	if a := w.account; a != nil && !a.dropped.Load() && a.hasBudget() && !a.isQuarantined() {
+		return a
+	}
+	w.pin(w.pool.leastLoaded(w.account))
+	return w.account
+}
 
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		fileList, err := call.Do()
-		if err == nil {
-			return fileList, nil
+// pin moves the worker to account; nil unpins it.
+func (w *Worker) pin(account *serviceAccount) {
+	if account == w.account {
+		return
+	}
+	if w.account != nil {
+		w.account.workers.Add(-1)
+	}
+	if account != nil {
+		account.workers.Add(1)
+	}
+	w.account = account
+}
+
+// enqueue hands a record to the database writer, accounting for the time
+// spent waiting when the queue is full.
+func (w *Worker) enqueue(record database.FileRecord) {
+	select {
+	case w.resultQueue <- record:
+		return
+	default:
+	}
+
+	start := time.Now()
+	w.resultQueue <- record
+	blocked := time.Since(start)
+	w.stats.QueueBlocked.Add(int64(blocked))
+	metrics.ResultQueueBlocked.WithLabelValues(w.config.TeamDriveName).Add(blocked.Seconds())
+}
+
+// fetchFolder builds the record of a rescanned root folder, which its
+// parent's listing would normally produce.
+func fetchFolder(ctx context.Context, config ScanConfig, pool *ServiceAccountPool) (*database.FileRecord, error) {
+	account := pool.getNext()
+	if config.Type == TargetMyDrive {
+		account = pool.all()[0]
+	}
+	if err := account.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	file, err := account.client.Get(ctx, config.RootID,
+		"id, name, mimeType, modifiedTime, createdTime, parents, shared, webViewLink")
+	if err != nil {
+		return nil, err
+	}
+	if file.MimeType != FolderMimeType {
+		return nil, fmt.Errorf("%s is not a folder", config.RootID)
+	}
+
+	record := &database.FileRecord{
+		ID:            file.Id,
+		Name:          file.Name,
+		TeamDriveID:   config.TeamDriveID,
+		TeamDriveName: config.TeamDriveName,
+		ModifiedTime:  file.ModifiedTime,
+		MimeType:      file.MimeType,
+		IsFolder:      true,
+		Path:          config.RootPath,
+		CreatedTime:   file.CreatedTime,
+		Shared:        file.Shared,
+		WebViewLink:   file.WebViewLink,
+	}
+	if len(file.Parents) > 0 {
+		record.ParentID = file.Parents[0]
+	}
+	return record, nil
+}
+
+// resolveShortcut looks up the target of a shortcut, which may live in
+// another drive, and records its size. Failures are logged and leave the
+// target size unknown.
+func (w *Worker) resolveShortcut(account *serviceAccount, record *database.FileRecord) {
+	if err := account.limiter.Wait(w.ctx); err != nil {
+		return
+	}
+
+	w.stats.APICallsTotal.Add(1)
+	metrics.APICalls.WithLabelValues(w.config.TeamDriveName).Inc()
+	target, err := account.client.Get(w.ctx, record.ShortcutTargetID, "id, size, mimeType")
+	if err != nil {
+		account.recordFailure(err)
+		w.stats.APICallsFailed.Add(1)
+		log.Printf("[%s] Worker-%d: Cannot resolve shortcut %s -> %s: %v",
+			w.config.TeamDriveName, w.id, record.Name, record.ShortcutTargetID, err)
+		return
+	}
+
+	account.recordSuccess()
+	w.stats.APICallsSuccess.Add(1)
+	record.ShortcutTargetSize = target.Size
+	if target.MimeType != "" {
+		record.ShortcutTargetMimeType = target.MimeType
+	}
+}
+
+// countRevisions records the number of stored revisions of a file and
+// their total size. Failures are logged and leave both unknown.
+func (w *Worker) countRevisions(account *serviceAccount, record *database.FileRecord) {
+	if err := account.limiter.Wait(w.ctx); err != nil {
+		return
+	}
+
+	w.stats.APICallsTotal.Add(1)
+	metrics.APICalls.WithLabelValues(w.config.TeamDriveName).Inc()
+	revisions, err := account.client.Revisions(w.ctx, record.ID)
+	if err != nil {
+		account.recordFailure(err)
+		w.stats.APICallsFailed.Add(1)
+		log.Printf("[%s] Worker-%d: Cannot list revisions of %s: %v",
+			w.config.TeamDriveName, w.id, record.Name, err)
+		return
+	}
+
+	account.recordSuccess()
+	w.stats.APICallsSuccess.Add(1)
+	record.RevisionCount = len(revisions)
+	record.RevisionSize = 0
+	for _, revision := range revisions {
+		record.RevisionSize += revision.Size
+	}
+}
+
+// listPermissions records the grants made on an item itself; inherited
+// ones are recorded with the folder they were made on. Failures are logged
+// and leave the stored permissions as they were.
+func (w *Worker) listPermissions(account *serviceAccount, record *database.FileRecord) {
+	if err := account.limiter.Wait(w.ctx); err != nil {
+		return
+	}
+
+	w.stats.APICallsTotal.Add(1)
+	metrics.APICalls.WithLabelValues(w.config.TeamDriveName).Inc()
+	permissions, err := account.client.Permissions(w.ctx, record.ID)
+	if err != nil {
+		account.recordFailure(err)
+		w.stats.APICallsFailed.Add(1)
+		log.Printf("[%s] Worker-%d: Cannot list permissions of %s: %v",
+			w.config.TeamDriveName, w.id, record.Name, err)
+		return
+	}
+
+	account.recordSuccess()
+	w.stats.APICallsSuccess.Add(1)
+	record.Permissions = make([]database.Permission, 0, len(permissions))
+	for _, p := range permissions {
+		if inherited(p) {
+			continue
 		}
+		domain := p.Domain
+		if p.Type != "domain" {
+			domain = database.EmailDomain(p.EmailAddress)
+		}
+		record.Permissions = append(record.Permissions, database.Permission{
+			ID:           p.Id,
+			Type:         p.Type,
+			Role:         p.Role,
+			EmailAddress: p.EmailAddress,
+			Domain:       strings.ToLower(domain),
+			Discoverable: p.AllowFileDiscovery,
+		})
+	}
+}
 
-		if gerr, ok := err.(*googleapi.Error); ok {
-			if gerr.Code == 403 || gerr.Code == 429 {
-				delay := baseDelay * time.Duration(1<<uint(attempt))
-				log.Printf("[%s] Worker-%d: Rate limit, waiting %v",
-					w.config.TeamDriveName, w.id, delay)
-				time.Sleep(delay)
-				continue
+// inherited reports whether a permission only applies through a parent.
+// Permission details are only set on shared drive items.
+func inherited(p *drive.Permission) bool {
+	if len(p.PermissionDetails) == 0 {
+		return false
+	}
+	for _, detail := range p.PermissionDetails {
+		if !detail.Inherited {
+			return false
+		}
+	}
+	return true
+}
+
+// fileLabels returns a file's custom properties and the configured Drive
+// labels applied to it, each label field as "label.field". It is never nil,
+// so files that lost their labels have them removed.
+func (w *Worker) fileLabels(file *drive.File) []database.Label {
+	labels := make([]database.Label, 0)
+	for key, value := range file.Properties {
+		labels = append(labels, database.Label{Source: database.LabelSourceProperty, Key: key, Value: value})
+	}
+	for key, value := range file.AppProperties {
+		labels = append(labels, database.Label{Source: database.LabelSourceAppProperty, Key: key, Value: value})
+	}
+	if file.LabelInfo == nil {
+		return labels
+	}
+
+	names := make(map[string]string, len(w.config.Labels))
+	for name, id := range w.config.Labels {
+		names[id] = name
+	}
+	for _, label := range file.LabelInfo.Labels {
+		name := names[label.Id]
+		if name == "" {
+			name = label.Id
+		}
+		labels = append(labels, database.Label{Source: database.LabelSourceLabel, Key: name})
+		for id, field := range label.Fields {
+			values := append(append(append([]string(nil), field.Selection...), field.Text...), field.DateString...)
+			for _, n := range field.Integer {
+				values = append(values, strconv.FormatInt(n, 10))
 			}
+			for _, user := range field.User {
+				values = append(values, user.EmailAddress)
+			}
+			labels = append(labels, database.Label{
+				Source: database.LabelSourceLabel,
+				Key:    name + "." + id,
+				Value:  strings.Join(values, ","),
+			})
+		}
+	}
+	return labels
+}
+
+// executeWithRetry lists one page, retrying rate limits, server and
+// network errors with exponential backoff and full jitter, or as long as a
+// Retry-After header asks. An account out of daily quota, or rate limited
+// again and again, is swapped for another; the account that succeeded is
+// returned.
+func (w *Worker) executeWithRetry(req ListRequest, account *serviceAccount) (*drive.FileList, *serviceAccount, error) {
+	var err error
+	limited := 0 // consecutive rate limits on account
+	for attempt := 0; attempt < retryAttempts; attempt++ {
+		var fileList *drive.FileList
+		fileList, err = account.client.List(w.ctx, req)
+		if err == nil {
+			account.recordSuccess()
+			return fileList, account, nil
 		}
+		if w.ctx.Err() != nil {
+			return nil, account, w.ctx.Err()
+		}
+		account.recordFailure(err)
 
-		if attempt < maxRetries-1 {
-			delay := baseDelay * time.Duration(1<<uint(attempt))
-			time.Sleep(delay)
+		reason := retryReason(err)
+		if reason == "" || attempt == retryAttempts-1 {
+			break
+		}
+		metrics.APIRetries.WithLabelValues(reason).Inc()
+
+		if reason == retryDailyLimit {
+			account.exhaustBudget()
+			if w.config.Type != TargetMyDrive {
+				if next := w.pool.leastLoaded(account); next.hasBudget() {
+					log.Printf("[%s] Worker-%d: %s is out of daily quota, switching to %s",
+						w.config.TeamDriveName, w.id, account.name, next.name)
+					metrics.AccountSwitches.WithLabelValues(reason).Inc()
+					account, limited = next, 0
+					continue
+				}
+			}
+			if err := w.pool.waitForBudget(w.ctx); err != nil {
+				return nil, account, err
+			}
 			continue
 		}
 
-		return nil, err
+		// Another account may well have quota to spare; it still waits
+		// for its own limiter
+		if reason == retryRateLimit && w.config.Type != TargetMyDrive {
+			if limited++; limited >= rotateAfter {
+				if next := w.pool.leastLoaded(account); next != account && next.hasBudget() && !next.isQuarantined() {
+					log.Printf("[%s] Worker-%d: %s keeps hitting rate limits, switching to %s",
+						w.config.TeamDriveName, w.id, account.name, next.name)
+					metrics.AccountSwitches.WithLabelValues(reason).Inc()
+					account, limited = next, 0
+					if err := account.limiter.Wait(w.ctx); err != nil {
+						return nil, account, err
+					}
+					continue
+				}
+			}
+		}
+
+		delay := backoff(attempt, retryAfter(err))
+		if reason == retryRateLimit {
+			log.Printf("[%s] Worker-%d: Rate limit, waiting %v",
+				w.config.TeamDriveName, w.id, delay.Round(time.Millisecond))
+		}
+		metrics.APIRetryWait.Add(delay.Seconds())
+		if err := w.sleep(delay); err != nil {
+			return nil, account, err
+		}
 	}
 
-	return nil, fmt.Errorf("max retries exceeded")
+	return nil, account, err
+}
+
+// sleep waits for d, returning early if the scan is canceled.
+func (w *Worker) sleep(d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
 }
 
-func dbWriter(db *database.Database, resultQueue <-chan database.FileRecord, done chan<- struct{}, stats *Stats, batchSize int) {
+func dbWriter(db RecordSink, resultQueue <-chan database.FileRecord, done chan<- struct{}, stats *Stats, batchSize int) {
 	defer close(done)
 
 	batch := make([]database.FileRecord, 0, batchSize)
@@ -281,8 +915,19 @@ func dbWriter(db *database.Database, resultQueue <-chan database.FileRecord, don
 			return
 		}
 
-		if err := db.BatchInsert(batch); err != nil {
+		start := time.Now()
+		err := db.BatchInsert(batch)
+		took := time.Since(start)
+		metrics.DBInsertDuration.Observe(took.Seconds())
+		if took > slowFlush {
+			log.Printf("[%s] Writing %d records took %v; the database is holding up the scan",
+				stats.TeamDriveName, len(batch), took.Round(time.Second))
+		}
+		metrics.DBBatchSize.Observe(float64(len(batch)))
+
+		if err != nil {
 			log.Printf("[%s] DB insert failed: %v", stats.TeamDriveName, err)
+			stats.DBInsertsFailed.Add(int64(len(batch)))
 		} else {
 			stats.DBInserts.Add(int64(len(batch)))
 		}
@@ -309,6 +954,26 @@ func dbWriter(db *database.Database, resultQueue <-chan database.FileRecord, don
 	}
 }
 
+// sampleMetrics publishes queue depths and per-account limiter state to
+// Prometheus until stop is closed.
+func sampleMetrics(teamDriveName string, queue *folderQueue, resultQueue chan database.FileRecord, pool *ServiceAccountPool, stop <-chan struct{}) {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			metrics.FolderQueueDepth.WithLabelValues(teamDriveName).Set(float64(queue.depth()))
+			metrics.ResultQueueDepth.WithLabelValues(teamDriveName).Set(float64(len(resultQueue)))
+			pool.sampleMetrics()
+		case <-stop:
+			metrics.FolderQueueDepth.WithLabelValues(teamDriveName).Set(0)
+			metrics.ResultQueueDepth.WithLabelValues(teamDriveName).Set(0)
+			return
+		}
+	}
+}
+
 func logStats(stats *Stats, stop <-chan struct{}) {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
@@ -317,6 +982,10 @@ func logStats(stats *Stats, stop <-chan struct{}) {
 		select {
 		case <-ticker.C:
 			printStats(stats, 0)
+			p := stats.progress()
+			log.Printf("Progress:       %.1f%% (%d/%d folders listed), ETA %v (from %s)",
+				p.Percent, p.FoldersCompleted, p.FoldersDiscovered,
+				(time.Duration(p.ETASeconds) * time.Second).Round(time.Second), p.Estimate)
 		case <-stop:
 			return
 		}
@@ -347,6 +1016,9 @@ func printStats(stats *Stats, accountCount int) {
 	log.Printf("API Success:    %d (%.1f%%)", apiSuccess, successRate)
 	log.Printf("API Failed:     %d", apiFailed)
 	log.Printf("DB Inserts:     %d", dbInserts)
+	log.Printf("Failed:         %d folders, %d records", stats.FoldersFailed.Load(), stats.DBInsertsFailed.Load())
+	log.Printf("Excluded:       %d", stats.Excluded.Load())
+	log.Printf("Queue Waits:    %v", time.Duration(stats.QueueBlocked.Load()).Round(time.Millisecond))
 
 	if accountCount > 0 {
 		log.Printf("Accounts Used:  %d", accountCount)
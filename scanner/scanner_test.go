@@ -0,0 +1,248 @@
+package scanner_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"teamdrive-scanner/database"
+	"teamdrive-scanner/scanner"
+	"teamdrive-scanner/scanner/drivetest"
+)
+
+// memorySink collects the records of a scan.
+type memorySink struct {
+	mu      sync.Mutex
+	records map[string]database.FileRecord
+}
+
+func (s *memorySink) BatchInsert(records []database.FileRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records == nil {
+		s.records = make(map[string]database.FileRecord)
+	}
+	for _, record := range records {
+		s.records[record.ID] = record
+	}
+	return nil
+}
+
+// newPool returns a pool of accounts accounts talking to srv.
+func newPool(t *testing.T, srv *drivetest.Server, accounts int, ratePerAccount int) *scanner.ServiceAccountPool {
+	t.Helper()
+	dir := t.TempDir()
+	if err := drivetest.WriteAccounts(dir, accounts); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := scanner.NewServiceAccountPool(dir, ratePerAccount, srv.Factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func scanConfig() scanner.ScanConfig {
+	return scanner.ScanConfig{
+		TeamDriveID:       "D",
+		TeamDriveName:     "Drive",
+		WorkersPerAccount: 2,
+		PageSize:          100,
+		BatchInsertSize:   10,
+	}
+}
+
+// addTree adds folders folders below the drive D, each holding files
+// files, and returns the number of items added.
+func addTree(srv *drivetest.Server, folders, files int) int {
+	srv.AddDrive("D", "Drive")
+	for i := 0; i < folders; i++ {
+		srv.AddFolder("D", fmt.Sprintf("f%d", i), fmt.Sprintf("Folder %d", i))
+		for j := 0; j < files; j++ {
+			srv.AddFile(fmt.Sprintf("f%d", i), fmt.Sprintf("f%d-%d", i, j), fmt.Sprintf("file %d.bin", j), int64(j))
+		}
+	}
+	return folders * (files + 1)
+}
+
+func TestScanTraversal(t *testing.T) {
+	srv := drivetest.NewServer()
+	defer srv.Close()
+	// Pages of three force paging in every folder
+	srv.MaxPageSize = 3
+	srv.AddDrive("D", "Drive")
+	srv.AddFolder("D", "a", "A")
+	srv.AddFolder("a", "b", "B")
+	srv.AddFolder("b", "c", "C")
+	for i := 0; i < 7; i++ {
+		srv.AddFile("c", fmt.Sprintf("c%d", i), fmt.Sprintf("deep %d.txt", i), 100)
+		srv.AddFile("D", fmt.Sprintf("r%d", i), fmt.Sprintf("top %d.txt", i), 10)
+	}
+
+	sink := &memorySink{}
+	if err := scanner.ScanTeamDrive(scanConfig(), sink, newPool(t, srv, 2, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(sink.records), 3+14; got != want {
+		t.Fatalf("scanned %d items, want %d", got, want)
+	}
+	for id, want := range map[string]string{
+		"a":  "/A",
+		"b":  "/A/B",
+		"c":  "/A/B/C",
+		"c6": "/A/B/C/deep 6.txt",
+		"r0": "/top 0.txt",
+	} {
+		record := sink.records[id]
+		if record.Path != want {
+			t.Errorf("path of %s = %q, want %q", id, record.Path, want)
+		}
+		if record.TeamDriveID != "D" {
+			t.Errorf("teamdrive of %s = %q, want D", id, record.TeamDriveID)
+		}
+	}
+	if !sink.records["b"].IsFolder || sink.records["b"].ParentID != "a" {
+		t.Errorf("folder b = %+v, want a folder below a", sink.records["b"])
+	}
+
+	// The root and c take three pages each, a and b one
+	if got := srv.Requests()["files.list"]; got != 8 {
+		t.Errorf("files.list calls = %d, want 8", got)
+	}
+}
+
+func TestScanRetriesErrors(t *testing.T) {
+	srv := drivetest.NewServer()
+	defer srv.Close()
+	items := addTree(srv, 4, 5)
+
+	// A rate limit, a quota error and a server error; each is retried
+	srv.Fail(429, 403, 500)
+	sink := &memorySink{}
+	pool := newPool(t, srv, 1, 100)
+	if err := scanner.ScanTeamDrive(scanConfig(), sink, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.records) != items {
+		t.Errorf("scanned %d items, want %d", len(sink.records), items)
+	}
+	// One listing of the root and each folder, plus the failed attempts
+	if got, want := srv.Requests()["files.list"], 1+4+3; got != want {
+		t.Errorf("files.list calls = %d, want %d", got, want)
+	}
+
+	status := pool.Statuses()[0]
+	if status.Errors429 != 1 || status.Errors403 != 1 {
+		t.Errorf("account saw %d 429s and %d 403s, want 1 each", status.Errors429, status.Errors403)
+	}
+	// Rate limits slow the account down
+	if status.RateLimit >= 100 {
+		t.Errorf("account rate after rate limits = %.1f, want below 100", status.RateLimit)
+	}
+}
+
+func TestScanSwitchesAccountOutOfQuota(t *testing.T) {
+	srv := drivetest.NewServer()
+	defer srv.Close()
+	items := addTree(srv, 3, 2)
+
+	// An account out of daily quota is not retried but swapped
+	srv.FailWith(403, "dailyLimitExceeded")
+	sink := &memorySink{}
+	config := scanConfig()
+	config.WorkersPerAccount = 1
+	pool := newPool(t, srv, 2, 100)
+	start := time.Now()
+	if err := scanner.ScanTeamDrive(config, sink, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.records) != items {
+		t.Errorf("scanned %d items, want %d", len(sink.records), items)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("scan took %v, want no backoff for the switch", elapsed)
+	}
+	exhausted := 0
+	for _, status := range pool.Statuses() {
+		exhausted += int(status.Errors403)
+	}
+	if exhausted != 1 {
+		t.Errorf("accounts saw %d quota errors, want 1", exhausted)
+	}
+}
+
+func TestScanFailedFolderMarksNothingDeleted(t *testing.T) {
+	srv := drivetest.NewServer()
+	defer srv.Close()
+	srv.AddDrive("D", "Drive")
+	srv.AddFolder("D", "a", "A")
+	srv.AddFile("a", "a1", "a.txt", 1)
+	srv.AddFolder("a", "b", "B")
+	srv.AddFile("b", "b1", "b.txt", 1)
+	srv.AddFile("D", "r1", "top.txt", 1)
+
+	db, err := database.InitDatabase(filepath.Join(t.TempDir(), "index.db"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	pool := newPool(t, srv, 1, 100)
+	scan := func() error {
+		manifest, err := db.StartScan("D")
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanErr := scanner.ScanTeamDrive(scanConfig(), manifest, pool)
+		if err := manifest.Finish(scanErr, 5); err != nil {
+			t.Fatal(err)
+		}
+		return scanErr
+	}
+	if err := scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A folder that cannot be listed hides its subtree from the scan
+	srv.FailFolder("a", 404)
+	if err := scan(); err == nil {
+		t.Fatal("scan with a failed folder listing succeeded")
+	}
+
+	deleted, _, err := db.GetDeleted(context.Background(), "D", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range deleted {
+		t.Errorf("%s marked deleted after a failed listing", record.Path)
+	}
+	scans, err := db.GetScans(context.Background(), "D", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scans) != 1 {
+		t.Errorf("kept %d scans, want only the complete one", len(scans))
+	}
+}
+
+func TestScanRateLimit(t *testing.T) {
+	srv := drivetest.NewServer()
+	defer srv.Close()
+	addTree(srv, 40, 0)
+
+	// 41 listings at 20/s with a burst of 20 take over a second
+	config := scanConfig()
+	config.RateLimit = 20
+	start := time.Now()
+	if err := scanner.ScanTeamDrive(config, &memorySink{}, newPool(t, srv, 2, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("scan took %v, want the rate limit to hold it to over 900ms", elapsed)
+	}
+}
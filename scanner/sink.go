@@ -0,0 +1,103 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"teamdrive-scanner/database"
+)
+
+// RecordSink receives scanned records in batches. *database.Database is
+// the usual sink.
+type RecordSink interface {
+	BatchInsert(records []database.FileRecord) error
+}
+
+// NDJSONSink writes records as newline-delimited JSON, one object per line,
+// for piping an inventory into other tools without a database.
+type NDJSONSink struct {
+	mu      sync.Mutex
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func NewNDJSONSink(w io.Writer) *NDJSONSink {
+	writer := bufio.NewWriterSize(w, 1<<20)
+	return &NDJSONSink{
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+	}
+}
+
+func (s *NDJSONSink) BatchInsert(records []database.FileRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range records {
+		if err := s.encoder.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+	return s.writer.Flush()
+}
+
+// TargetCount is what a CountingSink saw of one scan target.
+type TargetCount struct {
+	TeamDriveID   string
+	TeamDriveName string
+	Files         int64
+	Folders       int64
+	Size          int64
+	First, Last   time.Time // arrival of the first and last batch
+}
+
+// CountingSink tallies records per target and discards them, for dry runs
+// that estimate a scan before anything is written.
+type CountingSink struct {
+	mu      sync.Mutex
+	targets map[string]*TargetCount
+}
+
+func NewCountingSink() *CountingSink {
+	return &CountingSink{targets: make(map[string]*TargetCount)}
+}
+
+func (s *CountingSink) BatchInsert(records []database.FileRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for i := range records {
+		r := &records[i]
+		count := s.targets[r.TeamDriveID]
+		if count == nil {
+			count = &TargetCount{TeamDriveID: r.TeamDriveID, TeamDriveName: r.TeamDriveName, First: now}
+			s.targets[r.TeamDriveID] = count
+		}
+		if r.IsFolder {
+			count.Folders++
+		} else {
+			count.Files++
+			count.Size += r.Size
+		}
+		count.Last = now
+	}
+	return nil
+}
+
+// Counts returns the tallies sorted by target name.
+func (s *CountingSink) Counts() []TargetCount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make([]TargetCount, 0, len(s.targets))
+	for _, count := range s.targets {
+		counts = append(counts, *count)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].TeamDriveName < counts[j].TeamDriveName })
+	return counts
+}
@@ -0,0 +1,67 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// thumbnailLimit caps the bytes read of one thumbnail; Drive's are tens of
+// kilobytes.
+const thumbnailLimit = 4 << 20
+
+// ErrNoThumbnail is returned by FetchThumbnail for files Drive has no
+// thumbnail of, such as folders and most Google-native files.
+var ErrNoThumbnail = errors.New("file has no thumbnail")
+
+// FetchThumbnail returns the thumbnail of a file and its content type,
+// fetched through one of the pool's accounts. link is the thumbnailLink
+// stored by the last scan; when it is empty or has expired, the file's
+// current one is looked up, at one API call.
+func FetchThumbnail(ctx context.Context, pool *ServiceAccountPool, fileID, link string) ([]byte, string, error) {
+	account := pool.getNext()
+	if account == nil {
+		return nil, "", errors.New("no service accounts loaded")
+	}
+	if link != "" {
+		data, contentType, err := readThumbnail(ctx, account.client, link)
+		if err == nil || !linkExpired(err) {
+			return data, contentType, err
+		}
+	}
+
+	if err := account.limiter.Wait(ctx); err != nil {
+		return nil, "", err
+	}
+	file, err := account.client.Get(ctx, fileID, "thumbnailLink")
+	if err != nil {
+		account.recordFailure(err)
+		return nil, "", err
+	}
+	account.recordSuccess()
+	if file.ThumbnailLink == "" {
+		return nil, "", ErrNoThumbnail
+	}
+	return readThumbnail(ctx, account.client, file.ThumbnailLink)
+}
+
+func readThumbnail(ctx context.Context, client DriveClient, link string) ([]byte, string, error) {
+	body, contentType, err := client.Thumbnail(ctx, link)
+	if err != nil {
+		return nil, "", err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, thumbnailLimit))
+	return data, contentType, err
+}
+
+// linkExpired reports whether a thumbnail link was refused, as links are a
+// few hours after Drive hands them out.
+func linkExpired(err error) bool {
+	switch APIStatus(err) {
+	case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package scanner
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// accountPollInterval is how often the service accounts directory is
+	// checked for new and removed keys.
+	accountPollInterval = 30 * time.Second
+
+	// revokedThreshold is the number of auth failures in a row after which
+	// an account's key is taken to be revoked and dropped from the pool.
+	revokedThreshold = 10
+)
+
+// WatchAccounts keeps the pool in step with its service accounts directory
+// until ctx is cancelled: keys dropped into the directory join the pool,
+// and accounts whose key was deleted or keeps failing authentication leave
+// it. A dropped key is retried once its file changes. Pools created from
+// OAuth credentials have no directory and are left alone.
+func (p *ServiceAccountPool) WatchAccounts(ctx context.Context) {
+	if p.dir == "" {
+		return
+	}
+
+	ticker := time.NewTicker(accountPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.syncAccounts()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncAccounts adds new keys and drops revoked accounts. The last account
+// is never dropped, so a scan can still fail with a useful error.
+func (p *ServiceAccountPool) syncAccounts() {
+	files, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		log.Printf("Cannot read service accounts directory: %v", err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := p.all()
+	loaded := make(map[string]bool, len(current))
+	for _, account := range current {
+		loaded[account.file] = true
+	}
+
+	present := make(map[string]bool, len(files))
+	var added []*serviceAccount
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		present[file.Name()] = true
+		if loaded[file.Name()] {
+			continue
+		}
+		if modTime, ok := p.rejected[file.Name()]; ok && modTime.Equal(file.ModTime()) {
+			continue
+		}
+
+		account, err := p.load(file.Name())
+		if err != nil {
+			log.Printf("Skipping %s: %v", file.Name(), err)
+			p.rejected[file.Name()] = file.ModTime()
+			continue
+		}
+		delete(p.rejected, file.Name())
+		added = append(added, account)
+		log.Printf("Service account %s added to the pool", account.name)
+	}
+
+	next := make([]*serviceAccount, 0, len(current)+len(added))
+	var dropped []*serviceAccount
+	for _, account := range current {
+		account.mu.Lock()
+		revoked := account.authFailures >= revokedThreshold
+		account.mu.Unlock()
+
+		if present[account.file] && !revoked {
+			next = append(next, account)
+			continue
+		}
+		dropped = append(dropped, account)
+	}
+	next = append(next, added...)
+
+	if len(next) == 0 {
+		return
+	}
+	for _, account := range dropped {
+		account.dropped.Store(true)
+		if !present[account.file] {
+			log.Printf("Service account %s removed from the pool: key file deleted", account.name)
+			continue
+		}
+		log.Printf("Service account %s removed from the pool after %d authentication failures",
+			account.name, revokedThreshold)
+		p.rejected[account.file] = fileModTime(files, account.file)
+	}
+	if len(added) > 0 || len(dropped) > 0 {
+		p.accounts.Store(&next)
+	}
+}
+
+func fileModTime(files []os.FileInfo, name string) time.Time {
+	for _, file := range files {
+		if file.Name() == name {
+			return file.ModTime()
+		}
+	}
+	return time.Time{}
+}
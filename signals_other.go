@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// handlePauseSignals does nothing where there are no user signals; use
+// the /api/scan/pause endpoint of the daemon instead.
+func handlePauseSignals() {}
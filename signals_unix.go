@@ -0,0 +1,30 @@
+//go:build unix
+
+package main
+
+import (
+    "log"
+    "os"
+    "os/signal"
+    "syscall"
+
+    "teamdrive-scanner/scanner"
+)
+
+// handlePauseSignals pauses the scans on SIGUSR1 and resumes them on
+// SIGUSR2, e.g. kill -USR1 <pid>.
+func handlePauseSignals() {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+    log.Printf("Send SIGUSR1 to pause scans and SIGUSR2 to resume them (pid %d)", os.Getpid())
+
+    go func() {
+        for sig := range signals {
+            if sig == syscall.SIGUSR1 {
+                scanner.PauseScans()
+            } else {
+                scanner.ResumeScans()
+            }
+        }
+    }()
+}
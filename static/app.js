@@ -6,6 +6,7 @@ class TeamDriveExplorer {
         this.pageSize = 100;
         this.breadcrumbs = [];
         this.teamDrives = [];
+        this.searchFilters = {};
         this.contextMenu = document.getElementById('contextMenu');
         this.contextTarget = null;
 
@@ -16,11 +17,59 @@ class TeamDriveExplorer {
         await this.loadTeamDrives();
         this.setupEventListeners();
         this.setupContextMenu();
+        await this.loadSearchFromUrl();
+    }
+
+    // Opens the search in the page URL, either a saved search
+    // (?search=<id>) or plain /api/search parameters (?q=...&teamdrive=...)
+    async loadSearchFromUrl() {
+        let params = new URLSearchParams(window.location.search);
+        const saved = params.get('search');
+        if (saved) {
+            try {
+                const response = await this.api(`/api/searches/${encodeURIComponent(saved)}`);
+                if (!response.ok) throw new Error(`HTTP ${response.status}`);
+                const data = await response.json();
+                params = new URLSearchParams(data.search.params);
+            } catch (error) {
+                console.error('Failed to load saved search:', error);
+                return;
+            }
+        }
+
+        const teamDrive = this.teamDrives.find(td => td.id === params.get('teamdrive'));
+        if (teamDrive) {
+            this.selectTeamDrive(teamDrive.id, teamDrive.name);
+        }
+
+        const query = params.get('q') || '';
+        ['search', 'q', 'teamdrive', 'parent', 'limit'].forEach(key => params.delete(key));
+        this.searchFilters = Object.fromEntries(params);
+
+        if (query || Object.keys(this.searchFilters).length > 0) {
+            document.getElementById('searchInput').value = query;
+            this.loadFiles(query);
+        }
+    }
+
+    // fetch wrapper that sends the saved API key and asks for one when the
+    // server rejects the request
+    async api(url) {
+        const key = localStorage.getItem('apiKey');
+        const response = await fetch(url, key ? { headers: { 'Authorization': `Bearer ${key}` } } : {});
+        if (response.status === 401) {
+            const entered = prompt('This server requires an API key:');
+            if (entered) {
+                localStorage.setItem('apiKey', entered);
+                return this.api(url);
+            }
+        }
+        return response;
     }
 
     async loadTeamDrives() {
         try {
-            const response = await fetch('/api/teamdrives');
+            const response = await this.api('/api/teamdrives');
             this.teamDrives = await response.json();
             this.renderTeamDrives();
         } catch (error) {
@@ -52,6 +101,7 @@ class TeamDriveExplorer {
         this.currentParent = id;
         this.currentPage = 0;
         this.breadcrumbs = [{ id: id, name: name }];
+        this.searchFilters = {};
 
         document.querySelectorAll('.teamdrive-item').forEach(item => {
             item.classList.toggle('active', item.dataset.id === id);
@@ -66,17 +116,40 @@ class TeamDriveExplorer {
         fileList.innerHTML = '<div class="loading">⏳ Loading...</div>';
 
         try {
-            const params = new URLSearchParams({
-                teamdrive: this.currentTeamDrive || '',
-                parent: this.currentParent || '',
-                q: query,
-                limit: this.pageSize,
-                offset: this.currentPage * this.pageSize
-            });
+            let url;
+            if (!query && this.currentTeamDrive && Object.keys(this.searchFilters).length === 0) {
+                // Plain folder navigation
+                const params = new URLSearchParams({
+                    limit: this.pageSize,
+                    offset: this.currentPage * this.pageSize
+                });
+                const drive = encodeURIComponent(this.currentTeamDrive);
+                const folder = encodeURIComponent(this.currentParent || this.currentTeamDrive);
+                url = `/api/browse/${drive}/${folder}?${params}`;
+            } else {
+                const params = new URLSearchParams({
+                    teamdrive: this.currentTeamDrive || '',
+                    parent: this.currentParent || '',
+                    q: query,
+                    limit: this.pageSize,
+                    offset: this.currentPage * this.pageSize,
+                    ...this.searchFilters
+                });
+                url = `/api/search?${params}`;
+            }
 
-            const response = await fetch(`/api/search?${params}`);
+            const response = await this.api(url);
             const data = await response.json();
 
+            // A query the server cannot search comes back with the reason
+            if (response.status === 400) {
+                const message = document.createElement('div');
+                message.className = 'loading';
+                message.textContent = `❌ ${data.error}` + (data.hint ? `. ${data.hint}` : '');
+                fileList.replaceChildren(message);
+                return;
+            }
+
             this.renderFiles(data.files);
             this.renderPagination(data.total_count);
             this.renderBreadcrumbs();
@@ -102,18 +175,33 @@ class TeamDriveExplorer {
             item.dataset.name = file.name;
             item.dataset.path = file.path || file.name;
 
+            const targetIsFolder = file.is_shortcut &&
+                file.shortcut_target_mime_type === 'application/vnd.google-apps.folder';
+
             const icon = document.createElement('div');
-            icon.className = `file-icon ${file.is_folder ? 'folder' : 'file'}`;
-            icon.textContent = file.is_folder ? '📁' : '📄';
+            icon.className = `file-icon ${file.is_folder || targetIsFolder ? 'folder' : 'file'}`;
+            icon.textContent = file.is_shortcut ? '🔗' : (file.is_folder ? '📁' : '📄');
+            if (file.has_thumbnail) {
+                this.loadThumbnail(icon, file.id);
+            }
 
             const name = document.createElement('div');
             name.className = 'file-name';
-            name.textContent = this.truncateName(file.name, 80);
+            if (file.name_highlight) {
+                // Escaped by the server; <mark> is the only markup
+                name.innerHTML = file.name_highlight;
+            } else {
+                name.textContent = this.truncateName(file.name, 80);
+            }
             name.title = file.name;
 
             const size = document.createElement('div');
             size.className = 'file-size';
-            size.textContent = this.formatBytes(file.total_size || file.size);
+            if (file.is_shortcut && !file.total_size) {
+                size.textContent = 'Shortcut';
+            } else {
+                size.textContent = this.formatBytes(file.total_size || file.size);
+            }
 
             const date = document.createElement('div');
             date.className = 'file-date';
@@ -128,6 +216,14 @@ class TeamDriveExplorer {
                 item.addEventListener('click', () => {
                     this.openFolder(file.id, file.name);
                 });
+            } else if (targetIsFolder) {
+                item.addEventListener('click', () => {
+                    this.openFolder(file.shortcut_target_id, file.name);
+                });
+            } else if (file.web_view_link) {
+                item.addEventListener('dblclick', () => {
+                    window.open(file.web_view_link, '_blank', 'noopener');
+                });
             }
 
             item.addEventListener('contextmenu', (e) => {
@@ -154,13 +250,43 @@ class TeamDriveExplorer {
         });
     }
 
-    openFolder(id, name) {
+    // Replaces an icon with the file's thumbnail, fetched through the
+    // server so the API key stays out of image URLs
+    async loadThumbnail(icon, fileId) {
+        try {
+            const response = await this.api(`/api/thumbnail/${encodeURIComponent(fileId)}`);
+            if (!response.ok) {
+                return;
+            }
+            const img = document.createElement('img');
+            img.alt = '';
+            img.onload = () => URL.revokeObjectURL(img.src);
+            img.src = URL.createObjectURL(await response.blob());
+            icon.replaceChildren(img);
+        } catch (error) {
+            console.error('Failed to load thumbnail:', error);
+        }
+    }
+
+    async openFolder(id, name) {
         this.currentParent = id;
         this.currentPage = 0;
-        this.breadcrumbs.push({ id, name });
+        this.breadcrumbs = await this.loadPath(id, name);
         this.loadFiles();
     }
 
+    async loadPath(id, name) {
+        try {
+            const response = await this.api(`/api/path/${encodeURIComponent(id)}`);
+            if (!response.ok) throw new Error(`HTTP ${response.status}`);
+            const data = await response.json();
+            return data.path.map(crumb => ({ id: crumb.id, name: crumb.name }));
+        } catch (error) {
+            console.error('Failed to load path:', error);
+            return [...this.breadcrumbs, { id, name }];
+        }
+    }
+
     renderBreadcrumbs() {
         const breadcrumb = document.getElementById('breadcrumb');
         breadcrumb.innerHTML = '';
@@ -193,7 +319,7 @@ class TeamDriveExplorer {
         if (!this.currentTeamDrive) return;
 
         try {
-            const response = await fetch(`/api/stats/${this.currentTeamDrive}`);
+            const response = await this.api(`/api/stats/${this.currentTeamDrive}`);
             const stats = await response.json();
 
             const container = document.getElementById('stats');
@@ -210,6 +336,33 @@ class TeamDriveExplorer {
                     <h4>Total Size</h4>
                     <div class="value">${stats.total_size_human}</div>
                 </div>
+                <div class="stat-card">
+                    <h4>Google Docs, Sheets &amp; Slides</h4>
+                    <div class="value">${this.formatNumber(stats.native_files)}</div>
+                </div>
+                ${stats.estimated_total_size ? `
+                <div class="stat-card">
+                    <h4>Estimated Size with Exports</h4>
+                    <div class="value">~${this.formatBytes(stats.estimated_total_size)}</div>
+                </div>` : ''}
+                ${stats.revisions.files ? `
+                <div class="stat-card">
+                    <h4>Old Revisions</h4>
+                    <div class="value">${stats.revisions.old_size_human}</div>
+                </div>` : ''}
+                ${stats.trash.files || stats.trash.folders ? `
+                <div class="stat-card">
+                    <h4>Recoverable from Trash</h4>
+                    <div class="value">${stats.trash.size_human}</div>
+                </div>` : ''}
+                <div class="stat-card">
+                    <h4>Average File Size</h4>
+                    <div class="value">${this.formatBytes(stats.average_file_size)}</div>
+                </div>
+                <div class="stat-card">
+                    <h4>Last Scan</h4>
+                    <div class="value">${stats.last_scan ? new Date(stats.last_scan).toLocaleString() : 'Never'}</div>
+                </div>
             `;
         } catch (error) {
             console.error('Failed to load stats:', error);
@@ -283,6 +436,12 @@ class TeamDriveExplorer {
                     this.copyToClipboard(this.contextTarget.name);
                 } else if (action === 'copy-path' && this.contextTarget) {
                     this.copyToClipboard(this.contextTarget.path);
+                } else if (action === 'open-drive' && this.contextTarget) {
+                    window.open(this.contextTarget.web_view_link, '_blank', 'noopener');
+                } else if (action === 'copy-link' && this.contextTarget) {
+                    this.copyToClipboard(this.contextTarget.web_view_link);
+                } else if (action === 'download' && this.contextTarget) {
+                    this.download(this.contextTarget);
                 }
 
                 this.contextMenu.style.display = 'none';
@@ -290,6 +449,24 @@ class TeamDriveExplorer {
         });
     }
 
+    // Downloads go through the server's service accounts, folders as a
+    // ZIP; a navigation cannot send headers, so the API key rides in the
+    // query
+    download(file) {
+        if (file.is_native) {
+            window.open(file.web_view_link, '_blank', 'noopener');
+            return;
+        }
+        const params = new URLSearchParams();
+        const key = localStorage.getItem('apiKey');
+        if (key) {
+            params.set('api_key', key);
+        }
+        const query = params.toString();
+        const route = file.is_folder ? 'zip' : 'download';
+        window.location.href = `/api/${route}/${encodeURIComponent(file.id)}${query ? '?' + query : ''}`;
+    }
+
     showContextMenu(event, file) {
         this.contextTarget = file;
         this.contextMenu.style.display = 'block';
@@ -0,0 +1,199 @@
+// API reference rendered from /api/openapi.json. It is embedded with the
+// rest of the interface, so the docs work offline and load no third-party
+// script on the origin that keeps the API key.
+
+const METHODS = ['get', 'post', 'put', 'patch', 'delete'];
+
+// el creates an element with text content and children; text is never
+// parsed as HTML
+function el(tag, options = {}, ...children) {
+    const node = document.createElement(tag);
+    if (options.className) {
+        node.className = options.className;
+    }
+    if (options.text !== undefined) {
+        node.textContent = options.text;
+    }
+    for (const [name, value] of Object.entries(options.attrs || {})) {
+        node.setAttribute(name, value);
+    }
+    node.append(...children);
+    return node;
+}
+
+class APIDocs {
+    constructor(root) {
+        this.root = root;
+        this.schemas = {};
+    }
+
+    async load() {
+        const response = await fetch('/api/openapi.json');
+        if (!response.ok) {
+            this.root.replaceChildren(el('p', { className: 'error', text: `Failed to load the API description (${response.status})` }));
+            return;
+        }
+        const spec = await response.json();
+        this.schemas = (spec.components && spec.components.schemas) || {};
+        this.render(spec);
+    }
+
+    render(spec) {
+        const header = el('header', {},
+            el('h1', { text: spec.info.title }),
+            el('p', { text: spec.info.description || '' }),
+            this.keyForm());
+
+        const list = el('div', { className: 'operations' });
+        for (const path of Object.keys(spec.paths).sort()) {
+            for (const method of METHODS) {
+                const operation = spec.paths[path][method];
+                if (operation) {
+                    list.append(this.operation(method, path, operation));
+                }
+            }
+        }
+        this.root.replaceChildren(header, list);
+    }
+
+    // keyForm edits the API key the interface sends, shared with the main
+    // page
+    keyForm() {
+        const input = el('input', { attrs: { type: 'password', placeholder: 'API key', autocomplete: 'off' } });
+        input.value = localStorage.getItem('apiKey') || '';
+        const save = el('button', { text: 'Save key' });
+        save.addEventListener('click', () => {
+            if (input.value) {
+                localStorage.setItem('apiKey', input.value);
+            } else {
+                localStorage.removeItem('apiKey');
+            }
+        });
+        return el('div', { className: 'key' }, input, save);
+    }
+
+    operation(method, path, operation) {
+        const summary = el('summary', {},
+            el('span', { className: `method ${method}`, text: method.toUpperCase() }),
+            el('code', { text: path }),
+            el('span', { className: 'summary', text: operation.summary || '' }));
+
+        const body = el('div', { className: 'body' });
+        const inputs = {};
+        const params = operation.parameters || [];
+        if (params.length > 0) {
+            const rows = params.map(param => {
+                const input = el('input', { attrs: { placeholder: param.schema.type } });
+                inputs[param.name] = { input, param };
+                return el('tr', {},
+                    el('td', {}, el('code', { text: param.name })),
+                    el('td', { text: param.in + (param.required ? ', required' : '') }),
+                    el('td', { text: param.description || '' }),
+                    el('td', {}, input));
+            });
+            body.append(el('h3', { text: 'Parameters' }), el('table', {}, ...rows));
+        }
+
+        let bodyInput = null;
+        if (operation.requestBody) {
+            const schema = operation.requestBody.content['application/json'].schema;
+            bodyInput = el('textarea', { attrs: { rows: 6 } });
+            bodyInput.value = JSON.stringify(this.example(schema, 0), null, 2);
+            body.append(el('h3', { text: 'Request body' }), bodyInput);
+        }
+
+        for (const [status, response] of Object.entries(operation.responses || {})) {
+            if (status === 'default') {
+                continue;
+            }
+            const content = response.content && response.content['application/json'];
+            body.append(el('h3', { text: `Response ${status}` }));
+            if (content) {
+                body.append(el('pre', { text: JSON.stringify(this.example(content.schema, 0), null, 2) }));
+            } else {
+                body.append(el('p', { text: response.description }));
+            }
+        }
+
+        const result = el('pre', { className: 'result' });
+        const send = el('button', { text: 'Send request' });
+        send.addEventListener('click', () => this.send(method, path, inputs, bodyInput, result));
+        body.append(el('div', { className: 'try' }, send), result);
+
+        return el('details', { className: 'operation' }, summary, body);
+    }
+
+    async send(method, path, inputs, bodyInput, result) {
+        const query = new URLSearchParams();
+        let url = path;
+        for (const [name, { input, param }] of Object.entries(inputs)) {
+            if (param.in === 'path') {
+                url = url.replace(`{${name}}`, encodeURIComponent(input.value));
+            } else if (input.value !== '') {
+                query.set(name, input.value);
+            }
+        }
+        if (query.toString()) {
+            url += '?' + query.toString();
+        }
+
+        const headers = {};
+        const key = localStorage.getItem('apiKey');
+        if (key) {
+            headers['Authorization'] = `Bearer ${key}`;
+        }
+        const request = { method: method.toUpperCase(), headers };
+        if (bodyInput) {
+            headers['Content-Type'] = 'application/json';
+            request.body = bodyInput.value;
+        }
+
+        result.textContent = `${request.method} ${url} ...`;
+        try {
+            const response = await fetch(url, request);
+            let text = await response.text();
+            try {
+                text = JSON.stringify(JSON.parse(text), null, 2);
+            } catch (e) {
+                // Not JSON; shown as is
+            }
+            result.textContent = `${response.status} ${response.statusText}\n\n${text.slice(0, 20000)}`;
+        } catch (e) {
+            result.textContent = `Request failed: ${e.message}`;
+        }
+    }
+
+    // example returns a sample value of a schema, following references
+    // down to a few levels so recursive types end
+    example(schema, depth) {
+        if (!schema) {
+            return null;
+        }
+        if (schema.$ref) {
+            if (depth > 4) {
+                return {};
+            }
+            return this.example(this.schemas[schema.$ref.split('/').pop()], depth + 1);
+        }
+        switch (schema.type) {
+            case 'object': {
+                const value = {};
+                for (const [name, property] of Object.entries(schema.properties || {})) {
+                    value[name] = this.example(property, depth + 1);
+                }
+                return value;
+            }
+            case 'array':
+                return [this.example(schema.items, depth + 1)];
+            case 'integer':
+            case 'number':
+                return 0;
+            case 'boolean':
+                return false;
+            default:
+                return schema.format === 'date-time' ? '2024-01-01T00:00:00Z' : '';
+        }
+    }
+}
+
+new APIDocs(document.getElementById('docs')).load();
@@ -0,0 +1,7 @@
+// Package static bundles the web interface into the binary.
+package static
+
+import "embed"
+
+//go:embed *.html *.js *.css
+var FS embed.FS
@@ -0,0 +1,199 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "teamdrive-scanner/database"
+)
+
+// defaultStrmURL streams a file straight from Drive; {id} is replaced
+// with the file's ID.
+const defaultStrmURL = "https://drive.google.com/uc?export=download&id={id}"
+
+// strmPageSize is the number of videos read per search page.
+const strmPageSize = 1000
+
+// runStrm writes a .strm file for every video in the selected drives, laid
+// out like the drives under output, or an M3U playlist when output ends in
+// .m3u or .m3u8. Unchanged .strm files are left alone, so media servers do
+// not rescan them.
+func runStrm(config *Config, db *database.Database, output string, teamDrives string, urlTemplate string) {
+    if output == "-" || output == "" {
+        log.Fatalf("-output is required: a directory, or an .m3u file")
+    }
+    if !strings.Contains(urlTemplate, "{id}") {
+        log.Fatalf("-strm-url must contain {id}")
+    }
+
+    drives := selectTeamDrives(config, teamDrives)
+    if len(drives) == 0 {
+        log.Fatalf("No drives match -teamdrive %q", teamDrives)
+    }
+
+    var writer strmWriter
+    switch strings.ToLower(filepath.Ext(output)) {
+    case ".m3u", ".m3u8":
+        playlist, err := newM3UWriter(output)
+        if err != nil {
+            log.Fatalf("Failed to create playlist: %v", err)
+        }
+        writer = playlist
+    default:
+        writer = &strmTree{root: output, written: make(map[string]bool)}
+    }
+
+    total := 0
+    for _, td := range drives {
+        opts := database.SearchOptions{
+            TeamDriveID: td.ID,
+            MimeType:    "video/*",
+            Sort:        "name",
+            Order:       "asc",
+            Limit:       strmPageSize,
+            NoCount:     true,
+        }
+        count := 0
+        for {
+            result, err := db.Search(context.Background(), opts)
+            if err != nil {
+                log.Fatalf("Failed to list videos of %s: %v", td.Name, err)
+            }
+            for _, file := range result.Files {
+                url := strings.ReplaceAll(urlTemplate, "{id}", file.ID)
+                if err := writer.write(file, url); err != nil {
+                    log.Fatalf("Failed to write %s: %v", file.Path, err)
+                }
+                count++
+            }
+            if !result.HasMore {
+                break
+            }
+            opts.Cursor = result.NextCursor
+        }
+        log.Printf("%s: %d videos", td.Name, count)
+        total += count
+    }
+
+    if err := writer.close(); err != nil {
+        log.Fatalf("Failed to finish %s: %v", output, err)
+    }
+    log.Printf("=== Wrote %d videos to %s ===", total, output)
+}
+
+// selectTeamDrives returns the configured drives named by a comma-separated
+// list of IDs or names, or all of them for an empty list.
+func selectTeamDrives(config *Config, list string) []TeamDrive {
+    if list == "" {
+        return config.TeamDrives
+    }
+
+    var selected []TeamDrive
+    for _, want := range strings.Split(list, ",") {
+        want = strings.TrimSpace(want)
+        for _, td := range config.TeamDrives {
+            if td.ID == want || strings.EqualFold(td.Name, want) {
+                selected = append(selected, td)
+                break
+            }
+        }
+    }
+    return selected
+}
+
+type strmWriter interface {
+    write(file database.FileRecord, url string) error
+    close() error
+}
+
+// strmTree writes one .strm file per video below root.
+type strmTree struct {
+    root    string
+    written map[string]bool
+    updated int
+}
+
+func (t *strmTree) write(file database.FileRecord, url string) error {
+    parts := []string{t.root, safeFileName(file.TeamDriveName)}
+    dirs := strings.Split(strings.Trim(file.Path, "/"), "/")
+    for _, dir := range dirs[:len(dirs)-1] {
+        parts = append(parts, safeFileName(dir))
+    }
+    dir := filepath.Join(parts...)
+
+    base := safeFileName(strings.TrimSuffix(file.Name, filepath.Ext(file.Name)))
+    name := filepath.Join(dir, base+".strm")
+    // Drive allows several files of the same name in a folder
+    if t.written[name] {
+        name = filepath.Join(dir, base+" ("+file.ID+").strm")
+    }
+    t.written[name] = true
+
+    content := []byte(url + "\n")
+    if existing, err := os.ReadFile(name); err == nil && bytes.Equal(existing, content) {
+        return nil
+    }
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return err
+    }
+    t.updated++
+    return os.WriteFile(name, content, 0o644)
+}
+
+func (t *strmTree) close() error {
+    log.Printf("%d .strm files written or updated, %d unchanged", t.updated, len(t.written)-t.updated)
+    return nil
+}
+
+// m3uWriter writes all videos to one extended M3U playlist.
+type m3uWriter struct {
+    file *os.File
+    w    *bufio.Writer
+}
+
+func newM3UWriter(path string) (*m3uWriter, error) {
+    file, err := os.Create(path)
+    if err != nil {
+        return nil, err
+    }
+    w := bufio.NewWriter(file)
+    _, err = w.WriteString("#EXTM3U\n")
+    return &m3uWriter{file: file, w: w}, err
+}
+
+func (m *m3uWriter) write(file database.FileRecord, url string) error {
+    title := strings.NewReplacer("\r", " ", "\n", " ").Replace(file.Name)
+    _, err := fmt.Fprintf(m.w, "#EXTINF:-1,%s\n%s\n", title, url)
+    return err
+}
+
+func (m *m3uWriter) close() error {
+    if err := m.w.Flush(); err != nil {
+        m.file.Close()
+        return err
+    }
+    return m.file.Close()
+}
+
+// safeFileName makes a Drive name usable as a file name on any OS: path
+// separators and characters Windows rejects become underscores, and names
+// that would refer to a parent directory are replaced.
+func safeFileName(name string) string {
+    name = strings.Map(func(r rune) rune {
+        if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+            return '_'
+        }
+        return r
+    }, name)
+    name = strings.TrimRight(name, ". ")
+    if name == "" {
+        return "_"
+    }
+    return name
+}
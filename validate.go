@@ -0,0 +1,286 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "time"
+
+    "teamdrive-scanner/database"
+    "teamdrive-scanner/scanner"
+
+    "github.com/robfig/cron/v3"
+)
+
+// applyDefaults fills in settings left at zero, which would otherwise make
+// for a broken scan (a page size of 0) or server (port 0).
+func applyDefaults(config *Config) {
+    if config.ServiceAccountsDir == "" {
+        config.ServiceAccountsDir = "./service_accounts"
+    }
+
+    s := &config.Scanner
+    if s.WorkersPerAccount == 0 {
+        s.WorkersPerAccount = 3
+    }
+    if s.RatePerAccount == 0 {
+        s.RatePerAccount = 10
+    }
+    if s.PageSize == 0 {
+        s.PageSize = 1000
+    }
+    if s.BatchInsertSize == 0 {
+        s.BatchInsertSize = 5000
+    }
+    if s.ConcurrentTeamDrives == 0 {
+        s.ConcurrentTeamDrives = 1
+    }
+    // Google resets the Drive API quotas at midnight Pacific Time
+    if s.BudgetTimezone == "" {
+        s.BudgetTimezone = "America/Los_Angeles"
+    }
+
+    if config.Database.Path == "" && config.Database.Driver != "postgres" {
+        config.Database.Path = "teamdrives.db"
+    }
+
+    if config.Web.Port == 0 {
+        config.Web.Port = 8080
+    }
+    if config.Web.Host == "" {
+        config.Web.Host = "0.0.0.0"
+    }
+    if config.Downloads.Concurrency == 0 {
+        config.Downloads.Concurrency = 4
+    }
+}
+
+// validateConfig checks for missing required fields and out-of-range
+// values, returning one message per problem. Run after applyDefaults.
+func validateConfig(config *Config) []string {
+    var problems []string
+    problem := func(format string, args ...interface{}) {
+        problems = append(problems, fmt.Sprintf(format, args...))
+    }
+
+    seen := make(map[string]bool)
+    for i, td := range config.TeamDrives {
+        name := fmt.Sprintf("teamdrives[%d]", i)
+        if td.ID == "" {
+            problem("%s: id is required", name)
+        } else if seen[td.ID] {
+            problem("%s: duplicate id %s", name, td.ID)
+        }
+        seen[td.ID] = true
+
+        switch td.Type {
+        case "", scanner.TargetTeamDrive, scanner.TargetMyDrive, scanner.TargetFolder:
+        case scanner.TargetS3:
+            if td.S3.Bucket == "" {
+                problem("%s: s3.bucket is required for s3 targets", name)
+            }
+        case scanner.TargetLocal:
+            if td.Path == "" {
+                problem("%s: path is required for local targets", name)
+            }
+        case scanner.TargetRclone:
+            if td.Remote == "" {
+                problem("%s: remote is required for rclone targets", name)
+            }
+        default:
+            problem("%s: unknown type %q", name, td.Type)
+        }
+
+        if td.WorkersPerAccount < 0 || td.Rate < 0 {
+            problem("%s: workers_per_account and rate must not be negative", name)
+        }
+        if td.PageSize < 0 || td.PageSize > 1000 {
+            problem("%s: page_size must be between 1 and 1000", name)
+        }
+        if _, err := scanConfigFor(config, td); err != nil {
+            problem("%s: %v", name, err)
+        }
+    }
+
+    switch config.Auth.Mode {
+    case "", "service_accounts":
+    case "oauth":
+        if config.Auth.OAuthClientFile == "" || config.Auth.OAuthTokenFile == "" {
+            problem("auth: oauth_client_file and oauth_token_file are required in oauth mode")
+        }
+    default:
+        problem("auth.mode: unknown mode %q (use service_accounts or oauth)", config.Auth.Mode)
+    }
+
+    s := config.Scanner
+    if s.WorkersPerAccount <= 0 {
+        problem("scanner.workers_per_account must be at least 1")
+    }
+    if s.RatePerAccount <= 0 {
+        problem("scanner.rate_per_account must be at least 1")
+    }
+    if s.PageSize <= 0 || s.PageSize > 1000 {
+        problem("scanner.page_size must be between 1 and 1000")
+    }
+    if s.BatchInsertSize <= 0 {
+        problem("scanner.batch_insert_size must be at least 1")
+    }
+    if s.ConcurrentTeamDrives <= 0 {
+        problem("scanner.concurrent_teamdrives must be at least 1")
+    }
+    if s.MinFileSize < 0 || s.MaxFileSize < 0 || s.MaxFileSize > 0 && s.MaxFileSize < s.MinFileSize {
+        problem("scanner.min_file_size and max_file_size must not be negative, and max not below min")
+    }
+    if s.MemoryLimitMB < 0 {
+        problem("scanner.memory_limit_mb must not be negative")
+    }
+    if s.DailyBudgetPerAccount < 0 {
+        problem("scanner.daily_budget_per_account must not be negative")
+    }
+    if s.KeepScans < 0 {
+        problem("scanner.keep_scans must not be negative")
+    }
+    if s.ContentMaxSize < 0 {
+        problem("scanner.content_max_size must not be negative")
+    }
+    for _, mimeType := range s.ContentMimeTypes {
+        if !scanner.ContentSupported(mimeType) {
+            problem("scanner.content_mime_types: cannot extract the text of %s", mimeType)
+        }
+    }
+    if _, err := time.LoadLocation(s.BudgetTimezone); err != nil {
+        problem("scanner.budget_timezone %q: %v", s.BudgetTimezone, err)
+    }
+    if s.Schedule != "" {
+        if _, err := cron.ParseStandard(s.Schedule); err != nil {
+            problem("scanner.schedule %q: %v", s.Schedule, err)
+        }
+    }
+    switch s.ScanPermissions {
+    case "", scanner.PermissionsFolders, scanner.PermissionsAll:
+    default:
+        problem("scanner.scan_permissions %q: use folders, all or leave empty", s.ScanPermissions)
+    }
+    for name, id := range s.Labels {
+        if name == "" || strings.ContainsAny(name, " .,=:") || id == "" {
+            problem("scanner.labels %q: names need a label ID and cannot contain spaces or . , = :", name)
+        }
+    }
+
+    switch config.Database.Driver {
+    case "", "sqlite":
+        if config.Database.Path == "" {
+            problem("database.path is required for sqlite")
+        }
+        if config.Database.InstanceID != "" {
+            problem("database.instance_id needs the postgres driver")
+        }
+    case "postgres":
+        if config.Database.DSN == "" {
+            problem("database.dsn is required for postgres")
+        }
+        if config.Database.ShardDir != "" {
+            problem("database.shard_dir needs the sqlite driver")
+        }
+        if config.Scanner.StagingDir != "" {
+            problem("scanner.staging_dir needs the sqlite driver")
+        }
+        if id := config.Database.InstanceID; id != "" && !database.ValidInstanceID(id) {
+            problem("database.instance_id %q: use 1-48 lowercase letters, digits and underscores", id)
+        }
+    default:
+        problem("database.driver: unknown driver %q (use sqlite or postgres)", config.Database.Driver)
+    }
+    if config.Database.CacheSizeMB < 0 || config.Database.WriteQueueSize < 0 ||
+        config.Database.BusyRetries < 0 || config.Database.BusyRetryMs < 0 {
+        problem("database: cache_size_mb, write_queue_size, busy_retries and busy_retry_ms must not be negative")
+    }
+    if config.Database.ResultCacheTTLSeconds < 0 {
+        problem("database.result_cache_ttl_seconds must not be negative")
+    }
+    if config.Database.ChangeRetentionDays < 0 {
+        problem("database.change_retention_days must not be negative")
+    }
+    if config.Database.DeletedRetentionDays < 0 {
+        problem("database.deleted_retention_days must not be negative")
+    }
+    if config.Database.CheckpointIntervalSeconds < 0 {
+        problem("database.checkpoint_interval_seconds must not be negative")
+    }
+    for kind, size := range config.Database.NativeSizeEstimates {
+        if size < 0 {
+            problem("database.native_size_estimates.%s must not be negative", kind)
+        }
+    }
+
+    w := config.Web
+    if w.Port <= 0 || w.Port > 65535 {
+        problem("web.port must be between 1 and 65535")
+    }
+    if w.RateLimit.RequestsPerMinute < 0 || w.RateLimit.Burst < 0 {
+        problem("web.rate_limit values must not be negative")
+    }
+    if w.QueryTimeoutSeconds < 0 {
+        problem("web.query_timeout_seconds must not be negative")
+    }
+    if w.ThumbnailCacheMB < -1 {
+        problem("web.thumbnail_cache_mb must be -1 (off) or more")
+    }
+    if w.ZipMaxMB < -1 {
+        problem("web.zip_max_mb must be -1 (off) or more")
+    }
+    if (w.TLS.Cert == "") != (w.TLS.Key == "") {
+        problem("web.tls: cert and key must be set together")
+    }
+    for i, key := range w.APIKeys {
+        if key.Key == "" {
+            problem("web.api_keys[%d]: key is empty", i)
+        }
+        if key.Instance != "" && config.Database.Driver != "postgres" {
+            problem("web.api_keys[%d]: instance needs the postgres driver", i)
+        } else if key.Instance != "" && !database.ValidInstanceID(key.Instance) {
+            problem("web.api_keys[%d]: invalid instance %q", i, key.Instance)
+        }
+    }
+
+    if config.Downloads.Concurrency < 1 || config.Downloads.Concurrency > 32 {
+        problem("downloads.concurrency must be between 1 and 32")
+    }
+    if config.Downloads.Bandwidth < 0 {
+        problem("downloads.bandwidth must not be negative")
+    }
+
+    return problems
+}
+
+// checkEnvironment checks that the directories the config points at exist.
+// Only -validate-config runs it: the web server, for one, needs no service
+// accounts.
+func checkEnvironment(config *Config) []string {
+    var problems []string
+
+    needsPool := false
+    for i, td := range config.TeamDrives {
+        switch td.Type {
+        case "", scanner.TargetTeamDrive, scanner.TargetMyDrive, scanner.TargetFolder:
+            needsPool = true
+        case scanner.TargetLocal:
+            if info, err := os.Stat(td.Path); err != nil || !info.IsDir() {
+                problems = append(problems, fmt.Sprintf("teamdrives[%d]: path %q is not a readable directory", i, td.Path))
+            }
+        }
+    }
+
+    if needsPool && (config.Auth.Mode == "" || config.Auth.Mode == "service_accounts") {
+        if info, err := os.Stat(config.ServiceAccountsDir); err != nil || !info.IsDir() {
+            problems = append(problems, fmt.Sprintf("service_accounts_dir %q is not a readable directory", config.ServiceAccountsDir))
+        }
+    }
+    if dir := config.Downloads.Dir; dir != "" {
+        if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+            problems = append(problems, fmt.Sprintf("downloads.dir %q is not a directory", dir))
+        }
+    }
+
+    return problems
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "text/tabwriter"
+
+    "teamdrive-scanner/database"
+)
+
+// runVerify checks a backup manifest against the index of a drive and
+// writes the missing and mismatched files to stdout. It exits with status
+// 1 if there are any, so scripts can tell a verified backup apart.
+func runVerify(config *Config, db *database.Database, query queryFlags, manifestPath string, root string) {
+    switch query.format {
+    case "table", "json":
+    default:
+        log.Fatalf("Invalid -format %q: use table or json", query.format)
+    }
+    if query.teamDrive == "" || manifestPath == "" {
+        log.Fatalf("-teamdrive and -manifest are required in verify mode")
+    }
+    if query.limit <= 0 {
+        log.Fatalf("-limit must be positive")
+    }
+
+    file, err := os.Open(manifestPath)
+    if err != nil {
+        log.Fatalf("Failed to open manifest: %v", err)
+    }
+    format := "json"
+    if strings.EqualFold(filepath.Ext(manifestPath), ".csv") {
+        format = "csv"
+    }
+    entries, err := database.ReadManifest(file, format)
+    file.Close()
+    if err != nil {
+        log.Fatalf("Failed to read manifest: %v", err)
+    }
+
+    report, err := db.VerifyManifest(context.Background(), teamDriveID(config, query.teamDrive), root, entries, query.limit)
+    if err != nil {
+        log.Fatalf("Verification failed: %v", err)
+    }
+
+    if query.format == "json" {
+        encoder := json.NewEncoder(os.Stdout)
+        encoder.SetIndent("", "  ")
+        if err := encoder.Encode(report); err != nil {
+            log.Fatalf("Failed to write report: %v", err)
+        }
+    } else {
+        fmt.Printf("Checked %d files: %d matched (%d by size only), %d missing, %d of another size, %d with another checksum; %d indexed files not in the manifest\n",
+            report.Checked, report.Matched, report.SizeOnly, report.Missing, report.SizeMismatch, report.MD5Mismatch, report.Extra)
+        if len(report.Problems) > 0 {
+            fmt.Println()
+            w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+            fmt.Fprintln(w, "STATUS\tSIZE\tINDEXED\tPATH\t")
+            for _, p := range report.Problems {
+                indexed := "-"
+                if p.Status != database.VerifyMissing {
+                    indexed = database.FormatBytes(p.IndexedSize)
+                }
+                fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", p.Status, database.FormatBytes(p.Size), indexed, p.Path)
+            }
+            w.Flush()
+        }
+        if problems := report.Missing + report.SizeMismatch + report.MD5Mismatch; problems > len(report.Problems) {
+            fmt.Printf("\nShowing %d of %d problems; raise -limit for more\n", len(report.Problems), problems)
+        }
+    }
+
+    if report.Missing+report.SizeMismatch+report.MD5Mismatch > 0 {
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,75 @@
+package web
+
+import (
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Handler: Size, row counts and maintenance state of the database
+func (s *Server) getDatabaseHealth(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	health, err := s.database(c).Health(ctx)
+	if err != nil {
+		return dbError(c, err, "Failed to read database health")
+	}
+	return c.JSON(fiber.Map{
+		"database":   health,
+		"optimizing": s.optimizing.Load(),
+	})
+}
+
+// Handler: Start database maintenance in the background; GET /api/admin/db
+// reports when it is done. Writes wait for it to finish.
+func (s *Server) optimizeDatabase(c *fiber.Ctx) error {
+	if s.db.ReadOnly() {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The database is opened read-only",
+		})
+	}
+	if !s.optimizing.CompareAndSwap(false, true) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Maintenance is already running",
+		})
+	}
+
+	go func() {
+		defer s.optimizing.Store(false)
+		report, err := s.db.Maintain()
+		if err != nil {
+			log.Printf("Maintenance failed: %v", err)
+			return
+		}
+		log.Printf("Maintenance complete in %v: %d -> %d bytes", report.Duration, report.SizeBefore, report.SizeAfter)
+	}()
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"optimizing": true})
+}
+
+// Handler: Delete everything indexed about a drive, for a decommissioned
+// drive or one to index again from scratch
+func (s *Server) deleteTeamDriveData(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if s.database(c).ReadOnly() {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The database is opened read-only",
+		})
+	}
+	if s.scans != nil && !otherInstance(c) {
+		for _, scan := range s.scans.Running() {
+			if scan.TeamDriveID == id {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": "The drive is being scanned; cancel the scan first",
+				})
+			}
+		}
+	}
+
+	deleted, err := s.database(c).DeleteTeamDriveData(c.UserContext(), id)
+	if err != nil {
+		return dbError(c, err, "Failed to delete drive data")
+	}
+	return c.JSON(fiber.Map{"teamdrive_id": id, "deleted": deleted})
+}
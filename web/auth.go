@@ -0,0 +1,139 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// APIKey grants access to the API. A key with TeamDrives only sees those
+// drives; a key without sees everything and may also use the admin
+// endpoints (discovery and account health). In config a key is either a
+// plain string or an object with key and teamdrives.
+type APIKey struct {
+	Key        string   `json:"key"`
+	TeamDrives []string `json:"teamdrives"`
+	// Instance is the instance ID whose data the key reads, for servers
+	// in front of a PostgreSQL database shared by several organizations;
+	// empty reads the server's own
+	Instance string `json:"instance"`
+}
+
+func (k *APIKey) UnmarshalJSON(data []byte) error {
+	var key string
+	if err := json.Unmarshal(data, &key); err == nil {
+		k.Key = key
+		return nil
+	}
+
+	type plain APIKey
+	return json.Unmarshal(data, (*plain)(k))
+}
+
+// scopeLocal is the fiber.Ctx local holding the drive IDs a request may see.
+const scopeLocal = "teamdrive_scope"
+
+// instanceLocal is the fiber.Ctx local holding the instance ID of the
+// request's key, when it has one.
+const instanceLocal = "instance"
+
+// requestKey returns the API key sent with a request, taken from an
+// "Authorization: Bearer" header, an X-API-Key header or the api_key query
+// parameter, in that order.
+func requestKey(c *fiber.Ctx) string {
+	if auth := c.Get(fiber.HeaderAuthorization); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	if key := c.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return c.Query("api_key")
+}
+
+// matchAPIKey returns the one of keys sent with a request, or nil. Keys
+// are compared in constant time.
+func matchAPIKey(keys []APIKey, c *fiber.Ctx) *APIKey {
+	key := requestKey(c)
+	if key == "" {
+		return nil
+	}
+	for i := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(keys[i].Key)) == 1 {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+// requireAPIKey rejects requests that do not carry one of keys and records
+// the matching key's drive scope and instance.
+func requireAPIKey(keys []APIKey) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if valid := matchAPIKey(keys, c); valid != nil {
+			if len(valid.TeamDrives) > 0 {
+				c.Locals(scopeLocal, valid.TeamDrives)
+			}
+			if valid.Instance != "" {
+				c.Locals(instanceLocal, valid.Instance)
+			}
+			return c.Next()
+		}
+
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="api"`)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Missing or invalid API key",
+		})
+	}
+}
+
+// scope returns the drives the request is limited to, or nil for all.
+func scope(c *fiber.Ctx) []string {
+	drives, _ := c.Locals(scopeLocal).([]string)
+	return drives
+}
+
+// inScope reports whether the request may see teamDriveID.
+func inScope(c *fiber.Ctx, teamDriveID string) bool {
+	return driveAllowed(scope(c), teamDriveID)
+}
+
+// driveAllowed reports whether a key limited to drives may see
+// teamDriveID; nil drives allows all.
+func driveAllowed(drives []string, teamDriveID string) bool {
+	if drives == nil {
+		return true
+	}
+	for _, id := range drives {
+		if id == teamDriveID {
+			return true
+		}
+	}
+	return false
+}
+
+// requireUnscoped limits admin endpoints to keys without a drive scope.
+func requireUnscoped(c *fiber.Ctx) error {
+	if scope(c) != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "This API key is limited to specific Team Drives",
+		})
+	}
+	return c.Next()
+}
+
+// fileInScope reports whether the request may see the drive holding id,
+// which may also be a drive root.
+func (s *Server) fileInScope(ctx context.Context, c *fiber.Ctx, id string) (bool, error) {
+	if scope(c) == nil || inScope(c, id) {
+		return true, nil
+	}
+
+	file, err := s.database(c).GetFile(ctx, id)
+	if err != nil || file == nil {
+		return false, err
+	}
+	return inScope(c, file.TeamDriveID), nil
+}
@@ -0,0 +1,62 @@
+package web
+
+import (
+	"strconv"
+
+	"teamdrive-scanner/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Handler: Files created, modified or trashed by scans since a cursor,
+// oldest first. since=now returns no changes and the cursor to follow the
+// feed from.
+func (s *Server) getChanges(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	drives, ok := requestedDrives(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	if c.Query("since") == "now" {
+		latest, err := s.database(c).LatestChange(ctx)
+		if err != nil {
+			return dbError(c, err, "Change lookup failed")
+		}
+		return c.JSON(fiber.Map{
+			"changes":  []database.Change{},
+			"cursor":   strconv.FormatInt(latest, 10),
+			"has_more": false,
+		})
+	}
+
+	since, err := strconv.ParseInt(c.Query("since", "0"), 10, 64)
+	if err != nil || since < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid since: use the cursor of a previous response, now or 0",
+		})
+	}
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	changes, hasMore, err := s.database(c).GetChanges(ctx, since, drives, limit)
+	if err != nil {
+		return dbError(c, err, "Change lookup failed")
+	}
+	cursor := since
+	if len(changes) > 0 {
+		cursor = changes[len(changes)-1].Seq
+	}
+
+	return c.JSON(fiber.Map{
+		"changes":  changes,
+		"cursor":   strconv.FormatInt(cursor, 10),
+		"has_more": hasMore,
+	})
+}
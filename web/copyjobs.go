@@ -0,0 +1,253 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"teamdrive-scanner/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// defaultCopyConcurrency is the parallel copies of jobs that set none
+	defaultCopyConcurrency = 4
+	maxCopyConcurrency     = 32
+	// maxCopySources caps the items selected for one job
+	maxCopySources = 1000
+)
+
+// CopyControl runs the copy jobs of this process.
+type CopyControl interface {
+	// Start runs a stored job in the background.
+	Start(job database.CopyJob) error
+	// Cancel stops a running job, reporting whether it was running.
+	Cancel(id string) bool
+	Running(id string) bool
+}
+
+type copyJobRequest struct {
+	Sources       []string `json:"sources"`
+	DestTeamDrive string   `json:"dest_teamdrive"`
+	DestFolder    string   `json:"dest_folder"`
+	Concurrency   int      `json:"concurrency"`
+}
+
+// copiesUnavailable responds to job requests when no jobs run here.
+func copiesUnavailable(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+		"error": "Copy jobs need daemon mode and auth.write_access",
+	})
+}
+
+// parseCopyJob reads and validates a create request body against the
+// index: the sources must be indexed, and the destination a folder of a
+// known drive outside them.
+func (s *Server) parseCopyJob(ctx context.Context, c *fiber.Ctx) (copyJobRequest, error) {
+	var req copyJobRequest
+	if err := c.BodyParser(&req); err != nil {
+		return req, fmt.Errorf("invalid request body: %v", err)
+	}
+
+	sources := make([]string, 0, len(req.Sources))
+	seen := make(map[string]bool)
+	for _, id := range req.Sources {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			sources = append(sources, id)
+		}
+	}
+	if len(sources) == 0 || len(sources) > maxCopySources {
+		return req, fmt.Errorf("sources must list 1 to %d file or folder IDs", maxCopySources)
+	}
+	req.Sources = sources
+
+	if req.Concurrency == 0 {
+		req.Concurrency = defaultCopyConcurrency
+	}
+	if req.Concurrency < 1 || req.Concurrency > maxCopyConcurrency {
+		return req, fmt.Errorf("concurrency must be between 1 and %d", maxCopyConcurrency)
+	}
+
+	known := false
+	for _, drive := range s.teamDrives(ctx) {
+		known = known || drive.ID == req.DestTeamDrive
+	}
+	if !known {
+		return req, fmt.Errorf("dest_teamdrive must be a configured or discovered drive")
+	}
+
+	// The drive's root is its ID, and has no record
+	var dest *database.FileRecord
+	if req.DestFolder == "" || req.DestFolder == req.DestTeamDrive {
+		req.DestFolder = req.DestTeamDrive
+	} else {
+		folder, err := s.db.GetFile(ctx, req.DestFolder)
+		if err != nil {
+			return req, err
+		}
+		if folder == nil || !folder.IsFolder || folder.TeamDriveID != req.DestTeamDrive {
+			return req, fmt.Errorf("dest_folder must be an indexed folder of dest_teamdrive")
+		}
+		dest = folder
+	}
+
+	for _, id := range req.Sources {
+		source, err := s.db.GetFile(ctx, id)
+		if err != nil {
+			return req, err
+		}
+		if source == nil {
+			return req, fmt.Errorf("source %s is not in the index", id)
+		}
+		if dest != nil && source.IsFolder && source.TeamDriveID == dest.TeamDriveID &&
+			(source.ID == dest.ID || strings.HasPrefix(dest.Path, source.Path+"/")) {
+			return req, fmt.Errorf("cannot copy %s into itself", source.Path)
+		}
+	}
+	return req, nil
+}
+
+// Handler: List copy jobs, newest first
+func (s *Server) getCopyJobs(c *fiber.Ctx) error {
+	if s.copies == nil {
+		return copiesUnavailable(c)
+	}
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	jobs, err := s.db.GetCopyJobs(ctx)
+	if err != nil {
+		return dbError(c, err, "Copy job lookup failed")
+	}
+	return c.JSON(jobs)
+}
+
+// Handler: Get a copy job and its progress, stored every few seconds
+// while it runs
+func (s *Server) getCopyJob(c *fiber.Ctx) error {
+	if s.copies == nil {
+		return copiesUnavailable(c)
+	}
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	job, err := s.db.GetCopyJob(ctx, c.Params("id"))
+	if err != nil {
+		return dbError(c, err, "Copy job lookup failed")
+	}
+	if job == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Copy job not found",
+		})
+	}
+	return c.JSON(job)
+}
+
+// Handler: Queue a job copying files and folders into a folder of another
+// drive with the service accounts
+func (s *Server) createCopyJob(c *fiber.Ctx) error {
+	if s.copies == nil {
+		return copiesUnavailable(c)
+	}
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	req, err := s.parseCopyJob(ctx, c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	job, err := s.db.CreateCopyJob(ctx, req.Sources, req.DestTeamDrive, req.DestFolder, req.Concurrency)
+	if err != nil {
+		return dbError(c, err, "Creating copy job failed")
+	}
+	if err := s.copies.Start(*job); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(job)
+}
+
+// Handler: Cancel a running copy job. The copies made so far are kept.
+func (s *Server) cancelCopyJob(c *fiber.Ctx) error {
+	if s.copies == nil {
+		return copiesUnavailable(c)
+	}
+	id := c.Params("id")
+	if !s.copies.Cancel(id) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No copy job with this ID is running",
+		})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"canceled": id,
+	})
+}
+
+// Handler: Run a finished, failed or canceled copy job again. Items it
+// copied already are skipped.
+func (s *Server) resumeCopyJob(c *fiber.Ctx) error {
+	if s.copies == nil {
+		return copiesUnavailable(c)
+	}
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	job, err := s.db.GetCopyJob(ctx, c.Params("id"))
+	if err != nil {
+		return dbError(c, err, "Copy job lookup failed")
+	}
+	if job == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Copy job not found",
+		})
+	}
+	if s.copies.Running(job.ID) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Copy job is already running",
+		})
+	}
+
+	job.Status = database.JobQueued
+	if err := s.db.UpdateCopyJob(ctx, job); err != nil {
+		return dbError(c, err, "Updating copy job failed")
+	}
+	if err := s.copies.Start(*job); err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// Handler: Delete a copy job that is not running. The copies it made are
+// kept.
+func (s *Server) deleteCopyJob(c *fiber.Ctx) error {
+	if s.copies == nil {
+		return copiesUnavailable(c)
+	}
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	id := c.Params("id")
+	if s.copies.Running(id) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Copy job is running; cancel it first",
+		})
+	}
+	deleted, err := s.db.DeleteCopyJob(ctx, id)
+	if err != nil {
+		return dbError(c, err, "Deleting copy job failed")
+	}
+	if !deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Copy job not found",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,74 @@
+package web
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Handler: Recorded full scans of a drive, newest first
+func (s *Server) getScans(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	teamDriveID := c.Params("teamdrive_id")
+	if !inScope(c, teamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	scans, err := s.database(c).GetScans(ctx, teamDriveID, limit)
+	if err != nil {
+		return dbError(c, err, "Scan lookup failed")
+	}
+
+	return c.JSON(fiber.Map{
+		"teamdrive_id": teamDriveID,
+		"scans":        scans,
+	})
+}
+
+// Handler: Files added, removed, resized and moved between two scans of a
+// drive
+func (s *Server) getScanDiff(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	teamDriveID := c.Params("teamdrive_id")
+	if !inScope(c, teamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	from, errFrom := strconv.ParseInt(c.Query("from"), 10, 64)
+	to, errTo := strconv.ParseInt(c.Query("to"), 10, 64)
+	if errFrom != nil || errTo != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "from and to must be scan IDs",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	diff, err := s.database(c).DiffScans(ctx, teamDriveID, from, to, limit)
+	if err != nil {
+		return dbError(c, err, "Scan diff failed")
+	}
+	if diff == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Scan not found or not finished",
+		})
+	}
+
+	return c.JSON(diff)
+}
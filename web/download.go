@@ -0,0 +1,153 @@
+package web
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"teamdrive-scanner/database"
+	"teamdrive-scanner/scanner"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// downloadWriteTimeout bounds the transfer of one download, in place of
+// the server's write timeout, which is sized for JSON responses.
+const downloadWriteTimeout = 12 * time.Hour
+
+// downloadHeaders are the headers of Drive's response passed on to the
+// client.
+var downloadHeaders = []string{fiber.HeaderContentType, fiber.HeaderContentRange, fiber.HeaderLastModified}
+
+// isDownload reports whether a request path streams file content, as
+// downloads and ZIPs do; routes are matched case-insensitively.
+func isDownload(path string) bool {
+	path = strings.ToLower(path)
+	return strings.HasPrefix(path, "/api/download/") || strings.HasPrefix(path, "/api/zip/")
+}
+
+// requestConfig lifts the write timeout for downloads and ZIPs.
+func requestConfig(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+	if isDownload(string(header.RequestURI())) {
+		return fasthttp.RequestConfig{WriteTimeout: downloadWriteTimeout}
+	}
+	return fasthttp.RequestConfig{}
+}
+
+// Handler: Stream a file's content from Drive through the service
+// accounts, honouring Range requests
+func (s *Server) download(c *fiber.Ctx) error {
+	if s.openDownload == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Downloads are not available: no service accounts loaded",
+		})
+	}
+
+	ctx, cancel := s.queryContext(c)
+	file, err := s.database(c).GetFile(ctx, c.Params("file_id"))
+	cancel()
+	if err != nil {
+		return dbError(c, err, "File lookup failed")
+	}
+	if file == nil || !inScope(c, file.TeamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+
+	// A shortcut downloads its target
+	fileID, mimeType := file.ID, file.MimeType
+	if file.IsShortcut && file.ShortcutTargetID != "" {
+		fileID, mimeType = file.ShortcutTargetID, file.ShortcutTargetMimeType
+	}
+	if file.IsFolder || mimeType == scanner.FolderMimeType {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Folders cannot be downloaded",
+		})
+	}
+	if database.IsGoogleNative(mimeType) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Google-native files have no content to download",
+			"hint":  "Export them through the file's export_links",
+		})
+	}
+
+	// The transfer outlives the handler, so it is not bound to the query
+	// timeout; the client going away closes it
+	resp, err := s.openDownload(c.UserContext(), file.TeamDriveName, fileID, c.Get(fiber.HeaderRange))
+	if err != nil {
+		switch status := scanner.APIStatus(err); status {
+		case http.StatusNotFound:
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "File not found in Drive",
+			})
+		case http.StatusRequestedRangeNotSatisfiable:
+			return c.Status(status).JSON(fiber.Map{
+				"error": "Range not satisfiable",
+			})
+		}
+		log.Printf("Failed to download %s: %v", fileID, err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Download failed: " + err.Error(),
+		})
+	}
+
+	// Content from the drives is untrusted and served from the origin
+	// holding the API key, so it may not run script: only media types are
+	// displayed inline, and never sniffed or run unsandboxed
+	disposition := "attachment"
+	if c.QueryBool("inline") && inlineSafe(resp.Header.Get(fiber.HeaderContentType)) {
+		disposition = "inline"
+	}
+	c.Set(fiber.HeaderContentDisposition, disposition+`; filename*=UTF-8''`+encodeFilename(file.Name))
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderContentSecurityPolicy, "sandbox")
+	for _, header := range downloadHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			c.Set(header, value)
+		}
+	}
+	c.Status(resp.StatusCode)
+	c.Context().SetBodyStream(resp.Body, int(resp.ContentLength))
+	return nil
+}
+
+// inlineSafe reports whether content of a type can be displayed inline:
+// images, video, audio and PDFs, but not SVG images, which can hold script.
+func inlineSafe(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case mediaType == "application/pdf":
+		return true
+	}
+	for _, prefix := range []string{"image/", "video/", "audio/"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeFilename percent-encodes a file name for the filename* parameter
+// of Content-Disposition (RFC 5987).
+func encodeFilename(name string) string {
+	var b strings.Builder
+	for _, c := range []byte(name) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,222 @@
+package web
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"teamdrive-scanner/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxDownloadConcurrency caps the parallel downloads of one job.
+const maxDownloadConcurrency = 32
+
+// DownloadControl runs the download jobs of this process.
+type DownloadControl interface {
+	// Start runs a stored job in the background.
+	Start(job database.DownloadJob) error
+	// Cancel stops a running job, reporting whether it was running.
+	Cancel(id string) bool
+	Running(id string) bool
+	// Defaults returns the concurrency and bandwidth of jobs that set
+	// none.
+	Defaults() (concurrency int, bandwidth int64)
+}
+
+type downloadJobRequest struct {
+	Params      string `json:"params"`
+	Dest        string `json:"dest"`
+	Concurrency int    `json:"concurrency"`
+	Bandwidth   int64  `json:"bandwidth"`
+}
+
+// downloadsUnavailable responds to job requests when no jobs run here.
+func downloadsUnavailable(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+		"error": "Download jobs are only available in daemon mode with downloads.dir set",
+	})
+}
+
+// parseDownloadJob reads and validates a create request body.
+func (s *Server) parseDownloadJob(c *fiber.Ctx) (downloadJobRequest, error) {
+	var req downloadJobRequest
+	if err := c.BodyParser(&req); err != nil {
+		return req, fmt.Errorf("invalid request body: %v", err)
+	}
+
+	params, err := normalizeSearchParams(req.Params)
+	if err != nil {
+		return req, err
+	}
+	if params == "" {
+		return req, fmt.Errorf("params is required: a job downloads the files of a search")
+	}
+	req.Params = params
+
+	// The destination is relative to the download directory and stays in it
+	req.Dest = filepath.ToSlash(filepath.Clean(strings.TrimSpace(req.Dest)))
+	if req.Dest == "" || req.Dest == "." || !filepath.IsLocal(req.Dest) {
+		return req, fmt.Errorf("dest must be a relative path inside the download directory")
+	}
+
+	concurrency, bandwidth := s.downloads.Defaults()
+	if req.Concurrency == 0 {
+		req.Concurrency = concurrency
+	}
+	if req.Concurrency < 1 || req.Concurrency > maxDownloadConcurrency {
+		return req, fmt.Errorf("concurrency must be between 1 and %d", maxDownloadConcurrency)
+	}
+	if req.Bandwidth == 0 {
+		req.Bandwidth = bandwidth
+	}
+	if req.Bandwidth < 0 {
+		return req, fmt.Errorf("bandwidth must not be negative")
+	}
+	return req, nil
+}
+
+// Handler: List download jobs, newest first
+func (s *Server) getDownloadJobs(c *fiber.Ctx) error {
+	if s.downloads == nil {
+		return downloadsUnavailable(c)
+	}
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	jobs, err := s.db.GetDownloadJobs(ctx)
+	if err != nil {
+		return dbError(c, err, "Download job lookup failed")
+	}
+	return c.JSON(jobs)
+}
+
+// Handler: Get a download job and its progress, stored every few seconds
+// while it runs
+func (s *Server) getDownloadJob(c *fiber.Ctx) error {
+	if s.downloads == nil {
+		return downloadsUnavailable(c)
+	}
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	job, err := s.db.GetDownloadJob(ctx, c.Params("id"))
+	if err != nil {
+		return dbError(c, err, "Download job lookup failed")
+	}
+	if job == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Download job not found",
+		})
+	}
+	return c.JSON(job)
+}
+
+// Handler: Queue a job downloading the files of a search to a directory
+// under downloads.dir
+func (s *Server) createDownloadJob(c *fiber.Ctx) error {
+	if s.downloads == nil {
+		return downloadsUnavailable(c)
+	}
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	req, err := s.parseDownloadJob(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	job, err := s.db.CreateDownloadJob(ctx, req.Params, req.Dest, req.Concurrency, req.Bandwidth)
+	if err != nil {
+		return dbError(c, err, "Creating download job failed")
+	}
+	if err := s.downloads.Start(*job); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(job)
+}
+
+// Handler: Cancel a running download job. Its partial downloads are kept
+// for resuming it.
+func (s *Server) cancelDownloadJob(c *fiber.Ctx) error {
+	if s.downloads == nil {
+		return downloadsUnavailable(c)
+	}
+	id := c.Params("id")
+	if !s.downloads.Cancel(id) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No download job with this ID is running",
+		})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"canceled": id,
+	})
+}
+
+// Handler: Run a finished, failed or canceled download job again. Files
+// already downloaded are skipped and partial ones continued.
+func (s *Server) resumeDownloadJob(c *fiber.Ctx) error {
+	if s.downloads == nil {
+		return downloadsUnavailable(c)
+	}
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	job, err := s.db.GetDownloadJob(ctx, c.Params("id"))
+	if err != nil {
+		return dbError(c, err, "Download job lookup failed")
+	}
+	if job == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Download job not found",
+		})
+	}
+	if s.downloads.Running(job.ID) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Download job is already running",
+		})
+	}
+
+	job.Status = database.JobQueued
+	if err := s.db.UpdateDownloadJob(ctx, job); err != nil {
+		return dbError(c, err, "Updating download job failed")
+	}
+	if err := s.downloads.Start(*job); err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// Handler: Delete a download job that is not running. The files it
+// downloaded are kept.
+func (s *Server) deleteDownloadJob(c *fiber.Ctx) error {
+	if s.downloads == nil {
+		return downloadsUnavailable(c)
+	}
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	id := c.Params("id")
+	if s.downloads.Running(id) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Download job is running; cancel it first",
+		})
+	}
+	deleted, err := s.db.DeleteDownloadJob(ctx, id)
+	if err != nil {
+		return dbError(c, err, "Deleting download job failed")
+	}
+	if !deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Download job not found",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,704 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+
+	"teamdrive-scanner/database"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// maxGraphQLDepth caps how deeply a query may nest fields, so a query
+// cannot walk a whole drive through children of children.
+const maxGraphQLDepth = 10
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// graphQLScope is the context key of the requesting key's drive scope.
+type graphQLScope struct{}
+
+// Handler: GraphQL queries over files, folders and stats. Fields share
+// the names of the REST API's JSON.
+func (s *Server) graphQL(c *fiber.Ctx) error {
+	var req graphQLRequest
+	if c.Method() == fiber.MethodGet {
+		req.Query = c.Query("query")
+		req.OperationName = c.Query("operationName")
+		if variables := c.Query("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				return c.Status(400).JSON(fiber.Map{
+					"error": "invalid variables: " + err.Error(),
+				})
+			}
+		}
+	} else if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "invalid request body: " + err.Error(),
+		})
+	}
+	if req.Query == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "query is required",
+		})
+	}
+
+	document, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(req.Query)})})
+	if err == nil && queryDepth(document) > maxGraphQLDepth {
+		err = fmt.Errorf("query nests deeper than %d levels", maxGraphQLDepth)
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"errors": []fiber.Map{{"message": err.Error()}},
+		})
+	}
+
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	result := graphql.Do(graphql.Params{
+		Schema:         s.graphQLSchema(),
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        context.WithValue(ctx, graphQLScope{}, scope(c)),
+	})
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return dbError(c, ctx.Err(), "Query failed")
+	}
+	return c.JSON(result)
+}
+
+// queryDepth returns the deepest nesting of fields in a document.
+func queryDepth(document *ast.Document) int {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, definition := range document.Definitions {
+		if fragment, ok := definition.(*ast.FragmentDefinition); ok {
+			fragments[fragment.Name.Value] = fragment
+		}
+	}
+
+	var depth func(set *ast.SelectionSet, seen map[string]bool) int
+	depth = func(set *ast.SelectionSet, seen map[string]bool) int {
+		if set == nil {
+			return 0
+		}
+		deepest := 0
+		for _, selection := range set.Selections {
+			d := 0
+			switch selection := selection.(type) {
+			case *ast.Field:
+				d = 1 + depth(selection.SelectionSet, seen)
+			case *ast.InlineFragment:
+				d = depth(selection.SelectionSet, seen)
+			case *ast.FragmentSpread:
+				name := selection.Name.Value
+				if fragment := fragments[name]; fragment != nil && !seen[name] {
+					seen[name] = true
+					d = depth(fragment.SelectionSet, seen)
+					delete(seen, name)
+				}
+			}
+			if d > deepest {
+				deepest = d
+			}
+		}
+		return deepest
+	}
+
+	deepest := 0
+	for _, definition := range document.Definitions {
+		if operation, ok := definition.(*ast.OperationDefinition); ok {
+			if d := depth(operation.SelectionSet, map[string]bool{}); d > deepest {
+				deepest = d
+			}
+		}
+	}
+	return deepest
+}
+
+// graphQLAllowed reports whether the request's key may see teamDriveID.
+func graphQLAllowed(ctx context.Context, teamDriveID string) bool {
+	drives, _ := ctx.Value(graphQLScope{}).([]string)
+	return driveAllowed(drives, teamDriveID)
+}
+
+// gqlFile is a file record as resolved by GraphQL. sized is set when the
+// total size and child count of a folder are already known.
+type gqlFile struct {
+	record database.FileRecord
+	sized  bool
+}
+
+// longType carries sizes, which overflow GraphQL's 32-bit Int.
+var longType = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "Long",
+	Description: "A 64-bit integer",
+	Serialize: func(value interface{}) interface{} {
+		switch value := value.(type) {
+		case int64:
+			return value
+		case int:
+			return int64(value)
+		}
+		return nil
+	},
+	ParseValue: func(value interface{}) interface{} {
+		switch value := value.(type) {
+		case float64:
+			return int64(value)
+		case int:
+			return int64(value)
+		}
+		return nil
+	},
+	ParseLiteral: func(value ast.Value) interface{} {
+		if value, ok := value.(*ast.IntValue); ok {
+			n, _ := strconv.ParseInt(value.Value, 10, 64)
+			return n
+		}
+		return nil
+	},
+})
+
+// graphQLSchema builds the schema on first use; its resolvers read the
+// request's database from their context.
+func (s *Server) graphQLSchema() graphql.Schema {
+	s.gql.once.Do(func() {
+		schema, err := newGraphQLSchema(s)
+		if err != nil {
+			log.Fatalf("GraphQL schema: %v", err)
+		}
+		s.gql.schema = schema
+	})
+	return s.gql.schema
+}
+
+// graphQLState holds the schema, which is built once per server.
+type graphQLState struct {
+	once   sync.Once
+	schema graphql.Schema
+}
+
+var pageArgs = graphql.FieldConfigArgument{
+	"limit":  {Type: graphql.Int, DefaultValue: 100},
+	"offset": {Type: graphql.Int, DefaultValue: 0},
+	"cursor": {Type: graphql.String},
+}
+
+// pageLimit reads the limit argument, falling back to 100 like the REST
+// API for values outside 1-1000.
+func pageLimit(args map[string]interface{}) (limit int, offset int) {
+	limit, _ = args["limit"].(int)
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	offset, _ = args["offset"].(int)
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// gqlExportLink is one of a Google-native file's export formats; a map
+// has no GraphQL type.
+type gqlExportLink struct {
+	MimeType string `json:"mime_type"`
+	URL      string `json:"url"`
+}
+
+func newGraphQLSchema(s *Server) (graphql.Schema, error) {
+	breadcrumbType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Breadcrumb",
+		Fields: graphql.Fields{
+			"id":        {Type: graphql.String},
+			"name":      {Type: graphql.String},
+			"is_folder": {Type: graphql.Boolean},
+		},
+	})
+
+	exportLinkType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "ExportLink",
+		Fields: graphql.Fields{
+			"mime_type": {Type: graphql.String},
+			"url":       {Type: graphql.String},
+		},
+	})
+
+	labelType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Label",
+		Fields: graphql.Fields{
+			"source": {Type: graphql.String},
+			"key":    {Type: graphql.String},
+			"value":  {Type: graphql.String},
+		},
+	})
+
+	var fileType, pageType *graphql.Object
+
+	// record resolves a field of the record underneath a gqlFile
+	record := func(t graphql.Output, get func(database.FileRecord) interface{}) *graphql.Field {
+		return &graphql.Field{Type: t, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*gqlFile).record), nil
+		}}
+	}
+
+	// children lists a folder's contents through Browse, computing
+	// subfolder sizes only when the query asks for them
+	children := func(p graphql.ResolveParams, teamDriveID string, folderID string) (interface{}, error) {
+		limit, offset := pageLimit(p.Args)
+		cursor, _ := p.Args["cursor"].(string)
+		sizes := selectsFileField(p.Info, "total_size", "child_count")
+
+		result, err := s.contextDatabase(p.Context).Browse(p.Context, teamDriveID, folderID, database.BrowseOptions{
+			Limit: limit, Offset: offset, Cursor: cursor, Sizes: sizes,
+		})
+		if err != nil || result == nil {
+			return nil, err
+		}
+		files := make([]*gqlFile, len(result.Files))
+		for i := range result.Files {
+			files[i] = &gqlFile{record: result.Files[i], sized: sizes}
+		}
+		return fiber.Map{
+			"files":       files,
+			"total_count": result.TotalCount,
+			"has_more":    result.HasMore,
+			"next_cursor": result.NextCursor,
+		}, nil
+	}
+
+	fileType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "File",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":             record(graphql.String, func(f database.FileRecord) interface{} { return f.ID }),
+				"name":           record(graphql.String, func(f database.FileRecord) interface{} { return f.Name }),
+				"parent_id":      record(graphql.String, func(f database.FileRecord) interface{} { return f.ParentID }),
+				"teamdrive_id":   record(graphql.String, func(f database.FileRecord) interface{} { return f.TeamDriveID }),
+				"teamdrive_name": record(graphql.String, func(f database.FileRecord) interface{} { return f.TeamDriveName }),
+				"size":           record(longType, func(f database.FileRecord) interface{} { return f.Size }),
+				"modified_time":  record(graphql.String, func(f database.FileRecord) interface{} { return f.ModifiedTime }),
+				"created_time":   record(graphql.String, func(f database.FileRecord) interface{} { return f.CreatedTime }),
+				"mime_type":      record(graphql.String, func(f database.FileRecord) interface{} { return f.MimeType }),
+				"ext":            record(graphql.String, func(f database.FileRecord) interface{} { return f.Ext }),
+				"is_folder":      record(graphql.Boolean, func(f database.FileRecord) interface{} { return f.IsFolder }),
+				"is_shortcut":    record(graphql.Boolean, func(f database.FileRecord) interface{} { return f.IsShortcut }),
+				"path":           record(graphql.String, func(f database.FileRecord) interface{} { return f.Path }),
+				"owners":         record(graphql.NewList(graphql.String), func(f database.FileRecord) interface{} { return f.Owners }),
+				"shared":         record(graphql.Boolean, func(f database.FileRecord) interface{} { return f.Shared }),
+				"is_native":      record(graphql.Boolean, func(f database.FileRecord) interface{} { return f.IsNative }),
+				"revision_count": record(graphql.Int, func(f database.FileRecord) interface{} { return f.RevisionCount }),
+				"revision_size":  record(longType, func(f database.FileRecord) interface{} { return f.RevisionSize }),
+				"trashed":        record(graphql.Boolean, func(f database.FileRecord) interface{} { return f.Trashed }),
+				"trashed_time":   record(graphql.String, func(f database.FileRecord) interface{} { return f.TrashedTime }),
+				"md5_checksum":   record(graphql.String, func(f database.FileRecord) interface{} { return f.MD5Checksum }),
+				"export_links": record(graphql.NewList(exportLinkType), func(f database.FileRecord) interface{} {
+					links := make([]gqlExportLink, 0, len(f.ExportLinks))
+					for mimeType, url := range f.ExportLinks {
+						links = append(links, gqlExportLink{MimeType: mimeType, URL: url})
+					}
+					sort.Slice(links, func(i, j int) bool { return links[i].MimeType < links[j].MimeType })
+					return links
+				}),
+				"labels": {
+					Type:        graphql.NewList(labelType),
+					Description: "Drive labels and custom properties",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						file := p.Source.(*gqlFile)
+						if file.record.Labels != nil {
+							return file.record.Labels, nil
+						}
+						return s.contextDatabase(p.Context).GetLabels(p.Context, file.record.ID)
+					},
+				},
+				"web_view_link":   record(graphql.String, func(f database.FileRecord) interface{} { return f.WebViewLink }),
+				"has_thumbnail":   record(graphql.Boolean, func(f database.FileRecord) interface{} { return f.HasThumbnail }),
+				"name_highlight":  record(graphql.String, func(f database.FileRecord) interface{} { return f.NameHighlight }),
+				"path_snippet":    record(graphql.String, func(f database.FileRecord) interface{} { return f.PathSnippet }),
+				"content_snippet": record(graphql.String, func(f database.FileRecord) interface{} { return f.ContentSnippet }),
+				"media_title":     record(graphql.String, func(f database.FileRecord) interface{} { return f.MediaTitle }),
+				"media_year":      record(graphql.Int, func(f database.FileRecord) interface{} { return f.MediaYear }),
+				"season":          record(graphql.Int, func(f database.FileRecord) interface{} { return f.Season }),
+				"episode":         record(graphql.Int, func(f database.FileRecord) interface{} { return f.Episode }),
+				"resolution":      record(graphql.String, func(f database.FileRecord) interface{} { return f.Resolution }),
+				"codec":           record(graphql.String, func(f database.FileRecord) interface{} { return f.Codec }),
+				"total_size": {
+					Type:        longType,
+					Description: "Size of a folder's contents, or of the file or shortcut target",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						file := p.Source.(*gqlFile)
+						switch {
+						case file.record.IsFolder && !file.sized:
+							size, _, err := s.contextDatabase(p.Context).GetFolderSize(p.Context, file.record.ID)
+							return size, err
+						case file.record.IsFolder:
+							return file.record.TotalSize, nil
+						case file.record.IsShortcut:
+							return file.record.ShortcutTargetSize, nil
+						}
+						return file.record.Size, nil
+					},
+				},
+				"child_count": {
+					Type:        graphql.Int,
+					Description: "Items anywhere below a folder",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						file := p.Source.(*gqlFile)
+						if file.sized || !file.record.IsFolder {
+							return file.record.ChildCount, nil
+						}
+						_, count, err := s.contextDatabase(p.Context).GetFolderSize(p.Context, file.record.ID)
+						return count, err
+					},
+				},
+				"parent": {
+					Type: fileType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						file := p.Source.(*gqlFile)
+						parent, err := s.contextDatabase(p.Context).GetFile(p.Context, file.record.ParentID)
+						if err != nil || parent == nil {
+							return nil, err
+						}
+						return &gqlFile{record: *parent}, nil
+					},
+				},
+				"ancestors": {
+					Type:        graphql.NewList(breadcrumbType),
+					Description: "Folders from the drive root down to the file",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return s.contextDatabase(p.Context).GetPath(p.Context, p.Source.(*gqlFile).record.ID)
+					},
+				},
+				"children": {
+					Type:        pageType,
+					Description: "A folder's contents, folders first; null for files",
+					Args:        pageArgs,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						file := p.Source.(*gqlFile)
+						if !file.record.IsFolder {
+							return nil, nil
+						}
+						return children(p, file.record.TeamDriveID, file.record.ID)
+					},
+				},
+			}
+		}),
+	})
+
+	pageType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "FilePage",
+		Fields: graphql.Fields{
+			"files":       {Type: graphql.NewList(fileType)},
+			"total_count": {Type: graphql.Int},
+			"has_more":    {Type: graphql.Boolean},
+			"next_cursor": {Type: graphql.String},
+			"fuzzy":       {Type: graphql.Boolean},
+			"substring":   {Type: graphql.Boolean},
+		},
+	})
+
+	folderType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Folder",
+		Description: "A folder being browsed, which may be a drive root",
+		Fields: graphql.Fields{
+			"id":             {Type: graphql.String},
+			"name":           {Type: graphql.String},
+			"path":           {Type: graphql.String},
+			"parent_id":      {Type: graphql.String},
+			"teamdrive_id":   {Type: graphql.String},
+			"teamdrive_name": {Type: graphql.String},
+			"total_size": {
+				Type: longType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					size, _, err := s.contextDatabase(p.Context).GetFolderSize(p.Context, p.Source.(*database.BrowseFolder).ID)
+					return size, err
+				},
+			},
+			"child_count": {
+				Type: graphql.Int,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					_, count, err := s.contextDatabase(p.Context).GetFolderSize(p.Context, p.Source.(*database.BrowseFolder).ID)
+					return count, err
+				},
+			},
+			"children": {
+				Type: pageType,
+				Args: pageArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					folder := p.Source.(*database.BrowseFolder)
+					return children(p, folder.TeamDriveID, folder.ID)
+				},
+			},
+		},
+	})
+
+	depthType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "DepthCount",
+		Fields: graphql.Fields{
+			"depth": {Type: graphql.Int},
+			"files": {Type: longType},
+		},
+	})
+
+	nativeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "NativeCount",
+		Fields: graphql.Fields{
+			"kind":           {Type: graphql.String},
+			"files":          {Type: longType},
+			"estimated_size": {Type: longType},
+		},
+	})
+
+	revisionsType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "RevisionStats",
+		Fields: graphql.Fields{
+			"files":          {Type: longType},
+			"revisions":      {Type: longType},
+			"size":           {Type: longType},
+			"old_size":       {Type: longType},
+			"old_size_human": {Type: graphql.String},
+		},
+	})
+
+	trashType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "TrashStats",
+		Fields: graphql.Fields{
+			"files":      {Type: longType},
+			"folders":    {Type: longType},
+			"size":       {Type: longType},
+			"size_human": {Type: graphql.String},
+		},
+	})
+
+	statsType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Stats",
+		Fields: graphql.Fields{
+			"teamdrive_id":          {Type: graphql.String},
+			"total_files":           {Type: longType},
+			"total_folders":         {Type: longType},
+			"total_size":            {Type: longType},
+			"total_size_human":      {Type: graphql.String},
+			"average_file_size":     {Type: longType},
+			"last_scan":             {Type: graphql.String},
+			"files_by_depth":        {Type: graphql.NewList(depthType)},
+			"native_files":          {Type: longType},
+			"native_by_kind":        {Type: graphql.NewList(nativeType)},
+			"estimated_native_size": {Type: longType},
+			"estimated_total_size":  {Type: longType},
+			"revisions":             {Type: revisionsType},
+			"trash":                 {Type: trashType},
+			"largest_file": {
+				Type: fileType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if largest := p.Source.(*database.Stats).LargestFile; largest != nil {
+						return &gqlFile{record: *largest}, nil
+					}
+					return nil, nil
+				},
+			},
+		},
+	})
+
+	teamDriveType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "TeamDrive",
+		Fields: graphql.Fields{
+			"id":   {Type: graphql.String},
+			"name": {Type: graphql.String},
+		},
+	})
+
+	searchArgs := graphql.FieldConfigArgument{
+		"q":               {Type: graphql.String},
+		"mode":            {Type: graphql.String},
+		"fuzzy":           {Type: graphql.Boolean},
+		"teamdrive":       {Type: graphql.String},
+		"parent":          {Type: graphql.String},
+		"mime_type":       {Type: graphql.String},
+		"ext":             {Type: graphql.String},
+		"label":           {Type: graphql.String},
+		"owner":           {Type: graphql.String},
+		"modified_by":     {Type: graphql.String},
+		"min_size":        {Type: longType},
+		"max_size":        {Type: longType},
+		"modified_after":  {Type: graphql.String},
+		"modified_before": {Type: graphql.String},
+		"created_after":   {Type: graphql.String},
+		"created_before":  {Type: graphql.String},
+		"shared":          {Type: graphql.Boolean},
+		"native":          {Type: graphql.Boolean},
+		"is_folder":       {Type: graphql.Boolean},
+		"trash":           {Type: graphql.String},
+		"resolution":      {Type: graphql.String},
+		"codec":           {Type: graphql.String},
+		"title":           {Type: graphql.String},
+		"year":            {Type: graphql.Int},
+		"season":          {Type: graphql.Int},
+		"episode":         {Type: graphql.Int},
+		"sort":            {Type: graphql.String},
+		"order":           {Type: graphql.String},
+		"limit":           {Type: graphql.Int},
+		"offset":          {Type: graphql.Int},
+		"cursor":          {Type: graphql.String},
+	}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"teamdrives": {
+				Type: graphql.NewList(teamDriveType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					drives := s.teamDrives(p.Context)
+					visible := make([]database.TeamDrive, 0, len(drives))
+					for _, drive := range drives {
+						if graphQLAllowed(p.Context, drive.ID) {
+							visible = append(visible, drive)
+						}
+					}
+					return visible, nil
+				},
+			},
+			"file": {
+				Type: fileType,
+				Args: graphql.FieldConfigArgument{"id": {Type: graphql.NewNonNull(graphql.String)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					file, err := s.contextDatabase(p.Context).GetFile(p.Context, p.Args["id"].(string))
+					if err != nil || file == nil || !graphQLAllowed(p.Context, file.TeamDriveID) {
+						return nil, err
+					}
+					return &gqlFile{record: *file}, nil
+				},
+			},
+			"folder": {
+				Type:        folderType,
+				Description: "A folder of a drive, or the drive's root without id",
+				Args: graphql.FieldConfigArgument{
+					"teamdrive": {Type: graphql.NewNonNull(graphql.String)},
+					"id":        {Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					teamDriveID := p.Args["teamdrive"].(string)
+					if !graphQLAllowed(p.Context, teamDriveID) {
+						return nil, nil
+					}
+					folderID, _ := p.Args["id"].(string)
+					if folderID == "" {
+						folderID = teamDriveID
+					}
+					folder, err := s.contextDatabase(p.Context).GetFolder(p.Context, teamDriveID, folderID)
+					if err != nil || folder == nil {
+						return nil, err
+					}
+					return folder, nil
+				},
+			},
+			"search": {
+				Type: pageType,
+				Args: searchArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					opts, err := parseSearchParams(func(key string, defaultValue ...string) string {
+						if v, ok := p.Args[key]; ok && v != nil {
+							return fmt.Sprint(v)
+						}
+						if len(defaultValue) > 0 {
+							return defaultValue[0]
+						}
+						return ""
+					})
+					if err != nil {
+						return nil, err
+					}
+					opts.TeamDriveIDs, _ = p.Context.Value(graphQLScope{}).([]string)
+
+					result, err := s.contextDatabase(p.Context).Search(p.Context, opts)
+					if err != nil {
+						return nil, err
+					}
+					files := make([]*gqlFile, len(result.Files))
+					for i := range result.Files {
+						files[i] = &gqlFile{record: result.Files[i]}
+					}
+					return fiber.Map{
+						"files":       files,
+						"total_count": result.TotalCount,
+						"has_more":    result.HasMore,
+						"next_cursor": result.NextCursor,
+						"fuzzy":       result.Fuzzy,
+						"substring":   result.Substring,
+					}, nil
+				},
+			},
+			"stats": {
+				Type: statsType,
+				Args: graphql.FieldConfigArgument{"teamdrive": {Type: graphql.NewNonNull(graphql.String)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					teamDriveID := p.Args["teamdrive"].(string)
+					if !graphQLAllowed(p.Context, teamDriveID) {
+						return nil, nil
+					}
+					return s.contextDatabase(p.Context).GetTeamDriveStats(p.Context, teamDriveID)
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+// selectsFileField reports whether a page field's files selection asks for
+// any of names. Named fragments are assumed to.
+func selectsFileField(info graphql.ResolveInfo, names ...string) bool {
+	for _, field := range info.FieldASTs {
+		for _, selection := range selections(field.SelectionSet) {
+			files, ok := selection.(*ast.Field)
+			if !ok {
+				return true
+			}
+			if files.Name.Value != "files" {
+				continue
+			}
+			for _, selection := range selections(files.SelectionSet) {
+				field, ok := selection.(*ast.Field)
+				if !ok {
+					return true
+				}
+				for _, name := range names {
+					if field.Name.Value == name {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// selections flattens the inline fragments of a selection set.
+func selections(set *ast.SelectionSet) []ast.Selection {
+	if set == nil {
+		return nil
+	}
+	var all []ast.Selection
+	for _, selection := range set.Selections {
+		if fragment, ok := selection.(*ast.InlineFragment); ok {
+			all = append(all, selections(fragment.SelectionSet)...)
+			continue
+		}
+		all = append(all, selection)
+	}
+	return all
+}
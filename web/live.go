@@ -0,0 +1,166 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"teamdrive-scanner/database"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	liveDefaultMax = 1000
+	liveMaxResults = 10000
+)
+
+// liveMessage is sent to /ws/search clients. ID is the sequence number of
+// the search it belongs to, so clients can drop results of a search they
+// have already replaced.
+type liveMessage struct {
+	Type    string                `json:"type"` // results, done or error
+	ID      int                   `json:"id"`
+	Files   []database.FileRecord `json:"files,omitempty"`
+	Count   int                   `json:"count,omitempty"`
+	HasMore bool                  `json:"has_more,omitempty"`
+	Error   string                `json:"error,omitempty"`
+}
+
+// requireUpgrade rejects plain HTTP requests to websocket routes.
+func requireUpgrade(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+	return c.Next()
+}
+
+// Handler: Live search over a websocket. A search starts from the URL's
+// query parameters when q is set, and again for every message, a JSON
+// object of /api/search parameters. Each search streams pages of limit
+// results until max results or the last match, and is abandoned as soon
+// as a newer one arrives.
+func (s *Server) liveSearch(conn *websocket.Conn) {
+	drives, _ := conn.Locals(scopeLocal).([]string)
+	// The connection outlives the upgrade request and its context
+	instance, _ := conn.Locals(instanceLocal).(string)
+	base, err := s.instanceContext(context.Background(), instance)
+	if err != nil {
+		conn.WriteJSON(liveMessage{Type: "error", Error: err.Error()})
+		return
+	}
+
+	var (
+		mu      sync.Mutex // serializes writes
+		wg      sync.WaitGroup
+		cancel  context.CancelFunc = func() {}
+		current int
+	)
+	send := func(msg liveMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return conn.WriteJSON(msg)
+	}
+
+	start := func(query func(key string, defaultValue ...string) string) {
+		cancel()
+		wg.Wait()
+
+		current++
+		id := current
+		opts, err := parseSearchParams(query)
+		if err != nil {
+			send(liveMessage{Type: "error", ID: id, Error: err.Error()})
+			return
+		}
+		opts.TeamDriveIDs = drives
+		opts.NoCount = true
+
+		max, err := strconv.Atoi(query("max", strconv.Itoa(liveDefaultMax)))
+		if err != nil || max <= 0 || max > liveMaxResults {
+			max = liveDefaultMax
+		}
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(base)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.streamSearch(ctx, id, opts, max, send)
+		}()
+	}
+
+	if conn.Query("q") != "" {
+		start(conn.Query)
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		var params map[string]interface{}
+		if err := json.Unmarshal(data, &params); err != nil {
+			send(liveMessage{Type: "error", ID: current, Error: "invalid message: " + err.Error()})
+			continue
+		}
+		start(func(key string, defaultValue ...string) string {
+			if v, ok := params[key]; ok && v != nil {
+				return fmt.Sprint(v)
+			}
+			if len(defaultValue) > 0 {
+				return defaultValue[0]
+			}
+			return ""
+		})
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+// streamSearch pages through a search with cursors, sending each page as
+// soon as it is read.
+func (s *Server) streamSearch(ctx context.Context, id int, opts database.SearchOptions, max int, send func(liveMessage) error) {
+	sent := 0
+	for {
+		if remaining := max - sent; remaining < opts.Limit {
+			opts.Limit = remaining
+		}
+
+		queryCtx, cancel := context.WithTimeout(ctx, s.settings().timeout)
+		result, err := s.contextDatabase(queryCtx).Search(queryCtx, opts)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, database.ErrInvalidQuery) {
+			send(liveMessage{Type: "error", ID: id, Error: err.Error()})
+			return
+		}
+		if err != nil {
+			send(liveMessage{Type: "error", ID: id, Error: "Search failed: " + err.Error()})
+			return
+		}
+
+		sent += len(result.Files)
+		if len(result.Files) > 0 {
+			if err := send(liveMessage{Type: "results", ID: id, Files: result.Files}); err != nil {
+				log.Printf("Live search write failed: %v", err)
+				return
+			}
+		}
+
+		if !result.HasMore || sent >= max {
+			send(liveMessage{Type: "done", ID: id, Count: sent, HasMore: result.HasMore})
+			return
+		}
+		opts.Cursor = result.NextCursor
+	}
+}
@@ -0,0 +1,137 @@
+package web
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"teamdrive-scanner/database"
+	"teamdrive-scanner/scanner"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type renameRequest struct {
+	Name string `json:"name"`
+}
+
+type moveRequest struct {
+	// ParentID is the folder to move into, the drive's ID for its root
+	ParentID string `json:"parent_id"`
+}
+
+// Handler: Rename a file or folder in Drive and in the index
+func (s *Server) renameFile(c *fiber.Ctx) error {
+	var req renameRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "name is required",
+		})
+	}
+	return s.applyMove(c, func(file *database.FileRecord) (string, string) {
+		return name, file.ParentID
+	})
+}
+
+// Handler: Move a file or folder to another folder of its drive, in Drive
+// and in the index
+func (s *Server) moveFile(c *fiber.Ctx) error {
+	var req moveRequest
+	if err := c.BodyParser(&req); err != nil || req.ParentID == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "parent_id is required",
+		})
+	}
+	return s.applyMove(c, func(file *database.FileRecord) (string, string) {
+		return file.Name, req.ParentID
+	})
+}
+
+// applyMove gives the file of the request the name and parent target
+// picks, first in Drive and then in the index, so the change shows before
+// the next scan.
+func (s *Server) applyMove(c *fiber.Ctx, target func(file *database.FileRecord) (name, parentID string)) error {
+	if s.move == nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Renaming and moving need auth.write_access and service accounts",
+		})
+	}
+
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	file, err := s.db.GetFile(ctx, c.Params("file_id"))
+	if err != nil {
+		return dbError(c, err, "File lookup failed")
+	}
+	if file == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+	if file.DeletedAt != "" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "File is no longer in Drive",
+		})
+	}
+
+	name, parentID := target(file)
+	if name == file.Name && parentID == file.ParentID {
+		return c.JSON(file)
+	}
+	if parentID != file.ParentID && parentID != file.TeamDriveID {
+		parent, err := s.db.GetFile(ctx, parentID)
+		if err != nil {
+			return dbError(c, err, "Folder lookup failed")
+		}
+		if parent == nil || !parent.IsFolder || parent.DeletedAt != "" || parent.TeamDriveID != file.TeamDriveID {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "parent_id must be an indexed folder of the file's drive",
+			})
+		}
+		if parent.ID == file.ID || strings.HasPrefix(parent.Path, file.Path+"/") {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "A folder cannot be moved into itself",
+			})
+		}
+	}
+
+	// Drive gets the change outside the query timeout, which is sized for
+	// reads, so a slow call is not left half applied
+	if err := s.move(c.UserContext(), file.TeamDriveName, file.ID, name, file.ParentID, parentID); err != nil {
+		switch status := scanner.APIStatus(err); status {
+		case http.StatusNotFound:
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "File not found in Drive",
+			})
+		case http.StatusBadRequest, http.StatusForbidden:
+			return c.Status(status).JSON(fiber.Map{
+				"error": "Drive refused the change: " + err.Error(),
+			})
+		}
+		log.Printf("Failed to move %s: %v", file.ID, err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Drive update failed: " + err.Error(),
+		})
+	}
+
+	moved, err := s.db.MoveFile(c.UserContext(), file.ID, name, parentID)
+	if err != nil {
+		log.Printf("Moved %s in Drive, but updating the index failed: %v", file.ID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Changed in Drive, but updating the index failed; the next scan corrects it: " + err.Error(),
+		})
+	}
+	if moved == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+	return c.JSON(moved)
+}
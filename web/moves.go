@@ -0,0 +1,53 @@
+package web
+
+import (
+	"strconv"
+
+	"teamdrive-scanner/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Handler: Moves and renames into, out of or within a drive, newest first
+func (s *Server) getMoves(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	teamDriveID := c.Params("teamdrive_id")
+	if !inScope(c, teamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	kind := c.Query("kind")
+	switch kind {
+	case "", database.MoveKindMove, database.MoveKindRename, database.MoveKindDrive:
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid kind: " + kind + " (use move, rename or drive)",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	offset, err := strconv.Atoi(c.Query("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	moves, total, err := s.database(c).GetMoves(ctx, teamDriveID, kind, limit, offset)
+	if err != nil {
+		return dbError(c, err, "Move lookup failed")
+	}
+
+	return c.JSON(fiber.Map{
+		"teamdrive_id": teamDriveID,
+		"moves":        moves,
+		"total":        total,
+		"limit":        limit,
+		"offset":       offset,
+	})
+}
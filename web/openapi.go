@@ -0,0 +1,622 @@
+package web
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"teamdrive-scanner/database"
+	"teamdrive-scanner/scanner"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// apiParam is a query parameter of an operation. Path parameters are read
+// from the route itself.
+type apiParam struct {
+	name        string
+	kind        string // JSON Schema type: string, integer or boolean
+	description string
+}
+
+// apiOperation documents a route. body and response are example values
+// whose types the schemas are generated from.
+type apiOperation struct {
+	summary  string
+	params   []apiParam
+	body     interface{}
+	response interface{}
+	status   int  // success status; 200 when zero
+	admin    bool // needs an API key without a drive scope
+}
+
+var pageParams = []apiParam{
+	{"limit", "integer", "Results per page, at most 1000"},
+	{"offset", "integer", "Results to skip"},
+}
+
+var searchParams = append([]apiParam{
+	{"q", "string", `Search terms: words, "quoted phrases", prefix*, -excluded, OR, and name:, path:, type:, ext: and label: terms; a regular expression with mode=regex`},
+	{"mode", "string", "fts (default), content to match the indexed text of documents instead of names, or regex"},
+	{"fuzzy", "boolean", "Tolerate typos, when the index supports it"},
+	{"teamdrive", "string", "Only this drive"},
+	{"parent", "string", "Only direct children of this folder"},
+	{"mime_type", "string", "MIME type; type/* matches a whole top-level type"},
+	{"ext", "string", "Comma-separated extensions"},
+	{"label", "string", "Comma-separated Drive labels or custom properties the file must all have, as key or key=value"},
+	{"owner", "string", "Owner email address"},
+	{"modified_by", "string", "Email address of the last modifying user"},
+	{"min_size", "integer", "Minimum size in bytes"},
+	{"max_size", "integer", "Maximum size in bytes"},
+	{"modified_after", "string", "RFC 3339 timestamp or date"},
+	{"modified_before", "string", "RFC 3339 timestamp or date"},
+	{"created_after", "string", "RFC 3339 timestamp or date"},
+	{"created_before", "string", "RFC 3339 timestamp or date"},
+	{"shared", "boolean", "Only shared or only unshared files"},
+	{"native", "boolean", "Only Google-native files (Docs, Sheets, Slides, ...) or only files with stored bytes"},
+	{"is_folder", "boolean", "Only folders or only files"},
+	{"trash", "string", "include to search trashed items too, only to search the trash; trashed items are left out by default"},
+	{"resolution", "string", "Video resolution parsed from the name, such as 2160p"},
+	{"codec", "string", "Video codec parsed from the name: h264, h265, av1, vp9, xvid, divx or mpeg2"},
+	{"title", "string", "Movie or show title parsed from the name, case-insensitive"},
+	{"year", "integer", "Release year parsed from the name"},
+	{"season", "integer", "Season number parsed from the name"},
+	{"episode", "integer", "Episode number parsed from the name"},
+	{"sort", "string", "name, size, modified or created; relevance when empty"},
+	{"order", "string", "asc (default) or desc"},
+	{"cursor", "string", "next_cursor of the previous page; overrides offset"},
+}, pageParams...)
+
+var grantParams = append([]apiParam{
+	{"teamdrive", "string", "Only this drive"},
+	{"format", "string", "json (default) or csv"},
+}, pageParams...)
+
+var grantResponse = fiber.Map{"grants": []database.Grant{}, "total": 0, "limit": 0, "offset": 0}
+
+var savedSearchResponse = fiber.Map{"search": database.SavedSearch{}, "link": ""}
+
+// apiOperations documents the /api routes, keyed by method and path as
+// registered in setupRoutes.
+var apiOperations = map[string]apiOperation{
+	"GET /api/teamdrives": {
+		summary:  "List configured and discovered drives",
+		response: []database.TeamDrive{},
+	},
+	"POST /api/teamdrives/discover": {
+		summary:  "Discover shared drives through the service accounts",
+		response: fiber.Map{"discovered": 0, "teamdrives": []database.TeamDrive{}},
+		admin:    true,
+	},
+	"DELETE /api/teamdrives/:id/data": {
+		summary:  "Delete a drive's files, scans, stats history and queued rescans from the index",
+		response: fiber.Map{"teamdrive_id": "", "deleted": []database.TableRows{}},
+		admin:    true,
+	},
+	"GET /api/teamdrives/:id/treemap": {
+		summary: "Nested folder sizes of a drive for treemap charts",
+		params: []apiParam{
+			{"depth", "integer", "Levels of folders below the root"},
+			{"limit", "integer", "Largest children kept per folder"},
+		},
+		response: database.TreemapNode{},
+	},
+	"GET /api/search": {
+		summary:  "Search files",
+		params:   searchParams,
+		response: database.SearchResult{},
+	},
+	"GET /api/recent": {
+		summary: "Files modified within the last days, newest first",
+		params: append([]apiParam{
+			{"days", "integer", "Days to look back"},
+			{"teamdrive", "string", "Only this drive"},
+			{"cursor", "string", "next_cursor of the previous page; overrides offset"},
+		}, pageParams...),
+		response: database.SearchResult{},
+	},
+	"GET /api/stats/:teamdrive_id": {
+		summary:  "Totals of a drive",
+		response: database.Stats{},
+	},
+	"GET /api/stats/:teamdrive_id/history": {
+		summary:  "A drive's totals as recorded after each scan",
+		params:   []apiParam{{"limit", "integer", "Latest snapshots to return"}},
+		response: fiber.Map{"teamdrive_id": "", "history": []database.StatsSnapshot{}},
+	},
+	"GET /api/trash/:teamdrive_id": {
+		summary:  "Items in a drive's trash, most recently trashed first, with the storage emptying it would free",
+		params:   pageParams,
+		response: fiber.Map{"teamdrive_id": "", "items": []database.FileRecord{}, "total": 0, "limit": 0, "offset": 0, "trash": database.TrashStats{}},
+	},
+	"GET /api/deleted/:teamdrive_id": {
+		summary:  "Files of a drive that full scans no longer found, most recently deleted first, kept until database.deleted_retention_days",
+		params:   pageParams,
+		response: fiber.Map{"teamdrive_id": "", "items": []database.FileRecord{}, "total": 0, "limit": 0, "offset": 0},
+	},
+	"GET /api/moves/:teamdrive_id": {
+		summary:  "Moves and renames into, out of or within a drive, newest first, as seen by rescans",
+		params:   append([]apiParam{{"kind", "string", "Only move, rename or drive (moves between drives)"}}, pageParams...),
+		response: fiber.Map{"teamdrive_id": "", "moves": []database.Move{}, "total": 0, "limit": 0, "offset": 0},
+	},
+	"GET /api/changes": {
+		summary: "Files created, modified or trashed by scans since a cursor, oldest first; needs database.change_feed",
+		params: []apiParam{
+			{"since", "string", "cursor of the previous response; 0 or empty for the whole feed, now for the current cursor alone"},
+			{"teamdrive", "string", "Only this drive"},
+			{"limit", "integer", "Changes per page, at most 1000"},
+		},
+		response: fiber.Map{"changes": []database.Change{}, "cursor": "", "has_more": false},
+	},
+	"GET /api/scans/:teamdrive_id": {
+		summary:  "Full scans of a drive recorded for diffing, newest first; needs scanner.keep_scans",
+		params:   []apiParam{{"limit", "integer", "Latest scans to return"}},
+		response: fiber.Map{"teamdrive_id": "", "scans": []database.Scan{}},
+	},
+	"GET /api/scans/:teamdrive_id/diff": {
+		summary: "Files added, removed, resized and moved between two recorded scans of a drive, with totals",
+		params: []apiParam{
+			{"from", "integer", "ID of the earlier scan"},
+			{"to", "integer", "ID of the later scan"},
+			{"limit", "integer", "Files listed per kind of change, at most 1000"},
+		},
+		response: database.ScanDiff{},
+	},
+	"POST /api/verify/:teamdrive_id": {
+		summary: "Check a backup manifest of path, size and md5 against the index of a drive; send CSV with a text/csv content type",
+		params: []apiParam{
+			{"root", "string", "Folder path of the drive the manifest paths are relative to"},
+			{"limit", "integer", "Problems listed, at most 1000"},
+		},
+		body:     []database.ManifestEntry{},
+		response: database.VerifyReport{},
+	},
+	"GET /api/file/:file_id": {
+		summary:  "A single file with its location",
+		response: fiber.Map{"file": database.FileRecord{}, "path": []database.Breadcrumb{}},
+	},
+	"GET /api/file/:file_id/permissions": {
+		summary:  "Permissions stored for a file by a permission scan",
+		response: fiber.Map{"file": database.FileRecord{}, "permissions": []database.Permission{}},
+	},
+	"POST /api/file/:file_id/rename": {
+		summary:  "Rename a file or folder in Drive and in the index; needs auth.write_access",
+		body:     renameRequest{},
+		response: database.FileRecord{},
+		admin:    true,
+	},
+	"POST /api/file/:file_id/move": {
+		summary:  "Move a file or folder to another folder of its drive, in Drive and in the index, with the paths below it; needs auth.write_access",
+		body:     moveRequest{},
+		response: database.FileRecord{},
+		admin:    true,
+	},
+	"GET /api/thumbnail/:file_id": {
+		summary: "A file's thumbnail image, fetched from Drive through the service accounts and cached in memory",
+	},
+	"GET /api/download/:file_id": {
+		summary: "Stream a file's content from Drive through the service accounts; honours Range headers, and downloads a shortcut's target",
+		params: []apiParam{
+			{"inline", "boolean", "Display images, video, audio and PDFs in the browser instead of saving them"},
+		},
+	},
+	"GET /api/zip/:folder_id": {
+		summary: "Stream a ZIP of the files below a folder, downloaded from Drive as it is written; Google-native files and shortcuts are left out, and folders over web.zip_max_mb refused with 413",
+	},
+	"GET /api/path/:file_id": {
+		summary:  "Ancestor chain of a file for breadcrumbs",
+		response: fiber.Map{"path": []database.Breadcrumb{}},
+	},
+	"GET /api/children/:folder_id": {
+		summary:  "Subfolders for tree browsing",
+		params:   pageParams,
+		response: fiber.Map{"folder_id": "", "children": []database.TreeNode{}},
+	},
+	"GET /api/browse/:teamdrive/:folder_id?": {
+		summary: "A folder's contents with its metadata; the drive root without folder_id",
+		params: append([]apiParam{
+			{"cursor", "string", "next_cursor of the previous page; overrides offset"},
+			{"sizes", "boolean", "Compute subfolder sizes (default true)"},
+		}, pageParams...),
+		response: database.BrowseResult{},
+	},
+	"GET /api/accounts": {
+		summary:  "Service account health as last reported by the scanner",
+		response: fiber.Map{"accounts": []database.AccountStatus{}, "total": 0, "quarantined": 0},
+		admin:    true,
+	},
+	"GET /api/admin/db": {
+		summary:  "Database size, WAL and full-text index sizes, row counts per table and the last maintenance run",
+		response: fiber.Map{"database": database.DatabaseHealth{}, "optimizing": false},
+		admin:    true,
+	},
+	"POST /api/admin/db/optimize": {
+		summary:  "Start database maintenance: integrity check, ANALYZE, vacuum and full-text index merge",
+		response: fiber.Map{"optimizing": false},
+		status:   fiber.StatusAccepted,
+		admin:    true,
+	},
+	"GET /api/scan/status": {
+		summary:  "Progress of running scans",
+		response: fiber.Map{"running": false, "paused": false, "scans": []scanner.Progress{}},
+	},
+	"POST /api/scan/pause": {
+		summary:  "Pause all scans",
+		response: fiber.Map{"paused": false},
+		admin:    true,
+	},
+	"POST /api/scan/resume": {
+		summary:  "Resume paused scans",
+		response: fiber.Map{"paused": false},
+		admin:    true,
+	},
+	"DELETE /api/scan/:teamdrive_id": {
+		summary:  "Cancel the running scan of a drive",
+		response: fiber.Map{"canceled": ""},
+		status:   fiber.StatusAccepted,
+	},
+	"GET /api/orphans": {
+		summary:  "Files whose parent folder is missing from the index",
+		params:   append([]apiParam{{"teamdrive", "string", "Only this drive"}}, pageParams...),
+		response: fiber.Map{"orphans": []database.FileRecord{}, "total": 0, "limit": 0, "offset": 0},
+	},
+	"GET /api/orphans/parents": {
+		summary:  "Missing parent folders with their orphan counts",
+		params:   []apiParam{{"teamdrive", "string", "Only this drive"}},
+		response: fiber.Map{"parents": []database.MissingParent{}, "count": 0},
+	},
+	"POST /api/orphans/requeue": {
+		summary: "Queue missing parents for rescanning by the next scan",
+		params: []apiParam{
+			{"teamdrive", "string", "Only this drive"},
+			{"parent", "string", "Only this missing parent"},
+		},
+		response: fiber.Map{"queued": 0, "folders": []database.MissingParent{}},
+	},
+	"GET /api/orphans/queue": {
+		summary:  "Folders waiting to be rescanned",
+		response: fiber.Map{"queue": []database.RescanRequest{}, "count": 0},
+		admin:    true,
+	},
+	"GET /api/permissions/public": {
+		summary:  "Files shared with anyone who has the link",
+		params:   grantParams,
+		response: grantResponse,
+	},
+	"GET /api/permissions/external": {
+		summary: "Files shared with users, groups or domains outside the internal domains",
+		params: append([]apiParam{
+			{"internal", "string", "Comma-separated internal domains; web.internal_domains when empty"},
+		}, grantParams...),
+		response: grantResponse,
+	},
+	"GET /api/searches": {
+		summary:  "List saved searches",
+		response: []database.SavedSearch{},
+	},
+	"POST /api/searches": {
+		summary:  "Save a search",
+		body:     savedSearchRequest{},
+		response: savedSearchResponse,
+		status:   fiber.StatusCreated,
+		admin:    true,
+	},
+	"GET /api/searches/:id": {
+		summary:  "Get a saved search",
+		response: savedSearchResponse,
+	},
+	"PUT /api/searches/:id": {
+		summary:  "Update a saved search",
+		body:     savedSearchRequest{},
+		response: savedSearchResponse,
+		admin:    true,
+	},
+	"DELETE /api/searches/:id": {
+		summary: "Delete a saved search",
+		status:  fiber.StatusNoContent,
+		admin:   true,
+	},
+	"GET /api/downloads": {
+		summary:  "List download jobs, newest first",
+		response: []database.DownloadJob{},
+		admin:    true,
+	},
+	"POST /api/downloads": {
+		summary:  "Queue a job downloading the files of a search to a directory under downloads.dir, with concurrency and bandwidth (bytes/s) limits",
+		body:     downloadJobRequest{},
+		response: database.DownloadJob{},
+		status:   fiber.StatusCreated,
+		admin:    true,
+	},
+	"GET /api/downloads/:id": {
+		summary:  "Get a download job and its progress",
+		response: database.DownloadJob{},
+		admin:    true,
+	},
+	"POST /api/downloads/:id/cancel": {
+		summary:  "Cancel a running download job, keeping its partial downloads",
+		response: fiber.Map{"canceled": ""},
+		status:   fiber.StatusAccepted,
+		admin:    true,
+	},
+	"POST /api/downloads/:id/resume": {
+		summary:  "Run a download job again, skipping finished files and continuing partial ones",
+		response: database.DownloadJob{},
+		status:   fiber.StatusAccepted,
+		admin:    true,
+	},
+	"DELETE /api/downloads/:id": {
+		summary: "Delete a download job that is not running; its files are kept",
+		status:  fiber.StatusNoContent,
+		admin:   true,
+	},
+	"GET /api/jobs": {
+		summary:  "List copy jobs, newest first",
+		response: []database.CopyJob{},
+		admin:    true,
+	},
+	"POST /api/jobs": {
+		summary:  "Queue a job copying files and folders into a folder of another drive with files.copy; dest_folder defaults to the drive's root",
+		body:     copyJobRequest{},
+		response: database.CopyJob{},
+		status:   fiber.StatusCreated,
+		admin:    true,
+	},
+	"GET /api/jobs/:id": {
+		summary:  "Get a copy job and its progress",
+		response: database.CopyJob{},
+		admin:    true,
+	},
+	"POST /api/jobs/:id/cancel": {
+		summary:  "Cancel a running copy job, keeping the copies made so far",
+		response: fiber.Map{"canceled": ""},
+		status:   fiber.StatusAccepted,
+		admin:    true,
+	},
+	"POST /api/jobs/:id/resume": {
+		summary:  "Run a copy job again, skipping the items it copied already",
+		response: database.CopyJob{},
+		status:   fiber.StatusAccepted,
+		admin:    true,
+	},
+	"DELETE /api/jobs/:id": {
+		summary: "Delete a copy job that is not running; its copies are kept",
+		status:  fiber.StatusNoContent,
+		admin:   true,
+	},
+	"GET /api/graphql": {
+		summary: "Run a GraphQL query over files, folders and stats",
+		params: []apiParam{
+			{"query", "string", "GraphQL query"},
+			{"variables", "string", "JSON object of variables"},
+			{"operationName", "string", "Operation to run"},
+		},
+		response: graphQLResponse,
+	},
+	"POST /api/graphql": {
+		summary:  "Run a GraphQL query over files, folders and stats",
+		body:     graphQLRequest{},
+		response: graphQLResponse,
+	},
+}
+
+var graphQLResponse = fiber.Map{"data": fiber.Map{}, "errors": []fiber.Map{}}
+
+// openAPI is the document served at /api/openapi.json, built from the
+// registered routes on first use.
+type openAPI struct {
+	once     sync.Once
+	document fiber.Map
+}
+
+// Handler: OpenAPI document of the API
+func (s *Server) openAPIDocument(c *fiber.Ctx) error {
+	s.openAPI.once.Do(func() {
+		s.openAPI.document = buildOpenAPI(s.app.GetRoutes(true))
+	})
+	return c.JSON(s.openAPI.document)
+}
+
+// routeParam matches the parameters of a fiber route path.
+var routeParam = regexp.MustCompile(`:(\w+)(\?)?`)
+
+// buildOpenAPI generates an OpenAPI 3 document for the /api routes.
+// Routes missing from apiOperations are listed without details.
+func buildOpenAPI(routes []fiber.Route) fiber.Map {
+	schemas := fiber.Map{
+		"Error": fiber.Map{
+			"type": "object",
+			"properties": fiber.Map{
+				"error": fiber.Map{"type": "string"},
+				"hint":  fiber.Map{"type": "string"},
+			},
+		},
+	}
+	gen := &schemaGenerator{schemas: schemas}
+
+	paths := fiber.Map{}
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, "/api/") || route.Method == fiber.MethodHead ||
+			route.Path == "/api/openapi.json" || route.Path == "/api/docs" {
+			continue
+		}
+		op, ok := apiOperations[route.Method+" "+route.Path]
+		if !ok {
+			op.summary = route.Method + " " + route.Path
+		}
+
+		// OpenAPI has no optional path parameters; such routes are listed
+		// with and without them
+		variants := []string{route.Path}
+		if strings.HasSuffix(route.Path, "?") {
+			variants = append(variants, route.Path[:strings.LastIndex(route.Path, "/:")])
+		}
+		for _, path := range variants {
+			openPath := routeParam.ReplaceAllString(path, "{$1}")
+			item, _ := paths[openPath].(fiber.Map)
+			if item == nil {
+				item = fiber.Map{}
+				paths[openPath] = item
+			}
+			item[strings.ToLower(route.Method)] = gen.operation(op, routeParam.FindAllStringSubmatch(path, -1))
+		}
+	}
+
+	return fiber.Map{
+		"openapi": "3.0.3",
+		"info": fiber.Map{
+			"title":   "TeamDrive Scanner API",
+			"version": "1.0",
+			"description": "Search and browse the index of scanned drives. Endpoints marked admin need an API key " +
+				"without a drive scope; scoped keys only see their drives.",
+		},
+		"paths": paths,
+		"components": fiber.Map{
+			"schemas": schemas,
+			"securitySchemes": fiber.Map{
+				"bearer":       fiber.Map{"type": "http", "scheme": "bearer"},
+				"apiKeyHeader": fiber.Map{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"apiKeyQuery":  fiber.Map{"type": "apiKey", "in": "query", "name": "api_key"},
+			},
+		},
+		"security": []fiber.Map{{"bearer": []string{}}, {"apiKeyHeader": []string{}}, {"apiKeyQuery": []string{}}},
+	}
+}
+
+func (g *schemaGenerator) operation(op apiOperation, pathParams [][]string) fiber.Map {
+	var params []fiber.Map
+	for _, match := range pathParams {
+		params = append(params, fiber.Map{
+			"name": match[1], "in": "path", "required": true, "schema": fiber.Map{"type": "string"},
+		})
+	}
+	for _, param := range op.params {
+		params = append(params, fiber.Map{
+			"name": param.name, "in": "query", "description": param.description,
+			"schema": fiber.Map{"type": param.kind},
+		})
+	}
+
+	status := op.status
+	if status == 0 {
+		status = fiber.StatusOK
+	}
+	success := fiber.Map{"description": http.StatusText(status)}
+	if op.response != nil {
+		success["content"] = fiber.Map{"application/json": fiber.Map{"schema": g.value(op.response)}}
+	}
+	errorContent := fiber.Map{"application/json": fiber.Map{"schema": fiber.Map{"$ref": "#/components/schemas/Error"}}}
+
+	operation := fiber.Map{
+		"summary": op.summary,
+		"responses": fiber.Map{
+			strconv.Itoa(status): success,
+			"default":            fiber.Map{"description": "Error", "content": errorContent},
+		},
+	}
+	if op.admin {
+		operation["summary"] = op.summary + " (admin)"
+	}
+	if params != nil {
+		operation["parameters"] = params
+	}
+	if op.body != nil {
+		operation["requestBody"] = fiber.Map{
+			"required": true,
+			"content":  fiber.Map{"application/json": fiber.Map{"schema": g.value(op.body)}},
+		}
+	}
+	return operation
+}
+
+// schemaGenerator turns Go types into JSON Schemas, following their json
+// tags. Named structs become components, so recursive types work.
+type schemaGenerator struct {
+	schemas fiber.Map
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// value returns the schema of an example value. The keys of a fiber.Map
+// become the properties of an object.
+func (g *schemaGenerator) value(v interface{}) fiber.Map {
+	m, ok := v.(fiber.Map)
+	if !ok {
+		return g.schema(reflect.TypeOf(v))
+	}
+	properties := fiber.Map{}
+	for key, value := range m {
+		properties[key] = g.value(value)
+	}
+	return fiber.Map{"type": "object", "properties": properties}
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) fiber.Map {
+	switch {
+	case t == timeType:
+		return fiber.Map{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		schema := g.schema(t.Elem())
+		if _, ref := schema["$ref"]; ref {
+			return fiber.Map{"allOf": []fiber.Map{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return fiber.Map{"type": "string"}
+	case reflect.Bool:
+		return fiber.Map{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fiber.Map{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return fiber.Map{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return fiber.Map{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return fiber.Map{"type": "object"}
+	case reflect.Struct:
+		return g.structSchema(t)
+	}
+	return fiber.Map{}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) fiber.Map {
+	name := t.Name()
+	if name != "" {
+		name = strings.ToUpper(name[:1]) + name[1:]
+		ref := fiber.Map{"$ref": "#/components/schemas/" + name}
+		if _, done := g.schemas[name]; done {
+			return ref
+		}
+		g.schemas[name] = fiber.Map{} // placeholder while the fields refer back to t
+	}
+
+	properties := fiber.Map{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		fieldName := strings.Split(tag, ",")[0]
+		if fieldName == "" {
+			fieldName = field.Name
+		}
+		properties[fieldName] = g.schema(field.Type)
+	}
+	schema := fiber.Map{"type": "object", "properties": properties}
+
+	if name == "" {
+		return schema
+	}
+	g.schemas[name] = schema
+	return fiber.Map{"$ref": "#/components/schemas/" + name}
+}
@@ -0,0 +1,136 @@
+package web
+
+import (
+	"strconv"
+
+	"teamdrive-scanner/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// requestedDrives returns the drives a report or feed covers:
+// the teamdrive query parameter if set, else every drive the API key may
+// see. ok is false when the requested drive is out of scope.
+func requestedDrives(c *fiber.Ctx) (drives []string, ok bool) {
+	if id := c.Query("teamdrive"); id != "" {
+		return []string{id}, inScope(c, id)
+	}
+	return scope(c), true
+}
+
+// Handler: Files whose parent folder is missing from the index
+func (s *Server) getOrphans(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	drives, ok := requestedDrives(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	offset, err := strconv.Atoi(c.Query("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	orphans, total, err := s.database(c).GetOrphans(ctx, drives, limit, offset)
+	if err != nil {
+		return dbError(c, err, "Orphan lookup failed")
+	}
+
+	return c.JSON(fiber.Map{
+		"orphans": orphans,
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// Handler: Missing parent folders with their orphan counts
+func (s *Server) getMissingParents(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	drives, ok := requestedDrives(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	parents, err := s.database(c).GetMissingParents(ctx, drives)
+	if err != nil {
+		return dbError(c, err, "Orphan lookup failed")
+	}
+
+	return c.JSON(fiber.Map{
+		"parents": parents,
+		"count":   len(parents),
+	})
+}
+
+// Handler: Queue missing parents for rescanning by the next scan. Queues
+// every missing parent of the selected drives, or only the one given as
+// parent.
+func (s *Server) requeueOrphans(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	drives, ok := requestedDrives(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	parents, err := s.database(c).GetMissingParents(ctx, drives)
+	if err != nil {
+		return dbError(c, err, "Orphan lookup failed")
+	}
+
+	if id := c.Query("parent"); id != "" {
+		var selected []database.MissingParent
+		for _, parent := range parents {
+			if parent.ID == id {
+				selected = append(selected, parent)
+			}
+		}
+		if len(selected) == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "No orphans with this parent",
+			})
+		}
+		parents = selected
+	}
+
+	if err := s.database(c).QueueRescan(ctx, parents); err != nil {
+		return dbError(c, err, "Failed to queue rescan")
+	}
+
+	return c.JSON(fiber.Map{
+		"queued":  len(parents),
+		"folders": parents,
+	})
+}
+
+// Handler: Folders waiting to be rescanned
+func (s *Server) getRescanQueue(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	queue, err := s.database(c).GetRescanQueue(ctx)
+	if err != nil {
+		return dbError(c, err, "Rescan queue lookup failed")
+	}
+
+	return c.JSON(fiber.Map{
+		"queue": queue,
+		"count": len(queue),
+	})
+}
@@ -0,0 +1,129 @@
+package web
+
+import (
+	"context"
+	"encoding/csv"
+	"strconv"
+	"strings"
+
+	"teamdrive-scanner/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Handler: Permissions stored for a file by a permission scan
+func (s *Server) getFilePermissions(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	fileID := c.Params("file_id")
+
+	file, err := s.database(c).GetFile(ctx, fileID)
+	if err != nil {
+		return dbError(c, err, "File lookup failed")
+	}
+	if file == nil || !inScope(c, file.TeamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+
+	permissions, err := s.database(c).GetPermissions(ctx, fileID)
+	if err != nil {
+		return dbError(c, err, "Permission lookup failed")
+	}
+	if permissions == nil {
+		permissions = make([]database.Permission, 0)
+	}
+
+	return c.JSON(fiber.Map{
+		"file":        file,
+		"permissions": permissions,
+	})
+}
+
+// Handler: Files shared with anyone who has the link
+func (s *Server) getPublicGrants(c *fiber.Ctx) error {
+	return s.grantReport(c, func(ctx context.Context, drives []string, limit int, offset int) ([]database.Grant, int, error) {
+		return s.database(c).GetPublicGrants(ctx, drives, limit, offset)
+	})
+}
+
+// Handler: Files shared with users, groups or domains outside the internal
+// domains, taken from the internal query parameter or the config
+func (s *Server) getExternalGrants(c *fiber.Ctx) error {
+	internal := s.settings().internal
+	if v := c.Query("internal"); v != "" {
+		internal = nil
+		for _, domain := range strings.Split(v, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				internal = append(internal, domain)
+			}
+		}
+	}
+	if len(internal) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No internal domains: set web.internal_domains or pass internal",
+		})
+	}
+
+	return s.grantReport(c, func(ctx context.Context, drives []string, limit int, offset int) ([]database.Grant, int, error) {
+		return s.database(c).GetExternalGrants(ctx, internal, drives, limit, offset)
+	})
+}
+
+// grantReport serves a page of an access report as JSON, or as CSV with
+// format=csv.
+func (s *Server) grantReport(c *fiber.Ctx, load func(ctx context.Context, drives []string, limit int, offset int) ([]database.Grant, int, error)) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	drives, ok := requestedDrives(c)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	offset, err := strconv.Atoi(c.Query("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	grants, total, err := load(ctx, drives, limit, offset)
+	if err != nil {
+		return dbError(c, err, "Access report failed")
+	}
+
+	if c.Query("format") == "csv" {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		w := csv.NewWriter(c)
+		w.Write([]string{"teamdrive_name", "path", "file_id", "type", "role", "email_address", "domain", "discoverable", "web_view_link"})
+		for _, grant := range grants {
+			w.Write([]string{
+				grant.File.TeamDriveName,
+				grant.File.Path,
+				grant.File.ID,
+				grant.Permission.Type,
+				grant.Permission.Role,
+				grant.Permission.EmailAddress,
+				grant.Permission.Domain,
+				strconv.FormatBool(grant.Permission.Discoverable),
+				grant.File.WebViewLink,
+			})
+		}
+		w.Flush()
+		return w.Error()
+	}
+
+	return c.JSON(fiber.Map{
+		"grants": grants,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
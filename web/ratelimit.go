@@ -0,0 +1,86 @@
+package web
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/time/rate"
+)
+
+// clientLimiters hands out one token bucket per client. Buckets idle for
+// longer than idleAfter are dropped so the map does not grow without bound.
+type clientLimiters struct {
+	mu        sync.Mutex
+	limiters  map[string]*clientLimiter
+	limit     rate.Limit
+	burst     int
+	idleAfter time.Duration
+	lastSweep time.Time
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func (l *clientLimiters) get(key string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > l.idleAfter {
+		for k, client := range l.limiters {
+			if now.Sub(client.lastSeen) > l.idleAfter {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	client, ok := l.limiters[key]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = client
+	}
+	client.lastSeen = now
+	return client.limiter
+}
+
+// rateLimit allows each client perMinute requests a minute with bursts of
+// up to burst, answering 429 with Retry-After once exhausted. It runs
+// before authentication, so guessing keys is limited too: clients are
+// identified by the one of keys they send, or by IP otherwise, as a key
+// that does not match could be changed on every request. Under prefork
+// every process keeps its own buckets.
+func rateLimit(perMinute float64, burst int, keys []APIKey) fiber.Handler {
+	if burst <= 0 {
+		burst = int(math.Max(1, perMinute/6))
+	}
+	limiters := &clientLimiters{
+		limiters:  make(map[string]*clientLimiter),
+		limit:     rate.Limit(perMinute / 60),
+		burst:     burst,
+		idleAfter: 10 * time.Minute,
+		lastSweep: time.Now(),
+	}
+
+	return func(c *fiber.Ctx) error {
+		client := "ip:" + c.IP()
+		if key := matchAPIKey(keys, c); key != nil {
+			client = "key:" + key.Key
+		}
+
+		reservation := limiters.get(client).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": "Rate limit exceeded",
+			})
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,83 @@
+package web
+
+import (
+	"teamdrive-scanner/scanner"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ScanControl is what the server needs of the scans sharing its process.
+type ScanControl interface {
+	// Running returns the progress of the running scans.
+	Running() []scanner.Progress
+	// Cancel cancels the running scans of a drive, reporting whether
+	// there were any.
+	Cancel(teamDriveID string) bool
+	// Pause stops or resumes the scans' API calls.
+	Pause(paused bool)
+	Paused() bool
+}
+
+// scansUnavailable responds to scan requests when scans run elsewhere.
+func scansUnavailable(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+		"error": "Scan control is only available in daemon mode",
+	})
+}
+
+// Handler: Progress of running scans
+func (s *Server) getScanStatus(c *fiber.Ctx) error {
+	if s.scans == nil {
+		return scansUnavailable(c)
+	}
+
+	scans := make([]scanner.Progress, 0)
+	for _, scan := range s.scans.Running() {
+		if inScope(c, scan.TeamDriveID) {
+			scans = append(scans, scan)
+		}
+	}
+	return c.JSON(fiber.Map{
+		"running": len(scans) > 0,
+		"paused":  s.scans.Paused(),
+		"scans":   scans,
+	})
+}
+
+// Handler: Cancel the running scan of a Team Drive. What it found so far
+// is kept and its unfinished folders are queued for the next scan.
+func (s *Server) cancelScan(c *fiber.Ctx) error {
+	if s.scans == nil {
+		return scansUnavailable(c)
+	}
+
+	id := c.Params("teamdrive_id")
+	if !inScope(c, id) || !s.scans.Cancel(id) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No scan of this Team Drive is running",
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"canceled": id,
+	})
+}
+
+// Handler: Pause all scans, freeing the accounts' quota for other tools.
+// Scans started while paused wait too.
+func (s *Server) pauseScans(c *fiber.Ctx) error {
+	if s.scans == nil {
+		return scansUnavailable(c)
+	}
+	s.scans.Pause(true)
+	return c.JSON(fiber.Map{"paused": true})
+}
+
+// Handler: Resume paused scans
+func (s *Server) resumeScans(c *fiber.Ctx) error {
+	if s.scans == nil {
+		return scansUnavailable(c)
+	}
+	s.scans.Pause(false)
+	return c.JSON(fiber.Map{"paused": false})
+}
@@ -0,0 +1,214 @@
+package web
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"teamdrive-scanner/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type savedSearchRequest struct {
+	Name   string `json:"name"`
+	Params string `json:"params"`
+}
+
+// normalizeSearchParams validates a search query string the way /api/search
+// would and returns it re-encoded without paging state or credentials.
+func normalizeSearchParams(params string) (string, error) {
+	values, err := searchValues(params)
+	if err != nil {
+		return "", err
+	}
+	if _, err := parseSearchParams(queryValues(values)); err != nil {
+		return "", err
+	}
+	return values.Encode(), nil
+}
+
+// SearchOptions returns the options of a search query string as stored
+// with saved searches, for searches run outside a request.
+func SearchOptions(params string) (database.SearchOptions, error) {
+	values, err := searchValues(params)
+	if err != nil {
+		return database.SearchOptions{}, err
+	}
+	return parseSearchParams(queryValues(values))
+}
+
+func searchValues(params string) (url.Values, error) {
+	values, err := url.ParseQuery(strings.TrimPrefix(params, "?"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+	for _, key := range []string{"offset", "cursor", "api_key"} {
+		values.Del(key)
+	}
+	return values, nil
+}
+
+// queryValues looks up parameters in values the way fiber's Query does.
+func queryValues(values url.Values) func(key string, defaultValue ...string) string {
+	return func(key string, defaultValue ...string) string {
+		if v := values.Get(key); v != "" {
+			return v
+		}
+		if len(defaultValue) > 0 {
+			return defaultValue[0]
+		}
+		return ""
+	}
+}
+
+// parseSavedSearch reads and validates a create or update request body.
+func parseSavedSearch(c *fiber.Ctx) (savedSearchRequest, error) {
+	var req savedSearchRequest
+	if err := c.BodyParser(&req); err != nil {
+		return req, fmt.Errorf("invalid request body: %v", err)
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return req, fmt.Errorf("name is required")
+	}
+
+	params, err := normalizeSearchParams(req.Params)
+	if err != nil {
+		return req, err
+	}
+	req.Params = params
+	return req, nil
+}
+
+// savedSearchLink is the shareable URL of a saved search; the web UI loads
+// the search it names on startup.
+func savedSearchLink(id string) string {
+	return "/?search=" + url.QueryEscape(id)
+}
+
+// searchVisible reports whether the request may see a saved search. Saved
+// searches are shared, so keys limited to drives only see those that
+// name no drive or one of theirs; running them is scoped like any search.
+func searchVisible(c *fiber.Ctx, search database.SavedSearch) bool {
+	if scope(c) == nil {
+		return true
+	}
+	values, err := searchValues(search.Params)
+	if err != nil {
+		return false
+	}
+	teamDriveID := values.Get("teamdrive")
+	return teamDriveID == "" || inScope(c, teamDriveID)
+}
+
+// Handler: List saved searches
+func (s *Server) getSavedSearches(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	searches, err := s.database(c).GetSavedSearches(ctx)
+	if err != nil {
+		return dbError(c, err, "Saved search lookup failed")
+	}
+
+	visible := searches[:0]
+	for _, search := range searches {
+		if searchVisible(c, search) {
+			visible = append(visible, search)
+		}
+	}
+
+	return c.JSON(visible)
+}
+
+// Handler: Get a saved search
+func (s *Server) getSavedSearch(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	search, err := s.database(c).GetSavedSearch(ctx, c.Params("id"))
+	if err != nil {
+		return dbError(c, err, "Saved search lookup failed")
+	}
+	if search == nil || !searchVisible(c, *search) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Saved search not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"search": search,
+		"link":   savedSearchLink(search.ID),
+	})
+}
+
+// Handler: Save a search
+func (s *Server) createSavedSearch(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	req, err := parseSavedSearch(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	search, err := s.database(c).CreateSavedSearch(ctx, req.Name, req.Params)
+	if err != nil {
+		return dbError(c, err, "Saving search failed")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"search": search,
+		"link":   savedSearchLink(search.ID),
+	})
+}
+
+// Handler: Update a saved search
+func (s *Server) updateSavedSearch(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	req, err := parseSavedSearch(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	search, err := s.database(c).UpdateSavedSearch(ctx, c.Params("id"), req.Name, req.Params)
+	if err != nil {
+		return dbError(c, err, "Saving search failed")
+	}
+	if search == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Saved search not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"search": search,
+		"link":   savedSearchLink(search.ID),
+	})
+}
+
+// Handler: Delete a saved search
+func (s *Server) deleteSavedSearch(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	deleted, err := s.database(c).DeleteSavedSearch(ctx, c.Params("id"))
+	if err != nil {
+		return dbError(c, err, "Deleting search failed")
+	}
+	if !deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Saved search not found",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -1,29 +1,158 @@
 package web
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"teamdrive-scanner/database"
+	"teamdrive-scanner/static"
 
+	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/etag"
+	"github.com/gofiber/fiber/v2/middleware/filesystem"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Config holds the server options that vary between run modes.
+type Config struct {
+	// Prefork runs one process per CPU. It must be off when the server
+	// shares its process with other work, such as the scan daemon, since
+	// every child would re-run main.
+	Prefork bool
+
+	// Discover lists the shared drives visible to the service accounts.
+	// Nil disables /api/teamdrives/discover.
+	Discover func() ([]database.TeamDrive, error)
+
+	// Thumbnail fetches the thumbnail of a file and its content type from
+	// Drive, from link while it is valid. Nil disables /api/thumbnail.
+	Thumbnail func(ctx context.Context, fileID, link string) ([]byte, string, error)
+
+	// Download starts a download of a file from Drive, of byteRange, an
+	// HTTP Range header value, when set, counting the call under
+	// teamDrive. Nil disables /api/download.
+	Download func(ctx context.Context, teamDrive, fileID, byteRange string) (*http.Response, error)
+
+	// Move renames a file in Drive to name, when set, and moves it from
+	// the folder oldParent to newParent, when they differ, counting the
+	// call under teamDrive. Nil disables renaming and moving.
+	Move func(ctx context.Context, teamDrive, fileID, name, oldParent, newParent string) error
+
+	// ThumbnailCacheSize is the bytes of thumbnails kept in memory. Zero
+	// uses defaultThumbnailCache; negative caches none.
+	ThumbnailCacheSize int64
+
+	// ZipMaxSize caps the bytes of the files in one /api/zip archive. Zero
+	// uses defaultZipMaxSize; negative disables the endpoint.
+	ZipMaxSize int64
+
+	// Scans controls the scans running in this process. Nil, as when
+	// scans run in a separate process, disables the /api/scan endpoints.
+	Scans ScanControl
+
+	// Downloads runs the download jobs of this process. Nil disables the
+	// /api/downloads endpoints.
+	Downloads DownloadControl
+
+	// Copies runs the copy jobs of this process. Nil disables the /api/jobs
+	// endpoints.
+	Copies CopyControl
+
+	// APIKeys, when set, are required on every /api request.
+	APIKeys []APIKey
+
+	// RateLimit is the number of /api requests a minute allowed per
+	// client, with bursts of up to RateBurst. Zero disables limiting.
+	RateLimit float64
+	RateBurst int
+
+	// TLS serves HTTPS instead of HTTP when configured.
+	TLS TLSConfig
+
+	// QueryTimeout bounds the database work of one request. Zero uses
+	// defaultQueryTimeout, which leaves time to respond before the
+	// server's write timeout.
+	QueryTimeout time.Duration
+
+	// InternalDomains are the organization's email domains, for the
+	// external access report.
+	InternalDomains []string
+
+	// Instance is the instance ID of the server's own database, and
+	// OpenInstance opens the database of another instance sharing its
+	// PostgreSQL backend, for API keys bound to it. Nil rejects those keys.
+	Instance     string
+	OpenInstance func(instanceID string) (*database.Database, error)
+}
+
+const defaultQueryTimeout = 8 * time.Second
+
 type Server struct {
-	app        *fiber.App
-	db         *database.Database
-	teamDrives interface{}
+	app       *fiber.App
+	db        *database.Database
+	discover  func() ([]database.TeamDrive, error)
+	scans     ScanControl
+	downloads DownloadControl
+	copies    CopyControl
+	tls       TLSConfig
+	live      atomic.Pointer[settings]
+	openAPI   openAPI
+	gql       graphQLState
+	tenants   tenantSet
+
+	fetchThumbnail func(ctx context.Context, fileID, link string) ([]byte, string, error)
+	thumbnails     *thumbnailCache
+	openDownload   func(ctx context.Context, teamDrive, fileID, byteRange string) (*http.Response, error)
+	move           func(ctx context.Context, teamDrive, fileID, name, oldParent, newParent string) error
+	zipMaxSize     int64
+
+	optimizing atomic.Bool // maintenance started through the API is running
+}
+
+// settings are the options Reload can change while the server runs.
+type settings struct {
+	teamDrives []database.TeamDrive
+	auth       fiber.Handler // nil when no API keys are configured
+	limit      fiber.Handler // nil when rate limiting is off
+	timeout    time.Duration // per-request database timeout
+	internal   []string      // InternalDomains
+}
+
+func newSettings(teamDrives []database.TeamDrive, cfg Config) *settings {
+	live := &settings{
+		teamDrives: teamDrives,
+		timeout:    cfg.QueryTimeout,
+		internal:   cfg.InternalDomains,
+	}
+	if len(cfg.APIKeys) > 0 {
+		live.auth = requireAPIKey(cfg.APIKeys)
+	}
+	if cfg.RateLimit > 0 {
+		live.limit = rateLimit(cfg.RateLimit, cfg.RateBurst, cfg.APIKeys)
+	}
+	if live.timeout <= 0 {
+		live.timeout = defaultQueryTimeout
+	}
+	return live
 }
 
-func NewServer(db *database.Database, teamDrives interface{}) *Server {
+func NewServer(db *database.Database, teamDrives []database.TeamDrive, cfg Config) *Server {
 	app := fiber.New(fiber.Config{
-		Prefork:               true,
+		Prefork:               cfg.Prefork,
 		CaseSensitive:         false,
 		StrictRouting:         false,
 		ServerHeader:          "TeamDrive Scanner",
@@ -42,27 +171,76 @@ func NewServer(db *database.Database, teamDrives interface{}) *Server {
 	}))
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "*",
-		AllowMethods: "GET,POST,HEAD,OPTIONS",
+		AllowMethods: "GET,POST,PUT,DELETE,HEAD,OPTIONS",
 	}))
 	app.Use(compress.New(compress.Config{
+		// Downloads pass Drive's bytes and ranges through untouched, and
+		// ZIPs are of files compressed already
+		Next: func(c *fiber.Ctx) bool {
+			return isDownload(c.Path())
+		},
 		Level: compress.LevelBestSpeed,
 	}))
+	app.Server().HeaderReceived = requestConfig
 
 	server := &Server{
-		app:        app,
-		db:         db,
-		teamDrives: teamDrives,
+		app:            app,
+		db:             db,
+		discover:       cfg.Discover,
+		fetchThumbnail: cfg.Thumbnail,
+		thumbnails:     newThumbnailCache(cfg.ThumbnailCacheSize),
+		openDownload:   cfg.Download,
+		move:           cfg.Move,
+		zipMaxSize:     cfg.ZipMaxSize,
+		scans:          cfg.Scans,
+		downloads:      cfg.Downloads,
+		copies:         cfg.Copies,
+		tls:            cfg.TLS,
+		tenants:        tenantSet{instance: cfg.Instance, open: cfg.OpenInstance},
 	}
+	server.live.Store(newSettings(teamDrives, cfg))
 
 	server.setupRoutes()
 	return server
 }
 
+// Reload applies a changed drive list, API keys, rate limit and query
+// timeout to the running server. Requests in flight finish with the old
+// settings, and rate limit buckets start over. Prefork, TLS, discovery,
+// download and copy jobs and the instances are fixed at start.
+func (s *Server) Reload(teamDrives []database.TeamDrive, cfg Config) {
+	s.live.Store(newSettings(teamDrives, cfg))
+}
+
+func (s *Server) settings() *settings {
+	return s.live.Load()
+}
+
+// authenticate and throttle apply the current API keys and rate limit.
+func (s *Server) authenticate(c *fiber.Ctx) error {
+	if auth := s.settings().auth; auth != nil {
+		return auth(c)
+	}
+	return c.Next()
+}
+
+func (s *Server) throttle(c *fiber.Ctx) error {
+	if limit := s.settings().limit; limit != nil {
+		return limit(c)
+	}
+	return c.Next()
+}
+
 func (s *Server) setupRoutes() {
+	// Assets are embedded so the binary runs from any directory
+	assets := http.FS(static.FS)
 	s.app.Get("/", func(c *fiber.Ctx) error {
-		return c.SendFile("./static/index.html")
+		return filesystem.SendFile(c, assets, "index.html")
 	})
-	s.app.Static("/static", "./static")
+	s.app.Use("/static", filesystem.New(filesystem.Config{
+		Root:   assets,
+		MaxAge: 3600,
+	}))
 
 	s.app.Get("/health", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{
@@ -71,10 +249,75 @@ func (s *Server) setupRoutes() {
 		})
 	})
 
-	api := s.app.Group("/api")
+	s.app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+
+	// The API description is public, so clients can be generated without a key
+	s.app.Get("/api/openapi.json", s.openAPIDocument)
+	s.app.Get("/api/docs", func(c *fiber.Ctx) error {
+		return filesystem.SendFile(c, assets, "docs.html")
+	})
+
+	api := s.app.Group("/api", s.throttle, s.authenticate, s.selectInstance)
 	api.Get("/teamdrives", s.getTeamDrives)
+	api.Post("/teamdrives/discover", requireUnscoped, requireOwnInstance, s.discoverTeamDrives)
+	api.Get("/teamdrives/:id/treemap", s.getTreemap)
+	api.Delete("/teamdrives/:id/data", requireUnscoped, s.deleteTeamDriveData)
 	api.Get("/search", s.search)
+	api.Get("/recent", s.getRecent)
 	api.Get("/stats/:teamdrive_id", s.getStats)
+	api.Get("/stats/:teamdrive_id/history", s.getStatsHistory)
+	api.Get("/trash/:teamdrive_id", s.getTrash)
+	api.Get("/deleted/:teamdrive_id", s.getDeleted)
+	api.Get("/moves/:teamdrive_id", s.getMoves)
+	api.Get("/changes", s.getChanges)
+	api.Get("/scans/:teamdrive_id", s.getScans)
+	api.Get("/scans/:teamdrive_id/diff", s.getScanDiff)
+	api.Post("/verify/:teamdrive_id", s.verifyManifest)
+	api.Get("/file/:file_id", s.getFile)
+	api.Get("/file/:file_id/permissions", s.getFilePermissions)
+	api.Post("/file/:file_id/rename", requireUnscoped, requireOwnInstance, s.renameFile)
+	api.Post("/file/:file_id/move", requireUnscoped, requireOwnInstance, s.moveFile)
+	api.Get("/thumbnail/:file_id", requireOwnInstance, s.getThumbnail)
+	api.Get("/download/:file_id", requireOwnInstance, s.download)
+	api.Get("/zip/:folder_id", requireOwnInstance, s.zipFolder)
+	api.Get("/path/:file_id", s.getPath)
+	api.Get("/children/:folder_id", s.getChildren)
+	api.Get("/browse/:teamdrive/:folder_id?", etag.New(), s.browse)
+	api.Get("/accounts", requireUnscoped, s.getAccounts)
+	api.Get("/scan/status", requireOwnInstance, s.getScanStatus)
+	api.Post("/scan/pause", requireUnscoped, requireOwnInstance, s.pauseScans)
+	api.Post("/scan/resume", requireUnscoped, requireOwnInstance, s.resumeScans)
+	api.Delete("/scan/:teamdrive_id", requireOwnInstance, s.cancelScan)
+	api.Get("/orphans", s.getOrphans)
+	api.Get("/orphans/parents", s.getMissingParents)
+	api.Post("/orphans/requeue", s.requeueOrphans)
+	api.Get("/orphans/queue", requireUnscoped, s.getRescanQueue)
+	api.Get("/permissions/public", s.getPublicGrants)
+	api.Get("/permissions/external", s.getExternalGrants)
+	api.Get("/searches", s.getSavedSearches)
+	api.Post("/searches", requireUnscoped, s.createSavedSearch)
+	api.Get("/searches/:id", s.getSavedSearch)
+	api.Put("/searches/:id", requireUnscoped, s.updateSavedSearch)
+	api.Delete("/searches/:id", requireUnscoped, s.deleteSavedSearch)
+	api.Get("/downloads", requireUnscoped, requireOwnInstance, s.getDownloadJobs)
+	api.Post("/downloads", requireUnscoped, requireOwnInstance, s.createDownloadJob)
+	api.Get("/downloads/:id", requireUnscoped, requireOwnInstance, s.getDownloadJob)
+	api.Post("/downloads/:id/cancel", requireUnscoped, requireOwnInstance, s.cancelDownloadJob)
+	api.Post("/downloads/:id/resume", requireUnscoped, requireOwnInstance, s.resumeDownloadJob)
+	api.Delete("/downloads/:id", requireUnscoped, requireOwnInstance, s.deleteDownloadJob)
+	api.Get("/jobs", requireUnscoped, requireOwnInstance, s.getCopyJobs)
+	api.Post("/jobs", requireUnscoped, requireOwnInstance, s.createCopyJob)
+	api.Get("/jobs/:id", requireUnscoped, requireOwnInstance, s.getCopyJob)
+	api.Post("/jobs/:id/cancel", requireUnscoped, requireOwnInstance, s.cancelCopyJob)
+	api.Post("/jobs/:id/resume", requireUnscoped, requireOwnInstance, s.resumeCopyJob)
+	api.Delete("/jobs/:id", requireUnscoped, requireOwnInstance, s.deleteCopyJob)
+	api.Get("/admin/db", requireUnscoped, s.getDatabaseHealth)
+	api.Post("/admin/db/optimize", requireUnscoped, requireOwnInstance, s.optimizeDatabase)
+	api.Get("/graphql", s.graphQL)
+	api.Post("/graphql", s.graphQL)
+
+	live := s.app.Group("/ws", requireUpgrade, s.throttle, s.authenticate, s.selectInstance)
+	live.Get("/search", websocket.New(s.liveSearch))
 
 	s.app.Use(func(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
@@ -83,39 +326,370 @@ func (s *Server) setupRoutes() {
 	})
 }
 
-// Handler: Get team drives list
+// queryContext returns the context for a request's database calls.
+func (s *Server) queryContext(c *fiber.Ctx) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.UserContext(), s.settings().timeout)
+}
+
+// dbError responds to a failed database call: 504 if it ran out of time,
+// 500 with the error otherwise.
+func dbError(c *fiber.Ctx, err error, message string) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return c.Status(fiber.StatusGatewayTimeout).JSON(fiber.Map{
+			"error": message + ": query timed out",
+		})
+	}
+	return c.Status(500).JSON(fiber.Map{
+		"error": message + ": " + err.Error(),
+	})
+}
+
+// Handler: Get team drives list (configured plus discovered)
 func (s *Server) getTeamDrives(c *fiber.Ctx) error {
-	return c.JSON(s.teamDrives)
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	drives := s.teamDrives(ctx)
+	visible := make([]database.TeamDrive, 0, len(drives))
+	for _, drive := range drives {
+		if inScope(c, drive.ID) {
+			visible = append(visible, drive)
+		}
+	}
+	return c.JSON(visible)
+}
+
+// teamDrives returns the configured drives followed by discovered ones.
+// Another instance's configured drives are unknown here: its keys see the
+// drives it discovered.
+func (s *Server) teamDrives(ctx context.Context) []database.TeamDrive {
+	configured := s.settings().teamDrives
+	if _, ok := ctx.Value(instanceDatabase{}).(*database.Database); ok {
+		configured = nil
+	}
+	discovered, err := s.contextDatabase(ctx).GetTeamDrives(ctx)
+	if err != nil {
+		log.Printf("Failed to load discovered team drives: %v", err)
+		return configured
+	}
+	return database.MergeTeamDrives(configured, discovered)
+}
+
+// Handler: Discover shared drives through the service accounts
+func (s *Server) discoverTeamDrives(c *fiber.Ctx) error {
+	if s.discover == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Discovery is not available: no service accounts loaded",
+		})
+	}
+
+	drives, err := s.discover()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Discovery failed: " + err.Error(),
+		})
+	}
+
+	if err := s.db.SaveTeamDrives(drives); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Saving discovered drives failed: " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"discovered": len(drives),
+		"teamdrives": database.MergeTeamDrives(s.settings().teamDrives, drives),
+	})
 }
 
 // Handler: Search files
 func (s *Server) search(c *fiber.Ctx) error {
-	query := c.Query("q", "")
-	teamDriveID := c.Query("teamdrive", "")
-	parentID := c.Query("parent", "")
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
 
-	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	opts, err := parseSearchOptions(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	opts.TeamDriveIDs = scope(c)
+
+	result, err := s.database(c).Search(ctx, opts)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if errors.Is(err, database.ErrInvalidQuery) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+			"hint":  queryHint,
+		})
+	}
+	if err != nil {
+		return dbError(c, err, "Search failed")
+	}
+
+	return c.JSON(result)
+}
+
+// queryHint is returned with queries that cannot be searched.
+const queryHint = `Search for words, "quoted phrases" or prefix* words; ` +
+	`exclude with -word, combine alternatives with OR, and limit terms with name:, path:, type:, ext: or label:`
+
+// maxRegexLength caps mode=regex patterns. Go regexps run in linear time,
+// but very long patterns are still expensive to compile and match.
+const maxRegexLength = 512
+
+// parseSearchOptions reads the query, paging and filter parameters of a
+// search request.
+func parseSearchOptions(c *fiber.Ctx) (database.SearchOptions, error) {
+	return parseSearchParams(c.Query)
+}
+
+// parseSearchParams parses search parameters from any source, such as
+// query strings or websocket messages.
+func parseSearchParams(query func(key string, defaultValue ...string) string) (database.SearchOptions, error) {
+	opts := database.SearchOptions{
+		Query:       query("q", ""),
+		TeamDriveID: query("teamdrive", ""),
+		ParentID:    query("parent", ""),
+		MimeType:    query("mime_type", ""),
+		Owner:       query("owner", ""),
+		ModifiedBy:  query("modified_by", ""),
+		Cursor:      query("cursor", ""),
+		Resolution:  query("resolution", ""),
+		Codec:       query("codec", ""),
+		MediaTitle:  query("title", ""),
+	}
+
+	limit, err := strconv.Atoi(query("limit", "100"))
 	if err != nil || limit <= 0 || limit > 1000 {
 		limit = 100
 	}
+	opts.Limit = limit
 
-	offset, err := strconv.Atoi(c.Query("offset", "0"))
+	offset, err := strconv.Atoi(query("offset", "0"))
 	if err != nil || offset < 0 {
 		offset = 0
 	}
+	opts.Offset = offset
+
+	switch opts.Sort = query("sort", ""); opts.Sort {
+	case "", "name", "size", "modified", "created":
+	default:
+		return opts, fmt.Errorf("invalid sort: %s (use name, size, modified or created)", opts.Sort)
+	}
+	switch opts.Order = query("order", "asc"); opts.Order {
+	case "asc", "desc":
+	default:
+		return opts, fmt.Errorf("invalid order: %s (use asc or desc)", opts.Order)
+	}
+
+	if v := query("min_size"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return opts, fmt.Errorf("invalid min_size: %s", v)
+		}
+		opts.MinSize = size
+	}
+	if v := query("max_size"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return opts, fmt.Errorf("invalid max_size: %s", v)
+		}
+		opts.MaxSize = size
+	}
+	if opts.MinSize > 0 && opts.MaxSize > 0 && opts.MinSize > opts.MaxSize {
+		return opts, fmt.Errorf("min_size must not exceed max_size")
+	}
+
+	if v := query("modified_after"); v != "" {
+		ts, err := parseTimeParam(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid modified_after: %s", v)
+		}
+		opts.ModifiedAfter = ts
+	}
+	if v := query("modified_before"); v != "" {
+		ts, err := parseTimeParam(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid modified_before: %s", v)
+		}
+		opts.ModifiedBefore = ts
+	}
 
-	result, err := s.db.Search(query, teamDriveID, parentID, limit, offset)
+	if v := query("created_after"); v != "" {
+		ts, err := parseTimeParam(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid created_after: %s", v)
+		}
+		opts.CreatedAfter = ts
+	}
+	if v := query("created_before"); v != "" {
+		ts, err := parseTimeParam(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid created_before: %s", v)
+		}
+		opts.CreatedBefore = ts
+	}
+
+	if v := query("ext"); v != "" {
+		for _, ext := range strings.Split(v, ",") {
+			if ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")); ext != "" {
+				opts.Extensions = append(opts.Extensions, ext)
+			}
+		}
+	}
+
+	if v := query("label"); v != "" {
+		for _, label := range strings.Split(v, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				opts.Labels = append(opts.Labels, label)
+			}
+		}
+	}
+
+	if v := query("shared"); v != "" {
+		shared, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid shared: %s", v)
+		}
+		opts.Shared = &shared
+	}
+
+	switch opts.Trash = query("trash", ""); opts.Trash {
+	case "", database.TrashInclude, database.TrashOnly:
+	default:
+		return opts, fmt.Errorf("invalid trash: %s (use include or only)", opts.Trash)
+	}
+
+	if v := query("native"); v != "" {
+		native, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid native: %s", v)
+		}
+		opts.Native = &native
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"year", &opts.Year}, {"season", &opts.Season}, {"episode", &opts.Episode}} {
+		if v := query(param.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return opts, fmt.Errorf("invalid %s: %s", param.name, v)
+			}
+			*param.value = n
+		}
+	}
+
+	switch mode := query("mode", "fts"); mode {
+	case "fts":
+	case "content":
+		opts.Content = true
+	case "regex":
+		if len(opts.Query) > maxRegexLength {
+			return opts, fmt.Errorf("regex too long: %d characters (max %d)", len(opts.Query), maxRegexLength)
+		}
+		re, err := regexp.Compile(opts.Query)
+		if err != nil {
+			return opts, fmt.Errorf("invalid regex: %v", err)
+		}
+		opts.Regex = re
+		opts.Query = ""
+	default:
+		return opts, fmt.Errorf("invalid mode: %s (use fts, content or regex)", mode)
+	}
+
+	if v := query("fuzzy"); v != "" {
+		fuzzy, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid fuzzy: %s", v)
+		}
+		opts.Fuzzy = fuzzy
+	}
+
+	if v := query("is_folder"); v != "" {
+		isFolder, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid is_folder: %s", v)
+		}
+		opts.IsFolder = &isFolder
+	}
+
+	return opts, nil
+}
+
+// driveTimeLayout is how Drive formats timestamps such as modifiedTime.
+const driveTimeLayout = "2006-01-02T15:04:05.000Z"
+
+// parseTimeParam accepts RFC3339 timestamps or plain dates and formats them
+// the way Drive reports modifiedTime, so they compare correctly as strings.
+func parseTimeParam(v string) (string, error) {
+	t, err := time.Parse(time.RFC3339, v)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Search failed: " + err.Error(),
+		t, err = time.Parse("2006-01-02", v)
+		if err != nil {
+			return "", err
+		}
+	}
+	return t.UTC().Format(driveTimeLayout), nil
+}
+
+// Handler: Files modified within the last days, newest first
+func (s *Server) getRecent(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	days, err := strconv.Atoi(c.Query("days", "7"))
+	if err != nil || days < 1 || days > 365 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "days must be between 1 and 365",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	offset, err := strconv.Atoi(c.Query("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	isFolder := false
+	result, err := s.database(c).Search(ctx, database.SearchOptions{
+		TeamDriveID:   c.Query("teamdrive"),
+		TeamDriveIDs:  scope(c),
+		ModifiedAfter: time.Now().UTC().AddDate(0, 0, -days).Format(driveTimeLayout),
+		IsFolder:      &isFolder,
+		Sort:          "modified",
+		Order:         "desc",
+		Limit:         limit,
+		Offset:        offset,
+		Cursor:        c.Query("cursor"),
+	})
+	if errors.Is(err, database.ErrInvalidCursor) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
 		})
 	}
+	if err != nil {
+		return dbError(c, err, "Recent files lookup failed")
+	}
 
 	return c.JSON(result)
 }
 
 // Handler: Get team drive statistics
 func (s *Server) getStats(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
 	teamDriveID := c.Params("teamdrive_id")
 
 	if teamDriveID == "" {
@@ -123,15 +697,269 @@ func (s *Server) getStats(c *fiber.Ctx) error {
 			"error": "Team Drive ID is required",
 		})
 	}
+	if !inScope(c, teamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
 
-	stats := s.db.GetTeamDriveStats(teamDriveID)
+	stats, err := s.database(c).GetTeamDriveStats(ctx, teamDriveID)
+	if err != nil {
+		return dbError(c, err, "Stats lookup failed")
+	}
 	return c.JSON(stats)
 }
 
+// Handler: Get a drive's totals as recorded after each scan
+func (s *Server) getStatsHistory(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	teamDriveID := c.Params("teamdrive_id")
+	if !inScope(c, teamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	history, err := s.database(c).GetStatsHistory(ctx, teamDriveID, limit)
+	if err != nil {
+		return dbError(c, err, "History lookup failed")
+	}
+
+	return c.JSON(fiber.Map{
+		"teamdrive_id": teamDriveID,
+		"history":      history,
+	})
+}
+
+// Handler: Get nested folder sizes of a drive for treemap charts
+func (s *Server) getTreemap(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	teamDriveID := c.Params("id")
+	if !inScope(c, teamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	depth, err := strconv.Atoi(c.Query("depth", "3"))
+	if err != nil || depth < 1 || depth > 10 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "depth must be between 1 and 10",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "limit must be between 1 and 500",
+		})
+	}
+
+	tree, err := s.database(c).GetTreemap(ctx, teamDriveID, depth, limit)
+	if err != nil {
+		return dbError(c, err, "Treemap failed")
+	}
+
+	return c.JSON(tree)
+}
+
+// Handler: Get a single file with its location
+func (s *Server) getFile(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	fileID := c.Params("file_id")
+
+	file, err := s.database(c).GetFile(ctx, fileID)
+	if err != nil {
+		return dbError(c, err, "File lookup failed")
+	}
+	if file == nil || !inScope(c, file.TeamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+
+	chain, err := s.database(c).GetPath(ctx, fileID)
+	if err != nil {
+		return dbError(c, err, "Path lookup failed")
+	}
+
+	return c.JSON(fiber.Map{
+		"file": file,
+		"path": chain,
+	})
+}
+
+// Handler: Get ancestor chain of a file for breadcrumbs
+func (s *Server) getPath(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	fileID := c.Params("file_id")
+
+	allowed, err := s.fileInScope(ctx, c, fileID)
+	if err != nil {
+		return dbError(c, err, "Path lookup failed")
+	}
+	if !allowed {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+
+	chain, err := s.database(c).GetPath(ctx, fileID)
+	if err != nil {
+		return dbError(c, err, "Path lookup failed")
+	}
+	if len(chain) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"path": chain,
+	})
+}
+
+// Handler: List subfolders for tree browsing
+func (s *Server) getChildren(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	folderID := c.Params("folder_id")
+
+	allowed, err := s.fileInScope(ctx, c, folderID)
+	if err != nil {
+		return dbError(c, err, "Listing failed")
+	}
+	if !allowed {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Folder not found",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "1000"))
+	if err != nil || limit <= 0 || limit > 5000 {
+		limit = 1000
+	}
+
+	offset, err := strconv.Atoi(c.Query("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	children, err := s.database(c).GetChildren(ctx, folderID, limit, offset)
+	if err != nil {
+		return dbError(c, err, "Listing failed")
+	}
+
+	return c.JSON(fiber.Map{
+		"folder_id": folderID,
+		"children":  children,
+	})
+}
+
+// Handler: List a folder with its metadata; without folder_id, the drive
+// root. Responses carry an ETag, so clients revalidate instead of
+// downloading a listing that has not changed.
+func (s *Server) browse(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	teamDriveID := c.Params("teamdrive")
+	folderID := c.Params("folder_id", teamDriveID)
+	if !inScope(c, teamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	offset, err := strconv.Atoi(c.Query("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	sizes, err := strconv.ParseBool(c.Query("sizes", "true"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "invalid sizes: " + c.Query("sizes"),
+		})
+	}
+
+	result, err := s.database(c).Browse(ctx, teamDriveID, folderID, database.BrowseOptions{
+		Limit:  limit,
+		Offset: offset,
+		Cursor: c.Query("cursor"),
+		Sizes:  sizes,
+	})
+	if errors.Is(err, database.ErrInvalidCursor) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return dbError(c, err, "Browse failed")
+	}
+	if result == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Folder not found",
+		})
+	}
+
+	c.Set(fiber.HeaderCacheControl, "private, no-cache")
+	return c.JSON(result)
+}
+
+// Handler: Get service account health as last reported by the scanner
+func (s *Server) getAccounts(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	statuses, err := s.database(c).GetAccountStatuses(ctx)
+	if err != nil {
+		return dbError(c, err, "Account lookup failed")
+	}
+
+	quarantined := 0
+	for _, status := range statuses {
+		if status.Quarantined {
+			quarantined++
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"accounts":    statuses,
+		"total":       len(statuses),
+		"quarantined": quarantined,
+	})
+}
+
 // Start server
 func (s *Server) Start(host string, port int) error {
 	addr := fmt.Sprintf("%s:%d", host, port)
-	log.Printf("🚀 Server starting on http://%s", addr)
-	log.Printf("📁 Access the web interface at http://%s", addr)
+	scheme := "http"
+	if s.tls.enabled() {
+		scheme = "https"
+	}
+	log.Printf("🚀 Server starting on %s://%s", scheme, addr)
+	log.Printf("📁 Access the web interface at %s://%s", scheme, addr)
+
+	if s.tls.enabled() {
+		return s.listenTLS(addr)
+	}
 	return s.app.Listen(addr)
 }
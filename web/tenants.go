@@ -0,0 +1,122 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"teamdrive-scanner/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// tenantSet holds the databases of the other instances that API keys are
+// bound to, opened on first use and kept for the life of the server.
+type tenantSet struct {
+	instance string // the server's own
+	open     func(instanceID string) (*database.Database, error)
+
+	mu  sync.Mutex
+	dbs map[string]*database.Database
+}
+
+// get returns the database of an instance, opening it on first use.
+func (t *tenantSet) get(instanceID string) (*database.Database, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if db := t.dbs[instanceID]; db != nil {
+		return db, nil
+	}
+	db, err := t.open(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if t.dbs == nil {
+		t.dbs = make(map[string]*database.Database)
+	}
+	t.dbs[instanceID] = db
+	return db, nil
+}
+
+// instanceDatabase is the context key of another instance's database, for
+// requests whose key is bound to it. It is not kept in the fiber.Ctx
+// locals, which fasthttp closes at the end of the request.
+type instanceDatabase struct{}
+
+var (
+	errOtherInstance       = errors.New("this API key belongs to another instance")
+	errInstanceUnavailable = errors.New("the database of this API key's instance is unavailable")
+)
+
+// selectInstance points the requests of keys bound to another instance at
+// that instance's database.
+func (s *Server) selectInstance(c *fiber.Ctx) error {
+	instance, _ := c.Locals(instanceLocal).(string)
+	ctx, err := s.instanceContext(c.UserContext(), instance)
+	if err == errOtherInstance {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "This API key belongs to another instance",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "The database of this API key's instance is unavailable",
+		})
+	}
+	c.SetUserContext(ctx)
+	return c.Next()
+}
+
+// instanceContext returns ctx carrying the database of instance, or ctx
+// itself for the server's own instance.
+func (s *Server) instanceContext(ctx context.Context, instance string) (context.Context, error) {
+	if instance == "" || instance == s.tenants.instance {
+		return ctx, nil
+	}
+	if s.tenants.open == nil {
+		return nil, errOtherInstance
+	}
+
+	db, err := s.tenants.get(instance)
+	if err != nil {
+		log.Printf("Failed to open the database of instance %s: %v", instance, err)
+		return nil, errInstanceUnavailable
+	}
+	return context.WithValue(ctx, instanceDatabase{}, db), nil
+}
+
+// database returns the database a request reads: the one of its key's
+// instance, or the server's own.
+func (s *Server) database(c *fiber.Ctx) *database.Database {
+	return s.contextDatabase(c.UserContext())
+}
+
+// contextDatabase is database for code holding only a request's context.
+func (s *Server) contextDatabase(ctx context.Context) *database.Database {
+	if db, ok := ctx.Value(instanceDatabase{}).(*database.Database); ok {
+		return db
+	}
+	return s.db
+}
+
+// otherInstance reports whether a request's key is bound to another
+// instance, whose configured drives, scans and service accounts are not
+// this server's.
+func otherInstance(c *fiber.Ctx) bool {
+	_, ok := c.UserContext().Value(instanceDatabase{}).(*database.Database)
+	return ok
+}
+
+// requireOwnInstance limits the endpoints about this process's scans and
+// database maintenance, and those calling Drive through its service
+// accounts, to keys of its own instance.
+func requireOwnInstance(c *fiber.Ctx) error {
+	if otherInstance(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "This API key belongs to another instance",
+		})
+	}
+	return c.Next()
+}
@@ -0,0 +1,146 @@
+package web
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"teamdrive-scanner/scanner"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultThumbnailCache is the bytes of thumbnails kept in memory when the
+// size is not configured, some thousands of Drive's.
+const defaultThumbnailCache = 64 << 20
+
+// thumbnailCacheControl lets browsers keep a thumbnail for an hour. A
+// modified file is served under the same URL, so it is not forever.
+const thumbnailCacheControl = "private, max-age=3600"
+
+type thumbnail struct {
+	key         string
+	data        []byte
+	contentType string
+}
+
+// thumbnailCache is a least recently used cache of thumbnails, bounded by
+// their total size. Entries are keyed by file ID and modification time,
+// so a modified file's thumbnail is fetched again.
+type thumbnailCache struct {
+	limit int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+}
+
+// newThumbnailCache returns a cache of up to limit bytes, or nil to cache
+// nothing when limit is negative.
+func newThumbnailCache(limit int64) *thumbnailCache {
+	if limit < 0 {
+		return nil
+	}
+	if limit == 0 {
+		limit = defaultThumbnailCache
+	}
+	return &thumbnailCache{limit: limit, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *thumbnailCache) get(key string) (*thumbnail, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*thumbnail), true
+}
+
+func (c *thumbnailCache) put(entry *thumbnail) {
+	if c == nil || int64(len(entry.data)) > c.limit {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok {
+		c.size -= int64(len(element.Value.(*thumbnail).data))
+		element.Value = entry
+		c.order.MoveToFront(element)
+	} else {
+		c.entries[entry.key] = c.order.PushFront(entry)
+	}
+	c.size += int64(len(entry.data))
+	for c.size > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		evicted := oldest.Value.(*thumbnail)
+		delete(c.entries, evicted.key)
+		c.size -= int64(len(evicted.data))
+	}
+}
+
+// Handler: Thumbnail of a file, fetched from Drive through the service
+// accounts so the browser needs no Google credentials
+func (s *Server) getThumbnail(c *fiber.Ctx) error {
+	if s.fetchThumbnail == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Thumbnails are not available: no service accounts loaded",
+		})
+	}
+
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	file, err := s.database(c).GetFile(ctx, c.Params("file_id"))
+	if err != nil {
+		return dbError(c, err, "File lookup failed")
+	}
+	if file == nil || !inScope(c, file.TeamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+	if file.IsFolder {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File has no thumbnail",
+		})
+	}
+
+	key := file.ID + "@" + file.ModifiedTime
+	entry, ok := s.thumbnails.get(key)
+	if !ok {
+		// A file scanned before thumbnails were recorded has no link yet,
+		// and gets one looked up
+		data, contentType, err := s.fetchThumbnail(ctx, file.ID, file.ThumbnailLink)
+		if errors.Is(err, scanner.ErrNoThumbnail) || scanner.APIStatus(err) == http.StatusNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "File has no thumbnail",
+			})
+		}
+		if err != nil {
+			log.Printf("Failed to fetch the thumbnail of %s: %v", file.ID, err)
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+				"error": "Fetching the thumbnail failed: " + err.Error(),
+			})
+		}
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		entry = &thumbnail{key: key, data: data, contentType: contentType}
+		s.thumbnails.put(entry)
+	}
+
+	c.Set(fiber.HeaderCacheControl, thumbnailCacheControl)
+	c.Set(fiber.HeaderContentType, entry.contentType)
+	return c.Send(entry.data)
+}
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig enables HTTPS. CertFile and KeyFile serve a fixed certificate;
+// otherwise AutocertDomains obtains and renews certificates from Let's
+// Encrypt using the TLS-ALPN challenge, which requires the server to be
+// reachable on port 443 under those names.
+type TLSConfig struct {
+	CertFile         string
+	KeyFile          string
+	AutocertDomains  []string
+	AutocertCacheDir string
+	AutocertEmail    string
+}
+
+func (t TLSConfig) enabled() bool {
+	return t.CertFile != "" || t.KeyFile != "" || len(t.AutocertDomains) > 0
+}
+
+// listenTLS serves HTTPS on addr. Autocert uses a custom listener, which
+// Fiber cannot prefork, so it always runs in a single process.
+func (s *Server) listenTLS(addr string) error {
+	if s.tls.CertFile != "" || s.tls.KeyFile != "" {
+		return s.app.ListenTLS(addr, s.tls.CertFile, s.tls.KeyFile)
+	}
+
+	cacheDir := s.tls.AutocertCacheDir
+	if cacheDir == "" {
+		cacheDir = "autocert-cache"
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(s.tls.AutocertDomains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      s.tls.AutocertEmail,
+	}
+
+	config := manager.TLSConfig()
+	config.MinVersion = tls.VersionTLS12
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	return s.app.Listener(tls.NewListener(ln, config))
+}
@@ -0,0 +1,48 @@
+package web
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Handler: Trashed items of a drive and the storage emptying the trash
+// would free
+func (s *Server) getTrash(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	teamDriveID := c.Params("teamdrive_id")
+	if !inScope(c, teamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	offset, err := strconv.Atoi(c.Query("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	items, total, err := s.database(c).GetTrash(ctx, teamDriveID, limit, offset)
+	if err != nil {
+		return dbError(c, err, "Trash lookup failed")
+	}
+	trash, err := s.database(c).GetTrashStats(ctx, teamDriveID)
+	if err != nil {
+		return dbError(c, err, "Trash lookup failed")
+	}
+
+	return c.JSON(fiber.Map{
+		"teamdrive_id": teamDriveID,
+		"items":        items,
+		"total":        total,
+		"limit":        limit,
+		"offset":       offset,
+		"trash":        trash,
+	})
+}
@@ -0,0 +1,48 @@
+package web
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"teamdrive-scanner/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Handler: Check a backup manifest, posted as JSON or as CSV with a
+// text/csv content type, against the index of a drive
+func (s *Server) verifyManifest(c *fiber.Ctx) error {
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	teamDriveID := c.Params("teamdrive_id")
+	if !inScope(c, teamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Team Drive not found",
+		})
+	}
+
+	format := "json"
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), "text/csv") {
+		format = "csv"
+	}
+	entries, err := database.ReadManifest(bytes.NewReader(c.Body()), format)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid manifest: " + err.Error(),
+		})
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	report, err := s.database(c).VerifyManifest(ctx, teamDriveID, c.Query("root"), entries, limit)
+	if err != nil {
+		return dbError(c, err, "Verification failed")
+	}
+
+	return c.JSON(report)
+}
@@ -0,0 +1,186 @@
+package web
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"teamdrive-scanner/database"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultZipMaxSize caps the bytes of the files in one ZIP when no cap is
+// configured.
+const defaultZipMaxSize = 2 << 30
+
+// zipErrorsName is the archive entry listing the files that could not be
+// downloaded.
+const zipErrorsName = "zip-errors.txt"
+
+// zipEntry is a file or folder of a ZIP, by its name in the archive.
+type zipEntry struct {
+	name   string
+	record database.FileRecord
+}
+
+// zipEntries names the items below a folder in its ZIP: their paths
+// relative to it, with components that could escape the archive's root
+// replaced and the IDs of files sharing a name added. Google-native files
+// and shortcuts, which have no content to download, are counted and left
+// out.
+func zipEntries(folder *database.FileRecord, tree []database.FileRecord) ([]zipEntry, int64, int) {
+	var entries []zipEntry
+	var size int64
+	skipped := 0
+	seen := make(map[string]bool)
+	for _, record := range tree {
+		if !record.IsFolder && (record.IsShortcut || record.IsNative || database.IsGoogleNative(record.MimeType)) {
+			skipped++
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(record.Path, folder.Path+"/"), "/")
+		for i, part := range parts {
+			switch part {
+			case "", ".", "..":
+				parts[i] = "_"
+			}
+		}
+		name := strings.Join(parts, "/")
+		if seen[name] {
+			ext := ""
+			if !record.IsFolder {
+				if dot := strings.LastIndexByte(parts[len(parts)-1], '.'); dot > 0 {
+					ext = parts[len(parts)-1][dot:]
+				}
+			}
+			name = strings.TrimSuffix(name, ext) + " (" + record.ID + ")" + ext
+		}
+		seen[name] = true
+		if record.IsFolder {
+			name += "/"
+		}
+		entries = append(entries, zipEntry{name: name, record: record})
+		size += record.Size
+	}
+	return entries, size, skipped
+}
+
+// Handler: Stream a ZIP of a folder's files, downloaded from Drive through
+// the service accounts while it is written
+func (s *Server) zipFolder(c *fiber.Ctx) error {
+	if s.openDownload == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "ZIP downloads are not available: no service accounts loaded",
+		})
+	}
+	if s.zipMaxSize < 0 {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "ZIP downloads are disabled",
+		})
+	}
+
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+
+	db := s.database(c)
+	folder, err := db.GetFile(ctx, c.Params("folder_id"))
+	if err != nil {
+		return dbError(c, err, "Folder lookup failed")
+	}
+	if folder == nil || !inScope(c, folder.TeamDriveID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Folder not found",
+		})
+	}
+	if !folder.IsFolder {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Only folders are zipped",
+			"hint":  "Download files through /api/download/:file_id",
+		})
+	}
+
+	tree, err := db.FolderTree(ctx, folder.ID)
+	if err != nil {
+		return dbError(c, err, "Folder listing failed")
+	}
+	entries, size, skipped := zipEntries(folder, tree)
+	limit := s.zipMaxSize
+	if limit == 0 {
+		limit = defaultZipMaxSize
+	}
+	if size > limit {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": "Folder is too large to zip",
+			"size":  size,
+			"limit": limit,
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename*=UTF-8''`+encodeFilename(folder.Name+".zip"))
+	c.Set("X-Skipped-Files", strconv.Itoa(skipped))
+	teamDrive := folder.TeamDriveName
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		s.writeZip(w, teamDrive, entries)
+	})
+	return nil
+}
+
+// writeZip writes a ZIP of entries, stored uncompressed as most of Drive's
+// files are compressed already. Files Drive will not send are listed in
+// zipErrorsName; a download cut off midway ends the archive there, which
+// the client sees as a truncated archive.
+func (s *Server) writeZip(w *bufio.Writer, teamDrive string, entries []zipEntry) {
+	// The client going away fails the next write, which ends the transfer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	archive := zip.NewWriter(w)
+	var failed []string
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Store}
+		if modified, err := time.Parse(time.RFC3339, entry.record.ModifiedTime); err == nil {
+			header.Modified = modified
+		}
+		if entry.record.IsFolder {
+			if _, err := archive.CreateHeader(header); err != nil {
+				return
+			}
+			continue
+		}
+
+		resp, err := s.openDownload(ctx, teamDrive, entry.record.ID, "")
+		if err != nil {
+			log.Printf("ZIP: cannot download %s: %v", entry.record.Path, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", entry.name, err))
+			continue
+		}
+		dst, err := archive.CreateHeader(header)
+		if err == nil {
+			_, err = io.Copy(dst, resp.Body)
+		}
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("ZIP: transfer of %s cut off: %v", entry.record.Path, err)
+			return
+		}
+	}
+
+	if len(failed) > 0 {
+		dst, err := archive.CreateHeader(&zip.FileHeader{Name: zipErrorsName, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return
+		}
+		io.WriteString(dst, strings.Join(failed, "\n")+"\n")
+	}
+	if err := archive.Close(); err == nil {
+		w.Flush()
+	}
+}